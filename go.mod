@@ -2,8 +2,23 @@ module github.com/zhangjinpeng87/openbms
 
 go 1.21.3
 
+require (
+	github.com/DATA-DOG/go-sqlmock v1.5.2
+	github.com/gorilla/mux v1.8.1
+	github.com/jmoiron/sqlx v1.3.5
+	github.com/mattn/go-sqlite3 v1.14.20
+	github.com/pingcap/log v1.1.0
+	github.com/stretchr/testify v1.8.1
+	go.uber.org/zap v1.28.0
+	golang.org/x/sync v0.0.0-20190423024810-112230192c58
+)
+
 require (
 	github.com/aws/aws-sdk-go-v2 v1.24.1 // indirect
-	github.com/jmoiron/sqlx v1.3.5 // indirect
-	github.com/mattn/go-sqlite3 v1.14.20 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/stretchr/objx v0.5.0 // indirect
+	go.uber.org/multierr v1.10.0 // indirect
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+// Actions of audit events.
+const (
+	// ActionUnauthenticated is a request without valid credentials.
+	ActionUnauthenticated = "unauthenticated"
+	// ActionDenied is a report for a station or container the gateway
+	// doesn't own.
+	ActionDenied = "denied"
+)
+
+// Event is an audit event of a rejected request.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Gateway   string    `json:"gateway,omitempty"`
+	Remote    string    `json:"remote,omitempty"`
+	Station   int       `json:"station,omitempty"`
+	Container int       `json:"container,omitempty"`
+	Reason    string    `json:"reason"`
+}
+
+// Auditor records audit events as JSON lines, every event is also logged.
+// A nil Auditor only logs.
+type Auditor struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewAuditor creates an auditor writing to w.
+func NewAuditor(w io.Writer) *Auditor {
+	return &Auditor{w: w}
+}
+
+// OpenAuditLog opens the audit log file for appending, an empty path
+// returns a nil Auditor which only logs.
+func OpenAuditLog(path string) (*Auditor, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewAuditor(f), nil
+}
+
+// Close closes the underlying writer if it is an io.Closer.
+func (a *Auditor) Close() error {
+	if a == nil {
+		return nil
+	}
+	if closer, ok := a.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Record records the event.
+func (a *Auditor) Record(e *Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Warn("gateway request rejected",
+		zap.String("action", e.Action),
+		zap.String("gateway", e.Gateway),
+		zap.String("remote", e.Remote),
+		zap.Int("station", e.Station),
+		zap.Int("container", e.Container),
+		zap.String("reason", e.Reason))
+	if a == nil {
+		return
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Error("failed to encode audit event", zap.Error(err))
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		log.Error("failed to write audit event", zap.Error(err))
+	}
+}
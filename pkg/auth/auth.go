@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+var (
+	// ErrUnauthenticated is returned when a request has no valid credentials.
+	ErrUnauthenticated = errors.New("gateway is not authenticated")
+	// ErrForbidden is returned when a gateway reports for cells it doesn't own.
+	ErrForbidden = errors.New("gateway is not allowed to report for the station")
+	// ErrNotOperator is returned when an identity which is not an operator
+	// calls a control endpoint.
+	ErrNotOperator = errors.New("identity is not an operator")
+)
+
+// Gateway is an authenticated gateway.
+type Gateway struct {
+	// ID identifies the gateway.
+	ID string
+	// Operator may call the control endpoints of the API.
+	Operator bool
+
+	tokenHash []byte
+	// allowed containers by station, nil means all containers
+	stations map[int]map[int]bool
+}
+
+// Allowed reports whether the gateway may report for the container.
+func (g *Gateway) Allowed(station, container int) bool {
+	containers, ok := g.stations[station]
+	if !ok {
+		return false
+	}
+	return containers == nil || containers[container]
+}
+
+// Authenticator authenticates gateways by client certificates or bearer
+// tokens, and checks the readings they report against their ACLs.
+type Authenticator struct {
+	gateways map[string]*Gateway
+	auditor  *Auditor
+}
+
+// NewAuthenticator creates an authenticator of the configured gateways,
+// rejected requests are recorded by the auditor.
+func NewAuthenticator(cfg *config.GatewayAuthConfig, auditor *Auditor) (*Authenticator, error) {
+	a := &Authenticator{gateways: make(map[string]*Gateway), auditor: auditor}
+	for _, gc := range cfg.Gateways {
+		if gc.ID == "" {
+			return nil, errors.New("gateway id is empty")
+		}
+		if _, ok := a.gateways[gc.ID]; ok {
+			return nil, fmt.Errorf("duplicate gateway %s", gc.ID)
+		}
+		g := &Gateway{ID: gc.ID, Operator: gc.Operator, stations: make(map[int]map[int]bool)}
+		if gc.TokenSHA256 != "" {
+			hash, err := hex.DecodeString(gc.TokenSHA256)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid token hash of gateway %s", gc.ID)
+			}
+			g.tokenHash = hash
+		}
+		for _, acl := range gc.Stations {
+			if len(acl.Containers) == 0 {
+				g.stations[acl.Station] = nil
+				continue
+			}
+			containers, ok := g.stations[acl.Station]
+			if ok && containers == nil {
+				// all containers are allowed already
+				continue
+			}
+			if containers == nil {
+				containers = make(map[int]bool)
+				g.stations[acl.Station] = containers
+			}
+			for _, c := range acl.Containers {
+				containers[c] = true
+			}
+		}
+		a.gateways[gc.ID] = g
+	}
+	return a, nil
+}
+
+// Gateway returns the configured gateway of the id.
+func (a *Authenticator) Gateway(id string) (*Gateway, bool) {
+	g, ok := a.gateways[id]
+	return g, ok
+}
+
+// Audit records an audit event of a request rejected by the caller.
+func (a *Authenticator) Audit(e *Event) {
+	a.auditor.Record(e)
+}
+
+// HashToken returns the hex encoded SHA-256 of a token, as configured in
+// GatewayConfig.TokenSHA256.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// Authenticate identifies the gateway of an HTTP request. A verified client
+// certificate is matched by its common name, otherwise the request must
+// carry "Authorization: Bearer <gateway id>:<token>".
+func (a *Authenticator) Authenticate(r *http.Request) (*Gateway, error) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if g, ok := a.gateways[cn]; ok {
+			return g, nil
+		}
+		a.auditor.Record(&Event{Action: ActionUnauthenticated, Gateway: cn, Remote: r.RemoteAddr, Reason: "unknown client certificate"})
+		return nil, ErrUnauthenticated
+	}
+
+	scheme, credentials, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		a.auditor.Record(&Event{Action: ActionUnauthenticated, Remote: r.RemoteAddr, Reason: "missing credentials"})
+		return nil, ErrUnauthenticated
+	}
+	id, token, _ := strings.Cut(credentials, ":")
+	return a.AuthenticateToken(id, token, r.RemoteAddr)
+}
+
+// AuthenticateOperator authenticates the identity of an HTTP request like
+// Authenticate, and checks that it is an operator.
+func (a *Authenticator) AuthenticateOperator(r *http.Request) (*Gateway, error) {
+	g, err := a.Authenticate(r)
+	if err != nil {
+		return nil, err
+	}
+	if !g.Operator {
+		a.auditor.Record(&Event{Action: ActionDenied, Gateway: g.ID, Remote: r.RemoteAddr, Reason: "not an operator for " + r.URL.Path})
+		return nil, ErrNotOperator
+	}
+	return g, nil
+}
+
+// AuthenticateToken authenticates a gateway by its id and token, it is also
+// used for MQTT usernames and passwords.
+func (a *Authenticator) AuthenticateToken(id, token, remote string) (*Gateway, error) {
+	g, ok := a.gateways[id]
+	hash := sha256.Sum256([]byte(token))
+	if !ok || g.tokenHash == nil || subtle.ConstantTimeCompare(hash[:], g.tokenHash) != 1 {
+		a.auditor.Record(&Event{Action: ActionUnauthenticated, Gateway: id, Remote: remote, Reason: "invalid token"})
+		return nil, ErrUnauthenticated
+	}
+	return g, nil
+}
+
+// Authorize checks that the gateway may report all the readings, a batch
+// with any foreign reading is rejected as a whole.
+func (a *Authenticator) Authorize(g *Gateway, remote string, states []*data_model.BatteryState) error {
+	for _, state := range states {
+		if err := a.AuthorizeContainer(g, remote, state.Station, state.Container); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AuthorizeContainer checks that the gateway may report for the container.
+func (a *Authenticator) AuthorizeContainer(g *Gateway, remote string, station, container int) error {
+	if g.Allowed(station, container) {
+		return nil
+	}
+	a.auditor.Record(&Event{
+		Action:    ActionDenied,
+		Gateway:   g.ID,
+		Remote:    remote,
+		Station:   station,
+		Container: container,
+		Reason:    "station or container not allowed",
+	})
+	return fmt.Errorf("%w: station %d container %d", ErrForbidden, station, container)
+}
@@ -0,0 +1,132 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+func testConfig() *config.GatewayAuthConfig {
+	return &config.GatewayAuthConfig{Gateways: []config.GatewayConfig{
+		{
+			ID:          "gw-1",
+			TokenSHA256: HashToken("secret-1"),
+			Stations: []config.GatewayStationACL{
+				{Station: 1},
+				{Station: 2, Containers: []int{1, 2}},
+			},
+		},
+		{ID: "gw-cert", Stations: []config.GatewayStationACL{{Station: 3}}},
+		{ID: "operator", TokenSHA256: HashToken("secret-op"), Operator: true},
+	}}
+}
+
+func TestAuthenticate(t *testing.T) {
+	var audit bytes.Buffer
+	a, err := NewAuthenticator(testConfig(), NewAuditor(&audit))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("POST", "/sensor", nil)
+	r.Header.Set("Authorization", "Bearer gw-1:secret-1")
+	g, err := a.Authenticate(r)
+	require.NoError(t, err)
+	assert.Equal(t, "gw-1", g.ID)
+	assert.Empty(t, audit.String())
+
+	for _, header := range []string{"", "Basic Z3ctMTpzZWNyZXQtMQ==", "Bearer gw-1:secret-2", "Bearer gw-1", "Bearer gw-cert:"} {
+		r.Header.Set("Authorization", header)
+		_, err := a.Authenticate(r)
+		assert.ErrorIs(t, err, ErrUnauthenticated, header)
+	}
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	require.Len(t, lines, 5)
+	var e Event
+	require.NoError(t, json.Unmarshal([]byte(lines[2]), &e))
+	assert.Equal(t, ActionUnauthenticated, e.Action)
+	assert.Equal(t, "gw-1", e.Gateway)
+	assert.Equal(t, r.RemoteAddr, e.Remote)
+	assert.False(t, e.Time.IsZero())
+}
+
+func TestAuthenticateOperator(t *testing.T) {
+	var audit bytes.Buffer
+	a, err := NewAuthenticator(testConfig(), NewAuditor(&audit))
+	require.NoError(t, err)
+
+	r := httptest.NewRequest("PUT", "/fleet/setpoint", nil)
+	r.Header.Set("Authorization", "Bearer operator:secret-op")
+	g, err := a.AuthenticateOperator(r)
+	require.NoError(t, err)
+	assert.Equal(t, "operator", g.ID)
+
+	// a gateway may report readings but not control the stations
+	r.Header.Set("Authorization", "Bearer gw-1:secret-1")
+	_, err = a.AuthenticateOperator(r)
+	assert.ErrorIs(t, err, ErrNotOperator)
+	r.Header.Set("Authorization", "")
+	_, err = a.AuthenticateOperator(r)
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+
+	lines := strings.Split(strings.TrimSpace(audit.String()), "\n")
+	require.Len(t, lines, 2)
+	var e Event
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &e))
+	assert.Equal(t, ActionDenied, e.Action)
+	assert.Equal(t, "gw-1", e.Gateway)
+	assert.Equal(t, "not an operator for /fleet/setpoint", e.Reason)
+}
+
+func TestAuthorize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditor, err := OpenAuditLog(path)
+	require.NoError(t, err)
+	a, err := NewAuthenticator(testConfig(), auditor)
+	require.NoError(t, err)
+	g, ok := a.Gateway("gw-1")
+	require.True(t, ok)
+
+	assert.True(t, g.Allowed(1, 100))
+	assert.True(t, g.Allowed(2, 2))
+	assert.False(t, g.Allowed(2, 3))
+	assert.False(t, g.Allowed(3, 1))
+
+	allowed := []*data_model.BatteryState{{Station: 1, Container: 5}, {Station: 2, Container: 1}}
+	require.NoError(t, a.Authorize(g, "10.0.0.1:1234", allowed))
+	// one foreign reading rejects the batch
+	err = a.Authorize(g, "10.0.0.1:1234", append(allowed, &data_model.BatteryState{Station: 3, Container: 1}))
+	assert.ErrorIs(t, err, ErrForbidden)
+	require.NoError(t, auditor.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var e Event
+	require.NoError(t, json.Unmarshal(data, &e))
+	assert.Equal(t, Event{
+		Time: e.Time, Action: ActionDenied, Gateway: "gw-1", Remote: "10.0.0.1:1234",
+		Station: 3, Container: 1, Reason: "station or container not allowed",
+	}, e)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := NewAuthenticator(&config.GatewayAuthConfig{Gateways: []config.GatewayConfig{{}}}, nil)
+	assert.Error(t, err)
+	_, err = NewAuthenticator(&config.GatewayAuthConfig{Gateways: []config.GatewayConfig{{ID: "a"}, {ID: "a"}}}, nil)
+	assert.Error(t, err)
+	_, err = NewAuthenticator(&config.GatewayAuthConfig{Gateways: []config.GatewayConfig{{ID: "a", TokenSHA256: "abcd"}}}, nil)
+	assert.Error(t, err)
+
+	// a nil auditor only logs
+	a, err := NewAuthenticator(&config.GatewayAuthConfig{}, nil)
+	require.NoError(t, err)
+	_, err = a.AuthenticateToken("a", "b", "")
+	assert.ErrorIs(t, err, ErrUnauthenticated)
+}
@@ -0,0 +1,342 @@
+// Package grading grades retired EV modules for a second life in the
+// stations. The intake tests of the modules give their state of health,
+// DC resistance and self discharge, the accepted modules are graded into
+// tiers of fixed soh thresholds, so a tier means the same in every batch,
+// and the modules of a tier are grouped with their nearest neighbours in
+// capacity and resistance. The grades are stored as the metadata of the
+// packs.
+package grading
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// Defaults of the grading.
+const (
+	DefaultMinSOH           = 60
+	DefaultMaxSelfDischarge = 10
+	DefaultGroupSize        = 4
+)
+
+// DefaultTierSOH are the min soh of the tiers but the last.
+var DefaultTierSOH = []float64{85, 70}
+
+// ErrInvalidTest is returned for incomplete or inconsistent test data.
+var ErrInvalidTest = errors.New("invalid test")
+
+// Test is the intake test data of a module.
+type Test struct {
+	// Serial is the serial number of the module.
+	Serial string `json:"serial"`
+	// Station, Container and Pack locate the module if it is already
+	// installed as a pack.
+	Station   int `json:"station,omitempty"`
+	Container int `json:"container,omitempty"`
+	Pack      int `json:"pack,omitempty"`
+
+	// RatedCapacity is the nameplate capacity in ampere hours and
+	// Capacity the capacity discharged by the capacity test.
+	RatedCapacity float64 `json:"rated_capacity"`
+	Capacity      float64 `json:"capacity"`
+	// PulseCurrent is the current step in amps of the pulse resistance
+	// test and PulseVoltageDrop the voltage drop in volts it caused.
+	PulseCurrent     float64 `json:"pulse_current"`
+	PulseVoltageDrop float64 `json:"pulse_voltage_drop"`
+	// RestVoltageDrop is the open circuit voltage drop in mV over the
+	// RestHours of the self discharge measurement.
+	RestVoltageDrop float64 `json:"rest_voltage_drop"`
+	RestHours       float64 `json:"rest_hours"`
+}
+
+func (t *Test) validate() error {
+	switch {
+	case t.Serial == "":
+		return fmt.Errorf("%w: missing serial", ErrInvalidTest)
+	case t.RatedCapacity <= 0 || t.Capacity < 0:
+		return fmt.Errorf("%w: module %s: capacity %.1fAh of rated %.1fAh", ErrInvalidTest, t.Serial, t.Capacity, t.RatedCapacity)
+	case t.PulseCurrent <= 0 || t.PulseVoltageDrop < 0:
+		return fmt.Errorf("%w: module %s: pulse of %.1fA dropping %.3fV", ErrInvalidTest, t.Serial, t.PulseCurrent, t.PulseVoltageDrop)
+	case t.RestHours <= 0:
+		return fmt.Errorf("%w: module %s: rest of %.1fh", ErrInvalidTest, t.Serial, t.RestHours)
+	}
+	return nil
+}
+
+// TierSummary is the mean grades of the modules of a tier.
+type TierSummary struct {
+	Tier          int     `json:"tier"`
+	Modules       int     `json:"modules"`
+	SOH           float64 `json:"soh"`
+	Resistance    float64 `json:"resistance"`
+	SelfDischarge float64 `json:"self_discharge"`
+}
+
+// Group is a recommended group of modules of a tier matched in capacity and
+// resistance, to be assembled together.
+type Group struct {
+	// ID is the batch and the number of the group in the batch.
+	ID      string   `json:"id"`
+	Tier    int      `json:"tier"`
+	Serials []string `json:"serials"`
+	// CapacitySpread and ResistanceSpread are the spreads of the modules
+	// in percent of their mean.
+	CapacitySpread   float64 `json:"capacity_spread"`
+	ResistanceSpread float64 `json:"resistance_spread"`
+}
+
+// Report is the result of the grading of a batch of modules.
+type Report struct {
+	// Batch identifies the batch, the time of the grading.
+	Batch string `json:"batch"`
+	// Modules are the grades of the modules in the order of the tests.
+	Modules []data_model.PackMetadata `json:"modules"`
+	Tiers   []TierSummary             `json:"tiers"`
+	Groups  []Group                   `json:"groups"`
+}
+
+// MetadataStore stores the metadata of the packs, it is implemented by the
+// local store.
+type MetadataStore interface {
+	SavePackMetadata(metadata []data_model.PackMetadata) error
+}
+
+// Grader grades batches of intake tests.
+type Grader struct {
+	cfg   config.GradingConfig
+	store MetadataStore
+}
+
+// NewGrader creates a new Grader storing the grades in store, nil doesn't
+// store them.
+func NewGrader(cfg *config.GradingConfig, store MetadataStore) *Grader {
+	c := *cfg
+	if len(c.TierSOH) == 0 {
+		c.TierSOH = DefaultTierSOH
+	}
+	if c.MinSOH <= 0 {
+		c.MinSOH = DefaultMinSOH
+	}
+	if c.MaxSelfDischarge <= 0 {
+		c.MaxSelfDischarge = DefaultMaxSelfDischarge
+	}
+	if c.GroupSize <= 0 {
+		c.GroupSize = DefaultGroupSize
+	}
+	return &Grader{cfg: c, store: store}
+}
+
+// Grade grades the tested modules and stores their grades. Modules below
+// the min soh or over the max self discharge are rejected, the others are
+// graded into the first tier whose min soh they reach. The modules of a
+// tier are grouped with their nearest neighbours in capacity and
+// resistance, the modules left over are not grouped.
+func (g *Grader) Grade(tests []Test) (*Report, error) {
+	now := time.Now()
+	graded := now.Unix()
+	report := &Report{
+		Batch:   now.UTC().Format("20060102T150405.000000000Z"),
+		Modules: make([]data_model.PackMetadata, len(tests)),
+	}
+	seen := make(map[string]bool, len(tests))
+	var accepted []int
+	for i := range tests {
+		t := &tests[i]
+		if err := t.validate(); err != nil {
+			return nil, err
+		}
+		if seen[t.Serial] {
+			return nil, fmt.Errorf("%w: duplicate module %s", ErrInvalidTest, t.Serial)
+		}
+		seen[t.Serial] = true
+
+		m := data_model.PackMetadata{
+			Serial:        t.Serial,
+			Station:       t.Station,
+			Container:     t.Container,
+			Pack:          t.Pack,
+			SOH:           math.Min(100, t.Capacity/t.RatedCapacity*100),
+			Capacity:      t.Capacity,
+			Resistance:    t.PulseVoltageDrop / t.PulseCurrent * 1000,
+			SelfDischarge: t.RestVoltageDrop / t.RestHours * 24,
+			Graded:        graded,
+		}
+		switch {
+		case m.SOH < g.cfg.MinSOH:
+			m.Reason = fmt.Sprintf("state of health %.1f%% is below %.1f%%", m.SOH, g.cfg.MinSOH)
+		case m.SelfDischarge > g.cfg.MaxSelfDischarge:
+			m.Reason = fmt.Sprintf("self discharge %.1fmV/day is over %.1fmV/day", m.SelfDischarge, g.cfg.MaxSelfDischarge)
+		default:
+			accepted = append(accepted, i)
+		}
+		report.Modules[i] = m
+	}
+
+	g.tier(report, accepted)
+	g.group(report, accepted)
+	if g.store != nil {
+		if err := g.store.SavePackMetadata(report.Modules); err != nil {
+			return nil, fmt.Errorf("failed to store pack metadata: %w", err)
+		}
+	}
+	return report, nil
+}
+
+// tierOf returns the tier of a module of the soh, 1 the best.
+func (g *Grader) tierOf(soh float64) int {
+	for i, threshold := range g.cfg.TierSOH {
+		if soh >= threshold {
+			return i + 1
+		}
+	}
+	return len(g.cfg.TierSOH) + 1
+}
+
+// tier grades the accepted modules into the tiers, only the tiers with
+// modules are summarized.
+func (g *Grader) tier(report *Report, accepted []int) {
+	summaries := make([]TierSummary, len(g.cfg.TierSOH)+1)
+	for _, idx := range accepted {
+		m := &report.Modules[idx]
+		m.Tier = g.tierOf(m.SOH)
+		s := &summaries[m.Tier-1]
+		s.Modules++
+		s.SOH += m.SOH
+		s.Resistance += m.Resistance
+		s.SelfDischarge += m.SelfDischarge
+	}
+	for i := range summaries {
+		s := &summaries[i]
+		if s.Modules == 0 {
+			continue
+		}
+		n := float64(s.Modules)
+		s.Tier = i + 1
+		s.SOH, s.Resistance, s.SelfDischarge = s.SOH/n, s.Resistance/n, s.SelfDischarge/n
+		report.Tiers = append(report.Tiers, *s)
+	}
+}
+
+// standardize returns the capacity and resistance of the modules scaled
+// to a zero mean and a unit deviation, so both weigh the same.
+func standardize(modules []data_model.PackMetadata, indexes []int) [][2]float64 {
+	points := make([][2]float64, len(indexes))
+	for i, idx := range indexes {
+		points[i] = [2]float64{modules[idx].Capacity, modules[idx].Resistance}
+	}
+	for f := 0; f < 2; f++ {
+		var mean, variance float64
+		for _, p := range points {
+			mean += p[f]
+		}
+		mean /= float64(len(points))
+		for _, p := range points {
+			variance += (p[f] - mean) * (p[f] - mean)
+		}
+		std := math.Sqrt(variance / float64(len(points)))
+		for i := range points {
+			if std > 0 {
+				points[i][f] = (points[i][f] - mean) / std
+			} else {
+				points[i][f] = 0
+			}
+		}
+	}
+	return points
+}
+
+// distance returns the squared distance of two points.
+func distance(a, b [2]float64) float64 {
+	return (a[0]-b[0])*(a[0]-b[0]) + (a[1]-b[1])*(a[1]-b[1])
+}
+
+// group groups the modules of every tier over their standardized
+// capacity and resistance: every ungrouped module and its nearest
+// ungrouped neighbours form a candidate group, the tightest candidate is
+// grouped first, so the outliers are left over instead of spoiling a group.
+func (g *Grader) group(report *Report, accepted []int) {
+	byTier := make(map[int][]int)
+	for _, idx := range accepted {
+		tier := report.Modules[idx].Tier
+		byTier[tier] = append(byTier[tier], idx)
+	}
+	for _, summary := range report.Tiers {
+		modules := byTier[summary.Tier]
+		points := standardize(report.Modules, modules)
+		grouped := make([]bool, len(modules))
+		for left := len(modules); left >= g.cfg.GroupSize; left -= g.cfg.GroupSize {
+			var members []int
+			tightest := math.Inf(1)
+			for seed := range points {
+				if grouped[seed] {
+					continue
+				}
+				candidate := g.nearest(points, grouped, seed)
+				// the diameter of the candidate
+				var diameter float64
+				for _, i := range candidate {
+					for _, j := range candidate {
+						diameter = math.Max(diameter, distance(points[i], points[j]))
+					}
+				}
+				if diameter < tightest {
+					members, tightest = candidate, diameter
+				}
+			}
+			sort.SliceStable(members, func(i, j int) bool {
+				a, b := &report.Modules[modules[members[i]]], &report.Modules[modules[members[j]]]
+				if a.Capacity != b.Capacity {
+					return a.Capacity > b.Capacity
+				}
+				return a.Resistance < b.Resistance
+			})
+
+			group := Group{ID: fmt.Sprintf("%s-%d", report.Batch, len(report.Groups)+1), Tier: summary.Tier}
+			var capacities, resistances []float64
+			for _, i := range members {
+				grouped[i] = true
+				m := &report.Modules[modules[i]]
+				m.Group = group.ID
+				group.Serials = append(group.Serials, m.Serial)
+				capacities = append(capacities, m.Capacity)
+				resistances = append(resistances, m.Resistance)
+			}
+			group.CapacitySpread = spread(capacities)
+			group.ResistanceSpread = spread(resistances)
+			report.Groups = append(report.Groups, group)
+		}
+	}
+}
+
+// nearest returns the seed and its nearest ungrouped neighbours, a group of
+// them.
+func (g *Grader) nearest(points [][2]float64, grouped []bool, seed int) []int {
+	var neighbours []int
+	for i := range points {
+		if !grouped[i] {
+			neighbours = append(neighbours, i)
+		}
+	}
+	sort.SliceStable(neighbours, func(i, j int) bool {
+		return distance(points[neighbours[i]], points[seed]) < distance(points[neighbours[j]], points[seed])
+	})
+	return neighbours[:g.cfg.GroupSize]
+}
+
+// spread returns the spread of the values in percent of their mean.
+func spread(values []float64) float64 {
+	lo, hi, sum := math.Inf(1), math.Inf(-1), 0.0
+	for _, v := range values {
+		lo, hi, sum = math.Min(lo, v), math.Max(hi, v), sum+v
+	}
+	if sum == 0 {
+		return 0
+	}
+	return (hi - lo) / (sum / float64(len(values))) * 100
+}
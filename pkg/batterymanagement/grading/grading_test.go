@@ -0,0 +1,149 @@
+package grading
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+type fakeStore struct {
+	metadata []data_model.PackMetadata
+}
+
+func (f *fakeStore) SavePackMetadata(metadata []data_model.PackMetadata) error {
+	f.metadata = append(f.metadata, metadata...)
+	return nil
+}
+
+// module returns the test of a module of 100Ah rated capacity with a 100A
+// pulse and a 24 hours rest.
+func module(serial string, capacity, drop, rest float64) Test {
+	return Test{
+		Serial:        serial,
+		RatedCapacity: 100,
+		Capacity:      capacity,
+		PulseCurrent:  100, PulseVoltageDrop: drop,
+		RestVoltageDrop: rest, RestHours: 24,
+	}
+}
+
+func TestGrade(t *testing.T) {
+	tests := []Test{
+		module("m1", 91, 0.10, 2),
+		module("m2", 75, 0.15, 3),
+		module("m3", 89, 0.11, 2),
+		module("m4", 65, 0.22, 4),
+		module("m5", 50, 0.30, 4),
+		module("m6", 92, 0.10, 1),
+		module("m7", 76, 0.16, 3),
+		module("m8", 88, 0.10, 2),
+		module("m9", 74, 0.14, 3),
+		module("m10", 66, 0.23, 5),
+		module("m11", 90, 0.10, 20),
+		module("m12", 77, 0.15, 2),
+	}
+	store := &fakeStore{}
+	report, err := NewGrader(&config.GradingConfig{}, store).Grade(tests)
+	require.NoError(t, err)
+	require.Len(t, report.Modules, len(tests))
+	assert.Equal(t, report.Modules, store.metadata)
+
+	m := report.Modules[0]
+	assert.Equal(t, "m1", m.Serial)
+	assert.InDelta(t, 91, m.SOH, 1e-9)
+	assert.InDelta(t, 1, m.Resistance, 1e-9)
+	assert.InDelta(t, 2, m.SelfDischarge, 1e-9)
+	assert.NotZero(t, m.Graded)
+
+	// rejected modules aren't graded
+	assert.Zero(t, report.Modules[4].Tier)
+	assert.Equal(t, "state of health 50.0% is below 60.0%", report.Modules[4].Reason)
+	assert.Zero(t, report.Modules[10].Tier)
+	assert.Equal(t, "self discharge 20.0mV/day is over 10.0mV/day", report.Modules[10].Reason)
+
+	tiers := make(map[string]int)
+	for _, m := range report.Modules {
+		tiers[m.Serial] = m.Tier
+	}
+	assert.Equal(t, map[string]int{
+		"m1": 1, "m3": 1, "m6": 1, "m8": 1,
+		"m2": 2, "m7": 2, "m9": 2, "m12": 2,
+		"m4": 3, "m10": 3,
+		"m5": 0, "m11": 0,
+	}, tiers)
+	require.Len(t, report.Tiers, 3)
+	assert.Equal(t, TierSummary{Tier: 3, Modules: 2, SOH: 65.5, Resistance: 2.25, SelfDischarge: 4.5}, report.Tiers[2])
+
+	// the two modules of the last tier are too few for a group
+	require.Len(t, report.Groups, 2)
+	assert.Equal(t, report.Batch+"-1", report.Groups[0].ID)
+	assert.Equal(t, []string{"m6", "m1", "m3", "m8"}, report.Groups[0].Serials)
+	assert.InDelta(t, 4/90.0*100, report.Groups[0].CapacitySpread, 1e-9)
+	assert.InDelta(t, 0.1/1.025*100, report.Groups[0].ResistanceSpread, 1e-9)
+	assert.Equal(t, 2, report.Groups[1].Tier)
+	assert.Equal(t, []string{"m12", "m7", "m2", "m9"}, report.Groups[1].Serials)
+	assert.Equal(t, report.Groups[1].ID, report.Modules[1].Group)
+	assert.Empty(t, report.Modules[3].Group)
+
+	// the tiers and groups of another batch don't mix with the first
+	time.Sleep(time.Millisecond)
+	again, err := NewGrader(&config.GradingConfig{}, store).Grade(tests[:4])
+	require.NoError(t, err)
+	assert.Equal(t, 1, again.Modules[0].Tier)
+	assert.Equal(t, 2, again.Modules[1].Tier)
+	assert.NotEqual(t, report.Batch, again.Batch)
+	for _, group := range again.Groups {
+		assert.NotEqual(t, report.Groups[0].ID, group.ID)
+	}
+}
+
+func TestGradeGroups(t *testing.T) {
+	// two pairs matched in resistance interleaved in capacity, which a
+	// sort by capacity would pair across, and an outlier left over
+	tests := []Test{
+		module("a1", 95, 0.10, 1),
+		module("b1", 94.5, 0.20, 1),
+		module("a2", 94, 0.10, 1),
+		module("b2", 93.5, 0.20, 1),
+		module("c", 86, 0.15, 1),
+	}
+	report, err := NewGrader(&config.GradingConfig{GroupSize: 2}, nil).Grade(tests)
+	require.NoError(t, err)
+	var groups [][]string
+	for _, group := range report.Groups {
+		groups = append(groups, group.Serials)
+	}
+	assert.ElementsMatch(t, [][]string{{"a1", "a2"}, {"b1", "b2"}}, groups)
+	assert.Empty(t, report.Modules[4].Group)
+}
+
+func TestGradeFewModules(t *testing.T) {
+	report, err := NewGrader(&config.GradingConfig{GroupSize: 2}, nil).Grade([]Test{
+		module("a", 80, 0.1, 1),
+		module("b", 80, 0.1, 1),
+	})
+	require.NoError(t, err)
+	// the tiers keep their thresholds, the best one being empty
+	assert.Equal(t, []TierSummary{{Tier: 2, Modules: 2, SOH: 80, Resistance: 1, SelfDischarge: 1}}, report.Tiers)
+	require.Len(t, report.Groups, 1)
+	assert.Zero(t, report.Groups[0].CapacitySpread)
+}
+
+func TestGradeInvalid(t *testing.T) {
+	g := NewGrader(&config.GradingConfig{}, nil)
+	for _, tests := range [][]Test{
+		{module("", 80, 0.1, 1)},
+		{{Serial: "a", Capacity: 80, PulseCurrent: 100, RestHours: 24}},
+		{{Serial: "a", RatedCapacity: 100, Capacity: 80, RestHours: 24}},
+		{{Serial: "a", RatedCapacity: 100, Capacity: 80, PulseCurrent: 100}},
+		{module("a", 80, 0.1, 1), module("a", 80, 0.1, 1)},
+	} {
+		_, err := g.Grade(tests)
+		assert.ErrorIs(t, err, ErrInvalidTest, fmt.Sprint(tests))
+	}
+}
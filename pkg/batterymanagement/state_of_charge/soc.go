@@ -43,10 +43,6 @@
 
 package soc
 
-import (
-	"github.com/zhangjinpeng87/openbms/pkg/utils"
-)
-
 const (
 	// Discharge parameters of Li-ion battery
 	// DisLiMaxVoltage is the maximum voltage of a battery cell when discharging.
@@ -86,7 +82,7 @@ type DischargeCalculater struct {
 
 // NewDischargeCalculater creates a new soc calculater.
 func NewDischargeCalculater(MaxVoltage, MidHighVoltage, MidLowVoltage, MinVoltage float64) *DischargeCalculater {
-	return &DischargeSocCalculater{
+	return &DischargeCalculater{
 		DisMaxVoltage:     MaxVoltage,
 		DisMidHighVoltage: MidHighVoltage,
 		DisMidLowVoltage:  MidLowVoltage,
@@ -96,7 +92,7 @@ func NewDischargeCalculater(MaxVoltage, MidHighVoltage, MidLowVoltage, MinVoltag
 
 // NewDefaultDischargeCalculater creates a new soc calculater with default parameters.
 func NewDefaultDischargeCalculater() *DischargeCalculater {
-	return &DischargeSocCalculater{
+	return &DischargeCalculater{
 		DisMaxVoltage:     DisLiMaxVoltage,
 		DisMidHighVoltage: DisLiMidHighVoltage,
 		DisMidLowVoltage:  DisLiMidLowVoltage,
@@ -131,7 +127,7 @@ type ChargeCalculater struct {
 
 // NewChargeCalculater creates a new charge calculater.
 func NewChargeCalculater(MaxVoltage, MidHighVoltage, MidLowVoltage, MinVoltage, MaxChargingCurrent float64) *ChargeCalculater {
-	return &ChargeSocCalculater{
+	return &ChargeCalculater{
 		ChMaxVoltage:         MaxVoltage,
 		ChMidHighVoltage:     MidHighVoltage,
 		ChMidLowVoltage:      MidLowVoltage,
@@ -142,7 +138,7 @@ func NewChargeCalculater(MaxVoltage, MidHighVoltage, MidLowVoltage, MinVoltage,
 
 // NewDefaultChargeCalculater creates a new charge calculater with default parameters.
 func NewDefaultChargeCalculater() *ChargeCalculater {
-	return &ChargeSocCalculater{
+	return &ChargeCalculater{
 		ChMaxVoltage:         ChLiMaxVoltage,
 		ChMidHighVoltage:     ChLiMidHighVoltage,
 		ChMidLowVoltage:      ChLiMidLowVoltage,
@@ -153,7 +149,7 @@ func NewDefaultChargeCalculater() *ChargeCalculater {
 
 // SOC calculates the soc of a battery cell when charging.
 func (s *ChargeCalculater) SOC(voltage, current float64) float64 {
-	if current >= s.MaxChargingCurrent {
+	if current >= s.ChMaxChargingCurrent {
 		// Constant Current Charge Stage
 		if voltage < s.ChMinVoltage {
 			return 0
@@ -166,6 +162,6 @@ func (s *ChargeCalculater) SOC(voltage, current float64) float64 {
 		}
 	} else {
 		// Saturation Charge Stage
-		return 80 + (s.MaxChargingCurrent-current)/s.MaxChargingCurrent*20
+		return 80 + (s.ChMaxChargingCurrent-current)/s.ChMaxChargingCurrent*20
 	}
 }
@@ -0,0 +1,289 @@
+package canbus
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"go.uber.org/zap"
+)
+
+// DefaultFlushInterval is the default interval to emit assembled states.
+const DefaultFlushInterval = time.Second
+
+const (
+	// cellPlaceholder is replaced by the cell id in signal name templates.
+	cellPlaceholder = "{cell}"
+	// maxPending is the max number of readings kept while the ingester
+	// keeps failing.
+	maxPending = 100000
+)
+
+// Ingester accepts decoded readings, it is implemented by ingestion.Pipeline.
+type Ingester interface {
+	Ingest(states ...*data_model.BatteryState) error
+}
+
+// field is a value of a cell carried by a signal.
+type field uint8
+
+const (
+	fieldVoltage field = 1 << iota
+	fieldTemperature
+	fieldSOC
+	fieldPackCurrent
+)
+
+// binding binds a signal to a field of a cell.
+type binding struct {
+	field field
+	cell  int
+}
+
+// Assembler assembles the signals of a pack BMS into cell states. Cell
+// values usually arrive in multiplexed frames a few cells at a time, a
+// cell is emitted when a value of its next reading arrives or on flush,
+// carrying the latest known values of its other fields and the pack
+// current.
+type Assembler struct {
+	cfg      *config.CANConfig
+	db       *Database
+	bindings map[string]binding
+
+	mu      sync.Mutex
+	cells   map[int]*data_model.BatteryState
+	fresh   map[int]field
+	ready   []*data_model.BatteryState
+	current float64
+	unknown map[uint32]bool
+}
+
+// NewAssembler creates an assembler of the signals defined in db.
+func NewAssembler(cfg *config.CANConfig, db *Database) (*Assembler, error) {
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = DefaultFlushInterval
+	}
+	a := &Assembler{
+		cfg:      cfg,
+		db:       db,
+		bindings: make(map[string]binding),
+		cells:    make(map[int]*data_model.BatteryState),
+		fresh:    make(map[int]field),
+		unknown:  make(map[uint32]bool),
+	}
+	templates := []struct {
+		template string
+		field    field
+	}{
+		{cfg.CellVoltage, fieldVoltage},
+		{cfg.CellTemperature, fieldTemperature},
+		{cfg.CellSOC, fieldSOC},
+	}
+	for _, t := range templates {
+		if t.template != "" && strings.Count(t.template, cellPlaceholder) != 1 {
+			return nil, fmt.Errorf("signal template %q must contain %s once", t.template, cellPlaceholder)
+		}
+	}
+	for _, msg := range db.messages {
+		for _, sig := range msg.Signals {
+			if sig.Name == cfg.PackCurrent {
+				a.bindings[sig.Name] = binding{field: fieldPackCurrent}
+				continue
+			}
+			for _, t := range templates {
+				if cell, ok := matchTemplate(t.template, sig.Name); ok {
+					a.bindings[sig.Name] = binding{field: t.field, cell: cell}
+					break
+				}
+			}
+		}
+	}
+	if len(a.bindings) == 0 {
+		return nil, errors.New("no signal in the dbc file matches the cell signal templates")
+	}
+	return a, nil
+}
+
+// matchTemplate returns the cell id if the signal name matches the template.
+func matchTemplate(template, name string) (int, bool) {
+	if template == "" {
+		return 0, false
+	}
+	prefix, suffix, _ := strings.Cut(template, cellPlaceholder)
+	if len(name) <= len(prefix)+len(suffix) || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) {
+		return 0, false
+	}
+	cell, err := strconv.Atoi(name[len(prefix) : len(name)-len(suffix)])
+	if err != nil || cell < 0 {
+		return 0, false
+	}
+	return cell, true
+}
+
+// Add decodes the frame and applies its signals. Frames not defined in the
+// DBC file are ignored.
+func (a *Assembler) Add(f *Frame) error {
+	msg := a.db.Message(f.ID, f.Extended)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if msg == nil {
+		key := frameKey(f.ID, f.Extended)
+		if !a.unknown[key] {
+			a.unknown[key] = true
+			log.Debug("ignore undefined can frame", zap.Uint32("id", f.ID), zap.Bool("extended", f.Extended))
+		}
+		return nil
+	}
+	values, err := msg.Decode(f.Data)
+	if err != nil {
+		return fmt.Errorf("failed to decode message %s: %w", msg.Name, err)
+	}
+
+	ts := f.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
+	}
+	// apply in the order of definition, so cells are emitted in order
+	for _, sig := range msg.Signals {
+		v, ok := values[sig.Name]
+		if !ok {
+			continue
+		}
+		b, ok := a.bindings[sig.Name]
+		if !ok {
+			continue
+		}
+		if b.field == fieldPackCurrent {
+			a.current = v
+			continue
+		}
+		// the previous reading of the cell is complete
+		if a.fresh[b.cell]&b.field != 0 {
+			a.ready = append(a.ready, a.emit(b.cell))
+		}
+		cell, ok := a.cells[b.cell]
+		if !ok {
+			cell = &data_model.BatteryState{
+				Station:   a.cfg.Station,
+				Container: a.cfg.Container,
+				Pack:      a.cfg.Pack,
+				Cell:      b.cell,
+				Gateway:   "can:" + a.cfg.Interface,
+			}
+			a.cells[b.cell] = cell
+		}
+		switch b.field {
+		case fieldVoltage:
+			cell.Voltage = v
+		case fieldTemperature:
+			cell.Temperature = v
+		case fieldSOC:
+			cell.SOC = v
+		}
+		cell.Timestamp = ts.Unix()
+		a.fresh[b.cell] |= b.field
+	}
+	return nil
+}
+
+// emit returns a copy of the latest state of the cell.
+func (a *Assembler) emit(cell int) *data_model.BatteryState {
+	state := *a.cells[cell]
+	state.Current = a.current
+	state.State = data_model.StateOf(a.current)
+	delete(a.fresh, cell)
+	return &state
+}
+
+// Flush returns the readings assembled since the last flush.
+func (a *Assembler) Flush() []*data_model.BatteryState {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cells := make([]int, 0, len(a.fresh))
+	for cell := range a.fresh {
+		cells = append(cells, cell)
+	}
+	sort.Ints(cells)
+	states := a.ready
+	for _, cell := range cells {
+		states = append(states, a.emit(cell))
+	}
+	a.ready = nil
+	return states
+}
+
+// requeue puts back readings which failed to ingest, they are emitted
+// before the newer ones on the next flush.
+func (a *Assembler) requeue(states []*data_model.BatteryState) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ready = append(states, a.ready...)
+	if over := len(a.ready) - maxPending; over > 0 {
+		log.Warn("too many pending can readings, drop the oldest", zap.Int("dropped", over))
+		a.ready = a.ready[over:]
+	}
+}
+
+// Run reads frames from the source and ingests the assembled readings every
+// flush interval, until ctx is done or the source ends. The source is
+// closed when Run returns.
+func (a *Assembler) Run(ctx context.Context, src FrameSource, ingester Ingester) error {
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			f, err := src.ReadFrame()
+			if errors.Is(err, ErrInvalidFrame) {
+				log.Warn("skip invalid can frame", zap.Error(err))
+				continue
+			}
+			if err != nil {
+				readErr <- err
+				return
+			}
+			if err := a.Add(f); err != nil {
+				log.Warn("drop undecodable can frame", zap.Stringer("frame", f), zap.Error(err))
+			}
+		}
+	}()
+
+	flush := func() {
+		states := a.Flush()
+		if len(states) == 0 {
+			return
+		}
+		if err := ingester.Ingest(states...); err != nil {
+			log.Warn("failed to ingest can readings, will retry", zap.Int("count", len(states)), zap.Error(err))
+			a.requeue(states)
+		}
+	}
+
+	ticker := time.NewTicker(a.cfg.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			src.Close()
+			<-readErr
+			flush()
+			return nil
+		case err := <-readErr:
+			src.Close()
+			flush()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
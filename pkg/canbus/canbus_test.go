@@ -0,0 +1,278 @@
+package canbus
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// testDBC defines a multiplexed cell voltage message with three cells per
+// frame, and an extended pack status message with a big endian signed
+// current and cell temperatures.
+const testDBC = `VERSION ""
+
+NS_ :
+	CM_
+
+BU_: BMS
+
+BO_ 1024 CellVoltages: 8 BMS
+ SG_ Mux M : 0|8@1+ (1,0) [0|255] "" Vector__XXX
+ SG_ Cell1_Voltage m0 : 8|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+ SG_ Cell2_Voltage m0 : 24|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+ SG_ Cell3_Voltage m0 : 40|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+ SG_ Cell4_Voltage m1 : 8|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+ SG_ Cell5_Voltage m1 : 24|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+ SG_ Cell6_Voltage m1 : 40|16@1+ (0.001,0) [0|5] "V" Vector__XXX
+
+BO_ 2147484673 PackStatus: 8 BMS
+ SG_ PackCurrent : 7|16@0- (0.1,0) [-3276.8|3276.7] "A" Vector__XXX
+ SG_ Cell1_Temperature : 16|8@1- (1,0) [-128|127] "C" Vector__XXX
+ SG_ Cell2_Temperature : 24|8@1- (1,0) [-128|127] "C" Vector__XXX
+
+CM_ SG_ 1024 Mux "selects the cells of the frame";
+VAL_ 1024 Mux 0 "cells 1-3" 1 "cells 4-6" ;
+`
+
+const testLog = `(1700000000.000000) vcan0 400#00E40CE50CE60C00
+(1700000000.010000) vcan0 400#01EE0CEF0CF00C00
+(1700000000.020000) vcan0 00000401#FF8319E700000000
+(1700000001.000000) vcan0 400#00E50CE50CE60C00
+(1700000001.010000) vcan0 123#00
+`
+
+func testConfig() *config.CANConfig {
+	return &config.CANConfig{
+		Interface:       "vcan0",
+		Station:         1,
+		Container:       2,
+		Pack:            3,
+		CellVoltage:     "Cell{cell}_Voltage",
+		CellTemperature: "Cell{cell}_Temperature",
+		PackCurrent:     "PackCurrent",
+	}
+}
+
+func TestParseDBC(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bms.dbc")
+	require.NoError(t, os.WriteFile(path, []byte(testDBC), 0o644))
+	db, err := LoadDBC(path)
+	require.NoError(t, err)
+	assert.Equal(t, 2, db.Messages())
+
+	msg := db.Message(0x400, false)
+	require.NotNil(t, msg)
+	assert.Equal(t, "CellVoltages", msg.Name)
+	require.NotNil(t, msg.Multiplexer)
+	require.Len(t, msg.Signals, 6)
+	sig := msg.Signals[3]
+	assert.Equal(t, Signal{
+		Name: "Cell4_Voltage", Start: 8, Length: 16, LittleEndian: true,
+		Factor: 0.001, Min: 0, Max: 5, Unit: "V", MuxValue: 1,
+	}, *sig)
+
+	status := db.Message(0x401, true)
+	require.NotNil(t, status)
+	assert.Nil(t, db.Message(0x401, false))
+	assert.False(t, status.Signals[0].LittleEndian)
+	assert.True(t, status.Signals[0].Signed)
+
+	_, err = ParseDBC(strings.NewReader(" SG_ A : 0|8@1+ (1,0) [0|1] \"\" X"))
+	assert.Error(t, err)
+	_, err = ParseDBC(strings.NewReader("BO_ 1 A: 8 X\n SG_ A m0M : 0|8@1+ (1,0) [0|1] \"\" X"))
+	assert.Error(t, err)
+	_, err = ParseDBC(strings.NewReader("BO_ 1 A: 8 X\n SG_ A m0 : 0|8@1+ (1,0) [0|1] \"\" X"))
+	assert.Error(t, err)
+}
+
+func TestDecodeSignals(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC))
+	require.NoError(t, err)
+
+	values, err := db.Message(0x400, false).Decode([]byte{0x01, 0xee, 0x0c, 0xef, 0x0c, 0xf0, 0x0c, 0x00})
+	require.NoError(t, err)
+	assert.Len(t, values, 3)
+	assert.InDelta(t, 3.310, values["Cell4_Voltage"], 1e-9)
+	assert.InDelta(t, 3.312, values["Cell6_Voltage"], 1e-9)
+
+	values, err = db.Message(0x401, true).Decode([]byte{0xff, 0x83, 0x19, 0xe7, 0, 0, 0, 0})
+	require.NoError(t, err)
+	assert.InDelta(t, -12.5, values["PackCurrent"], 1e-9)
+	assert.Equal(t, 25.0, values["Cell1_Temperature"])
+	assert.Equal(t, -25.0, values["Cell2_Temperature"])
+
+	// a Motorola signal crossing bytes with an odd length
+	sig := &Signal{Name: "x", Start: 3, Length: 12, Factor: 1}
+	v, err := sig.Decode([]byte{0x0a, 0xbc})
+	require.NoError(t, err)
+	assert.Equal(t, float64(0xabc), v)
+
+	_, err = db.Message(0x400, false).Decode([]byte{0x00, 0x01})
+	assert.Error(t, err)
+}
+
+func TestParseFrame(t *testing.T) {
+	f, err := ParseFrame("123#DEADBEEF")
+	require.NoError(t, err)
+	assert.Equal(t, &Frame{ID: 0x123, Data: []byte{0xde, 0xad, 0xbe, 0xef}}, f)
+	assert.Equal(t, "123#DEADBEEF", f.String())
+
+	f, err = ParseFrame("1ABCDEF0#")
+	require.NoError(t, err)
+	assert.True(t, f.Extended)
+	assert.Equal(t, uint32(0x1abcdef0), f.ID)
+	assert.Empty(t, f.Data)
+
+	f, err = ParseFrame("123##1" + strings.Repeat("00", 12))
+	require.NoError(t, err)
+	assert.Len(t, f.Data, 12)
+
+	for _, s := range []string{"123", "800#00", "12#00", "123#R", "123#0", "123#" + strings.Repeat("00", 9), "2ABCDEF0#00"} {
+		_, err := ParseFrame(s)
+		assert.ErrorIs(t, err, ErrInvalidFrame, s)
+	}
+}
+
+func TestCandumpReader(t *testing.T) {
+	r := NewCandumpReader(strings.NewReader("# recorded on vcan0\n\n" + testLog + "123#11 R\n"))
+	var frames []*Frame
+	for {
+		f, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		frames = append(frames, f)
+	}
+	require.Len(t, frames, 6)
+	assert.Equal(t, time.Unix(1700000000, 10000000), frames[1].Timestamp)
+	assert.True(t, frames[2].Extended)
+	assert.True(t, frames[5].Timestamp.IsZero())
+
+	_, err := NewCandumpReader(strings.NewReader("(1) vcan0\n")).ReadFrame()
+	assert.ErrorIs(t, err, ErrInvalidFrame)
+}
+
+func TestAssembler(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC))
+	require.NoError(t, err)
+	a, err := NewAssembler(testConfig(), db)
+	require.NoError(t, err)
+
+	r := NewCandumpReader(strings.NewReader(testLog))
+	for {
+		f, err := r.ReadFrame()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		require.NoError(t, a.Add(f))
+	}
+	states := a.Flush()
+	require.Len(t, states, 9)
+	// the first readings of cells 1-3 are complete when their next voltages arrive
+	assert.Equal(t, data_model.BatteryState{
+		Station: 1, Container: 2, Pack: 3, Cell: 1,
+		Voltage: 3.3, Current: -12.5, Temperature: 25, Timestamp: 1700000000, State: data_model.Discharging,
+		Gateway: "can:vcan0",
+	}, roundState(states[0]))
+	assert.Equal(t, -25.0, states[1].Temperature)
+	assert.Equal(t, 3, states[2].Cell)
+	for i, state := range states[3:] {
+		assert.Equal(t, i+1, state.Cell)
+	}
+	// the other values of the cell are carried over
+	assert.Equal(t, data_model.BatteryState{
+		Station: 1, Container: 2, Pack: 3, Cell: 1,
+		Voltage: 3.301, Current: -12.5, Temperature: 25, Timestamp: 1700000001, State: data_model.Discharging,
+		Gateway: "can:vcan0",
+	}, roundState(states[3]))
+	assert.Equal(t, 3.312, roundState(states[8]).Voltage)
+	assert.Empty(t, a.Flush())
+
+	_, err = NewAssembler(&config.CANConfig{CellVoltage: "Cell_V"}, db)
+	assert.Error(t, err)
+	_, err = NewAssembler(&config.CANConfig{CellVoltage: "Module{cell}_V"}, db)
+	assert.Error(t, err)
+}
+
+// roundState rounds the scaled voltage to mV for comparison.
+func roundState(s *data_model.BatteryState) data_model.BatteryState {
+	state := *s
+	state.Voltage = float64(int(state.Voltage*1000+0.5)) / 1000
+	return state
+}
+
+type flakyIngester struct {
+	mu     sync.Mutex
+	fail   int
+	states []*data_model.BatteryState
+}
+
+func (f *flakyIngester) Ingest(states ...*data_model.BatteryState) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail > 0 {
+		f.fail--
+		return errors.New("wal is full")
+	}
+	f.states = append(f.states, states...)
+	return nil
+}
+
+func (f *flakyIngester) received() []*data_model.BatteryState {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*data_model.BatteryState(nil), f.states...)
+}
+
+func TestAssemblerRun(t *testing.T) {
+	db, err := ParseDBC(strings.NewReader(testDBC))
+	require.NoError(t, err)
+	cfg := testConfig()
+	cfg.FlushInterval = time.Hour
+	a, err := NewAssembler(cfg, db)
+	require.NoError(t, err)
+
+	// the log ends with an invalid line which is skipped, the rest is
+	// flushed at the end of the log
+	ingester := &flakyIngester{}
+	require.NoError(t, a.Run(context.Background(), NewCandumpReader(strings.NewReader(testLog+"bad#frame\n")), ingester))
+	assert.Len(t, ingester.received(), 9)
+
+	// readings are kept until they are ingested
+	cfg.FlushInterval = 10 * time.Millisecond
+	pr, pw := io.Pipe()
+	ingester = &flakyIngester{fail: 2}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx, NewCandumpReader(pr), ingester) }()
+	_, err = io.WriteString(pw, testLog)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		ingester.mu.Lock()
+		defer ingester.mu.Unlock()
+		return ingester.fail == 0 && len(ingester.states) > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	latest := make(map[int]*data_model.BatteryState)
+	for _, state := range ingester.received() {
+		latest[state.Cell] = state
+	}
+	assert.Len(t, latest, 6)
+	assert.InDelta(t, 3.301, latest[1].Voltage, 1e-9)
+	assert.Equal(t, 25.0, latest[1].Temperature)
+}
@@ -0,0 +1,260 @@
+package canbus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// dbcExtendedFlag marks extended frame ids in DBC files.
+const dbcExtendedFlag = 1 << 31
+
+var (
+	messageRe = regexp.MustCompile(`^BO_\s+(\d+)\s+(\w+)\s*:\s*(\d+)\s+(\w+)`)
+	signalRe  = regexp.MustCompile(`^SG_\s+(\w+)\s*(M|m\d+M?)?\s*:\s*(\d+)\|(\d+)@([01])([+-])\s*\(\s*([^,\s]+)\s*,\s*([^)\s]+)\s*\)\s*\[\s*([^|\s]+)\s*\|\s*([^\]\s]+)\s*\]\s*"([^"]*)"`)
+)
+
+// Database is a set of message definitions loaded from a DBC file.
+type Database struct {
+	messages map[uint32]*Message
+}
+
+// Message is the definition of a CAN message.
+type Message struct {
+	// ID is the frame id without flags.
+	ID uint32
+	// Extended is set for 29 bits frame ids.
+	Extended bool
+	// Name is the message name.
+	Name string
+	// Length is the data length in bytes.
+	Length int
+	// Signals are the signals of the message.
+	Signals []*Signal
+	// Multiplexer is the multiplexer signal, nil if the message is not
+	// multiplexed.
+	Multiplexer *Signal
+}
+
+// Signal is the definition of a signal in a message.
+type Signal struct {
+	// Name is the signal name.
+	Name string
+	// Start is the start bit, the least significant bit for little endian
+	// signals and the most significant bit for big endian signals.
+	Start int
+	// Length is the length in bits.
+	Length int
+	// LittleEndian is set for Intel byte order, otherwise Motorola.
+	LittleEndian bool
+	// Signed is set for two's complement values.
+	Signed bool
+	// Factor and Offset scale the raw value, value = raw*Factor + Offset.
+	Factor float64
+	Offset float64
+	// Min and Max are the range of the value.
+	Min float64
+	Max float64
+	// Unit is the unit of the value.
+	Unit string
+	// MuxValue is the multiplexer value the signal is present in, -1 if
+	// the signal is always present.
+	MuxValue int
+}
+
+// LoadDBC loads the message definitions from a DBC file.
+func LoadDBC(path string) (*Database, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open dbc file: %w", err)
+	}
+	defer f.Close()
+	return ParseDBC(f)
+}
+
+// ParseDBC parses the message definitions of a DBC file. Only messages and
+// signals are parsed, other sections like comments and value tables are
+// ignored. Extended multiplexing is not supported.
+func ParseDBC(r io.Reader) (*Database, error) {
+	db := &Database{messages: make(map[uint32]*Message)}
+	var msg *Message
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "BO_ "):
+			m := messageRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("invalid message at line %d: %s", lineNo, line)
+			}
+			id, err := strconv.ParseUint(m[1], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid message id at line %d: %w", lineNo, err)
+			}
+			length, _ := strconv.Atoi(m[3])
+			msg = &Message{
+				ID:       uint32(id) &^ dbcExtendedFlag,
+				Extended: id&dbcExtendedFlag != 0,
+				Name:     m[2],
+				Length:   length,
+			}
+			db.messages[frameKey(msg.ID, msg.Extended)] = msg
+		case strings.HasPrefix(line, "SG_ "):
+			if msg == nil {
+				return nil, fmt.Errorf("signal without message at line %d", lineNo)
+			}
+			sig, mux, err := parseSignal(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid signal at line %d: %w", lineNo, err)
+			}
+			if mux {
+				if msg.Multiplexer != nil {
+					return nil, fmt.Errorf("message %s has more than one multiplexer", msg.Name)
+				}
+				msg.Multiplexer = sig
+				continue
+			}
+			msg.Signals = append(msg.Signals, sig)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read dbc file: %w", err)
+	}
+	for _, msg := range db.messages {
+		for _, sig := range msg.Signals {
+			if sig.MuxValue >= 0 && msg.Multiplexer == nil {
+				return nil, fmt.Errorf("multiplexed signal %s of message %s has no multiplexer", sig.Name, msg.Name)
+			}
+		}
+	}
+	return db, nil
+}
+
+func parseSignal(line string) (*Signal, bool, error) {
+	m := signalRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, false, fmt.Errorf("unrecognized signal %q", line)
+	}
+	sig := &Signal{
+		Name:         m[1],
+		LittleEndian: m[5] == "1",
+		Signed:       m[6] == "-",
+		Unit:         m[11],
+		MuxValue:     -1,
+	}
+	mux := false
+	switch indicator := m[2]; {
+	case indicator == "M":
+		mux = true
+	case strings.HasSuffix(indicator, "M"):
+		return nil, false, fmt.Errorf("extended multiplexing of signal %s is not supported", sig.Name)
+	case indicator != "":
+		sig.MuxValue, _ = strconv.Atoi(indicator[1:])
+	}
+	sig.Start, _ = strconv.Atoi(m[3])
+	sig.Length, _ = strconv.Atoi(m[4])
+	if sig.Length < 1 || sig.Length > 64 {
+		return nil, false, fmt.Errorf("invalid length %d of signal %s", sig.Length, sig.Name)
+	}
+	var err error
+	for i, v := range []*float64{&sig.Factor, &sig.Offset, &sig.Min, &sig.Max} {
+		if *v, err = strconv.ParseFloat(m[7+i], 64); err != nil {
+			return nil, false, fmt.Errorf("invalid number of signal %s: %w", sig.Name, err)
+		}
+	}
+	return sig, mux, nil
+}
+
+func frameKey(id uint32, extended bool) uint32 {
+	if extended {
+		return id | dbcExtendedFlag
+	}
+	return id
+}
+
+// Message returns the definition of the frame id, nil if it is unknown.
+func (db *Database) Message(id uint32, extended bool) *Message {
+	return db.messages[frameKey(id, extended)]
+}
+
+// Messages returns the number of message definitions.
+func (db *Database) Messages() int {
+	return len(db.messages)
+}
+
+// Decode decodes the signals present in the data, multiplexed signals are
+// decoded only if the multiplexer selects them.
+func (m *Message) Decode(data []byte) (map[string]float64, error) {
+	values := make(map[string]float64, len(m.Signals))
+	mux := int64(-1)
+	if m.Multiplexer != nil {
+		raw, err := m.Multiplexer.raw(data)
+		if err != nil {
+			return nil, err
+		}
+		mux = raw
+	}
+	for _, sig := range m.Signals {
+		if sig.MuxValue >= 0 && int64(sig.MuxValue) != mux {
+			continue
+		}
+		v, err := sig.Decode(data)
+		if err != nil {
+			return nil, err
+		}
+		values[sig.Name] = v
+	}
+	return values, nil
+}
+
+// Decode decodes the physical value of the signal.
+func (s *Signal) Decode(data []byte) (float64, error) {
+	raw, err := s.raw(data)
+	if err != nil {
+		return 0, err
+	}
+	if s.Signed {
+		return float64(raw)*s.Factor + s.Offset, nil
+	}
+	return float64(uint64(raw))*s.Factor + s.Offset, nil
+}
+
+// raw extracts the raw value, sign extended for signed signals.
+func (s *Signal) raw(data []byte) (int64, error) {
+	var raw uint64
+	if s.LittleEndian {
+		if (s.Start+s.Length-1)/8 >= len(data) {
+			return 0, fmt.Errorf("signal %s exceeds the frame of %d bytes", s.Name, len(data))
+		}
+		for i := s.Length - 1; i >= 0; i-- {
+			raw = raw<<1 | bitAt(data, s.Start+i)
+		}
+	} else {
+		// Motorola bits are numbered from the most significant bit and
+		// continue at the top of the next byte, the "sawtooth" numbering.
+		pos := s.Start
+		for i := 0; i < s.Length; i++ {
+			if pos < 0 || pos/8 >= len(data) {
+				return 0, fmt.Errorf("signal %s exceeds the frame of %d bytes", s.Name, len(data))
+			}
+			raw = raw<<1 | bitAt(data, pos)
+			if pos%8 == 0 {
+				pos += 15
+			} else {
+				pos--
+			}
+		}
+	}
+	if s.Signed && s.Length < 64 && raw&(1<<(s.Length-1)) != 0 {
+		raw |= ^uint64(0) << s.Length
+	}
+	return int64(raw), nil
+}
+
+func bitAt(data []byte, pos int) uint64 {
+	return uint64(data[pos/8]>>(pos%8)) & 1
+}
@@ -0,0 +1,159 @@
+package canbus
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxStandardID is the max 11 bits frame id.
+	maxStandardID = 0x7ff
+	// maxExtendedID is the max 29 bits frame id.
+	maxExtendedID = 0x1fffffff
+	// maxFDDataLength is the max data length of a CAN FD frame.
+	maxFDDataLength = 64
+)
+
+// ErrInvalidFrame is returned when a frame can't be parsed.
+var ErrInvalidFrame = errors.New("invalid can frame")
+
+// Frame is a CAN data frame.
+type Frame struct {
+	// ID is the frame id without flags.
+	ID uint32
+	// Extended is set for 29 bits frame ids.
+	Extended bool
+	// Data is the frame data.
+	Data []byte
+	// Timestamp is when the frame was received, zero if unknown.
+	Timestamp time.Time
+}
+
+// String formats the frame as candump does, e.g. "123#DEADBEEF".
+func (f *Frame) String() string {
+	id := fmt.Sprintf("%03X", f.ID)
+	if f.Extended {
+		id = fmt.Sprintf("%08X", f.ID)
+	}
+	sep := "#"
+	if len(f.Data) > 8 {
+		// CAN FD without flags
+		sep = "##0"
+	}
+	return id + sep + strings.ToUpper(hex.EncodeToString(f.Data))
+}
+
+// FrameSource is a source of CAN frames, like a SocketCAN interface or a
+// recorded candump log.
+type FrameSource interface {
+	// ReadFrame returns the next frame, io.EOF at the end of a log.
+	ReadFrame() (*Frame, error)
+	// Close closes the source, a blocked ReadFrame returns.
+	Close() error
+}
+
+// ParseFrame parses a frame in the candump format, "<id>#<data>" for
+// classic frames and "<id>##<flags><data>" for CAN FD frames. Ids of 8 hex
+// digits are extended. Remote frames are not supported.
+func ParseFrame(s string) (*Frame, error) {
+	id, data, ok := strings.Cut(s, "#")
+	if !ok {
+		return nil, fmt.Errorf("%w: missing # in %q", ErrInvalidFrame, s)
+	}
+	f := &Frame{Extended: len(id) == 8}
+	if len(id) != 3 && len(id) != 8 {
+		return nil, fmt.Errorf("%w: id %q", ErrInvalidFrame, id)
+	}
+	v, err := strconv.ParseUint(id, 16, 32)
+	if err != nil || (!f.Extended && v > maxStandardID) || v > maxExtendedID {
+		return nil, fmt.Errorf("%w: id %q", ErrInvalidFrame, id)
+	}
+	f.ID = uint32(v)
+
+	maxLength := 8
+	if strings.HasPrefix(data, "#") {
+		// CAN FD, skip the flags nibble
+		if len(data) < 2 {
+			return nil, fmt.Errorf("%w: missing fd flags in %q", ErrInvalidFrame, s)
+		}
+		data, maxLength = data[2:], maxFDDataLength
+	} else if strings.HasPrefix(data, "R") {
+		return nil, fmt.Errorf("%w: remote frame %q", ErrInvalidFrame, s)
+	}
+	// candump may separate the bytes with dots
+	if f.Data, err = hex.DecodeString(strings.ReplaceAll(data, ".", "")); err != nil {
+		return nil, fmt.Errorf("%w: data of %q: %v", ErrInvalidFrame, s, err)
+	}
+	if len(f.Data) > maxLength {
+		return nil, fmt.Errorf("%w: data of %q is too long", ErrInvalidFrame, s)
+	}
+	return f, nil
+}
+
+// CandumpReader reads frames from a log recorded by "candump -l", lines
+// look like "(1436509052.249713) vcan0 123#DEADBEEF". The timestamp and the
+// interface are optional.
+type CandumpReader struct {
+	r       io.Reader
+	scanner *bufio.Scanner
+	line    int
+}
+
+// NewCandumpReader creates a reader of the candump log.
+func NewCandumpReader(r io.Reader) *CandumpReader {
+	return &CandumpReader{r: r, scanner: bufio.NewScanner(r)}
+}
+
+// ReadFrame implements FrameSource, empty lines and comments starting
+// with # are skipped.
+func (c *CandumpReader) ReadFrame() (*Frame, error) {
+	for c.scanner.Scan() {
+		c.line++
+		line := strings.TrimSpace(c.scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		var ts time.Time
+		if strings.HasPrefix(fields[0], "(") && strings.HasSuffix(fields[0], ")") {
+			sec, err := strconv.ParseFloat(strings.Trim(fields[0], "()"), 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp at line %d: %w", c.line, err)
+			}
+			ts = time.UnixMicro(int64(sec * 1e6))
+			fields = fields[1:]
+		}
+		// the interface before and the direction flag after the frame are optional
+		i := 0
+		for i < len(fields) && !strings.Contains(fields[i], "#") {
+			i++
+		}
+		if i == len(fields) {
+			return nil, fmt.Errorf("%w: missing frame at line %d", ErrInvalidFrame, c.line)
+		}
+		f, err := ParseFrame(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse line %d: %w", c.line, err)
+		}
+		f.Timestamp = ts
+		return f, nil
+	}
+	if err := c.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// Close closes the underlying reader if it is an io.Closer.
+func (c *CandumpReader) Close() error {
+	if closer, ok := c.r.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+//go:build linux
+
+package canbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	canRaw = 1
+
+	canEFFFlag = 0x80000000
+	canRTRFlag = 0x40000000
+	canErrFlag = 0x20000000
+
+	// canFrameSize is the size of struct can_frame.
+	canFrameSize = 16
+)
+
+// sockaddrCAN is struct sockaddr_can.
+type sockaddrCAN struct {
+	family  uint16
+	_       [2]byte
+	ifindex int32
+	addr    [16]byte
+}
+
+// SocketCAN is a raw SocketCAN socket bound to an interface, e.g. can0 or
+// the virtual vcan0. Only classic CAN frames are supported.
+type SocketCAN struct {
+	f *os.File
+}
+
+// OpenSocketCAN opens a raw socket on the CAN interface.
+func OpenSocketCAN(iface string) (*SocketCAN, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find can interface %s: %w", iface, err)
+	}
+	fd, err := syscall.Socket(syscall.AF_CAN, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, canRaw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create can socket: %w", err)
+	}
+	addr := sockaddrCAN{family: syscall.AF_CAN, ifindex: int32(ifi.Index)}
+	// the syscall package has no sockaddr for CAN, bind it directly
+	if _, _, errno := syscall.Syscall(syscall.SYS_BIND, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr)); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to bind can socket to %s: %w", iface, errno)
+	}
+	// a non-blocking fd is handled by the runtime poller, so Close unblocks
+	// a pending read
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set can socket non-blocking: %w", err)
+	}
+	return &SocketCAN{f: os.NewFile(uintptr(fd), iface)}, nil
+}
+
+// ReadFrame implements FrameSource, error frames and remote frames are
+// skipped.
+func (s *SocketCAN) ReadFrame() (*Frame, error) {
+	var buf [canFrameSize]byte
+	for {
+		n, err := s.f.Read(buf[:])
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("failed to read can frame: %w", err)
+		}
+		if n != canFrameSize {
+			return nil, fmt.Errorf("%w: short read of %d bytes", ErrInvalidFrame, n)
+		}
+		id := binary.NativeEndian.Uint32(buf[0:])
+		if id&(canRTRFlag|canErrFlag) != 0 {
+			continue
+		}
+		length := int(buf[4])
+		if length > 8 {
+			return nil, fmt.Errorf("%w: data length %d", ErrInvalidFrame, length)
+		}
+		f := &Frame{Extended: id&canEFFFlag != 0, Data: append([]byte(nil), buf[8:8+length]...)}
+		if f.Extended {
+			f.ID = id & maxExtendedID
+		} else {
+			f.ID = id & maxStandardID
+		}
+		return f, nil
+	}
+}
+
+// WriteFrame sends a frame on the bus.
+func (s *SocketCAN) WriteFrame(f *Frame) error {
+	if len(f.Data) > 8 {
+		return fmt.Errorf("%w: data length %d", ErrInvalidFrame, len(f.Data))
+	}
+	var buf [canFrameSize]byte
+	id := f.ID
+	if f.Extended {
+		id |= canEFFFlag
+	}
+	binary.NativeEndian.PutUint32(buf[0:], id)
+	buf[4] = byte(len(f.Data))
+	copy(buf[8:], f.Data)
+	if _, err := s.f.Write(buf[:]); err != nil {
+		return fmt.Errorf("failed to write can frame: %w", err)
+	}
+	return nil
+}
+
+// Close closes the socket.
+func (s *SocketCAN) Close() error {
+	return s.f.Close()
+}
@@ -0,0 +1,37 @@
+//go:build linux
+
+package canbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestSocketCAN needs a virtual CAN interface:
+//
+//	ip link add dev vcan0 type vcan && ip link set up vcan0
+func TestSocketCAN(t *testing.T) {
+	rx, err := OpenSocketCAN("vcan0")
+	if err != nil {
+		t.Skipf("vcan0 is not available: %v", err)
+	}
+	defer rx.Close()
+	tx, err := OpenSocketCAN("vcan0")
+	require.NoError(t, err)
+	defer tx.Close()
+
+	frames := []*Frame{
+		{ID: 0x400, Data: []byte{0x00, 0xe4, 0x0c}},
+		{ID: 0x401, Extended: true, Data: []byte{0xff, 0x83}},
+	}
+	for _, f := range frames {
+		require.NoError(t, tx.WriteFrame(f))
+	}
+	for _, want := range frames {
+		f, err := rx.ReadFrame()
+		require.NoError(t, err)
+		assert.Equal(t, want, f)
+	}
+}
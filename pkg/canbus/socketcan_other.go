@@ -0,0 +1,31 @@
+//go:build !linux
+
+package canbus
+
+import "errors"
+
+var errUnsupported = errors.New("socketcan is only supported on linux")
+
+// SocketCAN is a raw SocketCAN socket, it is only available on Linux.
+type SocketCAN struct{}
+
+// OpenSocketCAN returns an error since SocketCAN is only available on Linux,
+// use a recorded candump log instead.
+func OpenSocketCAN(iface string) (*SocketCAN, error) {
+	return nil, errUnsupported
+}
+
+// ReadFrame implements FrameSource.
+func (s *SocketCAN) ReadFrame() (*Frame, error) {
+	return nil, errUnsupported
+}
+
+// WriteFrame sends a frame on the bus.
+func (s *SocketCAN) WriteFrame(f *Frame) error {
+	return errUnsupported
+}
+
+// Close closes the socket.
+func (s *SocketCAN) Close() error {
+	return nil
+}
@@ -1,8 +1,6 @@
 package config
 
-import (
-	"fmt"
-)
+import "time"
 
 // Config is the application configuration.
 type Config struct {
@@ -12,11 +10,537 @@ type Config struct {
 
 // ServerConfig is the server configuration.
 type ServerConfig struct {
+	// Host is the host to listen on, empty means all interfaces.
+	Host string
 	// Port is the port to listen on.
 	Port int
+	// MaxBodySize is the max size of a request body in bytes, 0 means
+	// server.DefaultMaxBodySize.
+	MaxBodySize int64
+}
+
+// SensorServerConfig is the sensor server configuration.
+type SensorServerConfig struct {
+	// Host is the host to listen on, empty means all interfaces.
+	Host string
+	// Port is the port to listen on.
+	Port int
+	// TLSCertFile and TLSKeyFile are the PEM files of the server
+	// certificate, empty serves plain HTTP.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile is the PEM file of the CAs verifying gateway client
+	// certificates, empty disables mutual TLS.
+	ClientCAFile string
+	// MaxBodySize is the max size of a request body in bytes, 0 means
+	// server.DefaultMaxBodySize.
+	MaxBodySize int64
+	// ReadHeaderTimeout is how long to read the request headers, 0 means
+	// server.DefaultReadHeaderTimeout.
+	ReadHeaderTimeout time.Duration
+}
+
+// GatewayAuthConfig is the authentication and authorization of gateways
+// reporting sensor data.
+type GatewayAuthConfig struct {
+	// Gateways are the known gateways.
+	Gateways []GatewayConfig
+	// AuditLog is the path of the audit log of rejected requests, empty
+	// writes audit events to the application log only.
+	AuditLog string
+}
+
+// GatewayConfig is the identity of a gateway and the cells it may report for.
+type GatewayConfig struct {
+	// ID identifies the gateway, it is the common name of the client
+	// certificate for mutual TLS and the username for MQTT.
+	ID string
+	// TokenSHA256 is the hex encoded SHA-256 of the bearer token of the
+	// gateway, empty disables token authentication of the gateway.
+	TokenSHA256 string
+	// Stations are the stations the gateway may report for.
+	Stations []GatewayStationACL
+	// Operator allows the identity to call the control endpoints of the
+	// API, e.g. fleet setpoints and forecasts.
+	Operator bool
+}
+
+// GatewayStationACL allows a gateway to report for the containers of a station.
+type GatewayStationACL struct {
+	// Station is the station id.
+	Station int
+	// Containers are the container ids, empty means all containers.
+	Containers []int
+}
+
+// MQTTConfig is the configuration of sensor data ingestion over MQTT.
+type MQTTConfig struct {
+	// Broker is the address of the MQTT broker, host:port.
+	Broker string
+	// ClientID identifies the session on the broker.
+	ClientID string
+	// Username is the username, empty for none.
+	Username string
+	// Password is the password, empty for none.
+	Password string
+	// Topic is the topic template gateways publish to, the levels
+	// {station}, {container}, {pack} and {cell} carry the cell ids,
+	// e.g. "bess/{station}/{container}/{pack}/{cell}". An optional
+	// {gateway} level carries the id of the publishing gateway.
+	Topic string
+	// QoS is the max quality of service level to subscribe with, 0 or 1.
+	QoS byte
+	// CleanSession discards the session on reconnect, by default the
+	// broker keeps QoS 1 messages while the adapter is offline.
+	CleanSession bool
+	// KeepAlive is the keep alive interval.
+	KeepAlive time.Duration
+	// ReconnectInterval is the interval to reconnect after the connection is lost.
+	ReconnectInterval time.Duration
+}
+
+// ModbusConfig is the configuration of polling BMUs and PCS devices over
+// Modbus TCP.
+type ModbusConfig struct {
+	// Interval is the polling interval of devices.
+	Interval time.Duration
+	// Timeout is the timeout of a request.
+	Timeout time.Duration
+	// Devices are the polled devices.
+	Devices []ModbusDeviceConfig
+}
+
+// ModbusDeviceConfig is a Modbus TCP device and its register map.
+type ModbusDeviceConfig struct {
+	// Name identifies the device in logs.
+	Name string
+	// Addr is the address of the device, host:port.
+	Addr string
+	// UnitID is the unit identifier of the device behind the address.
+	UnitID byte
+	// Interval overrides the polling interval of the device if set.
+	Interval time.Duration
+	// Blocks are the register maps of the cells of the device.
+	Blocks []ModbusCellBlock
+}
+
+// ModbusCellBlock maps a block of cells sharing the same register layout,
+// the registers of the i-th cell are at the point address plus i*Stride.
+type ModbusCellBlock struct {
+	// Station, Container and Pack are the ids of the pack of the cells.
+	Station   int
+	Container int
+	Pack      int
+	// FirstCell is the id of the first cell, cells are numbered consecutively.
+	FirstCell int
+	// Count is the number of cells.
+	Count int
+	// Stride is the number of registers between two cells, it can only be
+	// 0 for a single cell or if all points are shared.
+	Stride uint16
+
+	// Voltage, Current, SOC and Temperature are the points of the cell
+	// values, nil if not available. State is derived from the current
+	// if its point is nil.
+	Voltage     *ModbusPoint
+	Current     *ModbusPoint
+	SOC         *ModbusPoint
+	Temperature *ModbusPoint
+	State       *ModbusPoint
+}
+
+// ModbusPoint is a value stored in the registers of a device.
+type ModbusPoint struct {
+	// Table is the register table, "holding" (default) or "input".
+	Table string
+	// Address is the address of the first register.
+	Address uint16
+	// Type is the value type, "uint16" (default), "int16", "uint32",
+	// "int32" or "float32".
+	Type string
+	// WordOrder is the order of the registers of 32 bits values, "big"
+	// (default) for the high word first or "little" for the low word first.
+	WordOrder string
+	// Scale multiplies the raw value, 0 means 1.
+	Scale float64
+	// Offset is added to the scaled value.
+	Offset float64
+	// Shared means all cells of the block read the same registers, like
+	// the current of a pack.
+	Shared bool
+}
+
+// CANConfig is the configuration of sensor data ingestion from the CAN bus
+// of a pack BMS.
+type CANConfig struct {
+	// Interface is the SocketCAN interface, like can0 or vcan0.
+	Interface string
+	// DBCFile is the path of the DBC file defining the messages.
+	DBCFile string
+	// Station, Container and Pack are the ids of the pack on the bus.
+	Station   int
+	Container int
+	Pack      int
+	// CellVoltage, CellTemperature and CellSOC are the name templates of
+	// the cell signals, {cell} is replaced by the cell id, e.g.
+	// "Cell{cell}_Voltage". Empty templates are not decoded.
+	CellVoltage     string
+	CellTemperature string
+	CellSOC         string
+	// PackCurrent is the name of the pack current signal, which is the
+	// current of every cell of the pack.
+	PackCurrent string
+	// FlushInterval is the interval to emit the assembled cell states.
+	FlushInterval time.Duration
+}
+
+// WALConfig is the write-ahead log configuration of sensor data ingestion.
+type WALConfig struct {
+	// Dir is the directory of the write-ahead log.
+	Dir string
+	// SegmentSize is the size to roll over to a new segment in bytes.
+	SegmentSize int64
+	// MaxSize is the max total size of the log in bytes, 0 means unlimited.
+	MaxSize int64
+	// MaxAge is the max age of unconsumed data, 0 means unlimited.
+	MaxAge time.Duration
+}
+
+// HealthConfig is the configuration of sensor health detection, zero
+// values take the defaults of the data model.
+type HealthConfig struct {
+	// ReportInterval is the expected interval between readings of a cell.
+	ReportInterval time.Duration
+	// StaleIntervals is the number of report intervals without a reading
+	// after which a cell is stale.
+	StaleIntervals int
+	// FlatlineReadings is the number of consecutive identical readings
+	// after which a sensor is flatlined.
+	FlatlineReadings int
+	// MaxVoltageJump and MaxTemperatureJump are the max changes between
+	// two consecutive readings which are physically possible.
+	MaxVoltageJump     float64
+	MaxTemperatureJump float64
+	// MinVoltage, MaxVoltage, MinTemperature and MaxTemperature are the
+	// ranges of plausible readings.
+	MinVoltage     float64
+	MaxVoltage     float64
+	MinTemperature float64
+	MaxTemperature float64
+	// NeighbourVoltage and NeighbourTemperature are the max deviations of a
+	// cell from the median of its pack.
+	NeighbourVoltage     float64
+	NeighbourTemperature float64
+}
+
+// FilterConfig is the Kalman filter smoothing the readings of a sensor
+// type, zero values take the defaults of the data model.
+type FilterConfig struct {
+	// Adaptive estimates the noise covariances of every channel online,
+	// ProcessNoise and MeasurementNoise are the initial guesses then.
+	Adaptive bool
+	// InitialError is the initial estimate error covariance.
+	InitialError float64
+	// ProcessNoise and MeasurementNoise are the noise covariances.
+	ProcessNoise     float64
+	MeasurementNoise float64
+	// ForgettingFactor is the weight of the previous noise estimates
+	// against the latest reading, in (0, 1).
+	ForgettingFactor float64
+	// MinProcessNoise and MinMeasurementNoise bound the noise estimates.
+	MinProcessNoise     float64
+	MinMeasurementNoise float64
+}
+
+// SensorFiltersConfig is the filters of the sensor types.
+type SensorFiltersConfig struct {
+	Voltage     FilterConfig
+	Current     FilterConfig
+	Temperature FilterConfig
 }
 
 type LocalStoreConfig struct {
 	// Path is the path to the database file.
 	Path string
-}
\ No newline at end of file
+	// SnapshotDir is the directory where snapshot files are generated
+	// before they are uploaded to the cloud storage.
+	SnapshotDir string
+	// CheckpointInterval is the interval to checkpoint the estimator state
+	// of the cells, so a restart continues from it.
+	CheckpointInterval time.Duration
+	// CheckpointMaxAge is the max age of the estimator state of a cell
+	// restored at startup, older state is discarded.
+	CheckpointMaxAge time.Duration
+}
+
+// SnapshotUploadConfig is the configuration of snapshot uploads.
+type SnapshotUploadConfig struct {
+	// Compression is the compression of uploaded snapshots, "gzip" or empty for none.
+	Compression string
+	// KeyID is the id of the key-encryption key, empty disables encryption.
+	KeyID string
+	// KeyFile is the path of the file containing the hex encoded 32 bytes
+	// key-encryption key.
+	KeyFile string
+}
+
+// EnergyManagementConfig is the configuration of the charge and discharge
+// scheduling of the stations.
+type EnergyManagementConfig struct {
+	// Horizon is how far ahead schedules are planned, 24 to 48 hours.
+	Horizon time.Duration
+	// Step is the duration of a slot of a schedule.
+	Step time.Duration
+	// Stations are the scheduled stations.
+	Stations []StationEnergyConfig
+	// Firming are the stations firming renewable generation.
+	Firming []FirmingConfig
+	// Fleet is the dispatch of fleet-wide setpoints over the stations.
+	Fleet FleetConfig
+	// FrequencyResponse are the stations responding to the grid frequency.
+	FrequencyResponse []FrequencyResponseConfig
+	// PeakShaving are the behind the meter stations shaving the peaks of
+	// the import of their site.
+	PeakShaving []PeakShavingConfig
+}
+
+// PeakShavingConfig is the peak shaving of a behind the meter station, the
+// station discharges to hold the grid import of its site below the peak
+// target of the billing window, the demand forecast of the station is the
+// load forecast of the site.
+type PeakShavingConfig struct {
+	// Station is the id of the station, its limits are the ones of its
+	// StationEnergyConfig.
+	Station int
+	// Target is the peak target in kW at the start of a billing window,
+	// learned from the load forecast and the battery if 0.
+	Target float64
+	// DemandCharge is the charge per kW of the billed peak of a window.
+	DemandCharge float64
+	// DemandInterval is the averaging interval of the billed demand.
+	DemandInterval time.Duration
+	// BillingDay is the day of the month the billing windows start.
+	BillingDay int
+	// Interval is the control interval, the period of the measurements.
+	Interval time.Duration
+	// Meter is the meter the site load is read from.
+	Meter *LoadMeterConfig
+}
+
+// LoadMeterConfig is a meter reporting the load of a site over Modbus TCP.
+type LoadMeterConfig struct {
+	MeterConfig
+	// Load is the point of the load in kW.
+	Load ModbusPoint
+}
+
+// FrequencyResponseConfig is the frequency response of a station, its
+// power follows a droop curve of the grid frequency deviation.
+type FrequencyResponseConfig struct {
+	// Station is the id of the station, its limits are the ones of its
+	// StationEnergyConfig.
+	Station int
+	// Nominal is the nominal grid frequency in Hz.
+	Nominal float64
+	// Deadband is the deviation from the nominal frequency in Hz without
+	// response, negative for none.
+	Deadband float64
+	// Droop is the deviation beyond the deadband in percent of the nominal
+	// frequency at which the full Capacity responds.
+	Droop float64
+	// Capacity is the contracted response power in kW, the max discharge
+	// power of the station if 0.
+	Capacity float64
+	// Interval is the control interval.
+	Interval time.Duration
+	// RecoveryPower is the max power in kW moving the soc back to
+	// TargetSOC while the frequency is within the deadband, 0 disables
+	// the recovery.
+	RecoveryPower float64
+	// TargetSOC is the soc in percent the recovery aims at.
+	TargetSOC float64
+	// MaxFailedReads is the number of consecutive failed reads of the
+	// frequency after which the station is commanded 0 until a read
+	// succeeds again.
+	MaxFailedReads int
+	// Meter is the meter the frequency is read from, nil for a simulated
+	// feed.
+	Meter *FrequencyMeterConfig
+}
+
+// FrequencyMeterConfig is a meter reporting the grid frequency over Modbus
+// TCP.
+type FrequencyMeterConfig struct {
+	MeterConfig
+	// Frequency is the point of the frequency in Hz.
+	Frequency ModbusPoint
+}
+
+// MeterConfig is a meter read over Modbus TCP.
+type MeterConfig struct {
+	// Addr is the address of the meter, host:port.
+	Addr string
+	// UnitID is the unit identifier of the meter behind the address.
+	UnitID byte
+	// Timeout is the timeout of a request.
+	Timeout time.Duration
+}
+
+// FleetConfig is the configuration of the fleet dispatch, a fleet-wide
+// power setpoint is split over the configured stations.
+type FleetConfig struct {
+	// Interval is the dispatch interval, the energy of the stations
+	// limits their power over it.
+	Interval time.Duration
+	// DerateTemperature is the temperature in degrees Celsius above which
+	// the share of a station decreases, to 0 at MaxTemperature.
+	DerateTemperature float64
+	MaxTemperature    float64
+	// BalanceCycles is the number of equivalent full cycles a station is
+	// ahead of the fleet average at which its share is divided by e.
+	BalanceCycles float64
+}
+
+// FirmingConfig is the firming of the renewable generation of a station,
+// the station charges and discharges to keep the net output on the
+// committed profile and within the ramp rate.
+type FirmingConfig struct {
+	// Station is the id of the station, its limits are the ones of its
+	// StationEnergyConfig.
+	Station int
+	// RampRate is the max change of the net output in kW per minute.
+	RampRate float64
+	// Interval is the control interval, the period of the measurements.
+	Interval time.Duration
+}
+
+// StationEnergyConfig is the power and energy limits of a station.
+type StationEnergyConfig struct {
+	// ID is the id of the station.
+	ID int
+	// MaxChargePower and MaxDischargePower are the power limits in kW.
+	MaxChargePower    float64
+	MaxDischargePower float64
+	// CellVoltage is the nominal voltage of the cells converting their
+	// capacity in Ah to energy.
+	CellVoltage float64
+	// MinSOC and MaxSOC bound the state of charge in percent.
+	MinSOC float64
+	MaxSOC float64
+	// BackupReserve is the soc in percent reserved for outage backup, the
+	// station isn't planned nor allowed to discharge below it while the
+	// grid is available.
+	BackupReserve float64
+	// MinSOH is the min state of health in percent of a scheduled station,
+	// a station below it stays idle.
+	MinSOH float64
+	// Efficiency is the round trip efficiency in (0, 1].
+	Efficiency float64
+	// Arbitrage optimizes the revenue of price forecasts net of the
+	// battery wear instead of just shifting energy to the pricier slots.
+	Arbitrage bool
+	// CycleCost is the wear cost of a cycle of 100% depth of discharge, in
+	// the currency of the price forecasts, which are per kWh.
+	CycleCost float64
+	// DoDExponent is the exponent of the depth of discharge in the wear of
+	// a cycle, deeper cycles wear the cells more than shallow ones.
+	DoDExponent float64
+	// SOCBuckets is the number of stored energy levels of the optimizer,
+	// raised so a bucket is no larger than the energy moved in a slot.
+	SOCBuckets int
+}
+
+// PCSConfig is the configuration of the power conversion systems of the
+// stations and of the validation of their setpoints.
+type PCSConfig struct {
+	// AckTimeout is how long the PCS may take to report a dispatched
+	// setpoint before the command times out.
+	AckTimeout time.Duration
+	// PollInterval is the interval of reading the status of the PCS with
+	// pending commands.
+	PollInterval time.Duration
+	// Tolerance is the max difference in kW or kvar between a setpoint and
+	// the reported power acknowledging it.
+	Tolerance float64
+	// MaxTemperature is the max cell temperature in degrees Celsius at
+	// which a station may charge or discharge.
+	MaxTemperature float64
+	// MaxUnhealthyCells is the max number of cells with a faulty sensor of
+	// a station which may charge or discharge.
+	MaxUnhealthyCells int
+	// ReconnectDelay is how long the grid must be back before an islanded
+	// station reconnects.
+	ReconnectDelay time.Duration
+	// Stations are the PCS of the stations.
+	Stations []PCSStationConfig
+}
+
+// PCSStationConfig is the PCS of a station, its power and soc limits are
+// the ones of the StationEnergyConfig of the station.
+type PCSStationConfig struct {
+	// Station is the id of the station.
+	Station int
+	// Rating is the apparent power rating in kVA bounding the active and
+	// reactive power.
+	Rating float64
+	// Modbus is the register map of a PCS driven over Modbus TCP.
+	Modbus *PCSModbusConfig
+	// CriticalLoad is the load in kW the station supplies while islanded,
+	// above it the non critical loads must be shed, 0 for no limit.
+	CriticalLoad float64
+	// GridMeter is the meter detecting the loss of the grid, nil detects
+	// it from the grid fault of the PCS.
+	GridMeter *GridMeterConfig
+}
+
+// GridMeterConfig is a meter reporting the grid voltage over Modbus TCP.
+type GridMeterConfig struct {
+	MeterConfig
+	// Voltage is the point of the grid voltage in volts.
+	Voltage ModbusPoint
+	// MinVoltage is the voltage below which the grid is lost.
+	MinVoltage float64
+}
+
+// PCSModbusConfig is the register map of a PCS driven over Modbus TCP.
+type PCSModbusConfig struct {
+	// Addr is the address of the device, host:port.
+	Addr string
+	// UnitID is the unit identifier of the device behind the address.
+	UnitID byte
+	// Timeout is the timeout of a request.
+	Timeout time.Duration
+	// ActivePower and ReactivePower are the setpoints in kW and kvar,
+	// positive charges.
+	ActivePower   ModbusPoint
+	ReactivePower ModbusPoint
+	// Run starts the PCS when written 1 and stops it when written 0.
+	Run ModbusPoint
+	// GridForming switches the PCS to form the grid of the site when
+	// written 1 and to follow the grid when written 0.
+	GridForming ModbusPoint
+	// ActivePowerFeedback and ReactivePowerFeedback are the measured
+	// powers, Running is non zero when running and Faults is the fault
+	// bitmask of the PCS.
+	ActivePowerFeedback   ModbusPoint
+	ReactivePowerFeedback ModbusPoint
+	Running               ModbusPoint
+	Faults                ModbusPoint
+}
+
+// GradingConfig is the configuration of the intake grading of second-life
+// modules.
+type GradingConfig struct {
+	// TierSOH are the min state of health in percent of the tiers but the
+	// last, best first. An accepted module is graded into the first tier
+	// whose min soh it reaches, and into the last tier below them all.
+	TierSOH []float64
+	// MinSOH is the min state of health in percent of an accepted module.
+	MinSOH float64
+	// MaxSelfDischarge is the max self discharge in mV per day of an
+	// accepted module.
+	MaxSelfDischarge float64
+	// GroupSize is the number of modules of a recommended group of
+	// matched modules.
+	GroupSize int
+}
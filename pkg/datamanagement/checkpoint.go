@@ -0,0 +1,102 @@
+package data_model
+
+import (
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/utils"
+)
+
+// CellEstimate is the estimator state of a cell, checkpointed so a restart
+// continues from it instead of the first raw reading.
+type CellEstimate struct {
+	Station   int `json:"station"`
+	Container int `json:"container"`
+	Pack      int `json:"pack"`
+	Cell      int `json:"cell"`
+
+	// Voltage, Current and Temperature are the states of the filters.
+	Voltage     utils.FilterState `json:"voltage"`
+	Current     utils.FilterState `json:"current"`
+	Temperature utils.FilterState `json:"temperature"`
+	// SOC is the latest estimated state of charge in percent.
+	SOC float64 `json:"soc"`
+	// Timestamp is the timestamp of the latest applied reading.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// cellKey identifies a cell.
+type cellKey struct {
+	station, container, pack, cell int
+}
+
+// estimateOf returns the estimator state of the cell, the caller must hold
+// the lock of the shard.
+func (p *PackData) estimateOf(station, container, pack, cell int) (CellEstimate, bool) {
+	state, ok := p.cellData[cell]
+	if !ok {
+		return CellEstimate{}, false
+	}
+	return CellEstimate{
+		Station:     station,
+		Container:   container,
+		Pack:        pack,
+		Cell:        cell,
+		Voltage:     p.cellKalmanV[cell].State(),
+		Current:     p.cellKalmanC[cell].State(),
+		Temperature: p.cellKalmanT[cell].State(),
+		SOC:         state.SOC,
+		Timestamp:   state.Timestamp,
+	}, true
+}
+
+// restore continues the estimators of a new cell from its restored state.
+func (p *PackData) restore(state *BatteryState) {
+	e, ok := p.opts.estimates[cellKey{state.Station, state.Container, state.Pack, state.Cell}]
+	if !ok {
+		return
+	}
+	p.cellKalmanV[state.Cell].SetState(e.Voltage)
+	p.cellKalmanC[state.Cell].SetState(e.Current)
+	p.cellKalmanT[state.Cell].SetState(e.Temperature)
+	// keep the soc until the next ReCalculate
+	if state.SOC == 0 {
+		state.SOC = e.SOC
+	}
+}
+
+// Estimates returns the estimator state of all cells.
+func (s *BatteriesData) Estimates() []CellEstimate {
+	var estimates []CellEstimate
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for station, stationData := range shard.stationData {
+			for container, containerData := range stationData.containerData {
+				for pack, packData := range containerData.packData {
+					for cell := range packData.cellData {
+						if e, ok := packData.estimateOf(station, container, pack, cell); ok {
+							estimates = append(estimates, e)
+						}
+					}
+				}
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return estimates
+}
+
+// RestoreEstimates makes the cells continue from the checkpointed estimator
+// state at their first reading, the state of cells which didn't report
+// within maxAge is discarded, as the battery may have changed meanwhile. It
+// returns the number of restored cells and must be called before any update.
+func (s *BatteriesData) RestoreEstimates(estimates []CellEstimate, maxAge time.Duration) int {
+	now := time.Now()
+	s.opts.estimates = make(map[cellKey]CellEstimate, len(estimates))
+	for _, e := range estimates {
+		if now.Sub(time.Unix(e.Timestamp, 0)) > maxAge {
+			continue
+		}
+		s.opts.estimates[cellKey{e.Station, e.Container, e.Pack, e.Cell}] = e
+	}
+	return len(s.opts.estimates)
+}
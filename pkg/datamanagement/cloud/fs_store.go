@@ -0,0 +1,340 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+)
+
+const (
+	// fsMetaDir keeps the metadata of a filesystem store, it is hidden from
+	// listing so the store root can be read directly by Spark.
+	fsMetaDir = ".openbms"
+	// fsUploadsDir keeps the parts of in-progress multipart uploads.
+	fsUploadsDir = "uploads"
+	// fsETagsDir keeps the etags of objects.
+	fsETagsDir = "etags"
+)
+
+// fsStore is an object store backed by a directory on a local filesystem
+// or a mounted NAS, for sites which can't use public cloud. Objects are
+// stored as plain files under the root directory by their keys.
+type fsStore struct {
+	root string
+}
+
+// NewFsStore creates an object store in the root directory.
+func NewFsStore(root string) (ObjectStore, error) {
+	for _, dir := range []string{root, filepath.Join(root, fsMetaDir, fsUploadsDir), filepath.Join(root, fsMetaDir, fsETagsDir)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create directory: %w", err)
+		}
+	}
+	return &fsStore{root: root}, nil
+}
+
+// PutObject uploads the body as the object key in a single request.
+func (s *fsStore) PutObject(key string, body io.ReadSeeker) (string, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return "", err
+	}
+
+	digest := md5.New()
+	if err := writeFileAtomic(p, io.TeeReader(body, digest)); err != nil {
+		return "", err
+	}
+	etag := hex.EncodeToString(digest.Sum(nil))
+	return etag, s.saveETag(key, etag)
+}
+
+// GetObject gets the content of the object key.
+func (s *fsStore) GetObject(key string) (io.ReadCloser, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open object: %w", err)
+	}
+	return file, nil
+}
+
+// HeadObject gets the metadata of the object key.
+func (s *fsStore) HeadObject(key string) (*ObjectInfo, error) {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	etag, err := s.loadETag(key, p)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: key, ETag: etag, Size: info.Size()}, nil
+}
+
+// DeleteObject deletes the object key.
+func (s *fsStore) DeleteObject(key string) error {
+	p, err := s.objectPath(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{p, s.etagPath(key)} {
+		if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to delete object: %w", err)
+		}
+	}
+	return nil
+}
+
+// List lists the objects whose key starts with the prefix.
+func (s *fsStore) List(prefix string) ([]*ObjectInfo, error) {
+	// only walk the deepest directory which contains all matching keys
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+	walkRoot, err := s.objectPath(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []*ObjectInfo
+	err = filepath.WalkDir(walkRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if d.Name() == fsMetaDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) || strings.HasSuffix(key, ".tmp") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		etag, err := s.loadETag(key, p)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, &ObjectInfo{Key: key, ETag: etag, Size: info.Size()})
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// CreateMultipartUpload starts a multipart upload.
+func (s *fsStore) CreateMultipartUpload(key string) (string, error) {
+	if _, err := s.objectPath(key); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("failed to generate upload id: %w", err)
+	}
+	uploadID := hex.EncodeToString(id)
+	dir := s.uploadDir(uploadID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	// remember the key, so parts can't be mixed up between uploads
+	if err := snapshot.WriteFileAtomic(filepath.Join(dir, "key"), []byte(key)); err != nil {
+		return "", err
+	}
+	return uploadID, nil
+}
+
+// UploadPart uploads a part of a multipart upload.
+func (s *fsStore) UploadPart(key, uploadID string, partNumber int64, body io.ReadSeeker) (string, error) {
+	if err := s.checkUpload(key, uploadID); err != nil {
+		return "", err
+	}
+
+	digest := md5.New()
+	p := filepath.Join(s.uploadDir(uploadID), strconv.FormatInt(partNumber, 10))
+	if err := writeFileAtomic(p, io.TeeReader(body, digest)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// CompleteMultipartUpload completes a multipart upload.
+func (s *fsStore) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) (string, error) {
+	if err := s.checkUpload(key, uploadID); err != nil {
+		return "", err
+	}
+	if err := validateParts(parts); err != nil {
+		return "", err
+	}
+	etag, err := multipartETag(parts)
+	if err != nil {
+		return "", err
+	}
+
+	readers := make([]io.Reader, 0, len(parts))
+	for _, part := range parts {
+		file, err := os.Open(filepath.Join(s.uploadDir(uploadID), strconv.FormatInt(part.Number, 10)))
+		if err != nil {
+			return "", fmt.Errorf("invalid part %d: %w", part.Number, err)
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	p, _ := s.objectPath(key)
+	if err := writeFileAtomic(p, io.MultiReader(readers...)); err != nil {
+		return "", err
+	}
+	if err := s.saveETag(key, etag); err != nil {
+		return "", err
+	}
+	if err := os.RemoveAll(s.uploadDir(uploadID)); err != nil {
+		return "", fmt.Errorf("failed to remove upload directory: %w", err)
+	}
+	return etag, nil
+}
+
+// AbortMultipartUpload aborts a multipart upload.
+func (s *fsStore) AbortMultipartUpload(key, uploadID string) error {
+	if err := s.checkUpload(key, uploadID); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(s.uploadDir(uploadID)); err != nil {
+		return fmt.Errorf("failed to remove upload directory: %w", err)
+	}
+	return nil
+}
+
+// objectPath returns the file path of the object key. Keys are confined to
+// the root directory, keys pointing into the metadata directory are rejected.
+func (s *fsStore) objectPath(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/"+fsMetaDir || strings.HasPrefix(clean, "/"+fsMetaDir+"/") {
+		return "", fmt.Errorf("invalid object key: %s", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
+
+func (s *fsStore) uploadDir(uploadID string) string {
+	return filepath.Join(s.root, fsMetaDir, fsUploadsDir, uploadID)
+}
+
+func (s *fsStore) checkUpload(key, uploadID string) error {
+	if uploadID == "" || strings.ContainsAny(uploadID, `/\.`) {
+		return fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	data, err := os.ReadFile(filepath.Join(s.uploadDir(uploadID), "key"))
+	if os.IsNotExist(err) || (err == nil && string(data) != key) {
+		return fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read upload: %w", err)
+	}
+	return nil
+}
+
+func (s *fsStore) etagPath(key string) string {
+	return filepath.Join(s.root, fsMetaDir, fsETagsDir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (s *fsStore) saveETag(key, etag string) error {
+	p := s.etagPath(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	return snapshot.WriteFileAtomic(p, []byte(etag))
+}
+
+// loadETag loads the etag of the object, the etag is computed from the
+// content if the file was put into the directory by someone else.
+func (s *fsStore) loadETag(key, objectPath string) (string, error) {
+	data, err := os.ReadFile(s.etagPath(key))
+	if err == nil {
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("failed to read etag: %w", err)
+	}
+
+	file, err := os.Open(objectPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open object: %w", err)
+	}
+	defer file.Close()
+	digest := md5.New()
+	if _, err := io.Copy(digest, file); err != nil {
+		return "", fmt.Errorf("failed to read object: %w", err)
+	}
+	return hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// writeFileAtomic writes the content of r to a temporary file, syncs it and
+// renames it to p.
+func writeFileAtomic(p string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	tmp := p + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, p)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	return nil
+}
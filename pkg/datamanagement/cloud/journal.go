@@ -0,0 +1,157 @@
+package cloud
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+	"go.uber.org/zap"
+)
+
+const (
+	journalSuffix = ".journal"
+	// brokenSuffix is appended to journal entries which can't be decoded,
+	// so they are kept for inspection but not loaded again.
+	brokenSuffix = ".broken"
+)
+
+type uploadState int
+
+const (
+	// uploadPending means the snapshot file is generated but not uploaded yet,
+	// a multipart upload may be in progress.
+	uploadPending uploadState = iota + 1
+	// uploadUploaded means the snapshot file is uploaded and verified,
+	// but the manifest is not uploaded yet.
+	uploadUploaded
+	// uploadCommitted means both the snapshot file and the manifest are
+	// uploaded, the local file can be removed.
+	uploadCommitted
+	// uploadCorrupted means the local snapshot file doesn't match its
+	// manifest, it is kept on disk for inspection and never uploaded.
+	uploadCorrupted
+)
+
+func (s uploadState) String() string {
+	switch s {
+	case uploadPending:
+		return "Pending"
+	case uploadUploaded:
+		return "Uploaded"
+	case uploadCommitted:
+		return "Committed"
+	case uploadCorrupted:
+		return "Corrupted"
+	default:
+		return "Unknown"
+	}
+}
+
+// JournalEntry records the upload progress of a snapshot file.
+type JournalEntry struct {
+	// ID is the unique id of the entry.
+	ID string `json:"id"`
+	// Key is the object key of the snapshot file.
+	Key string `json:"key"`
+	// LocalPath is the path of the snapshot file on local disk.
+	LocalPath string `json:"local_path"`
+	// ObjectPath is the path of the compressed or encrypted snapshot file
+	// to upload, empty if the snapshot file is uploaded as is.
+	ObjectPath string `json:"object_path,omitempty"`
+	// Manifest is the manifest of the snapshot file.
+	Manifest *snapshot.Manifest `json:"manifest"`
+	// State is the upload state.
+	State uploadState `json:"state"`
+	// ETag is the etag the store returned for the uploaded object.
+	ETag string `json:"etag,omitempty"`
+	// UploadID is the id of the in-progress multipart upload.
+	UploadID string `json:"upload_id,omitempty"`
+	// Parts is the parts already uploaded in the multipart upload.
+	Parts []CompletedPart `json:"parts,omitempty"`
+	// Attempts is how many times the upload has been tried.
+	Attempts int `json:"attempts"`
+}
+
+// Journal persists upload progress on local disk, so that uploads can be
+// resumed after the process crashes or the site loses connectivity.
+// Each entry is stored in its own file and replaced atomically on update.
+type Journal struct {
+	dir string
+}
+
+// OpenJournal opens the journal in the given directory, creating it if needed.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	return &Journal{dir: dir}, nil
+}
+
+// Save persists the entry.
+func (j *Journal) Save(e *JournalEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode journal entry: %w", err)
+	}
+	return snapshot.WriteFileAtomic(j.path(e.ID), data)
+}
+
+// Remove removes the entry.
+func (j *Journal) Remove(id string) error {
+	if err := os.Remove(j.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove journal entry: %w", err)
+	}
+	return nil
+}
+
+// Load loads all entries, ordered by snapshot creation time.
+func (j *Journal) Load() ([]*JournalEntry, error) {
+	files, err := os.ReadDir(j.dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read journal directory: %w", err)
+	}
+
+	var entries []*JournalEntry
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), journalSuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(j.dir, f.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal entry: %w", err)
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(data, &e); err != nil || e.Manifest == nil {
+			j.moveAside(f.Name(), err)
+			continue
+		}
+		entries = append(entries, &e)
+	}
+
+	sort.Slice(entries, func(a, b int) bool {
+		if entries[a].Manifest.CreatedAt != entries[b].Manifest.CreatedAt {
+			return entries[a].Manifest.CreatedAt < entries[b].Manifest.CreatedAt
+		}
+		return entries[a].ID < entries[b].ID
+	})
+	return entries, nil
+}
+
+// moveAside renames a broken entry out of the journal, a partially written
+// or stale entry would otherwise be skipped on every start.
+func (j *Journal) moveAside(name string, err error) {
+	path := filepath.Join(j.dir, name)
+	log.Warn("skip broken upload journal entry", zap.String("file", path), zap.Error(err))
+	if err := os.Rename(path, path+brokenSuffix); err != nil {
+		log.Warn("failed to move broken upload journal entry aside", zap.String("file", path), zap.Error(err))
+	}
+}
+
+func (j *Journal) path(id string) string {
+	return filepath.Join(j.dir, id+journalSuffix)
+}
@@ -0,0 +1,24 @@
+package cloud
+
+import (
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+)
+
+// ListSnapshots lists the snapshot files of the station created in
+// [start, end] in the store, ordered by creation time. Only the date
+// partitions overlapping the time range are listed.
+func ListSnapshots(store ObjectStore, station int, start, end time.Time) ([]*snapshot.Ref, error) {
+	var keys []string
+	for _, prefix := range snapshot.DatePrefixes(station, start, end) {
+		objects, err := store.List(prefix)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objects {
+			keys = append(keys, obj.Key)
+		}
+	}
+	return snapshot.FilterRefs(keys, station, start, end), nil
+}
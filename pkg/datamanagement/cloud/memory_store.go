@@ -0,0 +1,177 @@
+package cloud
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type memoryObject struct {
+	data []byte
+	etag string
+}
+
+type memoryUpload struct {
+	key   string
+	parts map[int64][]byte
+}
+
+// memoryStore is an in-memory object store, it is used by tests which
+// shouldn't depend on any live service.
+type memoryStore struct {
+	mu sync.Mutex
+
+	objects map[string]*memoryObject
+	uploads map[string]*memoryUpload
+	// uploadSeq is used to generate upload ids
+	uploadSeq int
+}
+
+// NewMemoryStore creates a new in-memory object store.
+func NewMemoryStore() ObjectStore {
+	return &memoryStore{
+		objects: make(map[string]*memoryObject),
+		uploads: make(map[string]*memoryUpload),
+	}
+}
+
+// PutObject uploads the body as the object key in a single request.
+func (s *memoryStore) PutObject(key string, body io.ReadSeeker) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj := &memoryObject{data: data, etag: md5ETag(data)}
+	s.objects[key] = obj
+	return obj.etag, nil
+}
+
+// GetObject gets the content of the object key.
+func (s *memoryStore) GetObject(key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return io.NopCloser(bytes.NewReader(obj.data)), nil
+}
+
+// HeadObject gets the metadata of the object key.
+func (s *memoryStore) HeadObject(key string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	obj, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	return &ObjectInfo{Key: key, ETag: obj.etag, Size: int64(len(obj.data))}, nil
+}
+
+// DeleteObject deletes the object key.
+func (s *memoryStore) DeleteObject(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.objects, key)
+	return nil
+}
+
+// List lists the objects whose key starts with the prefix.
+func (s *memoryStore) List(prefix string) ([]*ObjectInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var objects []*ObjectInfo
+	for key, obj := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, &ObjectInfo{Key: key, ETag: obj.etag, Size: int64(len(obj.data))})
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+	return objects, nil
+}
+
+// CreateMultipartUpload starts a multipart upload.
+func (s *memoryStore) CreateMultipartUpload(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.uploadSeq++
+	uploadID := strconv.Itoa(s.uploadSeq)
+	s.uploads[uploadID] = &memoryUpload{key: key, parts: make(map[int64][]byte)}
+	return uploadID, nil
+}
+
+// UploadPart uploads a part of a multipart upload.
+func (s *memoryStore) UploadPart(key, uploadID string, partNumber int64, body io.ReadSeeker) (string, error) {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[uploadID]
+	if !ok || upload.key != key {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	upload.parts[partNumber] = data
+	return md5ETag(data), nil
+}
+
+// CompleteMultipartUpload completes a multipart upload.
+func (s *memoryStore) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	upload, ok := s.uploads[uploadID]
+	if !ok || upload.key != key {
+		return "", fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	if err := validateParts(parts); err != nil {
+		return "", err
+	}
+
+	var data []byte
+	for _, part := range parts {
+		partData, ok := upload.parts[part.Number]
+		if !ok || md5ETag(partData) != part.ETag {
+			return "", fmt.Errorf("invalid part %d", part.Number)
+		}
+		data = append(data, partData...)
+	}
+	etag, err := multipartETag(parts)
+	if err != nil {
+		return "", err
+	}
+
+	delete(s.uploads, uploadID)
+	s.objects[key] = &memoryObject{data: data, etag: etag}
+	return etag, nil
+}
+
+// AbortMultipartUpload aborts a multipart upload.
+func (s *memoryStore) AbortMultipartUpload(key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.uploads[uploadID]; !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchUpload, uploadID)
+	}
+	delete(s.uploads, uploadID)
+	return nil
+}
@@ -0,0 +1,188 @@
+package cloud
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrObjectNotFound is returned when the object doesn't exist.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrNoSuchUpload is returned when a multipart upload doesn't exist anymore,
+	// e.g. it was aborted or expired by the bucket lifecycle rules.
+	ErrNoSuchUpload = errors.New("no such multipart upload")
+)
+
+// CompletedPart is a part of a multipart upload which has been uploaded.
+type CompletedPart struct {
+	// Number is the part number, starts from 1.
+	Number int64 `json:"number"`
+	// ETag is the etag returned by the store for the part.
+	ETag string `json:"etag"`
+	// MD5 is the hex md5 of the part content.
+	MD5 string `json:"md5,omitempty"`
+	// Size is the size of the part in bytes.
+	Size int64 `json:"size"`
+}
+
+// ObjectInfo is the metadata of an object.
+type ObjectInfo struct {
+	// Key is the object key relative to the store root.
+	Key string
+	// ETag is the etag of the object.
+	ETag string
+	// Size is the size of the object in bytes.
+	Size int64
+}
+
+// ObjectStore is the interface of object storage backends snapshots are
+// archived to. Keys are slash separated and relative to the store root.
+//
+// Backends follow the S3 etag convention: the etag of an object put in a
+// single request is the hex md5 of its content, the etag of an object put
+// in a multipart upload is the hex md5 of the concatenated part md5s
+// suffixed by "-" and the part count. The uploader relies on it to verify
+// uploads end to end, unless the backend implements contentVerifier.
+type ObjectStore interface {
+	// PutObject uploads the body as the object key in a single request,
+	// return the etag of the object.
+	PutObject(key string, body io.ReadSeeker) (string, error)
+
+	// GetObject gets the content of the object key, the caller must close it.
+	GetObject(key string) (io.ReadCloser, error)
+
+	// HeadObject gets the metadata of the object key.
+	HeadObject(key string) (*ObjectInfo, error)
+
+	// DeleteObject deletes the object key, it is not an error if the object
+	// doesn't exist.
+	DeleteObject(key string) error
+
+	// List lists the objects whose key starts with the prefix.
+	List(prefix string) ([]*ObjectInfo, error)
+
+	// CreateMultipartUpload starts a multipart upload, return the upload id.
+	CreateMultipartUpload(key string) (string, error)
+
+	// UploadPart uploads a part of a multipart upload, return the etag of the part.
+	UploadPart(key, uploadID string, partNumber int64, body io.ReadSeeker) (string, error)
+
+	// CompleteMultipartUpload completes a multipart upload, return the etag of the object.
+	CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) (string, error)
+
+	// AbortMultipartUpload aborts a multipart upload.
+	AbortMultipartUpload(key, uploadID string) error
+}
+
+// contentVerifier is implemented by the backends which send the md5 of
+// every request body for the server to verify. Their etags are opaque, e.g.
+// S3 etags are not md5s with SSE-KMS nor on some S3-compatible stores, so
+// the uploader doesn't compare them.
+type contentVerifier interface {
+	verifiesContentMD5()
+}
+
+// ObjectStoreConfig is the object store configuration.
+type ObjectStoreConfig struct {
+	// URL is the location of the store, the backend is selected by its scheme:
+	//   s3://bucket/path         S3 or an S3-compatible store like MinIO or Ceph
+	//   file:///mnt/nas/path     a local filesystem or NAS directory
+	//   memory://                an in-memory store, for tests
+	URL string
+
+	// The following fields are only used by the s3 backend.
+
+	// AccessKey is the access key.
+	AccessKey string
+	// SecretKey is the secret key.
+	SecretKey string
+	// Endpoint is the endpoint, empty means AWS S3.
+	Endpoint string
+	// Region is the region.
+	Region string
+	// ForcePathStyle uses path-style addressing, most S3-compatible
+	// stores require it.
+	ForcePathStyle bool
+}
+
+// NewObjectStore creates and initializes the object store selected by the
+// scheme of the configured URL.
+func NewObjectStore(cfg *ObjectStoreConfig) (ObjectStore, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object store url %q: %w", cfg.URL, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing bucket in object store url %q", cfg.URL)
+		}
+		store := &s3StoreImpl{cfg: &S3StoreConfig{
+			AccessKey:      cfg.AccessKey,
+			SecretKey:      cfg.SecretKey,
+			Endpoint:       cfg.Endpoint,
+			Region:         cfg.Region,
+			ForcePathStyle: cfg.ForcePathStyle,
+			Bucket:         u.Host,
+			Path:           strings.Trim(u.Path, "/"),
+		}}
+		if err := store.Init(); err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "file":
+		root := u.Path
+		if u.Host != "" {
+			// file://relative/path
+			root = u.Host + u.Path
+		}
+		if root == "" {
+			return nil, fmt.Errorf("missing directory in object store url %q", cfg.URL)
+		}
+		return NewFsStore(filepath.FromSlash(root))
+	case "memory":
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unsupported object store scheme %q", u.Scheme)
+	}
+}
+
+// md5ETag returns the etag of an object put in a single request.
+func md5ETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// multipartETag returns the etag of an object put in a multipart upload
+// from the etags of its parts.
+func multipartETag(parts []CompletedPart) (string, error) {
+	digests := md5.New()
+	for _, part := range parts {
+		sum, err := hex.DecodeString(part.ETag)
+		if err != nil {
+			return "", fmt.Errorf("invalid etag of part %d: %w", part.Number, err)
+		}
+		digests.Write(sum)
+	}
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(digests.Sum(nil)), len(parts)), nil
+}
+
+// validateParts checks the parts are numbered 1..n in order.
+func validateParts(parts []CompletedPart) error {
+	if len(parts) == 0 {
+		return errors.New("no parts to complete")
+	}
+	for i, part := range parts {
+		if part.Number != int64(i+1) {
+			return fmt.Errorf("unexpected part number %d at %d", part.Number, i)
+		}
+	}
+	return nil
+}
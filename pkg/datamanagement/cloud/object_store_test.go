@@ -0,0 +1,120 @@
+package cloud
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testObjectStore runs the checks every object store backend must pass.
+func testObjectStore(t *testing.T, store ObjectStore) {
+	// single put
+	etag, err := store.PutObject("station=1/a.csv", bytes.NewReader([]byte("hello")))
+	require.NoError(t, err)
+	assert.Equal(t, md5ETag([]byte("hello")), etag)
+
+	info, err := store.HeadObject("station=1/a.csv")
+	require.NoError(t, err)
+	assert.Equal(t, etag, info.ETag)
+	assert.Equal(t, int64(5), info.Size)
+
+	body, err := store.GetObject("station=1/a.csv")
+	require.NoError(t, err)
+	data, err := io.ReadAll(body)
+	require.NoError(t, body.Close())
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+
+	_, err = store.GetObject("station=1/missing.csv")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+	_, err = store.HeadObject("station=1/missing.csv")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+
+	// multipart upload
+	uploadID, err := store.CreateMultipartUpload("station=1/b.csv")
+	require.NoError(t, err)
+	var parts []CompletedPart
+	for i, part := range []string{"0123", "4567", "89"} {
+		etag, err := store.UploadPart("station=1/b.csv", uploadID, int64(i+1), bytes.NewReader([]byte(part)))
+		require.NoError(t, err)
+		assert.Equal(t, md5ETag([]byte(part)), etag)
+		parts = append(parts, CompletedPart{Number: int64(i + 1), ETag: etag, Size: int64(len(part))})
+	}
+	etag, err = store.CompleteMultipartUpload("station=1/b.csv", uploadID, parts)
+	require.NoError(t, err)
+	expected, err := multipartETag(parts)
+	require.NoError(t, err)
+	assert.Equal(t, expected, etag)
+	info, err = store.HeadObject("station=1/b.csv")
+	require.NoError(t, err)
+	assert.Equal(t, etag, info.ETag)
+	assert.Equal(t, int64(10), info.Size)
+
+	// the upload is gone after it is completed
+	_, err = store.UploadPart("station=1/b.csv", uploadID, 1, bytes.NewReader([]byte("x")))
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+
+	uploadID, err = store.CreateMultipartUpload("station=1/c.csv")
+	require.NoError(t, err)
+	require.NoError(t, store.AbortMultipartUpload("station=1/c.csv", uploadID))
+	_, err = store.CompleteMultipartUpload("station=1/c.csv", uploadID, parts)
+	assert.ErrorIs(t, err, ErrNoSuchUpload)
+
+	// list
+	_, err = store.PutObject("station=2/a.csv", bytes.NewReader([]byte("world")))
+	require.NoError(t, err)
+	objects, err := store.List("station=1/")
+	require.NoError(t, err)
+	require.Len(t, objects, 2)
+	assert.Equal(t, "station=1/a.csv", objects[0].Key)
+	assert.Equal(t, "station=1/b.csv", objects[1].Key)
+	objects, err = store.List("station=")
+	require.NoError(t, err)
+	assert.Len(t, objects, 3)
+	objects, err = store.List("station=3/")
+	require.NoError(t, err)
+	assert.Empty(t, objects)
+
+	// delete
+	require.NoError(t, store.DeleteObject("station=1/a.csv"))
+	require.NoError(t, store.DeleteObject("station=1/a.csv"))
+	_, err = store.HeadObject("station=1/a.csv")
+	assert.ErrorIs(t, err, ErrObjectNotFound)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testObjectStore(t, NewMemoryStore())
+}
+
+func TestFsStore(t *testing.T) {
+	store, err := NewFsStore(t.TempDir())
+	require.NoError(t, err)
+	testObjectStore(t, store)
+
+	// keys can't escape the root directory or touch the metadata
+	_, err = store.PutObject(".openbms/etags/x", bytes.NewReader([]byte("x")))
+	assert.Error(t, err)
+	_, err = store.PutObject("../../x.csv", bytes.NewReader([]byte("x")))
+	require.NoError(t, err)
+	objects, err := store.List("x.csv")
+	require.NoError(t, err)
+	require.Len(t, objects, 1)
+}
+
+func TestNewObjectStore(t *testing.T) {
+	store, err := NewObjectStore(&ObjectStoreConfig{URL: "memory://"})
+	require.NoError(t, err)
+	assert.IsType(t, &memoryStore{}, store)
+
+	store, err = NewObjectStore(&ObjectStoreConfig{URL: "file://" + t.TempDir()})
+	require.NoError(t, err)
+	assert.IsType(t, &fsStore{}, store)
+
+	_, err = NewObjectStore(&ObjectStoreConfig{URL: "s3://"})
+	assert.Error(t, err)
+	_, err = NewObjectStore(&ObjectStoreConfig{URL: "gcs://bucket/path"})
+	assert.Error(t, err)
+}
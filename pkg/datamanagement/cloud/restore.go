@@ -0,0 +1,255 @@
+package cloud
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	localstore "github.com/zhangjinpeng87/openbms/pkg/datamanagement/local"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+	"go.uber.org/zap"
+)
+
+// DefaultRestoreLookback is how far back to search for a snapshot to restore.
+const DefaultRestoreLookback = 30 * 24 * time.Hour
+
+// ErrSnapshotNotFound is returned when there is no snapshot to restore from.
+var ErrSnapshotNotFound = errors.New("snapshot not found")
+
+// Restorer restores the last known battery states of a station from the
+// snapshots in the object store, e.g. when a failed site controller is replaced.
+type Restorer struct {
+	store ObjectStore
+	// dir is the directory to download snapshot files to.
+	dir string
+	// lookback is how far back to search for a snapshot.
+	lookback time.Duration
+	// keys unwraps the data keys of encrypted snapshots.
+	keys snapshot.KeyWrapper
+}
+
+// NewRestorer creates a new restorer which downloads snapshot files to dir.
+func NewRestorer(store ObjectStore, dir string) *Restorer {
+	return &Restorer{
+		store:    store,
+		dir:      dir,
+		lookback: DefaultRestoreLookback,
+	}
+}
+
+// SetKeyWrapper sets the key wrapper to decrypt encrypted snapshots with.
+func (r *Restorer) SetKeyWrapper(keys snapshot.KeyWrapper) {
+	r.keys = keys
+}
+
+// FindSnapshot finds the newest snapshot of the station created at or before t.
+func (r *Restorer) FindSnapshot(station int, t time.Time) (*snapshot.Ref, error) {
+	var found *snapshot.Ref
+	err := r.eachSnapshot(station, t, func(ref *snapshot.Ref) bool {
+		found = ref
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%w: station %d before %s", ErrSnapshotNotFound, station, t.UTC().Format(time.RFC3339))
+	}
+	return found, nil
+}
+
+// eachSnapshot calls fn with the snapshots of the station created at or
+// before t within the lookback, newest first, until fn returns false.
+func (r *Restorer) eachSnapshot(station int, t time.Time, fn func(ref *snapshot.Ref) bool) error {
+	// Walk back one date partition at a time, most restores are for the
+	// latest state so usually only one partition is listed.
+	end := t
+	for start := t.UTC().Truncate(24 * time.Hour); !start.Before(t.Add(-r.lookback).Truncate(24 * time.Hour)); start = start.Add(-24 * time.Hour) {
+		refs, err := ListSnapshots(r.store, station, start, end)
+		if err != nil {
+			return err
+		}
+		for i := len(refs) - 1; i >= 0; i-- {
+			if !fn(refs[i]) {
+				return nil
+			}
+		}
+		end = start.Add(-time.Second)
+	}
+	return nil
+}
+
+// Fetch downloads the snapshot and its manifest, decrypts and decompresses
+// the snapshot file if needed, verifies it against the manifest and returns
+// the battery states in it.
+func (r *Restorer) Fetch(ref *snapshot.Ref) (*snapshot.Manifest, []data_model.BatteryState, error) {
+	if ref.Format != "csv" {
+		return nil, nil, fmt.Errorf("unsupported format: %s", ref.Format)
+	}
+
+	manifest, err := r.fetchManifest(ref.ManifestKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	if manifest.ObjectKey() != ref.Key {
+		return nil, nil, fmt.Errorf("manifest of snapshot %s is for object %s", ref.Key, manifest.ObjectKey())
+	}
+
+	localPath := filepath.Join(r.dir, filepath.FromSlash(ref.FileKey()))
+	if err := r.download(ref.Key, localPath, manifest); err != nil {
+		return nil, nil, err
+	}
+	manifest.LocalPath = localPath
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	states, err := snapshot.ReadCsv(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(states) != manifest.RowCount {
+		return nil, nil, fmt.Errorf("snapshot %s has %d rows, expect %d", ref.Key, len(states), manifest.RowCount)
+	}
+	for i := range states {
+		if states[i].Station != ref.Station {
+			return nil, nil, fmt.Errorf("snapshot %s contains station %d", ref.Key, states[i].Station)
+		}
+	}
+
+	return manifest, states, nil
+}
+
+// Restore rebuilds the local store and the in-memory batteries data of the
+// station from the newest snapshot created at or before t. A snapshot whose
+// manifest is missing, e.g. the upload crashed before the manifest was put,
+// or which fails to download or verify is skipped for the one before it.
+// Either of local and data can be nil. It is meant to run on a fresh
+// controller before it starts accepting sensor data, the restored states
+// overwrite existing ones.
+func (r *Restorer) Restore(station int, t time.Time, local localstore.LocalStore, data *data_model.BatteriesData) (*snapshot.Manifest, error) {
+	var (
+		ref      *snapshot.Ref
+		manifest *snapshot.Manifest
+		states   []data_model.BatteryState
+		// fetchErr is the error of the newest skipped snapshot
+		fetchErr error
+	)
+	err := r.eachSnapshot(station, t, func(candidate *snapshot.Ref) bool {
+		m, s, err := r.Fetch(candidate)
+		if err != nil {
+			log.Warn("skip snapshot which can't be restored", zap.String("key", candidate.Key), zap.Error(err))
+			if fetchErr == nil {
+				fetchErr = err
+			}
+			return true
+		}
+		ref, manifest, states = candidate, m, s
+		return false
+	})
+	if err != nil {
+		return nil, err
+	}
+	if ref == nil {
+		if fetchErr != nil {
+			return nil, fetchErr
+		}
+		return nil, fmt.Errorf("%w: station %d before %s", ErrSnapshotNotFound, station, t.UTC().Format(time.RFC3339))
+	}
+
+	for i := range states {
+		if local != nil {
+			if err := local.Upsert(&states[i]); err != nil {
+				return nil, fmt.Errorf("failed to restore battery state: %w", err)
+			}
+		}
+		if data != nil {
+			state := states[i]
+			data.Update(&state)
+		}
+	}
+	if data != nil {
+		data.ReCalculate()
+	}
+
+	log.Info("restored station from snapshot",
+		zap.Int("station", station),
+		zap.String("key", ref.Key),
+		zap.Int("rows", len(states)),
+		zap.Int64("max-timestamp", manifest.MaxTimestamp))
+	return manifest, nil
+}
+
+func (r *Restorer) fetchManifest(key string) (*snapshot.Manifest, error) {
+	body, err := r.store.GetObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return snapshot.UnmarshalManifest(data)
+}
+
+// download downloads the object to localPath, decodes it if it is compressed
+// or encrypted, and verifies the sizes and checksums of both the object and
+// the snapshot file.
+func (r *Restorer) download(key, localPath string, manifest *snapshot.Manifest) error {
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	body, err := r.store.GetObject(key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	defer file.Close()
+
+	objectCrc, objectSize := crc32.NewIEEE(), new(sizeWriter)
+	src := io.TeeReader(body, io.MultiWriter(objectCrc, objectSize))
+	checksum, size := crc32.NewIEEE(), new(sizeWriter)
+	dst := io.MultiWriter(file, checksum, size)
+	if manifest.Encoded() {
+		err = snapshot.Decode(dst, src, manifest, r.keys)
+	} else {
+		_, err = io.Copy(dst, src)
+	}
+	if err != nil {
+		// Tell a corrupted object from a wrong key by the object checksum.
+		if _, cerr := io.Copy(io.Discard, src); cerr == nil && objectCrc.Sum32() != manifest.ObjectChecksum() {
+			return fmt.Errorf("%w: object crc32 %d, expect %d", errChecksumMismatch, objectCrc.Sum32(), manifest.ObjectChecksum())
+		}
+		return fmt.Errorf("failed to download snapshot file: %w", err)
+	}
+	// trailing bytes are not read by the decoder, but they must be verified too
+	if _, err := io.Copy(io.Discard, src); err != nil {
+		return fmt.Errorf("failed to download snapshot file: %w", err)
+	}
+	if int64(*objectSize) != manifest.ObjectSize() || objectCrc.Sum32() != manifest.ObjectChecksum() {
+		return fmt.Errorf("%w: object size %d crc32 %d, expect size %d crc32 %d",
+			errChecksumMismatch, *objectSize, objectCrc.Sum32(), manifest.ObjectSize(), manifest.ObjectChecksum())
+	}
+	if int64(*size) != manifest.Size || checksum.Sum32() != manifest.Checksum {
+		return fmt.Errorf("%w: size %d crc32 %d, expect size %d crc32 %d",
+			errChecksumMismatch, *size, checksum.Sum32(), manifest.Size, manifest.Checksum)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package cloud
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+)
+
+// fakeLocalStore records the upserted battery states.
+type fakeLocalStore struct {
+	states []data_model.BatteryState
+}
+
+func (f *fakeLocalStore) Open() error  { return nil }
+func (f *fakeLocalStore) Close() error { return nil }
+
+func (f *fakeLocalStore) Upsert(state *data_model.BatteryState) error {
+	f.states = append(f.states, *state)
+	return nil
+}
+
+func (f *fakeLocalStore) GetLatest(station, container, pack, cell int) (*data_model.BatteryState, error) {
+	return nil, nil
+}
+
+func (f *fakeLocalStore) GetHistory(station, container, pack, cell int) ([]*data_model.BatteryState, error) {
+	return nil, nil
+}
+
+func (f *fakeLocalStore) GenerateSnapshotFile(station int, format string) (*snapshot.Manifest, error) {
+	return nil, nil
+}
+
+func (f *fakeLocalStore) SaveEstimates(estimates []data_model.CellEstimate) error { return nil }
+
+func (f *fakeLocalStore) LoadEstimates() ([]data_model.CellEstimate, error) { return nil, nil }
+
+func (f *fakeLocalStore) SaveNoise(noise []data_model.ChannelNoise) error { return nil }
+
+func (f *fakeLocalStore) LoadNoise() ([]data_model.ChannelNoise, error) { return nil, nil }
+
+func (f *fakeLocalStore) SavePackMetadata(metadata []data_model.PackMetadata) error { return nil }
+
+func (f *fakeLocalStore) LoadPackMetadata() ([]data_model.PackMetadata, error) { return nil, nil }
+
+func (f *fakeLocalStore) SaveState(key string, value []byte) error { return nil }
+
+func (f *fakeLocalStore) LoadState(key string) ([]byte, error) { return nil, nil }
+
+func csvSnapshot(states ...data_model.BatteryState) []byte {
+	var b strings.Builder
+	b.WriteString(snapshot.CsvHeader)
+	for i := range states {
+		b.WriteString(snapshot.FormatCsvRow(&states[i]))
+	}
+	return []byte(b.String())
+}
+
+func TestRestore(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir()}
+	u := newTestUploader(t, t.TempDir(), source, store)
+
+	// upload 3 snapshots of station 1 with different voltages
+	for _, voltage := range []float64{3.5, 3.6, 3.7} {
+		source.content = csvSnapshot(
+			data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: voltage, Temperature: 25, State: data_model.Idle, Timestamp: 1699999990},
+			data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 2, Voltage: voltage, Temperature: 26, State: data_model.Idle, Timestamp: 1699999991},
+		)
+		require.NoError(t, u.Snapshot(1))
+	}
+	require.NoError(t, u.Flush())
+
+	// restore the state as of the second snapshot
+	r := NewRestorer(store, t.TempDir())
+	local := &fakeLocalStore{}
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	manifest, err := r.Restore(1, time.Unix(1700000002, 0), local, data)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000002), manifest.CreatedAt)
+	assert.Equal(t, 2, manifest.RowCount)
+
+	require.Len(t, local.states, 2)
+	assert.Equal(t, 3.6, local.states[0].Voltage)
+
+	cell, ok := data.GetCell(1, 1, 1, 2)
+	require.True(t, ok)
+	assert.InDelta(t, 3.6, cell.Voltage, 1e-9)
+	assert.InDelta(t, 26, cell.Temperature, 1e-9)
+	_, ok = data.GetCell(1, 1, 1, 3)
+	assert.False(t, ok)
+
+	// no snapshot before the first one
+	_, err = r.Restore(1, time.Unix(1700000000, 0), nil, nil)
+	assert.ErrorIs(t, err, ErrSnapshotNotFound)
+}
+
+func TestRestoreFallback(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir()}
+	u := newTestUploader(t, t.TempDir(), source, store)
+	for _, voltage := range []float64{3.5, 3.6, 3.7} {
+		source.content = csvSnapshot(
+			data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: voltage, Timestamp: 1699999990},
+		)
+		require.NoError(t, u.Snapshot(1))
+	}
+	require.NoError(t, u.Flush())
+
+	// the newest object is orphaned, its manifest was never put
+	newest := snapshot.FilePath(1, 1700000003, "csv")
+	require.NoError(t, store.DeleteObject(snapshot.ManifestKey(newest)))
+	// the second one is corrupted
+	second := snapshot.FilePath(1, 1700000002, "csv")
+	store.objects[second].data = []byte(strings.Replace(string(store.object(second)), "3.6", "4.6", 1))
+
+	r := NewRestorer(store, t.TempDir())
+	local := &fakeLocalStore{}
+	manifest, err := r.Restore(1, time.Unix(1700000003, 0), local, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1700000001), manifest.CreatedAt)
+	require.Len(t, local.states, 1)
+	assert.Equal(t, 3.5, local.states[0].Voltage)
+
+	// the orphaned object is still the newest snapshot found
+	ref, err := r.FindSnapshot(1, time.Unix(1700000003, 0))
+	require.NoError(t, err)
+	assert.Equal(t, newest, ref.Key)
+}
+
+func TestRestoreCorruptedSnapshot(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: csvSnapshot(
+		data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.7, Timestamp: 1699999990},
+	)}
+	u := newTestUploader(t, t.TempDir(), source, store)
+	require.NoError(t, u.Snapshot(1))
+	require.NoError(t, u.Flush())
+
+	// flip the voltage in the uploaded object
+	key := snapshot.FilePath(1, 1700000001, "csv")
+	store.objects[key].data = []byte(strings.Replace(string(store.object(key)), "3.7", "4.7", 1))
+
+	r := NewRestorer(store, t.TempDir())
+	_, err := r.Restore(1, time.Unix(1700000001, 0), nil, nil)
+	assert.ErrorIs(t, err, errChecksumMismatch)
+}
+
+func TestRestoreEncrypted(t *testing.T) {
+	keys, err := snapshot.NewAESKeyWrapper("kek-1", bytes.Repeat([]byte{7}, 32))
+	require.NoError(t, err)
+
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: csvSnapshot(
+		data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.7, Timestamp: 1699999990},
+		data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 2, Voltage: 3.8, Timestamp: 1699999991},
+	)}
+	u, err := NewUploader(&UploaderConfig{
+		JournalDir: t.TempDir(),
+		Format:     "csv",
+		Encoding:   &snapshot.EncodeOptions{Compression: snapshot.CompressionGzip, Keys: keys},
+	}, source, store)
+	require.NoError(t, err)
+	require.NoError(t, u.Snapshot(1))
+	require.NoError(t, u.Flush())
+
+	// no key to decrypt the snapshot
+	r := NewRestorer(store, t.TempDir())
+	_, err = r.Restore(1, time.Unix(1700000001, 0), nil, nil)
+	assert.ErrorIs(t, err, snapshot.ErrDecrypt)
+
+	r.SetKeyWrapper(keys)
+	local := &fakeLocalStore{}
+	manifest, err := r.Restore(1, time.Unix(1700000001, 0), local, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2, manifest.RowCount)
+	require.Len(t, local.states, 2)
+	assert.Equal(t, 3.8, local.states[1].Voltage)
+
+	// a corrupted object is reported as a checksum mismatch
+	key := snapshot.FilePath(1, 1700000001, "csv") + ".gz.enc"
+	store.objects[key].data[10] ^= 1
+	_, err = r.Restore(1, time.Unix(1700000001, 0), nil, nil)
+	assert.ErrorIs(t, err, errChecksumMismatch)
+}
@@ -1,13 +1,25 @@
 package cloud
 
 import (
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/request"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/aws"
-	"fmt"
-	"os"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
 )
 
 // S3StoreConfig is the S3 store configuration.
@@ -18,29 +30,39 @@ type S3StoreConfig struct {
 	SecretKey string
 	// Endpoint is the endpoint.
 	Endpoint string
+	// Region is the region.
+	Region string
 	// Bucket is the bucket.
 	Bucket string
 	// Path is the path.
 	Path string
+	// ForcePathStyle uses path-style addressing, most S3-compatible
+	// stores require it.
+	ForcePathStyle bool
 }
 
 // S3Store is the interface of S3 data store.
 // It is used to store real-time batteries data in S3.
 // The real-time batteries data is used to do e.
 type S3Store interface {
+	// S3Store is an ObjectStore backend.
+	ObjectStore
+
 	// Init initializes the S3 store.
 	Init() error
 
-	// Upload uploads the file to S3.
+	// Upload uploads the local snapshot file to S3, the path of the file
+	// must end with the snapshot layout.
 	Upload(fileName string) error
 
-	// Download downloads the file from S3.
+	// Download downloads the snapshot file from S3 to the local path, the
+	// path must end with the snapshot layout.
 	Download(fileName string) error
 }
 
 type s3StoreImpl struct {
 	cfg *S3StoreConfig
-	svc *s3.S3
+	svc s3iface.S3API
 }
 
 // NewS3Store creates a new S3 store.
@@ -50,6 +72,10 @@ func NewS3Store(cfg *S3StoreConfig) S3Store {
 
 // Init initializes the S3 store.
 func (s *s3StoreImpl) Init() error {
+	if s.svc != nil {
+		return s.createBucket(s.svc)
+	}
+
 	// create S3 client
 	creds := credentials.NewStaticCredentials(s.cfg.AccessKey, s.cfg.SecretKey, "")
 	_, err := creds.Get()
@@ -61,29 +87,43 @@ func (s *s3StoreImpl) Init() error {
 		Credentials: creds,
 		Endpoint:    aws.String(s.cfg.Endpoint),
 		Region:      aws.String(s.cfg.Region),
+
+		S3ForcePathStyle: aws.Bool(s.cfg.ForcePathStyle),
 	}
 
-	request.WithRetryer(awsConfig, aws.NewDefaultRetryer())
+	request.WithRetryer(awsConfig, client.DefaultRetryer{NumMaxRetries: client.DefaultRetryerMaxNumRetries})
 
 	svc := s3.New(session.New(), awsConfig)
+	if err := s.createBucket(svc); err != nil {
+		return err
+	}
+
+	s.svc = svc
+
+	return nil
+}
 
-	// create bucket if not exists
-	_, err = svc.CreateBucket(&s3.CreateBucketInput{
+// createBucket creates the bucket if not exists.
+func (s *s3StoreImpl) createBucket(svc s3iface.S3API) error {
+	_, err := svc.CreateBucket(&s3.CreateBucketInput{
 		Bucket: aws.String(s.cfg.Bucket),
 	})
+	if isAWSErrCode(err, s3.ErrCodeBucketAlreadyOwnedByYou) {
+		err = nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create bucket: %w", err)
 	}
 
-	s.svc = svc
-
 	return nil
 }
 
-// Upload uploads the file to S3.
+// Upload uploads the local snapshot file to S3, under the same key as the
+// file has in the local snapshot directory.
 func (s *s3StoreImpl) Upload(fileName string) error {
-	if s.svc == nil {
-		return errors.New("S3 store is not initialized")
+	key, err := snapshotKey(fileName)
+	if err != nil {
+		return err
 	}
 
 	file, err := os.Open(fileName)
@@ -92,37 +132,297 @@ func (s *s3StoreImpl) Upload(fileName string) error {
 	}
 	defer file.Close()
 
-	_, err = s.svc.PutObject(&s3.PutObjectInput{
-		Bucket: aws.String(s.cfg.Bucket),
-		Key:    aws.String(s.cfg.Path + "/" + fileName),
-		Body:   file,
-	})
-	if err != nil {
+	if _, err := s.PutObject(key, file); err != nil {
 		return fmt.Errorf("failed to upload file: %w", err)
 	}
 
 	return nil
 }
 
-// Download downloads the file from S3.
+// Download downloads the snapshot file from S3 to the local path with the
+// same key.
 func (s *s3StoreImpl) Download(fileName string) error {
-	if s.svc == nil {
-		return errors.New("S3 store is not initialized")
+	key, err := snapshotKey(fileName)
+	if err != nil {
+		return err
 	}
 
+	body, err := s.GetObject(key)
+	if err != nil {
+		return fmt.Errorf("failed to download file: %w", err)
+	}
+	defer body.Close()
+
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
 	file, err := os.Create(fileName)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
 	defer file.Close()
 
-	_, err = s.svc.GetObject(&s3.GetObjectInput{
+	if _, err := io.Copy(file, body); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+
+	return nil
+}
+
+// PutObject uploads the body as the object key in a single request.
+func (s *s3StoreImpl) PutObject(key string, body io.ReadSeeker) (string, error) {
+	if s.svc == nil {
+		return "", errors.New("S3 store is not initialized")
+	}
+
+	sum, err := contentMD5(body)
+	if err != nil {
+		return "", err
+	}
+	out, err := s.svc.PutObject(&s3.PutObjectInput{
+		Bucket:     aws.String(s.cfg.Bucket),
+		Key:        aws.String(s.objectKey(key)),
+		Body:       body,
+		ContentMD5: aws.String(sum),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to put object: %w", err)
+	}
+
+	return trimETag(aws.StringValue(out.ETag)), nil
+}
+
+// CreateMultipartUpload starts a multipart upload.
+func (s *s3StoreImpl) CreateMultipartUpload(key string) (string, error) {
+	if s.svc == nil {
+		return "", errors.New("S3 store is not initialized")
+	}
+
+	out, err := s.svc.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
 		Bucket: aws.String(s.cfg.Bucket),
-		Key:    aws.String(s.cfg.Path + "/" + fileName),
+		Key:    aws.String(s.objectKey(key)),
 	})
 	if err != nil {
-		return fmt.Errorf("failed to download file: %w", err)
+		return "", fmt.Errorf("failed to create multipart upload: %w", err)
+	}
+
+	return aws.StringValue(out.UploadId), nil
+}
+
+// UploadPart uploads a part of a multipart upload.
+func (s *s3StoreImpl) UploadPart(key, uploadID string, partNumber int64, body io.ReadSeeker) (string, error) {
+	if s.svc == nil {
+		return "", errors.New("S3 store is not initialized")
+	}
+
+	sum, err := contentMD5(body)
+	if err != nil {
+		return "", err
+	}
+	out, err := s.svc.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(s.cfg.Bucket),
+		Key:        aws.String(s.objectKey(key)),
+		UploadId:   aws.String(uploadID),
+		PartNumber: aws.Int64(partNumber),
+		Body:       body,
+		ContentMD5: aws.String(sum),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload part %d: %w", partNumber, wrapNoSuchUpload(err))
+	}
+
+	return trimETag(aws.StringValue(out.ETag)), nil
+}
+
+// CompleteMultipartUpload completes a multipart upload.
+func (s *s3StoreImpl) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) (string, error) {
+	if s.svc == nil {
+		return "", errors.New("S3 store is not initialized")
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(parts))
+	for _, part := range parts {
+		completed = append(completed, &s3.CompletedPart{
+			ETag:       aws.String(`"` + part.ETag + `"`),
+			PartNumber: aws.Int64(part.Number),
+		})
+	}
+
+	out, err := s.svc.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(s.cfg.Bucket),
+		Key:             aws.String(s.objectKey(key)),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload: %w", wrapNoSuchUpload(err))
+	}
+
+	return trimETag(aws.StringValue(out.ETag)), nil
+}
+
+// AbortMultipartUpload aborts a multipart upload.
+func (s *s3StoreImpl) AbortMultipartUpload(key, uploadID string) error {
+	if s.svc == nil {
+		return errors.New("S3 store is not initialized")
+	}
+
+	_, err := s.svc.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s.cfg.Bucket),
+		Key:      aws.String(s.objectKey(key)),
+		UploadId: aws.String(uploadID),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to abort multipart upload: %w", wrapNoSuchUpload(err))
+	}
+
+	return nil
+}
+
+// HeadObject gets the metadata of the object key.
+func (s *s3StoreImpl) HeadObject(key string) (*ObjectInfo, error) {
+	if s.svc == nil {
+		return nil, errors.New("S3 store is not initialized")
+	}
+
+	out, err := s.svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	// HeadObject has no body, so S3 can only reply a bare 404
+	if isAWSErrCode(err, s3.ErrCodeNoSuchKey) || isAWSErrCode(err, "NotFound") {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to head object: %w", err)
+	}
+
+	return &ObjectInfo{
+		Key:  key,
+		ETag: trimETag(aws.StringValue(out.ETag)),
+		Size: aws.Int64Value(out.ContentLength),
+	}, nil
+}
+
+// DeleteObject deletes the object key.
+func (s *s3StoreImpl) DeleteObject(key string) error {
+	if s.svc == nil {
+		return errors.New("S3 store is not initialized")
+	}
+
+	_, err := s.svc.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
 	}
 
 	return nil
 }
+
+// GetObject gets the content of the object key.
+func (s *s3StoreImpl) GetObject(key string) (io.ReadCloser, error) {
+	if s.svc == nil {
+		return nil, errors.New("S3 store is not initialized")
+	}
+
+	out, err := s.svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.cfg.Bucket),
+		Key:    aws.String(s.objectKey(key)),
+	})
+	if isAWSErrCode(err, s3.ErrCodeNoSuchKey) {
+		return nil, fmt.Errorf("%w: %s", ErrObjectNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object: %w", err)
+	}
+
+	return out.Body, nil
+}
+
+// List lists the objects whose key starts with the prefix.
+func (s *s3StoreImpl) List(prefix string) ([]*ObjectInfo, error) {
+	if s.svc == nil {
+		return nil, errors.New("S3 store is not initialized")
+	}
+
+	root := ""
+	if s.cfg.Path != "" {
+		root = path.Clean(s.cfg.Path) + "/"
+	}
+	var objects []*ObjectInfo
+	err := s.svc.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(s.cfg.Bucket),
+		Prefix: aws.String(root + prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, &ObjectInfo{
+				Key:  strings.TrimPrefix(aws.StringValue(obj.Key), root),
+				ETag: trimETag(aws.StringValue(obj.ETag)),
+				Size: aws.Int64Value(obj.Size),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	return objects, nil
+}
+
+// verifiesContentMD5 marks the S3 store as a contentVerifier, S3 rejects a
+// body not matching its Content-MD5 header with BadDigest.
+func (s *s3StoreImpl) verifiesContentMD5() {}
+
+// contentMD5 returns the base64 md5 of the body for the Content-MD5 header,
+// and rewinds the body.
+func contentMD5(body io.ReadSeeker) (string, error) {
+	digest := md5.New()
+	if _, err := io.Copy(digest, body); err != nil {
+		return "", fmt.Errorf("failed to read body: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", fmt.Errorf("failed to rewind body: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(digest.Sum(nil)), nil
+}
+
+// snapshotKey returns the key of a snapshot file from its local path, the
+// last levels of which are the partitions of the snapshot layout.
+func snapshotKey(fileName string) (string, error) {
+	parts := strings.Split(filepath.ToSlash(fileName), "/")
+	if len(parts) < 4 {
+		return "", fmt.Errorf("invalid snapshot file path: %s", fileName)
+	}
+	ref, err := snapshot.ParseKey(strings.Join(parts[len(parts)-4:], "/"))
+	if err != nil {
+		return "", err
+	}
+	return ref.Key, nil
+}
+
+// objectKey returns the full object key under the configured path.
+func (s *s3StoreImpl) objectKey(key string) string {
+	return path.Join(s.cfg.Path, key)
+}
+
+// trimETag removes the quotes S3 puts around etags.
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// wrapNoSuchUpload converts the S3 NoSuchUpload error to ErrNoSuchUpload,
+// so the caller can restart the upload from scratch.
+func wrapNoSuchUpload(err error) error {
+	if isAWSErrCode(err, s3.ErrCodeNoSuchUpload) {
+		return fmt.Errorf("%w: %v", ErrNoSuchUpload, err)
+	}
+	return err
+}
+
+func isAWSErrCode(err error, code string) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && aerr.Code() == code
+}
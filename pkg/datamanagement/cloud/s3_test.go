@@ -1,22 +1,23 @@
 package cloud
 
 import (
-	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
-	"time"
-
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/aws/credentials"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3/types"
-	"github.com/aws/aws-sdk-go-v2/service/s3/mock"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
 )
 
 // MockS3Client is a mock implementation of the S3 client.
 type MockS3Client struct {
+	s3iface.S3API
 	mock.Mock
 }
 
@@ -30,6 +31,21 @@ func (m *MockS3Client) PutObject(params *s3.PutObjectInput) (*s3.PutObjectOutput
 	return args.Get(0).(*s3.PutObjectOutput), args.Error(1)
 }
 
+func (m *MockS3Client) GetObject(params *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*s3.GetObjectOutput), args.Error(1)
+}
+
+func (m *MockS3Client) UploadPart(params *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*s3.UploadPartOutput), args.Error(1)
+}
+
+func (m *MockS3Client) CompleteMultipartUpload(params *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	args := m.Called(params)
+	return args.Get(0).(*s3.CompleteMultipartUploadOutput), args.Error(1)
+}
+
 func TestS3StoreInit(t *testing.T) {
 	// Create a mock S3 client
 	mockS3Client := &MockS3Client{}
@@ -75,17 +91,29 @@ func TestS3StoreUpload(t *testing.T) {
 		svc: mockS3Client,
 	}
 
-	// Configure expectations for PutObject method
-	mockS3Client.On("PutObject", mock.Anything).Return(&s3.PutObjectOutput{}, nil)
+	// Configure expectations for PutObject method, the file keeps its key
+	// of the snapshot layout under the configured path
+	key := snapshot.FilePath(1, 1700000000, "csv")
+	mockS3Client.On("PutObject", mock.MatchedBy(func(in *s3.PutObjectInput) bool {
+		return aws.StringValue(in.Key) == "test-path/"+key
+	})).Return(&s3.PutObjectOutput{}, nil)
+
+	// Create the file to upload
+	fileName := filepath.Join(t.TempDir(), filepath.FromSlash(key))
+	assert.Nil(t, os.MkdirAll(filepath.Dir(fileName), 0755))
+	assert.Nil(t, os.WriteFile(fileName, []byte("data"), 0644))
 
 	// Call the Upload method
-	err := s3Store.Upload("test-file.txt")
+	err := s3Store.Upload(fileName)
 
 	// Assert that the expectations were met
 	mockS3Client.AssertExpectations(t)
 
 	// Check for errors
 	assert.Nil(t, err, "Upload should not return an error")
+
+	// a file outside the snapshot layout has no key
+	assert.NotNil(t, s3Store.Upload("test-file.txt"))
 }
 
 func TestS3StoreDownload(t *testing.T) {
@@ -105,14 +133,60 @@ func TestS3StoreDownload(t *testing.T) {
 	}
 
 	// Configure expectations for GetObject method
-	mockS3Client.On("GetObject", mock.Anything).Return(&s3.GetObjectOutput{}, nil)
+	key := snapshot.FilePath(1, 1700000000, "csv")
+	mockS3Client.On("GetObject", mock.MatchedBy(func(in *s3.GetObjectInput) bool {
+		return aws.StringValue(in.Key) == "test-path/"+key
+	})).Return(&s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader("data"))}, nil)
 
 	// Call the Download method
-	err := s3Store.Download("test-file.txt")
+	fileName := filepath.Join(t.TempDir(), filepath.FromSlash(key))
+	err := s3Store.Download(fileName)
 
 	// Assert that the expectations were met
 	mockS3Client.AssertExpectations(t)
 
 	// Check for errors
 	assert.Nil(t, err, "Download should not return an error")
+
+	// The object body is written to the file
+	data, err := os.ReadFile(fileName)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestS3StoreMultipartUpload(t *testing.T) {
+	// Create a mock S3 client
+	mockS3Client := &MockS3Client{}
+
+	// Create a test S3StoreImpl with the mock client
+	s3Store := &s3StoreImpl{
+		cfg: &S3StoreConfig{
+			Bucket: "test-bucket",
+			Path:   "test-path",
+		},
+		svc: mockS3Client,
+	}
+
+	// Configure expectations for UploadPart and CompleteMultipartUpload methods
+	mockS3Client.On("UploadPart", mock.MatchedBy(func(in *s3.UploadPartInput) bool {
+		// the md5 of "data" for S3 to verify the part
+		return aws.StringValue(in.Key) == "test-path/1/test-file.csv" && aws.Int64Value(in.PartNumber) == 1 &&
+			aws.StringValue(in.ContentMD5) == "jXd/OF09/siBXSD3SWAm3A=="
+	})).Return(&s3.UploadPartOutput{ETag: aws.String(`"part-etag"`)}, nil)
+	mockS3Client.On("CompleteMultipartUpload", mock.MatchedBy(func(in *s3.CompleteMultipartUploadInput) bool {
+		parts := in.MultipartUpload.Parts
+		return len(parts) == 1 && aws.StringValue(parts[0].ETag) == `"part-etag"`
+	})).Return(&s3.CompleteMultipartUploadOutput{ETag: aws.String(`"object-etag-1"`)}, nil)
+
+	// Call the UploadPart and CompleteMultipartUpload methods
+	etag, err := s3Store.UploadPart("1/test-file.csv", "upload-id", 1, strings.NewReader("data"))
+	assert.Nil(t, err, "UploadPart should not return an error")
+	assert.Equal(t, "part-etag", etag)
+
+	etag, err = s3Store.CompleteMultipartUpload("1/test-file.csv", "upload-id", []CompletedPart{{Number: 1, ETag: etag}})
+	assert.Nil(t, err, "CompleteMultipartUpload should not return an error")
+	assert.Equal(t, "object-etag-1", etag)
+
+	// Assert that the expectations were met
+	mockS3Client.AssertExpectations(t)
 }
@@ -0,0 +1,480 @@
+package cloud
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/log"
+	localstore "github.com/zhangjinpeng87/openbms/pkg/datamanagement/local"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultPartSize is the default part size of multipart uploads.
+	// S3 requires every part except the last one to be at least 5MiB.
+	DefaultPartSize = 8 << 20
+	// DefaultRetryInterval is the default interval to retry failed uploads.
+	DefaultRetryInterval = 5 * time.Second
+	// DefaultMaxRetryInterval is the default max interval to retry failed uploads.
+	DefaultMaxRetryInterval = 5 * time.Minute
+
+	// encodedSuffix is appended to the path of a snapshot file to get the
+	// path of its compressed or encrypted object file.
+	encodedSuffix = ".obj"
+)
+
+// errChecksumMismatch is returned when the local snapshot file doesn't match its manifest.
+var errChecksumMismatch = errors.New("snapshot file checksum mismatch")
+
+// UploaderConfig is the snapshot uploader configuration.
+type UploaderConfig struct {
+	// JournalDir is the directory of the upload journal.
+	JournalDir string
+	// Stations is the stations to snapshot and upload.
+	Stations []int
+	// Format is the snapshot file format, "csv" or "parquet".
+	Format string
+	// SnapshotInterval is the interval to generate snapshots.
+	SnapshotInterval time.Duration
+	// MultipartThreshold is the file size above which multipart upload is used.
+	MultipartThreshold int64
+	// PartSize is the part size of multipart uploads.
+	PartSize int64
+	// RetryInterval is the initial interval to retry failed uploads,
+	// it doubles after each failure up to MaxRetryInterval.
+	RetryInterval time.Duration
+	// MaxRetryInterval is the max interval to retry failed uploads.
+	MaxRetryInterval time.Duration
+	// Encoding compresses and encrypts snapshot files before upload,
+	// nil uploads them as is.
+	Encoding *snapshot.EncodeOptions
+}
+
+// SnapshotSource generates snapshot files, it is implemented by localstore.LocalStore.
+type SnapshotSource interface {
+	GenerateSnapshotFile(station int, format string) (*snapshot.Manifest, error)
+}
+
+// Uploader periodically snapshots the local store and uploads the snapshot
+// files together with their manifests to the object store in background.
+//
+// The upload progress of every snapshot is recorded in a local journal, so
+// the upload is resumed after a crash or a long connectivity loss, and a
+// local snapshot file is removed only after both the file and its manifest
+// are confirmed in the object store.
+type Uploader struct {
+	cfg     *UploaderConfig
+	source  SnapshotSource
+	store   ObjectStore
+	journal *Journal
+	// opaqueETags is set if the store verifies the content itself and its
+	// etags are not md5s, see contentVerifier.
+	opaqueETags bool
+
+	// pending entries in snapshot creation order
+	pending []*JournalEntry
+}
+
+// NewUploader creates a new snapshot uploader.
+func NewUploader(cfg *UploaderConfig, source SnapshotSource, store ObjectStore) (*Uploader, error) {
+	journal, err := OpenJournal(cfg.JournalDir)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.MultipartThreshold <= 0 {
+		cfg.MultipartThreshold = cfg.PartSize
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.MaxRetryInterval < cfg.RetryInterval {
+		cfg.MaxRetryInterval = DefaultMaxRetryInterval
+	}
+	_, opaqueETags := store.(contentVerifier)
+	return &Uploader{
+		cfg:         cfg,
+		source:      source,
+		store:       store,
+		journal:     journal,
+		opaqueETags: opaqueETags,
+	}, nil
+}
+
+// Recover loads unfinished uploads from the journal.
+func (u *Uploader) Recover() error {
+	entries, err := u.journal.Load()
+	if err != nil {
+		return err
+	}
+
+	u.pending = u.pending[:0]
+	for _, e := range entries {
+		if e.State == uploadCorrupted {
+			continue
+		}
+		u.pending = append(u.pending, e)
+	}
+	if len(u.pending) > 0 {
+		log.Info("recovered pending snapshot uploads", zap.Int("count", len(u.pending)))
+	}
+	return nil
+}
+
+// Run recovers unfinished uploads, then snapshots all configured stations
+// every SnapshotInterval and uploads them until ctx is done. Failed uploads
+// are retried with exponential backoff.
+func (u *Uploader) Run(ctx context.Context) error {
+	if err := u.Recover(); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(u.cfg.SnapshotInterval)
+	defer ticker.Stop()
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	backoff := u.cfg.RetryInterval
+	nextRetry := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			for _, station := range u.cfg.Stations {
+				if err := u.Snapshot(station); err != nil {
+					log.Warn("failed to snapshot station", zap.Int("station", station), zap.Error(err))
+				}
+			}
+		case <-retry.C:
+		}
+
+		// Still backing off, wait for the retry timer.
+		if time.Now().Before(nextRetry) {
+			continue
+		}
+		if err := u.Flush(); err != nil {
+			log.Warn("failed to upload snapshots, will retry",
+				zap.Int("pending", len(u.pending)), zap.Duration("backoff", backoff), zap.Error(err))
+			nextRetry = time.Now().Add(backoff)
+			retry.Reset(backoff)
+			backoff *= 2
+			if backoff > u.cfg.MaxRetryInterval {
+				backoff = u.cfg.MaxRetryInterval
+			}
+			continue
+		}
+		backoff = u.cfg.RetryInterval
+	}
+}
+
+// Snapshot generates a snapshot file for the station and queues it for upload.
+func (u *Uploader) Snapshot(station int) error {
+	manifest, err := u.source.GenerateSnapshotFile(station, u.cfg.Format)
+	if errors.Is(err, localstore.ErrEmptySnapshot) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	e := &JournalEntry{
+		ID:        strconv.Itoa(manifest.Station) + "-" + strconv.FormatInt(manifest.CreatedAt, 10),
+		Key:       manifest.Key(),
+		LocalPath: manifest.LocalPath,
+		Manifest:  manifest,
+		State:     uploadPending,
+	}
+	if err := u.journal.Save(e); err != nil {
+		return err
+	}
+	u.pending = append(u.pending, e)
+	return nil
+}
+
+// Pending returns the number of snapshots waiting for upload.
+func (u *Uploader) Pending() int {
+	return len(u.pending)
+}
+
+// Flush uploads all pending snapshots in order. It stops at the first
+// failure and returns it, the failed snapshot and all after it stay pending.
+func (u *Uploader) Flush() error {
+	for len(u.pending) > 0 {
+		e := u.pending[0]
+		err := u.process(e)
+		if errors.Is(err, errChecksumMismatch) {
+			// Retrying won't help, keep the file for inspection and move on.
+			log.Error("snapshot file is corrupted, skip uploading it",
+				zap.String("file", e.LocalPath), zap.Error(err))
+			e.State = uploadCorrupted
+			if err := u.journal.Save(e); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return fmt.Errorf("failed to upload snapshot %s: %w", e.Key, err)
+		}
+		u.pending = u.pending[1:]
+	}
+	return nil
+}
+
+// process drives a journal entry to the end, every step is idempotent so it
+// is safe to run it again after a crash at any point.
+func (u *Uploader) process(e *JournalEntry) error {
+	if e.State == uploadPending {
+		e.Attempts++
+		err := u.encodeFile(e)
+		if err == nil {
+			err = u.uploadFile(e)
+		}
+		if err != nil {
+			// persist the attempts and multipart progress
+			if serr := u.journal.Save(e); serr != nil {
+				log.Warn("failed to save upload journal", zap.String("key", e.Key), zap.Error(serr))
+			}
+			return err
+		}
+		e.State = uploadUploaded
+		e.UploadID, e.Parts = "", nil
+		if err := u.journal.Save(e); err != nil {
+			return err
+		}
+	}
+
+	if e.State == uploadUploaded {
+		// Confirm the object really landed before we drop the local copy.
+		info, err := u.store.HeadObject(e.Key)
+		if err != nil {
+			return err
+		}
+		if info.Size != e.Manifest.ObjectSize() || info.ETag != e.ETag {
+			// The object is not what we uploaded, upload it again.
+			e.State = uploadPending
+			if err := u.journal.Save(e); err != nil {
+				return err
+			}
+			return fmt.Errorf("uploaded object mismatch, size %d etag %s, expect size %d etag %s",
+				info.Size, info.ETag, e.Manifest.ObjectSize(), e.ETag)
+		}
+
+		data, err := e.Manifest.Marshal()
+		if err != nil {
+			return fmt.Errorf("failed to encode manifest: %w", err)
+		}
+		etag, err := u.store.PutObject(e.Manifest.ManifestKey(), bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if sum := md5.Sum(data); !u.opaqueETags && etag != hex.EncodeToString(sum[:]) {
+			return fmt.Errorf("manifest etag mismatch, got %s", etag)
+		}
+
+		e.State = uploadCommitted
+		if err := u.journal.Save(e); err != nil {
+			return err
+		}
+	}
+
+	if e.State == uploadCommitted {
+		for _, path := range []string{e.LocalPath, e.ObjectPath} {
+			if path == "" {
+				continue
+			}
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove local snapshot file: %w", err)
+			}
+		}
+		if err := u.journal.Remove(e.ID); err != nil {
+			return err
+		}
+		log.Debug("snapshot uploaded", zap.String("key", e.Key), zap.Int("attempts", e.Attempts))
+	}
+	return nil
+}
+
+// encodeFile compresses and encrypts the snapshot file into an object file
+// next to it. It is done once per snapshot and recorded in the journal, so a
+// resumed upload sends exactly the same bytes.
+func (u *Uploader) encodeFile(e *JournalEntry) error {
+	if !u.cfg.Encoding.Enabled() || e.ObjectPath != "" {
+		return nil
+	}
+
+	file, err := os.Open(e.LocalPath)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	objectPath := e.LocalPath + encodedSuffix
+	tmp := objectPath + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create object file: %w", err)
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	// Verify the local file while encoding it, never upload a corrupted snapshot.
+	manifest := *e.Manifest
+	crc, size := crc32.NewIEEE(), new(sizeWriter)
+	objectCrc, objectSize := crc32.NewIEEE(), new(sizeWriter)
+	err = snapshot.Encode(io.MultiWriter(out, objectCrc, objectSize),
+		io.TeeReader(file, io.MultiWriter(crc, size)), &manifest, u.cfg.Encoding)
+	if err != nil {
+		return err
+	}
+	if int64(*size) != manifest.Size || crc.Sum32() != manifest.Checksum {
+		return fmt.Errorf("%w: size %d crc32 %d, expect size %d crc32 %d",
+			errChecksumMismatch, *size, crc.Sum32(), manifest.Size, manifest.Checksum)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("failed to sync object file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("failed to close object file: %w", err)
+	}
+	if err := os.Rename(tmp, objectPath); err != nil {
+		return fmt.Errorf("failed to rename object file: %w", err)
+	}
+
+	manifest.EncodedSize, manifest.EncodedChecksum = int64(*objectSize), objectCrc.Sum32()
+	e.Manifest, e.ObjectPath = &manifest, objectPath
+	e.Key = manifest.ObjectKey()
+	return u.journal.Save(e)
+}
+
+// uploadFile uploads the snapshot file, in a single request if it is small,
+// otherwise in a multipart upload which is resumed from the journal.
+func (u *Uploader) uploadFile(e *JournalEntry) error {
+	path := e.LocalPath
+	if e.ObjectPath != "" {
+		path = e.ObjectPath
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	// Verify the local file first, never upload a corrupted snapshot.
+	crc, digest := crc32.NewIEEE(), md5.New()
+	size, err := io.Copy(io.MultiWriter(crc, digest), file)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot file: %w", err)
+	}
+	if size != e.Manifest.ObjectSize() || crc.Sum32() != e.Manifest.ObjectChecksum() {
+		return fmt.Errorf("%w: size %d crc32 %d, expect size %d crc32 %d",
+			errChecksumMismatch, size, crc.Sum32(), e.Manifest.ObjectSize(), e.Manifest.ObjectChecksum())
+	}
+
+	if size <= u.cfg.MultipartThreshold {
+		expected := hex.EncodeToString(digest.Sum(nil))
+		etag, err := u.store.PutObject(e.Key, io.NewSectionReader(file, 0, size))
+		if err != nil {
+			return err
+		}
+		if !u.opaqueETags && etag != expected {
+			return fmt.Errorf("etag mismatch, got %s, expect %s", etag, expected)
+		}
+		e.ETag = etag
+		return nil
+	}
+
+	return u.uploadMultipart(e, file, size)
+}
+
+func (u *Uploader) uploadMultipart(e *JournalEntry, file *os.File, size int64) error {
+	if e.UploadID == "" {
+		uploadID, err := u.store.CreateMultipartUpload(e.Key)
+		if err != nil {
+			return err
+		}
+		e.UploadID, e.Parts = uploadID, nil
+		if err := u.journal.Save(e); err != nil {
+			return err
+		}
+	}
+
+	partCnt := (size + u.cfg.PartSize - 1) / u.cfg.PartSize
+	// the multipart etag is the md5 of all part md5s, suffixed by the part count
+	partDigests := md5.New()
+	for number := int64(1); number <= partCnt; number++ {
+		offset := (number - 1) * u.cfg.PartSize
+		length := u.cfg.PartSize
+		if offset+length > size {
+			length = size - offset
+		}
+		section := io.NewSectionReader(file, offset, length)
+		digest := md5.New()
+		if _, err := io.Copy(digest, section); err != nil {
+			return fmt.Errorf("failed to read snapshot file: %w", err)
+		}
+		sum := digest.Sum(nil)
+		partDigests.Write(sum)
+
+		// skip the parts uploaded before the crash
+		if int(number) <= len(e.Parts) && e.Parts[number-1].MD5 == hex.EncodeToString(sum) {
+			continue
+		}
+		e.Parts = e.Parts[:number-1]
+
+		etag, err := u.store.UploadPart(e.Key, e.UploadID, number, io.NewSectionReader(file, offset, length))
+		if errors.Is(err, ErrNoSuchUpload) {
+			// the upload is gone, start over next time
+			e.UploadID, e.Parts = "", nil
+		}
+		if err != nil {
+			return err
+		}
+		if !u.opaqueETags && etag != hex.EncodeToString(sum) {
+			return fmt.Errorf("part %d etag mismatch, got %s, expect %s", number, etag, hex.EncodeToString(sum))
+		}
+		e.Parts = append(e.Parts, CompletedPart{Number: number, ETag: etag, MD5: hex.EncodeToString(sum), Size: length})
+		if err := u.journal.Save(e); err != nil {
+			return err
+		}
+	}
+
+	expected := fmt.Sprintf("%s-%d", hex.EncodeToString(partDigests.Sum(nil)), partCnt)
+	etag, err := u.store.CompleteMultipartUpload(e.Key, e.UploadID, e.Parts)
+	if errors.Is(err, ErrNoSuchUpload) {
+		// We may have crashed right after the upload was completed last time,
+		// an opaque etag can only be checked by the size.
+		if info, herr := u.store.HeadObject(e.Key); herr == nil && info.Size == size &&
+			(u.opaqueETags || info.ETag == expected) {
+			e.ETag = info.ETag
+			return nil
+		}
+		e.UploadID, e.Parts = "", nil
+	}
+	if err != nil {
+		return err
+	}
+	if !u.opaqueETags && etag != expected {
+		return fmt.Errorf("etag mismatch, got %s, expect %s", etag, expected)
+	}
+	e.ETag = etag
+	return nil
+}
+
+// sizeWriter counts the bytes written to it.
+type sizeWriter int64
+
+func (w *sizeWriter) Write(p []byte) (int, error) {
+	*w += sizeWriter(len(p))
+	return len(p), nil
+}
@@ -0,0 +1,410 @@
+package cloud
+
+import (
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
+)
+
+var errOffline = errors.New("network is unreachable")
+
+// flakyStore wraps the in-memory object store and simulates connectivity loss.
+type flakyStore struct {
+	*memoryStore
+
+	// failAfter makes the store fail after that many successful calls, -1 means never.
+	failAfter   int
+	uploadCalls int
+	uploadCnt   int
+}
+
+func newFlakyStore() *flakyStore {
+	return &flakyStore{
+		memoryStore: NewMemoryStore().(*memoryStore),
+		failAfter:   -1,
+	}
+}
+
+func (f *flakyStore) call() error {
+	if f.failAfter == 0 {
+		return errOffline
+	}
+	if f.failAfter > 0 {
+		f.failAfter--
+	}
+	return nil
+}
+
+// object returns the content of the object key, nil if it doesn't exist.
+func (f *flakyStore) object(key string) []byte {
+	if obj, ok := f.objects[key]; ok {
+		return obj.data
+	}
+	return nil
+}
+
+func (f *flakyStore) PutObject(key string, body io.ReadSeeker) (string, error) {
+	if err := f.call(); err != nil {
+		return "", err
+	}
+	return f.memoryStore.PutObject(key, body)
+}
+
+func (f *flakyStore) CreateMultipartUpload(key string) (string, error) {
+	if err := f.call(); err != nil {
+		return "", err
+	}
+	f.uploadCnt++
+	return f.memoryStore.CreateMultipartUpload(key)
+}
+
+func (f *flakyStore) UploadPart(key, uploadID string, partNumber int64, body io.ReadSeeker) (string, error) {
+	if err := f.call(); err != nil {
+		return "", err
+	}
+	etag, err := f.memoryStore.UploadPart(key, uploadID, partNumber, body)
+	if err == nil {
+		f.uploadCalls++
+	}
+	return etag, err
+}
+
+func (f *flakyStore) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) (string, error) {
+	if err := f.call(); err != nil {
+		return "", err
+	}
+	return f.memoryStore.CompleteMultipartUpload(key, uploadID, parts)
+}
+
+func (f *flakyStore) HeadObject(key string) (*ObjectInfo, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return f.memoryStore.HeadObject(key)
+}
+
+func (f *flakyStore) List(prefix string) ([]*ObjectInfo, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return f.memoryStore.List(prefix)
+}
+
+func (f *flakyStore) GetObject(key string) (io.ReadCloser, error) {
+	if err := f.call(); err != nil {
+		return nil, err
+	}
+	return f.memoryStore.GetObject(key)
+}
+
+// kmsStore is a store whose etags are not the md5 of the content, like S3
+// with SSE-KMS, it verifies the content itself.
+type kmsStore struct {
+	*flakyStore
+}
+
+// opaque turns an md5 etag into an opaque one and back.
+func opaque(etag string) string {
+	b := []byte(etag)
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return string(b)
+}
+
+func (k *kmsStore) verifiesContentMD5() {}
+
+func (k *kmsStore) PutObject(key string, body io.ReadSeeker) (string, error) {
+	etag, err := k.flakyStore.PutObject(key, body)
+	return opaque(etag), err
+}
+
+func (k *kmsStore) UploadPart(key, uploadID string, partNumber int64, body io.ReadSeeker) (string, error) {
+	etag, err := k.flakyStore.UploadPart(key, uploadID, partNumber, body)
+	return opaque(etag), err
+}
+
+func (k *kmsStore) CompleteMultipartUpload(key, uploadID string, parts []CompletedPart) (string, error) {
+	plain := make([]CompletedPart, len(parts))
+	for i, part := range parts {
+		plain[i] = part
+		plain[i].ETag = opaque(part.ETag)
+	}
+	etag, err := k.flakyStore.CompleteMultipartUpload(key, uploadID, plain)
+	return opaque(etag), err
+}
+
+func (k *kmsStore) HeadObject(key string) (*ObjectInfo, error) {
+	info, err := k.flakyStore.HeadObject(key)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectInfo{Key: info.Key, ETag: opaque(info.ETag), Size: info.Size}, nil
+}
+
+// fakeSource generates snapshot files with the given content.
+type fakeSource struct {
+	dir     string
+	content []byte
+	seq     int64
+}
+
+func (f *fakeSource) GenerateSnapshotFile(station int, format string) (*snapshot.Manifest, error) {
+	f.seq++
+	m := &snapshot.Manifest{
+		Station:   station,
+		Format:    format,
+		CreatedAt: 1700000000 + f.seq,
+		Size:      int64(len(f.content)),
+		Checksum:  crc32.ChecksumIEEE(f.content),
+		// csv snapshots have a header line
+		RowCount: bytes.Count(f.content, []byte("\n")) - 1,
+	}
+	m.LocalPath = filepath.Join(f.dir, filepath.FromSlash(m.Key()))
+	m.FileName = filepath.Base(m.LocalPath)
+	if err := os.MkdirAll(filepath.Dir(m.LocalPath), 0755); err != nil {
+		return nil, err
+	}
+	return m, os.WriteFile(m.LocalPath, f.content, 0644)
+}
+
+func newTestUploader(t *testing.T, journalDir string, source SnapshotSource, store ObjectStore) *Uploader {
+	u, err := NewUploader(&UploaderConfig{
+		JournalDir:         journalDir,
+		Stations:           []int{1},
+		Format:             "csv",
+		MultipartThreshold: 16,
+		PartSize:           16,
+	}, source, store)
+	require.NoError(t, err)
+	require.NoError(t, u.Recover())
+	return u
+}
+
+func TestUploaderSinglePut(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: []byte("small snapshot")}
+	u := newTestUploader(t, t.TempDir(), source, store)
+
+	require.NoError(t, u.Snapshot(1))
+	require.NoError(t, u.Flush())
+	assert.Equal(t, 0, u.Pending())
+
+	key := snapshot.FilePath(1, 1700000001, "csv")
+	assert.Equal(t, source.content, store.object(key))
+	manifest, err := snapshot.UnmarshalManifest(store.object(snapshot.ManifestKey(key)))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(source.content)), manifest.Size)
+
+	// the local file is removed after the upload is confirmed
+	_, err = os.Stat(filepath.Join(source.dir, filepath.FromSlash(key)))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestUploaderResumeMultipart(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: bytes.Repeat([]byte("0123456789"), 10)}
+	journalDir := t.TempDir()
+	u := newTestUploader(t, journalDir, source, store)
+	require.NoError(t, u.Snapshot(1))
+
+	// lose connectivity after creating the upload and 3 parts
+	store.failAfter = 4
+	require.ErrorIs(t, u.Flush(), errOffline)
+	assert.Equal(t, 1, u.Pending())
+	assert.Equal(t, 3, store.uploadCalls)
+
+	// the local file must be kept until the upload is confirmed
+	key := snapshot.FilePath(1, 1700000001, "csv")
+	localPath := filepath.Join(source.dir, filepath.FromSlash(key))
+	_, err := os.Stat(localPath)
+	require.NoError(t, err)
+
+	// restart, the upload is resumed from the journal
+	store.failAfter = -1
+	u = newTestUploader(t, journalDir, source, store)
+	assert.Equal(t, 1, u.Pending())
+	require.NoError(t, u.Flush())
+
+	// 100 bytes in 16 bytes parts, only the missing 4 parts are uploaded again
+	assert.Equal(t, 7, store.uploadCalls)
+	assert.Equal(t, 1, store.uploadCnt)
+	assert.Equal(t, source.content, store.object(key))
+	_, err = os.Stat(localPath)
+	assert.True(t, os.IsNotExist(err))
+
+	entries, err := u.journal.Load()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestJournalBrokenEntry(t *testing.T) {
+	dir := t.TempDir()
+	journal, err := OpenJournal(dir)
+	require.NoError(t, err)
+	require.NoError(t, journal.Save(&JournalEntry{ID: "good", Manifest: &snapshot.Manifest{}, State: uploadPending}))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "torn"+journalSuffix), []byte(`{"id":"torn","ke`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "stale"+journalSuffix), []byte(`{"id":"stale"}`), 0644))
+
+	// broken entries are moved aside once, the rest still loads
+	for i := 0; i < 2; i++ {
+		entries, err := journal.Load()
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "good", entries[0].ID)
+	}
+	for _, id := range []string{"torn", "stale"} {
+		_, err := os.Stat(filepath.Join(dir, id+journalSuffix+brokenSuffix))
+		assert.NoError(t, err)
+		_, err = os.Stat(filepath.Join(dir, id+journalSuffix))
+		assert.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestUploaderOpaqueETags(t *testing.T) {
+	store := &kmsStore{newFlakyStore()}
+	source := &fakeSource{dir: t.TempDir(), content: bytes.Repeat([]byte("0123456789"), 10)}
+	journalDir := t.TempDir()
+	u := newTestUploader(t, journalDir, source, store)
+	require.NoError(t, u.Snapshot(1))
+	require.NoError(t, u.Snapshot(1))
+
+	store.failAfter = 4
+	require.ErrorIs(t, u.Flush(), errOffline)
+	store.failAfter = -1
+	u = newTestUploader(t, journalDir, source, store)
+	require.NoError(t, u.Flush())
+	assert.Equal(t, 0, u.Pending())
+
+	// the parts uploaded before the crash are skipped by their md5
+	assert.Equal(t, 14, store.uploadCalls)
+	for _, key := range []string{snapshot.FilePath(1, 1700000001, "csv"), snapshot.FilePath(1, 1700000002, "csv")} {
+		assert.Equal(t, source.content, store.object(key))
+		assert.NotNil(t, store.object(snapshot.ManifestKey(key)))
+	}
+}
+
+func TestUploaderRestartExpiredUpload(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: bytes.Repeat([]byte("a"), 40)}
+	u := newTestUploader(t, t.TempDir(), source, store)
+	require.NoError(t, u.Snapshot(1))
+
+	store.failAfter = 2
+	require.Error(t, u.Flush())
+
+	// the bucket lifecycle rules expire the upload while the site is offline
+	store.uploads = make(map[string]*memoryUpload)
+	store.failAfter = -1
+	require.ErrorIs(t, u.Flush(), ErrNoSuchUpload)
+	require.NoError(t, u.Flush())
+	assert.Equal(t, 2, store.uploadCnt)
+	assert.Equal(t, source.content, store.object(snapshot.FilePath(1, 1700000001, "csv")))
+}
+
+func TestUploaderCorruptedFile(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: []byte("snapshot")}
+	u := newTestUploader(t, t.TempDir(), source, store)
+	require.NoError(t, u.Snapshot(1))
+	require.NoError(t, u.Snapshot(1))
+
+	// corrupt the first snapshot file on disk
+	corrupted := filepath.Join(source.dir, filepath.FromSlash(snapshot.FilePath(1, 1700000001, "csv")))
+	require.NoError(t, os.WriteFile(corrupted, []byte("SNAPSHOT"), 0644))
+
+	require.NoError(t, u.Flush())
+	assert.Nil(t, store.object(snapshot.FilePath(1, 1700000001, "csv")))
+	assert.NotNil(t, store.object(snapshot.FilePath(1, 1700000002, "csv")))
+
+	// the corrupted file is kept for inspection
+	_, err := os.Stat(corrupted)
+	assert.NoError(t, err)
+}
+
+func TestListSnapshots(t *testing.T) {
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: []byte("snapshot")}
+	u := newTestUploader(t, t.TempDir(), source, store)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, u.Snapshot(1))
+	}
+	require.NoError(t, u.Flush())
+
+	refs, err := ListSnapshots(store, 1, time.Unix(1700000002, 0), time.Unix(1700000003, 0))
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	assert.Equal(t, int64(1700000002), refs[0].CreatedAt)
+	assert.Equal(t, int64(1700000003), refs[1].CreatedAt)
+
+	refs, err = ListSnapshots(store, 2, time.Unix(1700000000, 0), time.Unix(1700000003, 0))
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+}
+
+func TestUploaderEncrypted(t *testing.T) {
+	kek := bytes.Repeat([]byte{7}, 32)
+	keys, err := snapshot.NewAESKeyWrapper("kek-1", kek)
+	require.NoError(t, err)
+
+	store := newFlakyStore()
+	source := &fakeSource{dir: t.TempDir(), content: bytes.Repeat([]byte("3.700000,25.000000\n"), 20)}
+	journalDir := t.TempDir()
+	u, err := NewUploader(&UploaderConfig{
+		JournalDir:         journalDir,
+		Stations:           []int{1},
+		Format:             "csv",
+		MultipartThreshold: 16,
+		PartSize:           16,
+		Encoding:           &snapshot.EncodeOptions{Compression: snapshot.CompressionGzip, Keys: keys, SegmentSize: 32},
+	}, source, store)
+	require.NoError(t, err)
+	require.NoError(t, u.Snapshot(1))
+
+	// crash in the middle of the multipart upload
+	store.failAfter = 3
+	require.ErrorIs(t, u.Flush(), errOffline)
+	key := snapshot.FilePath(1, 1700000001, "csv")
+	localPath := filepath.Join(source.dir, filepath.FromSlash(key))
+	_, err = os.Stat(localPath + encodedSuffix)
+	require.NoError(t, err)
+
+	// the resumed upload reuses the encoded file, otherwise parts won't match
+	store.failAfter = -1
+	u, err = NewUploader(&UploaderConfig{
+		JournalDir:         journalDir,
+		MultipartThreshold: 16,
+		PartSize:           16,
+		Encoding:           &snapshot.EncodeOptions{Compression: snapshot.CompressionGzip, Keys: keys, SegmentSize: 32},
+	}, source, store)
+	require.NoError(t, err)
+	require.NoError(t, u.Recover())
+	require.NoError(t, u.Flush())
+	assert.Equal(t, 1, store.uploadCnt)
+
+	// both local files are removed, the object is neither plain nor the same size
+	for _, path := range []string{localPath, localPath + encodedSuffix} {
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	}
+	// the object key tells the encoding, the manifest is out of the partitions
+	assert.Nil(t, store.object(key))
+	object := store.object(key + ".gz.enc")
+	assert.NotContains(t, string(object), "3.700000")
+	manifest, err := snapshot.UnmarshalManifest(store.object(snapshot.ManifestKey(key)))
+	require.NoError(t, err)
+	assert.Equal(t, snapshot.CompressionGzip, manifest.Compression)
+	require.NotNil(t, manifest.Encryption)
+	assert.Equal(t, "kek-1", manifest.Encryption.KeyID)
+	assert.Equal(t, int64(len(object)), manifest.EncodedSize)
+	assert.Equal(t, int64(len(source.content)), manifest.Size)
+}
@@ -1,9 +1,13 @@
 package data_model
 
 import (
+	"math"
+	"sort"
 	"sync"
+	"time"
 
 	"github.com/zhangjinpeng87/openbms/pkg/batterymanagement/state_of_charge/soc"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
 	"github.com/zhangjinpeng87/openbms/pkg/utils"
 )
 
@@ -15,6 +19,22 @@ const (
 	Discharging
 )
 
+// IdleCurrent is the max absolute current in amps of an idle cell.
+const IdleCurrent = 0.05
+
+// StateOf derives the state of a cell from its current, a positive current
+// charges the cell.
+func StateOf(current float64) State {
+	switch {
+	case current > IdleCurrent:
+		return Charging
+	case current < -IdleCurrent:
+		return Discharging
+	default:
+		return Idle
+	}
+}
+
 func (s State) String() string {
 	switch s {
 	case Idle:
@@ -43,7 +63,7 @@ type BatteryState struct {
 	Voltage float64 `json:"voltage"`
 	// Current is the battery current in amps.
 	Current float64 `json:"current"`
-	// SOC is the estimated state of charge of the battery.
+	// SOC is the estimated state of charge of the battery in percent.
 	SOC float64 `json:"soc"`
 	// SOH is the estimated state of health of the battery.
 	SOH float64 `json:"soh"`
@@ -55,6 +75,14 @@ type BatteryState struct {
 	Timestamp int64 `json:"timestamp"`
 	// State is the state of the battery.
 	State State `json:"state"`
+	// Seq is the sequence number of the reading of the cell assigned by the
+	// gateway, 0 if the gateway doesn't number readings.
+	Seq uint64 `json:"seq,omitempty"`
+	// Gateway is the id of the gateway which reported the reading, set by
+	// the adapter which received it: the id of the authenticated gateway,
+	// "modbus:<device>" or "can:<interface>", empty if unknown. A value sent
+	// by a client is never trusted.
+	Gateway string `json:"gateway,omitempty"`
 }
 
 const (
@@ -62,73 +90,138 @@ const (
 )
 
 type PackData struct {
-	// Accumulated data of all cells in the pack
+	// Accumulated data of all cells in the pack, cells with a faulty
+	// voltage sensor are excluded from the capacity
 	maxCapacity     float64
 	currentCapacity float64
+	unhealthyCells  int
 
 	// cell id -> cell Data
-	cellData map[int]*datamodel.BatteryState
+	cellData map[int]*BatteryState
+	// cell id -> order of the readings of the cell
+	cellWindow map[int]*cellWindow
+	// cell id -> health of the sensors of the cell
+	cellHealth map[int]*cellHealth
+	opts       *options
 
 	// cell id -> cell voltage kalman filter
-	cellKalmanV map[int]*utils.KalmanFilter
+	cellKalmanV map[int]utils.Filter
 	// cell id -> cell current kalman filter
-	cellKalmanC map[int]*utils.KalmanFilter
+	cellKalmanC map[int]utils.Filter
 	// cell id -> cell temperature kalman filter
-	cellKalmanT map[int]*utils.KalmanFilter
+	cellKalmanT map[int]utils.Filter
 
 	// soc calculator
-	dischargeSOCCalc *soc.DischargeSOCCalculator
-	chargeSOCCalc    *soc.ChargeSOCCalculator
+	dischargeSOCCalc *soc.DischargeCalculater
+	chargeSOCCalc    *soc.ChargeCalculater
 }
 
 func NewPackData() *PackData {
 	return &PackData{
-		cellData:         make(map[int]*datamodel.BatteryState),
-		dischargeSOCCalc: soc.NewDefaultDischargeSOCCalculator(),
-		chargeSOCCalc:    soc.NewDefaultChargeSOCCalculator(),
+		cellData:         make(map[int]*BatteryState),
+		cellWindow:       make(map[int]*cellWindow),
+		cellHealth:       make(map[int]*cellHealth),
+		opts:             defaultOptions(),
+		cellKalmanV:      make(map[int]utils.Filter),
+		cellKalmanC:      make(map[int]utils.Filter),
+		cellKalmanT:      make(map[int]utils.Filter),
+		dischargeSOCCalc: soc.NewDefaultDischargeCalculater(),
+		chargeSOCCalc:    soc.NewDefaultChargeCalculater(),
 	}
 }
 
-func (p *PackData) Update(state *datamodel.BatteryState) {
-	// Smoonth the data collected by the sensors
+// Update applies the reading to the live state of its cell, duplicate and
+// late readings are not applied, so they don't disturb the filters.
+func (p *PackData) Update(state *BatteryState) UpdateResult {
+	w, ok := p.cellWindow[state.Cell]
+	if !ok {
+		w = &cellWindow{}
+		p.cellWindow[state.Cell] = w
+	}
+	if result := w.observe(state); result != Applied {
+		return result
+	}
+	h, ok := p.cellHealth[state.Cell]
+	if !ok {
+		h = &cellHealth{}
+		p.cellHealth[state.Cell] = h
+	}
+	h.observe(p.opts.health, state, time.Now())
+
+	// Smoonth the data collected by the sensors, a new cell continues from
+	// its restored estimator state if any
 	if _, ok := p.cellKalmanV[state.Cell]; !ok {
-		p.cellKalmanV[state.Cell] = utils.NewKalmanFilter(state.Voltage, 1, 0.01, 0.01)
+		ch := channel{state.Station, state.Container, state.Pack, state.Cell, SensorVoltage}
+		p.cellKalmanV[state.Cell] = p.opts.newFilter(ch, state.Voltage)
+		ch.sensor = SensorCurrent
+		p.cellKalmanC[state.Cell] = p.opts.newFilter(ch, state.Current)
+		ch.sensor = SensorTemperature
+		p.cellKalmanT[state.Cell] = p.opts.newFilter(ch, state.Temperature)
+		p.restore(state)
 	}
 	state.Voltage = p.cellKalmanV[state.Cell].Update(state.Voltage)
-	if _, ok := p.cellKalmanC[state.Cell]; !ok {
-		p.cellKalmanC[state.Cell] = utils.NewKalmanFilter(state.Current, 1, 0.01, 0.01)
-	}
 	state.Current = p.cellKalmanC[state.Cell].Update(state.Current)
-	if _, ok := p.cellKalmanT[state.Cell]; !ok {
-		p.cellKalmanT[state.Cell] = utils.NewKalmanFilter(state.Temperature, 1, 0.01, 0.01)
-	}
 	state.Temperature = p.cellKalmanT[state.Cell].Update(state.Temperature)
 
 	p.cellData[state.Cell] = state
+	return Applied
 }
 
-func (p *PackData) ReCalculate() float64 {
-	maxCapacity, currentCapacity := 0.0, 0.0
-	for _, cellData := range p.cellData {
+func (p *PackData) ReCalculate() {
+	now := time.Now()
+	checkNeighbours(p.cellHealth, p.opts.health, now)
+
+	maxCapacity, currentCapacity, unhealthy := 0.0, 0.0, 0
+	for cell, cellData := range p.cellData {
+		voltage, temperature := p.cellHealth[cell].report(p.opts.health, now)
+		if voltage != 0 || temperature != 0 {
+			unhealthy++
+		}
+		if voltage != 0 {
+			// the soc of a cell with a faulty voltage sensor is unknown
+			continue
+		}
 		maxCapacity += cellData.MaxCapacity
 
-		var socCalc *soc.SOCalculator
-		if cellData.State == datamodel.Charging {
+		var socCalc soc.SocCalculator
+		if cellData.State == Charging {
 			socCalc = p.chargeSOCCalc
 		} else {
 			socCalc = p.dischargeSOCCalc
 		}
-		cellData.SOC = socCalc.Calculate(cellData.Voltage, cellData.Current)
-		currentCapacity += cellData.SOC * cellData.MaxCapacity
+		cellData.SOC = socCalc.SOC(cellData.Voltage, cellData.Current)
+		currentCapacity += cellData.SOC / 100 * cellData.MaxCapacity
 	}
 	p.maxCapacity = maxCapacity
 	p.currentCapacity = currentCapacity
+	p.unhealthyCells = unhealthy
+}
+
+// healthOf returns the health of the cell, the caller must hold the lock
+// of the shard.
+func (p *PackData) healthOf(station, container, pack, cell int, now time.Time) (CellHealth, bool) {
+	h, ok := p.cellHealth[cell]
+	if !ok {
+		return CellHealth{}, false
+	}
+	voltage, temperature := h.report(p.opts.health, now)
+	return CellHealth{
+		Station:     station,
+		Container:   container,
+		Pack:        pack,
+		Cell:        cell,
+		LastReport:  h.lastReport.Unix(),
+		Voltage:     voltage,
+		Temperature: temperature,
+	}, true
 }
 
 type ContainerData struct {
 	// Accumulated data of all packs in the container
 	maxCapacity     float64
 	currentCapacity float64
+	unhealthyCells  int
+	opts            *options
 
 	// pack id -> pack Data
 	packData map[int]*PackData
@@ -137,32 +230,39 @@ type ContainerData struct {
 func NewContainerData() *ContainerData {
 	return &ContainerData{
 		packData: make(map[int]*PackData),
+		opts:     defaultOptions(),
 	}
 }
 
-func (c *ContainerData) Update(state *datamodel.BatteryState) {
+func (c *ContainerData) Update(state *BatteryState) UpdateResult {
 	if _, ok := c.packData[state.Pack]; !ok {
-		c.packData[state.Pack] = NewPackData()
+		p := NewPackData()
+		p.opts = c.opts
+		c.packData[state.Pack] = p
 	}
-	c.packData[state.Pack].Update(state)
+	return c.packData[state.Pack].Update(state)
 }
 
-func (c *ContainerData) ReCalculate() float64 {
-	maxCapacity, currentCapacity := 0.0, 0.0
+func (c *ContainerData) ReCalculate() {
+	maxCapacity, currentCapacity, unhealthy := 0.0, 0.0, 0
 	for _, packData := range c.packData {
 		packData.ReCalculate()
 
 		maxCapacity += packData.maxCapacity
 		currentCapacity += packData.currentCapacity
+		unhealthy += packData.unhealthyCells
 	}
 	c.maxCapacity = maxCapacity
 	c.currentCapacity = currentCapacity
+	c.unhealthyCells = unhealthy
 }
 
 type StationData struct {
 	// Accumulated data of all containers in the station
 	maxCapacity     float64
 	currentCapacity float64
+	unhealthyCells  int
+	opts            *options
 
 	// container id -> container Data
 	containerData map[int]*ContainerData
@@ -171,26 +271,31 @@ type StationData struct {
 func NewStationData() *StationData {
 	return &StationData{
 		containerData: make(map[int]*ContainerData),
+		opts:          defaultOptions(),
 	}
 }
 
-func (s *StationData) Update(state *datamodel.BatteryState) {
+func (s *StationData) Update(state *BatteryState) UpdateResult {
 	if _, ok := s.containerData[state.Container]; !ok {
-		s.containerData[state.Container] = NewContainerData()
+		c := NewContainerData()
+		c.opts = s.opts
+		s.containerData[state.Container] = c
 	}
-	s.containerData[state.Container].Update(state)
+	return s.containerData[state.Container].Update(state)
 }
 
-func (s *StationData) ReCalculate() float64 {
-	maxCapacity, currentCapacity := 0.0, 0.0
+func (s *StationData) ReCalculate() {
+	maxCapacity, currentCapacity, unhealthy := 0.0, 0.0, 0
 	for _, containerData := range s.containerData {
 		containerData.ReCalculate()
 
 		maxCapacity += containerData.maxCapacity
 		currentCapacity += containerData.currentCapacity
+		unhealthy += containerData.unhealthyCells
 	}
 	s.maxCapacity = maxCapacity
 	s.currentCapacity = currentCapacity
+	s.unhealthyCells = unhealthy
 }
 
 type DataShard struct {
@@ -200,41 +305,82 @@ type DataShard struct {
 	// Accumulated data of all stations
 	maxCapacity     float64
 	currentCapacity float64
+	unhealthyCells  int
+	opts            *options
 
 	// station id -> station Data
 	stationData map[int]*StationData
 }
 
 func NewDataShard() *DataShard {
-	return &DataDataShard{
+	return &DataShard{
 		stationData: make(map[int]*StationData),
+		opts:        defaultOptions(),
 	}
 }
 
-func (s *DataShard) Update(state *datamodel.BatteryState) {
+// Update applies the reading, it also returns how many seconds a late
+// reading is behind the live state of its cell.
+func (s *DataShard) Update(state *BatteryState) (UpdateResult, int64) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var live int64
+	if cell := s.cell(state.Station, state.Container, state.Pack, state.Cell); cell != nil {
+		live = cell.Timestamp
+	}
 	if _, ok := s.stationData[state.Station]; !ok {
-		s.stationData[state.Station] = NewStationData()
+		station := NewStationData()
+		station.opts = s.opts
+		s.stationData[state.Station] = station
+	}
+	result := s.stationData[state.Station].Update(state)
+	if result == Late {
+		return result, live - state.Timestamp
+	}
+	return result, 0
+}
+
+// pack returns the data of the pack, nil if unknown, the caller must hold
+// the lock.
+func (s *DataShard) pack(station, container, pack int) *PackData {
+	stationData, ok := s.stationData[station]
+	if !ok {
+		return nil
+	}
+	containerData, ok := stationData.containerData[container]
+	if !ok {
+		return nil
+	}
+	return containerData.packData[pack]
+}
+
+// cell returns the live state of the cell, nil if unknown, the caller must
+// hold the lock.
+func (s *DataShard) cell(station, container, pack, cell int) *BatteryState {
+	packData := s.pack(station, container, pack)
+	if packData == nil {
+		return nil
 	}
-	s.stationData[state.Station].Update(state)
+	return packData.cellData[cell]
 }
 
 func (s *DataShard) ReCalculate() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	maxCapacity, currentCapacity := 0.0, 0.0
+	maxCapacity, currentCapacity, unhealthy := 0.0, 0.0, 0
 	for _, stationData := range s.stationData {
 		stationData.ReCalculate()
 
 		maxCapacity += stationData.maxCapacity
 		currentCapacity += stationData.currentCapacity
+		unhealthy += stationData.unhealthyCells
 	}
 
 	s.maxCapacity = maxCapacity
 	s.currentCapacity = currentCapacity
+	s.unhealthyCells = unhealthy
 }
 
 type BatteriesData struct {
@@ -244,26 +390,192 @@ type BatteriesData struct {
 	// Accumulated data of all shards
 	maxCapacity     float64
 	currentCapacity float64
+	unhealthyCells  int
+
+	stats gatewayStats
+	opts  *options
 }
 
 func NewBatteriesData(shardCnt int) *BatteriesData {
+	opts := defaultOptions()
 	shards := make([]*DataShard, shardCnt)
 	for i := 0; i < shardCnt; i++ {
 		shards[i] = NewDataShard()
+		shards[i].opts = opts
 	}
 	return &BatteriesData{
 		shardCnt: shardCnt,
 		shards:   shards,
+		opts:     opts,
 	}
 }
 
-func (s *BatteriesData) Update(state *datamodel.BatteryState) {
+// Update applies the reading to the live state of its cell. Exact
+// duplicates of recent readings are dropped, and readings older than the
+// live state are not applied, the result is counted in the stats of the
+// reporting gateway.
+func (s *BatteriesData) Update(state *BatteryState) UpdateResult {
 	shard := s.shards[state.Station%s.shardCnt]
-	shard.Update(state)
+	result, lateness := shard.Update(state)
+	s.stats.record(state.Gateway, result, lateness)
+	return result
+}
+
+// GatewayStats returns the reorder stats by gateway, readings without a
+// gateway are counted under "".
+func (s *BatteriesData) GatewayStats() map[string]ReorderStats {
+	return s.stats.snapshot()
+}
+
+// SetHealthConfig sets the sensor health detection, it must be called
+// before any update.
+func (s *BatteriesData) SetHealthConfig(cfg *config.HealthConfig) {
+	s.opts.health = withHealthDefaults(cfg)
 }
 
 func (s *BatteriesData) ReCalculate() {
+	maxCapacity, currentCapacity, unhealthy := 0.0, 0.0, 0
 	for _, shard := range s.shards {
 		shard.ReCalculate()
+
+		shard.mu.RLock()
+		maxCapacity += shard.maxCapacity
+		currentCapacity += shard.currentCapacity
+		unhealthy += shard.unhealthyCells
+		shard.mu.RUnlock()
+	}
+	s.maxCapacity = maxCapacity
+	s.currentCapacity = currentCapacity
+	s.unhealthyCells = unhealthy
+}
+
+// CellHealth returns the health of the sensors of the cell.
+func (s *BatteriesData) CellHealth(station, container, pack, cell int) (CellHealth, bool) {
+	shard := s.shards[station%s.shardCnt]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	packData := shard.pack(station, container, pack)
+	if packData == nil {
+		return CellHealth{}, false
+	}
+	return packData.healthOf(station, container, pack, cell, time.Now())
+}
+
+// UnhealthyCells returns the health of all cells with a faulty sensor,
+// ordered by their ids. Neighbour disagreements are as of the last
+// ReCalculate.
+func (s *BatteriesData) UnhealthyCells() []CellHealth {
+	now := time.Now()
+	var cells []CellHealth
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for station, stationData := range shard.stationData {
+			for container, containerData := range stationData.containerData {
+				for pack, packData := range containerData.packData {
+					for cell := range packData.cellHealth {
+						if h, _ := packData.healthOf(station, container, pack, cell, now); !h.Healthy() {
+							cells = append(cells, h)
+						}
+					}
+				}
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		a, b := cells[i], cells[j]
+		if a.Station != b.Station {
+			return a.Station < b.Station
+		}
+		if a.Container != b.Container {
+			return a.Container < b.Container
+		}
+		if a.Pack != b.Pack {
+			return a.Pack < b.Pack
+		}
+		return a.Cell < b.Cell
+	})
+	return cells
+}
+
+// GetCell returns a copy of the latest state of the cell.
+func (s *BatteriesData) GetCell(station, container, pack, cell int) (BatteryState, bool) {
+	shard := s.shards[station%s.shardCnt]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	state := shard.cell(station, container, pack, cell)
+	if state == nil {
+		return BatteryState{}, false
+	}
+	return *state, true
+}
+
+// StationSummary is the accumulated state of a station as of the last
+// ReCalculate.
+type StationSummary struct {
+	// MaxCapacity and CurrentCapacity are the capacities of the healthy
+	// cells in ampere hours.
+	MaxCapacity     float64 `json:"max_capacity"`
+	CurrentCapacity float64 `json:"current_capacity"`
+	// SOH is the capacity weighted state of health of the cells reporting
+	// it, 0 if none does.
+	SOH float64 `json:"soh"`
+	// MaxTemperature is the max temperature of the cells with a healthy
+	// temperature sensor, TemperatureSensors the number of those cells.
+	// MaxTemperature is unknown and 0 if there is none, so a caller limiting
+	// the power by the temperature must check TemperatureSensors first.
+	MaxTemperature     float64 `json:"max_temperature"`
+	TemperatureSensors int     `json:"temperature_sensors"`
+	UnhealthyCells     int     `json:"unhealthy_cells"`
+}
+
+// SOC returns the state of charge of the station in percent.
+func (s *StationSummary) SOC() float64 {
+	if s.MaxCapacity == 0 {
+		return 0
+	}
+	return s.CurrentCapacity / s.MaxCapacity * 100
+}
+
+// Station returns the summary of the station.
+func (s *BatteriesData) Station(station int) (StationSummary, bool) {
+	shard := s.shards[station%s.shardCnt]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	stationData, ok := shard.stationData[station]
+	if !ok {
+		return StationSummary{}, false
+	}
+	summary := StationSummary{
+		MaxCapacity:     stationData.maxCapacity,
+		CurrentCapacity: stationData.currentCapacity,
+		UnhealthyCells:  stationData.unhealthyCells,
+	}
+	now := time.Now()
+	var soh, weight float64
+	summary.MaxTemperature = math.Inf(-1)
+	for _, containerData := range stationData.containerData {
+		for _, packData := range containerData.packData {
+			for id, cell := range packData.cellData {
+				if cell.SOH > 0 {
+					soh += cell.SOH * cell.MaxCapacity
+					weight += cell.MaxCapacity
+				}
+				if _, temperature := packData.cellHealth[id].report(packData.opts.health, now); temperature == 0 {
+					summary.MaxTemperature = math.Max(summary.MaxTemperature, cell.Temperature)
+					summary.TemperatureSensors++
+				}
+			}
+		}
+	}
+	if summary.TemperatureSensors == 0 {
+		summary.MaxTemperature = 0
+	}
+	if weight > 0 {
+		summary.SOH = soh / weight
 	}
+	return summary, true
 }
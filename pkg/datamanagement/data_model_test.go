@@ -2,142 +2,98 @@ package data_model
 
 import (
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// cellState returns a reading of a 100Ah cell in station 1, container 1 and
+// pack 1.
+func cellState(cell int, voltage float64, ts int64) *BatteryState {
+	return &BatteryState{
+		Station: 1, Container: 1, Pack: 1, Cell: cell,
+		Voltage: voltage, Temperature: 25, MaxCapacity: 100, Timestamp: ts,
+	}
+}
+
 func TestPackData(t *testing.T) {
-	// Create a new PackData and update it with some test data
 	packData := NewPackData()
-	state := &datamodel.BatteryState{
-		Cell:            1,
-		MaxCapacity:     100.0,
-		CurrentCapacity: 50.0,
-		Pack:            1,
-		Container:       1,
-		Station:         1,
-	}
-	packData.Update(state)
+	assert.Equal(t, Applied, packData.Update(cellState(1, 3.3, 100)))
+	// a cell with an implausible voltage is excluded from the capacity
+	assert.Equal(t, Applied, packData.Update(cellState(2, 6, 100)))
 
-	// Recalculate the PackData
-	packData.ReCalculate()
+	// duplicate and late readings don't change the live state
+	assert.Equal(t, Duplicate, packData.Update(cellState(2, 6, 100)))
+	assert.Equal(t, Late, packData.Update(cellState(1, 2.8, 90)))
+	assert.Equal(t, int64(100), packData.cellWindow[1].timestamp)
+	assert.Equal(t, int64(100), packData.cellData[1].Timestamp)
+	assert.InDelta(t, 3.3, packData.cellData[1].Voltage, 1e-9)
 
-	// Perform assertions
-	if packData.maxCapacity != 100.0 {
-		t.Errorf("Expected maxCapacity to be 100.0, got %f", packData.maxCapacity)
-	}
-	if packData.currentCapacity != 50.0 {
-		t.Errorf("Expected currentCapacity to be 50.0, got %f", packData.currentCapacity)
-	}
+	packData.ReCalculate()
+	assert.Equal(t, 100.0, packData.maxCapacity)
+	assert.Equal(t, 1, packData.unhealthyCells)
+	soc := packData.cellData[1].SOC
+	assert.Greater(t, soc, 0.0)
+	assert.InDelta(t, soc, packData.currentCapacity, 1e-9)
 }
 
 func TestContainerData(t *testing.T) {
 	containerData := NewContainerData()
-
-	// Create a test BatteryState
-	state := &datamodel.BatteryState{
-		Cell:           1,
-		MaxCapacity:    100.0,
-		CurrentCapacity: 50.0,
-		Pack:           1,
-		Container:      1,
-		Station:        1,
+	for pack := 1; pack <= 2; pack++ {
+		state := cellState(1, 3.3, 100)
+		state.Pack = pack
+		require.Equal(t, Applied, containerData.Update(state))
 	}
 
-	// Update ContainerData with the test BatteryState
-	containerData.Update(state)
-
-	// Recalculate ContainerData
 	containerData.ReCalculate()
-
-	// Perform assertions
-	if containerData.maxCapacity != 100.0 {
-		t.Errorf("Expected maxCapacity to be 100.0, got %f", containerData.maxCapacity)
-	}
-	if containerData.currentCapacity != 50.0 {
-		t.Errorf("Expected currentCapacity to be 50.0, got %f", containerData.currentCapacity)
-	}
+	assert.Equal(t, 200.0, containerData.maxCapacity)
+	assert.Equal(t, 0, containerData.unhealthyCells)
+	assert.InDelta(t, containerData.packData[1].currentCapacity*2, containerData.currentCapacity, 1e-9)
 }
 
 func TestStationData(t *testing.T) {
 	stationData := NewStationData()
-
-	// Create a test BatteryState
-	state := &datamodel.BatteryState{
-		Cell:           1,
-		MaxCapacity:    100.0,
-		CurrentCapacity: 50.0,
-		Pack:           1,
-		Container:      1,
-		Station:        1,
+	for container := 1; container <= 2; container++ {
+		state := cellState(1, 3.3, 100)
+		state.Container = container
+		require.Equal(t, Applied, stationData.Update(state))
 	}
+	stationData.Update(cellState(2, 0.1, 100))
 
-	// Update StationData with the test BatteryState
-	stationData.Update(state)
-
-	// Recalculate StationData
 	stationData.ReCalculate()
-
-	// Perform assertions
-	if stationData.maxCapacity != 100.0 {
-		t.Errorf("Expected maxCapacity to be 100.0, got %f", stationData.maxCapacity)
-	}
-	if stationData.currentCapacity != 50.0 {
-		t.Errorf("Expected currentCapacity to be 50.0, got %f", stationData.currentCapacity)
-	}
+	assert.Equal(t, 200.0, stationData.maxCapacity)
+	assert.Equal(t, 1, stationData.unhealthyCells)
+	assert.InDelta(t, stationData.containerData[1].currentCapacity*2, stationData.currentCapacity, 1e-9)
 }
 
-func TestDataDataShard(t *testing.T) {
-	DataDataShard := NewDataDataShard()
-
-	// Create a test BatteryState
-	state := &datamodel.BatteryState{
-		Cell:           1,
-		MaxCapacity:    100.0,
-		CurrentCapacity: 50.0,
-		Pack:           1,
-		Container:      1,
-		Station:        1,
-	}
-
-	// Update DataDataShard with the test BatteryState
-	DataDataShard.Update(state)
-
-	// Recalculate DataDataShard
-	DataDataShard.ReCalculate()
-
-	// Perform assertions
-	if DataShard.maxCapacity != 100.0 {
-		t.Errorf("Expected maxCapacity to be 100.0, got %f", DataShard.maxCapacity)
-	}
-	if DataShard.currentCapacity != 50.0 {
-		t.Errorf("Expected currentCapacity to be 50.0, got %f", DataShard.currentCapacity)
-	}
+func TestDataShard(t *testing.T) {
+	shard := NewDataShard()
+	result, lateness := shard.Update(cellState(1, 3.3, 100))
+	assert.Equal(t, Applied, result)
+	assert.Zero(t, lateness)
+	// the lateness is how far a late reading is behind the live state
+	result, lateness = shard.Update(cellState(1, 3.2, 70))
+	assert.Equal(t, Late, result)
+	assert.Equal(t, int64(30), lateness)
+	result, lateness = shard.Update(cellState(1, 3.3, 100))
+	assert.Equal(t, Duplicate, result)
+	assert.Zero(t, lateness)
+
+	shard.ReCalculate()
+	assert.Equal(t, 100.0, shard.maxCapacity)
+	assert.Greater(t, shard.currentCapacity, 0.0)
 }
 
 func TestBatteriesData(t *testing.T) {
-	shardCnt := DefaultShardCnt
-	BatteriesData := NewBatteriesData(shardCnt)
-
-	// Create a test BatteryState
-	state := &datamodel.BatteryState{
-		Cell:           1,
-		MaxCapacity:    100.0,
-		CurrentCapacity: 50.0,
-		Pack:           1,
-		Container:      1,
-		Station:        1,
+	data := NewBatteriesData(DefaultDataShardCnt)
+	for station := 1; station <= 2; station++ {
+		state := cellState(1, 3.3, 100)
+		state.Station = station
+		require.Equal(t, Applied, data.Update(state))
 	}
 
-	// Update Data with the test BatteryState
-	BatteriesData.Update(state)
-
-	// Recalculate Data
-	BatteriesData.ReCalculate()
-
-	// Perform assertions
-	if BatteriesData.maxCapacity != 100.0 {
-		t.Errorf("Expected maxCapacity to be 100.0, got %f", BatteriesData.maxCapacity)
-	}
-	if BatteriesData.currentCapacity != 50.0 {
-		t.Errorf("Expected currentCapacity to be 50.0, got %f", BatteriesData.currentCapacity)
-	}
+	data.ReCalculate()
+	assert.Equal(t, 200.0, data.maxCapacity)
+	assert.Equal(t, 0, data.unhealthyCells)
+	assert.InDelta(t, data.shards[1].currentCapacity*2, data.currentCapacity, 1e-9)
 }
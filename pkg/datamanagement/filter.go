@@ -0,0 +1,156 @@
+package data_model
+
+import (
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/utils"
+)
+
+// Defaults of the filters, they are the fixed filter used before the
+// filters were configurable.
+const (
+	DefaultFilterInitialError     = 1
+	DefaultFilterProcessNoise     = 0.01
+	DefaultFilterMeasurementNoise = 0.01
+	DefaultFilterForgettingFactor = 0.98
+	DefaultFilterMinNoise         = 1e-9
+)
+
+// Sensor is a sensor type of a cell.
+type Sensor string
+
+const (
+	SensorVoltage     Sensor = "voltage"
+	SensorCurrent     Sensor = "current"
+	SensorTemperature Sensor = "temperature"
+)
+
+// ChannelNoise is the learned noise of the adaptive filter of a sensor.
+type ChannelNoise struct {
+	Station   int    `json:"station"`
+	Container int    `json:"container"`
+	Pack      int    `json:"pack"`
+	Cell      int    `json:"cell"`
+	Sensor    Sensor `json:"sensor"`
+	utils.Noise
+}
+
+// channel identifies a sensor of a cell.
+type channel struct {
+	station, container, pack, cell int
+	sensor                         Sensor
+}
+
+// options are the settings shared by all levels of the batteries data.
+type options struct {
+	health  *config.HealthConfig
+	filters *config.SensorFiltersConfig
+	// learned noise restored at startup, read only after
+	noise map[channel]utils.Noise
+	// estimator state restored at startup, read only after
+	estimates map[cellKey]CellEstimate
+}
+
+func defaultOptions() *options {
+	return &options{
+		health:  withHealthDefaults(nil),
+		filters: withFilterDefaults(nil),
+	}
+}
+
+// withFilterDefaults returns a copy of cfg with the defaults filled in.
+func withFilterDefaults(cfg *config.SensorFiltersConfig) *config.SensorFiltersConfig {
+	c := config.SensorFiltersConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	for _, f := range []*config.FilterConfig{&c.Voltage, &c.Current, &c.Temperature} {
+		defaults := []struct {
+			v   *float64
+			def float64
+		}{
+			{&f.InitialError, DefaultFilterInitialError},
+			{&f.ProcessNoise, DefaultFilterProcessNoise},
+			{&f.MeasurementNoise, DefaultFilterMeasurementNoise},
+			{&f.ForgettingFactor, DefaultFilterForgettingFactor},
+			{&f.MinProcessNoise, DefaultFilterMinNoise},
+			{&f.MinMeasurementNoise, DefaultFilterMinNoise},
+		}
+		for _, d := range defaults {
+			if *d.v == 0 {
+				*d.v = d.def
+			}
+		}
+	}
+	return &c
+}
+
+// newFilter creates the filter of a channel starting at its first reading,
+// an adaptive filter starts from the restored noise of the channel.
+func (o *options) newFilter(ch channel, initialValue float64) utils.Filter {
+	var cfg *config.FilterConfig
+	switch ch.sensor {
+	case SensorVoltage:
+		cfg = &o.filters.Voltage
+	case SensorCurrent:
+		cfg = &o.filters.Current
+	default:
+		cfg = &o.filters.Temperature
+	}
+	if !cfg.Adaptive {
+		return utils.NewKalmanFilter(initialValue, cfg.InitialError, cfg.ProcessNoise, cfg.MeasurementNoise)
+	}
+	noise, ok := o.noise[ch]
+	if !ok {
+		noise = utils.Noise{Q: cfg.ProcessNoise, R: cfg.MeasurementNoise}
+	}
+	return utils.NewAdaptiveKalmanFilter(initialValue, cfg.InitialError, noise,
+		utils.Noise{Q: cfg.MinProcessNoise, R: cfg.MinMeasurementNoise}, cfg.ForgettingFactor)
+}
+
+// SetFilterConfig sets the filters of the sensor types, it must be called
+// before any update.
+func (s *BatteriesData) SetFilterConfig(cfg *config.SensorFiltersConfig) {
+	s.opts.filters = withFilterDefaults(cfg)
+}
+
+// Noise returns the learned noise of all adaptive filters.
+func (s *BatteriesData) Noise() []ChannelNoise {
+	var noise []ChannelNoise
+	for _, shard := range s.shards {
+		shard.mu.RLock()
+		for station, stationData := range shard.stationData {
+			for container, containerData := range stationData.containerData {
+				for pack, packData := range containerData.packData {
+					for _, f := range []struct {
+						sensor  Sensor
+						filters map[int]utils.Filter
+					}{
+						{SensorVoltage, packData.cellKalmanV},
+						{SensorCurrent, packData.cellKalmanC},
+						{SensorTemperature, packData.cellKalmanT},
+					} {
+						for cell, filter := range f.filters {
+							if adaptive, ok := filter.(*utils.AdaptiveKalmanFilter); ok {
+								noise = append(noise, ChannelNoise{
+									Station: station, Container: container, Pack: pack, Cell: cell,
+									Sensor: f.sensor, Noise: adaptive.Noise(),
+								})
+							}
+						}
+					}
+				}
+			}
+		}
+		shard.mu.RUnlock()
+	}
+	return noise
+}
+
+// RestoreNoise makes the adaptive filters start from the learned noise
+// instead of the configured guesses, it must be called before any update.
+func (s *BatteriesData) RestoreNoise(noise []ChannelNoise) {
+	s.opts.noise = make(map[channel]utils.Noise, len(noise))
+	for _, n := range noise {
+		s.opts.noise[channel{n.Station, n.Container, n.Pack, n.Cell, n.Sensor}] = n.Noise
+	}
+}
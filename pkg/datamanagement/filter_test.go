@@ -0,0 +1,44 @@
+package data_model
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/utils"
+)
+
+func TestAdaptiveFilters(t *testing.T) {
+	cfg := &config.SensorFiltersConfig{Voltage: config.FilterConfig{Adaptive: true, MeasurementNoise: 1}}
+	data := NewBatteriesData(DefaultDataShardCnt)
+	data.SetFilterConfig(cfg)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		data.Update(&BatteryState{
+			Station: 1, Container: 2, Pack: 3, Cell: 4, Timestamp: int64(i),
+			Voltage: 3.3 + rng.NormFloat64()*0.01, Temperature: 25 + rng.NormFloat64(),
+		})
+	}
+	// only the voltage filter is adaptive
+	noise := data.Noise()
+	require.Len(t, noise, 1)
+	assert.Equal(t, SensorVoltage, noise[0].Sensor)
+	assert.Equal(t, 4, noise[0].Cell)
+	assert.InDelta(t, 0.0001, noise[0].R, 0.00005)
+
+	// after a restart the filter starts from the learned noise
+	restarted := NewBatteriesData(DefaultDataShardCnt)
+	restarted.SetFilterConfig(cfg)
+	restarted.RestoreNoise(noise)
+	restarted.Update(&BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 4, Voltage: 3.3})
+	restored := restarted.Noise()
+	require.Len(t, restored, 1)
+	assert.InDelta(t, noise[0].R, restored[0].R, 0.00005)
+
+	// a fresh cell starts from the configured guess
+	restarted.Update(&BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 5, Voltage: 3.3})
+	filter := restarted.shards[1].stationData[1].containerData[2].packData[3].cellKalmanV[5]
+	assert.Greater(t, filter.(*utils.AdaptiveKalmanFilter).Noise().R, 0.5)
+}
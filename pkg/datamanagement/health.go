@@ -0,0 +1,213 @@
+package data_model
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+// Defaults of the sensor health detection.
+const (
+	DefaultReportInterval       = 10 * time.Second
+	DefaultStaleIntervals       = 3
+	DefaultFlatlineReadings     = 180
+	DefaultMaxVoltageJump       = 0.5
+	DefaultMaxTemperatureJump   = 10
+	DefaultMinVoltage           = 0.5
+	DefaultMaxVoltage           = 5
+	DefaultMinTemperature       = -40
+	DefaultMaxTemperature       = 120
+	DefaultNeighbourVoltage     = 0.3
+	DefaultNeighbourTemperature = 15
+
+	// minNeighbours is the min number of healthy cells of a pack to check
+	// cells against their neighbours.
+	minNeighbours = 3
+)
+
+// withHealthDefaults returns a copy of cfg with the defaults filled in.
+func withHealthDefaults(cfg *config.HealthConfig) *config.HealthConfig {
+	c := config.HealthConfig{}
+	if cfg != nil {
+		c = *cfg
+	}
+	defaults := []struct {
+		v   *float64
+		def float64
+	}{
+		{&c.MaxVoltageJump, DefaultMaxVoltageJump},
+		{&c.MaxTemperatureJump, DefaultMaxTemperatureJump},
+		{&c.MinVoltage, DefaultMinVoltage},
+		{&c.MaxVoltage, DefaultMaxVoltage},
+		{&c.MinTemperature, DefaultMinTemperature},
+		{&c.MaxTemperature, DefaultMaxTemperature},
+		{&c.NeighbourVoltage, DefaultNeighbourVoltage},
+		{&c.NeighbourTemperature, DefaultNeighbourTemperature},
+	}
+	for _, d := range defaults {
+		if *d.v == 0 {
+			*d.v = d.def
+		}
+	}
+	if c.ReportInterval <= 0 {
+		c.ReportInterval = DefaultReportInterval
+	}
+	if c.StaleIntervals <= 0 {
+		c.StaleIntervals = DefaultStaleIntervals
+	}
+	if c.FlatlineReadings <= 0 {
+		c.FlatlineReadings = DefaultFlatlineReadings
+	}
+	return &c
+}
+
+// SensorFault is a set of faults of a sensor.
+type SensorFault uint8
+
+const (
+	// FaultStale means the cell stopped reporting.
+	FaultStale SensorFault = 1 << iota
+	// FaultImplausible means the latest reading is out of the physical range.
+	FaultImplausible
+	// FaultJump means the latest reading changed faster than physically possible.
+	FaultJump
+	// FaultFlatline means the sensor reports the same value for too long.
+	FaultFlatline
+	// FaultNeighbour means the reading disagrees with the other cells of the pack.
+	FaultNeighbour
+)
+
+var faultNames = []string{"stale", "implausible", "jump", "flatline", "neighbour"}
+
+func (f SensorFault) String() string {
+	var names []string
+	for i, name := range faultNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// MarshalText encodes the faults as their comma separated names.
+func (f SensorFault) MarshalText() ([]byte, error) {
+	return []byte(f.String()), nil
+}
+
+// CellHealth is the health of the sensors of a cell. A cell with a faulty
+// temperature sensor has an unknown temperature, it must not be taken as a
+// cool cell.
+type CellHealth struct {
+	Station   int `json:"station"`
+	Container int `json:"container"`
+	Pack      int `json:"pack"`
+	Cell      int `json:"cell"`
+	// LastReport is when the latest reading arrived, in unix seconds.
+	LastReport int64 `json:"last_report"`
+	// Voltage and Temperature are the faults of the sensors.
+	Voltage     SensorFault `json:"voltage,omitempty"`
+	Temperature SensorFault `json:"temperature,omitempty"`
+}
+
+// Healthy reports whether both sensors of the cell are healthy.
+func (h *CellHealth) Healthy() bool {
+	return h.Voltage == 0 && h.Temperature == 0
+}
+
+// sensorHealth tracks the readings of a sensor.
+type sensorHealth struct {
+	last float64
+	// number of consecutive readings equal to the last one
+	same int
+	// faults of the latest reading
+	faults SensorFault
+	// set by the neighbour check of ReCalculate
+	neighbour bool
+}
+
+// observe checks the reading against the previous one.
+func (s *sensorHealth) observe(v, min, max, maxJump float64, flatline int, first bool) {
+	s.faults = 0
+	if v < min || v > max {
+		s.faults |= FaultImplausible
+	}
+	if !first {
+		if math.Abs(v-s.last) > maxJump {
+			s.faults |= FaultJump
+		}
+		if v == s.last {
+			s.same++
+		} else {
+			s.same = 0
+		}
+	}
+	if s.same+1 >= flatline {
+		s.faults |= FaultFlatline
+	}
+	s.last = v
+}
+
+func (s *sensorHealth) report(stale bool) SensorFault {
+	faults := s.faults
+	if s.neighbour {
+		faults |= FaultNeighbour
+	}
+	if stale {
+		faults |= FaultStale
+	}
+	return faults
+}
+
+// cellHealth tracks the health of the sensors of a cell.
+type cellHealth struct {
+	lastReport  time.Time
+	voltage     sensorHealth
+	temperature sensorHealth
+}
+
+func (h *cellHealth) observe(cfg *config.HealthConfig, state *BatteryState, now time.Time) {
+	first := h.lastReport.IsZero()
+	h.lastReport = now
+	h.voltage.observe(state.Voltage, cfg.MinVoltage, cfg.MaxVoltage, cfg.MaxVoltageJump, cfg.FlatlineReadings, first)
+	h.temperature.observe(state.Temperature, cfg.MinTemperature, cfg.MaxTemperature, cfg.MaxTemperatureJump, cfg.FlatlineReadings, first)
+}
+
+func (h *cellHealth) stale(cfg *config.HealthConfig, now time.Time) bool {
+	return now.Sub(h.lastReport) > time.Duration(cfg.StaleIntervals)*cfg.ReportInterval
+}
+
+func (h *cellHealth) report(cfg *config.HealthConfig, now time.Time) (voltage, temperature SensorFault) {
+	stale := h.stale(cfg, now)
+	return h.voltage.report(stale), h.temperature.report(stale)
+}
+
+// checkNeighbours flags the sensors deviating from the median of the other
+// healthy sensors of the pack, stale sensors are ignored.
+func checkNeighbours(cells map[int]*cellHealth, cfg *config.HealthConfig, now time.Time) {
+	check := func(sensor func(*cellHealth) *sensorHealth, maxDeviation float64) {
+		var values []float64
+		for _, h := range cells {
+			if s := sensor(h); s.faults == 0 && !h.stale(cfg, now) {
+				values = append(values, s.last)
+			}
+		}
+		enough := len(values) >= minNeighbours
+		median := 0.0
+		if enough {
+			sort.Float64s(values)
+			median = values[len(values)/2]
+			if len(values)%2 == 0 {
+				median = (values[len(values)/2-1] + median) / 2
+			}
+		}
+		for _, h := range cells {
+			s := sensor(h)
+			s.neighbour = enough && !h.stale(cfg, now) && math.Abs(s.last-median) > maxDeviation
+		}
+	}
+	check(func(h *cellHealth) *sensorHealth { return &h.voltage }, cfg.NeighbourVoltage)
+	check(func(h *cellHealth) *sensorHealth { return &h.temperature }, cfg.NeighbourTemperature)
+}
@@ -0,0 +1,88 @@
+package data_model
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+func TestSensorHealth(t *testing.T) {
+	cfg := withHealthDefaults(&config.HealthConfig{FlatlineReadings: 3})
+	h := &cellHealth{}
+	observe := func(voltage, temperature float64) (SensorFault, SensorFault) {
+		h.observe(cfg, &BatteryState{Voltage: voltage, Temperature: temperature}, time.Now())
+		return h.report(cfg, time.Now())
+	}
+
+	v, temp := observe(3.3, 25)
+	assert.Zero(t, v)
+	assert.Zero(t, temp)
+	// a temperature sensor stuck at the same value is flatlined
+	v, temp = observe(3.31, 25)
+	assert.Zero(t, v)
+	assert.Zero(t, temp)
+	v, temp = observe(3.32, 25)
+	assert.Zero(t, v)
+	assert.Equal(t, FaultFlatline, temp)
+	// an open circuit jumps out of the physical range
+	v, temp = observe(3.3, -60)
+	assert.Zero(t, v)
+	assert.Equal(t, FaultImplausible|FaultJump, temp)
+	assert.Equal(t, "implausible,jump", temp.String())
+	v, temp = observe(4.2, -59)
+	assert.Equal(t, FaultJump, v)
+	assert.Equal(t, FaultImplausible, temp)
+
+	// no report within the stale intervals
+	h.lastReport = time.Now().Add(-time.Minute)
+	v, temp = h.report(cfg, time.Now())
+	assert.Equal(t, FaultStale|FaultJump, v)
+	assert.Equal(t, FaultStale|FaultImplausible, temp)
+}
+
+func TestPackHealth(t *testing.T) {
+	data := NewBatteriesData(DefaultDataShardCnt)
+	data.SetHealthConfig(&config.HealthConfig{ReportInterval: 50 * time.Millisecond, StaleIntervals: 1, MaxTemperatureJump: 100})
+	update := func(cell int, voltage, temperature float64) {
+		data.Update(&BatteryState{
+			Station: 1, Container: 1, Pack: 1, Cell: cell,
+			Voltage: voltage, Temperature: temperature, MaxCapacity: 100, Timestamp: time.Now().UnixNano(),
+		})
+	}
+	for cell := 1; cell <= 4; cell++ {
+		update(cell, 3.3, 30)
+	}
+	// cell 4 reads a cool temperature among warm neighbours, cell 5 never
+	// reports again
+	update(4, 3.3, 5)
+	update(5, 3.3, 30)
+	data.ReCalculate()
+	assert.Equal(t, 1, data.unhealthyCells)
+
+	cells := data.UnhealthyCells()
+	require.Len(t, cells, 1)
+	assert.Equal(t, 4, cells[0].Cell)
+	assert.Zero(t, cells[0].Voltage)
+	assert.Equal(t, FaultNeighbour, cells[0].Temperature)
+	// a faulty temperature sensor doesn't change the capacity
+	assert.Equal(t, 500.0, data.maxCapacity)
+
+	time.Sleep(100 * time.Millisecond)
+	for cell := 1; cell <= 4; cell++ {
+		update(cell, 3.3+float64(cell)/100, 30)
+	}
+	data.ReCalculate()
+	health, ok := data.CellHealth(1, 1, 1, 5)
+	require.True(t, ok)
+	assert.Equal(t, FaultStale, health.Voltage)
+	assert.Equal(t, FaultStale, health.Temperature)
+	// the stale cell is excluded from the capacity
+	assert.Equal(t, 400.0, data.maxCapacity)
+	assert.Equal(t, 1, data.unhealthyCells)
+
+	_, ok = data.CellHealth(1, 1, 1, 6)
+	assert.False(t, ok)
+}
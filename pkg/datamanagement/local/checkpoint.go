@@ -0,0 +1,92 @@
+package localstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"go.uber.org/zap"
+)
+
+// Defaults of the estimator checkpoints.
+const (
+	DefaultCheckpointInterval = time.Minute
+	DefaultCheckpointMaxAge   = 10 * time.Minute
+)
+
+// Checkpointer checkpoints the estimator state of the cells and the
+// learned noise of the adaptive filters to the local store, so after a
+// restart the filters and the soc continue from where they were instead of
+// jumping to the first raw readings.
+type Checkpointer struct {
+	interval time.Duration
+	maxAge   time.Duration
+	store    LocalStore
+	data     *data_model.BatteriesData
+}
+
+// NewCheckpointer creates a new Checkpointer.
+func NewCheckpointer(cfg *config.LocalStoreConfig, store LocalStore, data *data_model.BatteriesData) *Checkpointer {
+	c := &Checkpointer{
+		interval: cfg.CheckpointInterval,
+		maxAge:   cfg.CheckpointMaxAge,
+		store:    store,
+		data:     data,
+	}
+	if c.interval <= 0 {
+		c.interval = DefaultCheckpointInterval
+	}
+	if c.maxAge <= 0 {
+		c.maxAge = DefaultCheckpointMaxAge
+	}
+	return c
+}
+
+// Restore restores the checkpointed estimator state, the state of cells
+// which didn't report within the max age is discarded. The learned noise
+// is a property of the sensors and is always restored. It must be called
+// before any update of the batteries data.
+func (c *Checkpointer) Restore() error {
+	estimates, err := c.store.LoadEstimates()
+	if err != nil {
+		return err
+	}
+	noise, err := c.store.LoadNoise()
+	if err != nil {
+		return err
+	}
+	restored := c.data.RestoreEstimates(estimates, c.maxAge)
+	c.data.RestoreNoise(noise)
+	log.Info("restored estimator state",
+		zap.Int("restored", restored), zap.Int("discarded", len(estimates)-restored),
+		zap.Int("noise", len(noise)))
+	return nil
+}
+
+// Checkpoint saves the estimator state of all cells and the learned noise
+// of all adaptive filters.
+func (c *Checkpointer) Checkpoint() error {
+	if err := c.store.SaveEstimates(c.data.Estimates()); err != nil {
+		return err
+	}
+	return c.store.SaveNoise(c.data.Noise())
+}
+
+// Run checkpoints every interval until ctx is done, then checkpoints once
+// more so a graceful restart loses nothing.
+func (c *Checkpointer) Run(ctx context.Context) error {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return c.Checkpoint()
+		case <-ticker.C:
+			if err := c.Checkpoint(); err != nil {
+				log.Warn("failed to checkpoint estimator state", zap.Error(err))
+			}
+		}
+	}
+}
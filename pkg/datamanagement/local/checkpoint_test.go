@@ -0,0 +1,77 @@
+package localstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+func TestCheckpointer(t *testing.T) {
+	cfg := &config.LocalStoreConfig{
+		Path:               filepath.Join(t.TempDir(), "bms.db"),
+		CheckpointInterval: 10 * time.Millisecond,
+		CheckpointMaxAge:   time.Hour,
+	}
+	store := NewSqliteStore(cfg)
+	require.NoError(t, store.Open())
+	defer store.Close()
+
+	filters := &config.SensorFiltersConfig{Voltage: config.FilterConfig{Adaptive: true}}
+	now := time.Now().Unix()
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	data.SetFilterConfig(filters)
+	for i := int64(0); i < 100; i++ {
+		data.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.3, Temperature: 25, Timestamp: now - 100 + i})
+	}
+	// the cell stopped reporting before the max age
+	data.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 2, Voltage: 3.3, Timestamp: now - 7200})
+	data.ReCalculate()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- NewCheckpointer(cfg, store, data).Run(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	estimates, err := store.LoadEstimates()
+	require.NoError(t, err)
+	assert.Len(t, estimates, 2)
+	noise, err := store.LoadNoise()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, data.Noise(), noise)
+	require.Len(t, noise, 2)
+
+	// after a restart the filters continue from the checkpoint, the first
+	// reading is smoothed instead of taken as is
+	restarted := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	restarted.SetFilterConfig(filters)
+	require.NoError(t, NewCheckpointer(cfg, store, restarted).Restore())
+	restarted.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.5, Temperature: 25, Timestamp: now + 1})
+	cell, ok := restarted.GetCell(1, 1, 1, 1)
+	require.True(t, ok)
+	assert.Less(t, cell.Voltage, 3.45)
+	assert.Greater(t, cell.SOC, 0.0)
+
+	// the stale cell starts from its first reading but keeps its learned
+	// noise
+	restarted.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 2, Voltage: 3.5, Timestamp: now + 1})
+	cell, ok = restarted.GetCell(1, 1, 1, 2)
+	require.True(t, ok)
+	assert.InDelta(t, 3.5, cell.Voltage, 1e-9)
+	restored := restarted.Noise()
+	require.Len(t, restored, len(noise))
+	for _, n := range noise {
+		for _, r := range restored {
+			if r.Cell == n.Cell {
+				assert.InDelta(t, n.R, r.R, n.R/2)
+			}
+		}
+	}
+}
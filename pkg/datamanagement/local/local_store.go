@@ -1,7 +1,8 @@
 package localstore
 
 import (
-	"github.com/zhangjinpeng87/openbms/pkg/datamodel"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
 )
 
 // LocalStore is the interface of local data store.
@@ -14,15 +15,47 @@ type LocalStore interface {
 	// Close closes the local store.
 	Close() error
 
-	// Update or insert a battery state.
-	Upsert(state *datamodel.BatteryState) error
+	// Update or insert a battery state, a state older than the latest one
+	// of the cell is appended to the history instead.
+	Upsert(state *data_model.BatteryState) error
 
 	// Get the latest battery state.
-	GetLatest(station, container, pack, cell int) (*datamodel.BatteryState, error)
+	GetLatest(station, container, pack, cell int) (*data_model.BatteryState, error)
+
+	// Get the late battery states of the cell, ordered by timestamp.
+	GetHistory(station, container, pack, cell int) ([]*data_model.BatteryState, error)
 
 	// Generate snapshot file of the battery state for specified station.
 	// The snapshot file will be upload to the cloud storage.
 	// Format can be "csv" or "parquet".
-	// return file name, file checksum and error
-	GenerateSnapshotFile(station int, format string) (string, int, error)
+	// return the manifest of the generated file and error
+	GenerateSnapshotFile(station int, format string) (*snapshot.Manifest, error)
+
+	// Save the estimator state of the cells, replacing the saved state of
+	// the same cells.
+	SaveEstimates(estimates []data_model.CellEstimate) error
+
+	// Load the saved estimator state of all cells.
+	LoadEstimates() ([]data_model.CellEstimate, error)
+
+	// Save the learned noise of the adaptive filters, replacing the saved
+	// noise of the same channels.
+	SaveNoise(noise []data_model.ChannelNoise) error
+
+	// Load the saved noise of all adaptive filters.
+	LoadNoise() ([]data_model.ChannelNoise, error)
+
+	// Save the metadata of the packs, replacing the saved metadata of the
+	// same serials.
+	SavePackMetadata(metadata []data_model.PackMetadata) error
+
+	// Load the saved metadata of all packs.
+	LoadPackMetadata() ([]data_model.PackMetadata, error)
+
+	// Save the encoded state of a controller under the key, replacing the
+	// saved state of the key.
+	SaveState(key string, value []byte) error
+
+	// Load the saved state of the key, nil if none.
+	LoadState(key string) ([]byte, error)
 }
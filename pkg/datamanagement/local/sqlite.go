@@ -3,17 +3,24 @@ package localstore
 import (
 	"bufio"
 	"database/sql"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/zhangjinpeng87/openbms/pkg/config"
 	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/snapshot"
 )
 
+// ErrEmptySnapshot is returned when there is no battery state to snapshot.
+var ErrEmptySnapshot = errors.New("no battery state to snapshot")
+
 type SqliteStore struct {
 	cfg *config.LocalStoreConfig
 
@@ -34,12 +41,13 @@ func (s *SqliteStore) Open() error {
 	db.SetMaxOpenConns(8)
 	db.SetMaxIdleConns(4)
 
+	s.db = db
+
 	// init schema
 	if err := s.initSchema(); err != nil {
 		return fmt.Errorf("failed to init schema: %w", err)
 	}
 
-	s.db = db
 	return nil
 }
 
@@ -64,30 +72,121 @@ func (s *SqliteStore) initSchema() error {
 			timestamp INTEGER NOT NULL,
 			PRIMARY KEY (station, container, pack, cell)
 		);
+		CREATE TABLE IF NOT EXISTS battery_history (
+			station INTEGER NOT NULL,
+			container INTEGER NOT NULL,
+			pack INTEGER NOT NULL,
+			cell INTEGER NOT NULL,
+			voltage REAL NOT NULL,
+			current REAL NOT NULL,
+			soc REAL NOT NULL,
+			temperature REAL NOT NULL,
+			state INTEGER NOT NULL,
+			timestamp INTEGER NOT NULL,
+			seq INTEGER NOT NULL,
+			gateway TEXT NOT NULL,
+			PRIMARY KEY (station, container, pack, cell, timestamp, seq)
+		);
+		CREATE TABLE IF NOT EXISTS cell_estimate (
+			station INTEGER NOT NULL,
+			container INTEGER NOT NULL,
+			pack INTEGER NOT NULL,
+			cell INTEGER NOT NULL,
+			voltage_x REAL NOT NULL,
+			voltage_p REAL NOT NULL,
+			current_x REAL NOT NULL,
+			current_p REAL NOT NULL,
+			temperature_x REAL NOT NULL,
+			temperature_p REAL NOT NULL,
+			soc REAL NOT NULL,
+			timestamp INTEGER NOT NULL,
+			PRIMARY KEY (station, container, pack, cell)
+		);
+		CREATE TABLE IF NOT EXISTS channel_noise (
+			station INTEGER NOT NULL,
+			container INTEGER NOT NULL,
+			pack INTEGER NOT NULL,
+			cell INTEGER NOT NULL,
+			sensor TEXT NOT NULL,
+			q REAL NOT NULL,
+			r REAL NOT NULL,
+			PRIMARY KEY (station, container, pack, cell, sensor)
+		);
+		CREATE TABLE IF NOT EXISTS controller_state (
+			key TEXT NOT NULL PRIMARY KEY,
+			value BLOB NOT NULL,
+			updated INTEGER NOT NULL
+		);
+		CREATE TABLE IF NOT EXISTS pack_metadata (
+			serial TEXT NOT NULL PRIMARY KEY,
+			station INTEGER NOT NULL,
+			container INTEGER NOT NULL,
+			pack INTEGER NOT NULL,
+			soh REAL NOT NULL,
+			capacity REAL NOT NULL,
+			resistance REAL NOT NULL,
+			self_discharge REAL NOT NULL,
+			tier INTEGER NOT NULL,
+			reason TEXT NOT NULL,
+			grp TEXT NOT NULL,
+			graded INTEGER NOT NULL
+		);
 	`)
 	return err
 }
 
-// Upsert upserts a battery state.
+// Upsert upserts a battery state, a state older than the stored one of the
+// cell doesn't overwrite the latest, it is appended to the history instead.
 // TODO: use perpared statement to improve performance.
-func (s *SqliteStore) Upsert(state *datamodel.BatteryState) error {
-	_, err := s.db.Exec(`
+func (s *SqliteStore) Upsert(state *data_model.BatteryState) error {
+	res, err := s.db.Exec(`
 		INSERT INTO battery_state(station, container, pack, cell, voltage, current, soc, temperature, state, timestamp)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 		ON CONFLICT(station, container, pack, cell) DO UPDATE SET
 			voltage = excluded.voltage,
 			current = excluded.current,
 			soc = excluded.soc,
 			temperature = excluded.temperature,
-			state = excluded.state
-			timestamp = excluded.timestamp,
-	`, state.Station, state.Container, state.Pack, state.Cell, state.Voltage, state.Current, state.soc, state.Temperature, state.State, state.Timestamp)
-	return err
+			state = excluded.state,
+			timestamp = excluded.timestamp
+		WHERE excluded.timestamp >= battery_state.timestamp
+	`, state.Station, state.Container, state.Pack, state.Cell, state.Voltage, state.Current, state.SOC, state.Temperature, state.State, state.Timestamp)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// a replayed late reading is already in the history
+	_, err = s.db.Exec(`
+		INSERT OR IGNORE INTO battery_history(station, container, pack, cell, voltage, current, soc, temperature, state, timestamp, seq, gateway)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, state.Station, state.Container, state.Pack, state.Cell, state.Voltage, state.Current, state.SOC, state.Temperature, state.State, state.Timestamp, state.Seq, state.Gateway)
+	if err != nil {
+		return fmt.Errorf("failed to append battery history: %w", err)
+	}
+	return nil
+}
+
+// GetHistory gets the late states of the cell, ordered by timestamp.
+func (s *SqliteStore) GetHistory(station, container, pack, cell int) ([]*data_model.BatteryState, error) {
+	var states []*data_model.BatteryState
+	err := s.db.Select(&states, `
+		SELECT station, container, pack, cell, voltage, current, soc, temperature, state, timestamp, seq, gateway
+		FROM battery_history
+		WHERE station = ? AND container = ? AND pack = ? AND cell = ?
+		ORDER BY timestamp, seq
+	`, station, container, pack, cell)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get battery history: %w", err)
+	}
+	return states, nil
 }
 
 // GetLatest gets the latest battery state.
-func (s *SqliteStore) GetLatest(station, container, pack, cell int) (*BatteryState, error) {
-	var state BatteryState
+func (s *SqliteStore) GetLatest(station, container, pack, cell int) (*data_model.BatteryState, error) {
+	var state data_model.BatteryState
 	err := s.db.Get(&state, `
 		SELECT * FROM battery_state
 		WHERE station = ? AND container = ? AND pack = ? AND cell = ?
@@ -100,77 +199,307 @@ func (s *SqliteStore) GetLatest(station, container, pack, cell int) (*BatterySta
 	return &state, err
 }
 
+// SaveEstimates saves the estimator state of the cells in a transaction, so
+// a crash doesn't leave a partial checkpoint.
+func (s *SqliteStore) SaveEstimates(estimates []data_model.CellEstimate) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(`
+		INSERT OR REPLACE INTO cell_estimate(station, container, pack, cell, voltage_x, voltage_p,
+			current_x, current_p, temperature_x, temperature_p, soc, timestamp)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, e := range estimates {
+		if _, err := stmt.Exec(e.Station, e.Container, e.Pack, e.Cell, e.Voltage.XHat, e.Voltage.P,
+			e.Current.XHat, e.Current.P, e.Temperature.XHat, e.Temperature.P, e.SOC, e.Timestamp); err != nil {
+			return fmt.Errorf("failed to save cell estimate: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LoadEstimates loads the saved estimator state of all cells.
+func (s *SqliteStore) LoadEstimates() ([]data_model.CellEstimate, error) {
+	rows, err := s.db.Query(`
+		SELECT station, container, pack, cell, voltage_x, voltage_p, current_x, current_p,
+			temperature_x, temperature_p, soc, timestamp
+		FROM cell_estimate
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query cell estimates: %w", err)
+	}
+	defer rows.Close()
+
+	var estimates []data_model.CellEstimate
+	for rows.Next() {
+		var e data_model.CellEstimate
+		if err := rows.Scan(&e.Station, &e.Container, &e.Pack, &e.Cell, &e.Voltage.XHat, &e.Voltage.P,
+			&e.Current.XHat, &e.Current.P, &e.Temperature.XHat, &e.Temperature.P, &e.SOC, &e.Timestamp); err != nil {
+			return nil, fmt.Errorf("failed to scan cell estimate: %w", err)
+		}
+		estimates = append(estimates, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cell estimates: %w", err)
+	}
+	return estimates, nil
+}
+
+// SaveNoise saves the learned noise of the adaptive filters in a
+// transaction.
+func (s *SqliteStore) SaveNoise(noise []data_model.ChannelNoise) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(`
+		INSERT OR REPLACE INTO channel_noise(station, container, pack, cell, sensor, q, r)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, n := range noise {
+		if _, err := stmt.Exec(n.Station, n.Container, n.Pack, n.Cell, n.Sensor, n.Q, n.R); err != nil {
+			return fmt.Errorf("failed to save channel noise: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LoadNoise loads the saved noise of all adaptive filters.
+func (s *SqliteStore) LoadNoise() ([]data_model.ChannelNoise, error) {
+	rows, err := s.db.Query(`
+		SELECT station, container, pack, cell, sensor, q, r
+		FROM channel_noise
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query channel noise: %w", err)
+	}
+	defer rows.Close()
+
+	var noise []data_model.ChannelNoise
+	for rows.Next() {
+		var n data_model.ChannelNoise
+		if err := rows.Scan(&n.Station, &n.Container, &n.Pack, &n.Cell, &n.Sensor, &n.Q, &n.R); err != nil {
+			return nil, fmt.Errorf("failed to scan channel noise: %w", err)
+		}
+		noise = append(noise, n)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read channel noise: %w", err)
+	}
+	return noise, nil
+}
+
+// SavePackMetadata saves the metadata of the packs in a transaction.
+func (s *SqliteStore) SavePackMetadata(metadata []data_model.PackMetadata) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Preparex(`
+		INSERT OR REPLACE INTO pack_metadata(serial, station, container, pack, soh, capacity,
+			resistance, self_discharge, tier, reason, grp, graded)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+	for _, m := range metadata {
+		if _, err := stmt.Exec(m.Serial, m.Station, m.Container, m.Pack, m.SOH, m.Capacity,
+			m.Resistance, m.SelfDischarge, m.Tier, m.Reason, m.Group, m.Graded); err != nil {
+			return fmt.Errorf("failed to save pack metadata: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// LoadPackMetadata loads the saved metadata of all packs.
+func (s *SqliteStore) LoadPackMetadata() ([]data_model.PackMetadata, error) {
+	rows, err := s.db.Query(`
+		SELECT serial, station, container, pack, soh, capacity, resistance, self_discharge,
+			tier, reason, grp, graded
+		FROM pack_metadata ORDER BY serial
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pack metadata: %w", err)
+	}
+	defer rows.Close()
+
+	var metadata []data_model.PackMetadata
+	for rows.Next() {
+		var m data_model.PackMetadata
+		if err := rows.Scan(&m.Serial, &m.Station, &m.Container, &m.Pack, &m.SOH, &m.Capacity,
+			&m.Resistance, &m.SelfDischarge, &m.Tier, &m.Reason, &m.Group, &m.Graded); err != nil {
+			return nil, fmt.Errorf("failed to scan pack metadata: %w", err)
+		}
+		metadata = append(metadata, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read pack metadata: %w", err)
+	}
+	return metadata, nil
+}
+
+// SaveState saves the encoded state of a controller under the key.
+func (s *SqliteStore) SaveState(key string, value []byte) error {
+	if _, err := s.db.Exec(`
+		INSERT OR REPLACE INTO controller_state(key, value, updated) VALUES (?, ?, ?)
+	`, key, value, time.Now().Unix()); err != nil {
+		return fmt.Errorf("failed to save state %s: %w", key, err)
+	}
+	return nil
+}
+
+// LoadState loads the saved state of the key, nil if none.
+func (s *SqliteStore) LoadState(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.Get(&value, `SELECT value FROM controller_state WHERE key = ?`, key)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load state %s: %w", key, err)
+	}
+	return value, nil
+}
+
 // GenerateSnapshotFile generates snapshot file of the battery state for a specified station.
 // The snapshot file will be upload to the cloud storage by certain frequency like per minute.
 // Format can be "csv" or "parquet".
-func (s *SqliteStore) GenerateSnapshotFile(station int, format string) (file string, checksum int, err error) {
+func (s *SqliteStore) GenerateSnapshotFile(station int, format string) (*snapshot.Manifest, error) {
 	if format != "csv" && format != "parquet" {
-		return "", "", fmt.Errorf("unsupported format: %s", format)
+		return nil, fmt.Errorf("unsupported format: %s", format)
 	}
 
 	// get all battery states of the station
-	var states []BatteryState
-	if err = s.db.Select(&states, `
+	var states []data_model.BatteryState
+	if err := s.db.Select(&states, `
 		SELECT * FROM battery_state
 		WHERE station = ?
-		ORDER BY container, pack ASC
+		ORDER BY container, pack, cell ASC
 	`, station); err != nil {
-		return "", "", fmt.Errorf("failed to get battery states: %w", err)
+		return nil, fmt.Errorf("failed to get battery states: %w", err)
+	}
+	if len(states) == 0 {
+		return nil, ErrEmptySnapshot
+	}
+
+	manifest := &snapshot.Manifest{
+		Station:      station,
+		Format:       format,
+		RowCount:     len(states),
+		MinTimestamp: states[0].Timestamp,
+		MaxTimestamp: states[0].Timestamp,
+		CreatedAt:    time.Now().Unix(),
+	}
+	for _, state := range states {
+		if state.Timestamp < manifest.MinTimestamp {
+			manifest.MinTimestamp = state.Timestamp
+		}
+		if state.Timestamp > manifest.MaxTimestamp {
+			manifest.MaxTimestamp = state.Timestamp
+		}
 	}
 
 	// generate file
+	var err error
 	switch format {
 	case "csv":
-		file, checksum, err = s.generateCsvFile(states)
+		err = s.generateCsvFile(states, manifest)
 	case "parquet":
-		file, checksum, err = s.generateParquetFile(states)
+		err = s.generateParquetFile(states, manifest)
 	}
 	if err != nil {
-		return "", "", fmt.Errorf("failed to generate file: %w", err)
+		return nil, fmt.Errorf("failed to generate file: %w", err)
 	}
+
+	return manifest, nil
 }
 
-// generateCsvFile generates csv file of the battery state.
-func (s *SqliteStore) generateCsvFile(states []BatteryState) (string, error) {
-	if len(states) == 0 {
-		return "", nil
-	}
+// ListSnapshotFiles lists the snapshot files of the station generated in
+// [start, end] which are still in the local snapshot directory, e.g. not
+// uploaded yet.
+func (s *SqliteStore) ListSnapshotFiles(station int, start, end time.Time) ([]*snapshot.Ref, error) {
+	return snapshot.ListDir(s.cfg.SnapshotDir, station, start, end)
+}
 
+// generateCsvFile generates csv file of the battery state and fills the
+// file related fields of the manifest.
+func (s *SqliteStore) generateCsvFile(states []data_model.BatteryState, manifest *snapshot.Manifest) error {
 	// open a local file for writing, the file name is the timestamp of the snapshot
-	t := time.Now()
-	file, err := os.Create(fmt.Sprintf("%d/%s/%d.csv", states[0].station, fmt.Sprintf("%d%02d%02d", t.Year(), t.Month(), t.Day()), t.Unix())
+	name := filepath.Join(s.cfg.SnapshotDir, filepath.FromSlash(manifest.Key()))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	file, err := os.Create(name)
 	if err != nil {
-		return "", fmt.Errorf("failed to create file: %w", err)
+		return fmt.Errorf("failed to create file: %w", err)
 	}
 	defer file.Close()
 
-	// create a writebuffer
-	w := bufio.NewWriter(file)
-	defer w.Flush()
+	// crc32 checksum, computed over exactly what is written to the file
+	checksum := crc32.NewIEEE()
 
-	// crc32 checksum
-	crc32 := crc32.NewIEEE()
+	// create a writebuffer
+	w := bufio.NewWriter(io.MultiWriter(file, checksum))
 
 	// write csv header, delimiter is comma
 	// station, container, pack, cell, voltage, current, soc, temperature, state, timestamp
-	header := "station,container,pack,cell,voltage,current,soc,temperature,state,timestamp\n"
-	w.WriteString(header)
-	crc32.Write([]byte(header))
+	if _, err := w.WriteString(snapshot.CsvHeader); err != nil {
+		return fmt.Errorf("failed to write file: %w", err)
+	}
 
 	// write csv body
 	for _, state := range states {
-		row := fmt.Sprintf("%d,%d,%d,%d,%f,%f,%f,%f,%d\n",
-			state.Station, state.Container, state.Pack, state.Cell,
-			state.Voltage, state.Current, state.SOC, state.Temperature, state.State, state.Timestamp)
-		crc32.Write([]byte(row))
-		w.WriteString(row)
+		if _, err := w.WriteString(snapshot.FormatCsvRow(&state)); err != nil {
+			return fmt.Errorf("failed to write file: %w", err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to flush file: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat file: %w", err)
 	}
 
-	return file.Name(), nil
+	manifest.FileName = filepath.Base(file.Name())
+	manifest.LocalPath = file.Name()
+	manifest.Size = info.Size()
+	manifest.Checksum = checksum.Sum32()
+	return nil
 }
 
 // generateParquetFile generates parquet file of the battery state.
-func (s *SqliteStore) generateParquetFile(states []BatteryState) (string, int, error) {
+func (s *SqliteStore) generateParquetFile(states []data_model.BatteryState, manifest *snapshot.Manifest) error {
 	// TODO
-	return "", 0, fmt.Errorf("not implemented")
+	return fmt.Errorf("not implemented")
 }
@@ -1,54 +1,35 @@
 package localstore
 
 import (
-	"database/sql"
 	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/jmoiron/sqlx"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
 )
 
 func TestSqliteStore_OpenClose(t *testing.T) {
-	// Create a new SqliteStore with a mocked SQL database
-	cfg := &config.LocalStoreConfig{Path: ":memory:"}
-	store := NewSqliteStore(cfg)
-
-	// Mock the SQL database
-	mockDB, mock, err := sqlmock.New()
-	if err != nil {
-		t.Fatalf("Error creating mock database: %v", err)
-	}
-	store.db = sqlx.NewDb(mockDB, "sqlite3")
-
-	// Expectations for the Open method
-	mock.ExpectConnect()
-	mock.ExpectExec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS battery_state.*")).
-		WillReturnResult(sqlmock.NewResult(0, 0))
-
-	// Call the Open method
+	// Open creates the database and its schema
+	store := NewSqliteStore(&config.LocalStoreConfig{Path: filepath.Join(t.TempDir(), "bms.db")})
 	if err := store.Open(); err != nil {
-		t.Errorf("Error opening database: %v", err)
+		t.Fatalf("Error opening database: %v", err)
 	}
 
-	// Verify expectations
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("Unfulfilled expectations: %v", err)
+	var count int
+	if err := store.db.Get(&count, "SELECT COUNT(*) FROM battery_state"); err != nil {
+		t.Errorf("Error querying battery_state: %v", err)
 	}
 
-	// Expectations for the Close method
-	mock.ExpectClose()
-
 	// Call the Close method
 	if err := store.Close(); err != nil {
 		t.Errorf("Error closing database: %v", err)
 	}
-
-	// Verify expectations
-	if err := mock.ExpectationsWereMet(); err != nil {
-		t.Errorf("Unfulfilled expectations: %v", err)
-	}
 }
 
 func TestSqliteStore_Upsert(t *testing.T) {
@@ -64,17 +45,17 @@ func TestSqliteStore_Upsert(t *testing.T) {
 	store.db = sqlx.NewDb(mockDB, "sqlite3")
 
 	// Sample BatteryState
-	state := &datamodel.BatteryState{
-		Station:        1,
-		Container:      2,
-		Pack:           3,
-		Cell:           4,
-		Voltage:        12.3,
-		Current:        4.5,
-		SOC:            78.9,
-		Temperature:    25.5,
-		State:          1,
-		Timestamp:      time.Now().Unix(),
+	state := &data_model.BatteryState{
+		Station:     1,
+		Container:   2,
+		Pack:        3,
+		Cell:        4,
+		Voltage:     12.3,
+		Current:     4.5,
+		SOC:         78.9,
+		Temperature: 25.5,
+		State:       1,
+		Timestamp:   time.Now().Unix(),
 	}
 
 	// Expectations for the Upsert method
@@ -105,7 +86,7 @@ func TestSqliteStore_GetLatest(t *testing.T) {
 	store.db = sqlx.NewDb(mockDB, "sqlite3")
 
 	// Sample BatteryState
-	state := &BatteryState{
+	state := &data_model.BatteryState{
 		Station:     1,
 		Container:   2,
 		Pack:        3,
@@ -145,9 +126,94 @@ func TestSqliteStore_GetLatest(t *testing.T) {
 	}
 }
 
+func TestSqliteStore_PackMetadata(t *testing.T) {
+	store := NewSqliteStore(&config.LocalStoreConfig{Path: filepath.Join(t.TempDir(), "bms.db")})
+	if err := store.Open(); err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer store.Close()
+
+	metadata := []data_model.PackMetadata{
+		{Serial: "m1", SOH: 91, Capacity: 91, Resistance: 1, SelfDischarge: 2, Tier: 1, Group: "20240101T000000.000000000Z-1", Graded: 100},
+		{Serial: "m2", Station: 1, Container: 2, Pack: 3, SOH: 50, Capacity: 50, Resistance: 3, SelfDischarge: 4, Reason: "rejected", Graded: 100},
+	}
+	if err := store.SavePackMetadata(metadata); err != nil {
+		t.Fatalf("Error saving pack metadata: %v", err)
+	}
+	// a regraded module replaces its metadata
+	metadata[0].Tier, metadata[0].Graded = 2, 200
+	if err := store.SavePackMetadata(metadata[:1]); err != nil {
+		t.Fatalf("Error saving pack metadata: %v", err)
+	}
+
+	loaded, err := store.LoadPackMetadata()
+	if err != nil {
+		t.Fatalf("Error loading pack metadata: %v", err)
+	}
+	if !reflect.DeepEqual(metadata, loaded) {
+		t.Errorf("Expected pack metadata %+v, got %+v", metadata, loaded)
+	}
+}
+
+func TestSqliteStore_State(t *testing.T) {
+	store := NewSqliteStore(&config.LocalStoreConfig{Path: filepath.Join(t.TempDir(), "bms.db")})
+	if err := store.Open(); err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer store.Close()
+
+	if value, err := store.LoadState("peak_shaving/1"); err != nil || value != nil {
+		t.Fatalf("Expected no state, got %q, %v", value, err)
+	}
+	for _, value := range []string{`{"peak":5}`, `{"peak":6}`} {
+		if err := store.SaveState("peak_shaving/1", []byte(value)); err != nil {
+			t.Fatalf("Error saving state: %v", err)
+		}
+	}
+	value, err := store.LoadState("peak_shaving/1")
+	if err != nil {
+		t.Fatalf("Error loading state: %v", err)
+	}
+	if string(value) != `{"peak":6}` {
+		t.Errorf("Expected the latest state, got %q", value)
+	}
+}
+
+func TestSqliteStore_History(t *testing.T) {
+	store := NewSqliteStore(&config.LocalStoreConfig{Path: filepath.Join(t.TempDir(), "bms.db")})
+	if err := store.Open(); err != nil {
+		t.Fatalf("Error opening database: %v", err)
+	}
+	defer store.Close()
+
+	latest := &data_model.BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 4, Voltage: 3.3, Timestamp: 200}
+	late := &data_model.BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 4, Voltage: 3.2, Timestamp: 100, Seq: 7, Gateway: "gw-1"}
+	// a late reading replayed from the wal is appended once
+	for _, state := range []*data_model.BatteryState{latest, late, late} {
+		if err := store.Upsert(state); err != nil {
+			t.Fatalf("Error upserting battery state: %v", err)
+		}
+	}
+
+	result, err := store.GetLatest(1, 2, 3, 4)
+	if err != nil {
+		t.Fatalf("Error getting latest battery state: %v", err)
+	}
+	if result.Timestamp != 200 || result.Voltage != 3.3 {
+		t.Errorf("Expected the latest battery state, got %+v", result)
+	}
+	history, err := store.GetHistory(1, 2, 3, 4)
+	if err != nil {
+		t.Fatalf("Error getting battery history: %v", err)
+	}
+	if !reflect.DeepEqual([]*data_model.BatteryState{late}, history) {
+		t.Errorf("Expected history %+v, got %+v", []*data_model.BatteryState{late}, history)
+	}
+}
+
 func TestSqliteStore_GenerateSnapshotFile_CSV(t *testing.T) {
 	// Create a new SqliteStore with a mocked SQL database
-	cfg := &config.LocalStoreConfig{Path: ":memory:"}
+	cfg := &config.LocalStoreConfig{Path: ":memory:", SnapshotDir: t.TempDir()}
 	store := NewSqliteStore(cfg)
 
 	// Mock the SQL database
@@ -158,7 +224,7 @@ func TestSqliteStore_GenerateSnapshotFile_CSV(t *testing.T) {
 	store.db = sqlx.NewDb(mockDB, "sqlite3")
 
 	// Sample BatteryStates
-	states := []BatteryState{
+	states := []data_model.BatteryState{
 		{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 12.3, Current: 4.5, SOC: 78.9, Temperature: 25.5, State: 1, Timestamp: time.Now().Unix()},
 		{Station: 1, Container: 1, Pack: 1, Cell: 2, Voltage: 11.8, Current: 3.7, SOC: 82.1, Temperature: 26.3, State: 1, Timestamp: time.Now().Unix()},
 		// Add more states as needed
@@ -172,10 +238,11 @@ func TestSqliteStore_GenerateSnapshotFile_CSV(t *testing.T) {
 			AddRow(states[1].Station, states[1].Container, states[1].Pack, states[1].Cell, states[1].Voltage, states[1].Current, states[1].SOC, states[1].Temperature, states[1].State, states[1].Timestamp))
 
 	// Call the GenerateSnapshotFile method with CSV format
-	file, _, err := store.GenerateSnapshotFile(1, "csv")
+	manifest, err := store.GenerateSnapshotFile(1, "csv")
 	if err != nil {
-		t.Errorf("Error generating CSV snapshot file: %v", err)
+		t.Fatalf("Error generating CSV snapshot file: %v", err)
 	}
+	file := manifest.LocalPath
 
 	// Verify expectations
 	if err := mock.ExpectationsWereMet(); err != nil {
@@ -190,6 +257,12 @@ func TestSqliteStore_GenerateSnapshotFile_CSV(t *testing.T) {
 	if fileInfo.Size() == 0 {
 		t.Error("Expected non-empty CSV file, got empty file")
 	}
+	if fileInfo.Size() != manifest.Size {
+		t.Errorf("Expected manifest size %d, got %d", fileInfo.Size(), manifest.Size)
+	}
+	if manifest.RowCount != len(states) {
+		t.Errorf("Expected manifest row count %d, got %d", len(states), manifest.RowCount)
+	}
 
 	// Clean up (remove the generated file)
 	if err := os.Remove(file); err != nil {
@@ -0,0 +1,32 @@
+package data_model
+
+// PackMetadata is the metadata of a pack, the result of the intake grading
+// of a second-life module.
+type PackMetadata struct {
+	// Serial is the serial number of the module.
+	Serial string `json:"serial"`
+	// Station, Container and Pack locate the pack once installed, 0
+	// before.
+	Station   int `json:"station,omitempty"`
+	Container int `json:"container,omitempty"`
+	Pack      int `json:"pack,omitempty"`
+
+	// SOH is the state of health in percent, the tested capacity over the
+	// rated one, Capacity the tested capacity in ampere hours.
+	SOH      float64 `json:"soh"`
+	Capacity float64 `json:"capacity"`
+	// Resistance is the DC resistance in milliohms of the pulse test.
+	Resistance float64 `json:"resistance"`
+	// SelfDischarge is the open circuit voltage drop in mV per day.
+	SelfDischarge float64 `json:"self_discharge"`
+	// Tier is the grade of the module, 1 the best, 0 if rejected and
+	// Reason tells why.
+	Tier   int    `json:"tier"`
+	Reason string `json:"reason,omitempty"`
+	// Group is the id of the recommended group of modules matched in
+	// capacity and resistance, unique across the graded batches, empty if
+	// none.
+	Group string `json:"group,omitempty"`
+	// Graded is the unix time of the grading.
+	Graded int64 `json:"graded"`
+}
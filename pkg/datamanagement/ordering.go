@@ -0,0 +1,136 @@
+package data_model
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"sync"
+)
+
+// ReorderWindow is the number of recent readings of a cell remembered to
+// detect duplicates.
+const ReorderWindow = 8
+
+// UpdateResult is how a reading is applied to the live state.
+type UpdateResult int
+
+const (
+	// Applied means the reading is the latest of its cell.
+	Applied UpdateResult = iota
+	// Duplicate means the reading was seen before, it is dropped.
+	Duplicate
+	// Late means a newer reading of the cell was applied before, it doesn't
+	// change the live state, the local store appends it to the history.
+	Late
+)
+
+func (r UpdateResult) String() string {
+	switch r {
+	case Applied:
+		return "Applied"
+	case Duplicate:
+		return "Duplicate"
+	case Late:
+		return "Late"
+	default:
+		return "Unknown"
+	}
+}
+
+// cellWindow tracks the order of the readings of a cell.
+type cellWindow struct {
+	timestamp int64
+	seq       uint64
+	// digests of the recent readings, as a ring
+	recent [ReorderWindow]uint64
+	next   int
+}
+
+// digest identifies a reading by its timestamp, sequence and raw values.
+func digest(state *BatteryState) uint64 {
+	var buf [48]byte
+	binary.LittleEndian.PutUint64(buf[0:], uint64(state.Timestamp))
+	binary.LittleEndian.PutUint64(buf[8:], state.Seq)
+	binary.LittleEndian.PutUint64(buf[16:], math.Float64bits(state.Voltage))
+	binary.LittleEndian.PutUint64(buf[24:], math.Float64bits(state.Current))
+	binary.LittleEndian.PutUint64(buf[32:], math.Float64bits(state.Temperature))
+	binary.LittleEndian.PutUint64(buf[40:], math.Float64bits(state.SOC))
+	h := fnv.New64a()
+	h.Write(buf[:])
+	return h.Sum64()
+}
+
+// observe classifies the reading against the previous ones of the cell and
+// remembers it. Readings are ordered by Timestamp, then by Seq within the
+// same second, so a gateway restarting its sequence is not late.
+func (w *cellWindow) observe(state *BatteryState) UpdateResult {
+	d := digest(state)
+	for _, r := range w.recent {
+		if r == d {
+			return Duplicate
+		}
+	}
+	w.recent[w.next] = d
+	w.next = (w.next + 1) % ReorderWindow
+
+	late := state.Timestamp < w.timestamp ||
+		state.Timestamp == w.timestamp && state.Seq < w.seq
+	if late {
+		return Late
+	}
+	w.timestamp, w.seq = state.Timestamp, state.Seq
+	return Applied
+}
+
+// ReorderStats are the ordering stats of the readings of a gateway.
+type ReorderStats struct {
+	// Applied is the number of readings applied to the live state.
+	Applied uint64 `json:"applied"`
+	// Duplicates is the number of dropped duplicate readings.
+	Duplicates uint64 `json:"duplicates"`
+	// Late is the number of readings older than the live state.
+	Late uint64 `json:"late"`
+	// MaxLateness is the max seconds a late reading was behind the live
+	// state of its cell.
+	MaxLateness int64 `json:"max_lateness"`
+}
+
+// gatewayStats are the reorder stats by gateway.
+type gatewayStats struct {
+	mu    sync.Mutex
+	stats map[string]*ReorderStats
+}
+
+func (g *gatewayStats) record(gateway string, result UpdateResult, lateness int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.stats == nil {
+		g.stats = make(map[string]*ReorderStats)
+	}
+	s, ok := g.stats[gateway]
+	if !ok {
+		s = &ReorderStats{}
+		g.stats[gateway] = s
+	}
+	switch result {
+	case Applied:
+		s.Applied++
+	case Duplicate:
+		s.Duplicates++
+	case Late:
+		s.Late++
+		if lateness > s.MaxLateness {
+			s.MaxLateness = lateness
+		}
+	}
+}
+
+func (g *gatewayStats) snapshot() map[string]ReorderStats {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	stats := make(map[string]ReorderStats, len(g.stats))
+	for gateway, s := range g.stats {
+		stats[gateway] = *s
+	}
+	return stats
+}
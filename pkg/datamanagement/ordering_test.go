@@ -0,0 +1,59 @@
+package data_model
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCellWindow(t *testing.T) {
+	w := &cellWindow{}
+	reading := func(ts int64, seq uint64, voltage float64) *BatteryState {
+		return &BatteryState{Timestamp: ts, Seq: seq, Voltage: voltage}
+	}
+
+	assert.Equal(t, Applied, w.observe(reading(10, 1, 3.3)))
+	assert.Equal(t, Duplicate, w.observe(reading(10, 1, 3.3)))
+	// the sequence orders readings of the same second
+	assert.Equal(t, Applied, w.observe(reading(10, 2, 3.4)))
+	assert.Equal(t, Late, w.observe(reading(10, 0, 3.5)))
+	assert.Equal(t, Late, w.observe(reading(9, 5, 3.3)))
+	// a late reading sent again is a duplicate
+	assert.Equal(t, Duplicate, w.observe(reading(9, 5, 3.3)))
+	// a restarted sequence is not late
+	assert.Equal(t, Applied, w.observe(reading(11, 1, 3.3)))
+
+	// duplicates are detected within the window only
+	for i := int64(0); i < ReorderWindow; i++ {
+		require.Equal(t, Applied, w.observe(reading(20+i, 0, 3.3)))
+	}
+	assert.Equal(t, Late, w.observe(reading(9, 5, 3.3)))
+	assert.Equal(t, Duplicate, w.observe(reading(27, 0, 3.3)))
+}
+
+func TestBatteriesDataOrdering(t *testing.T) {
+	data := NewBatteriesData(DefaultDataShardCnt)
+	update := func(gateway string, ts int64, voltage float64) UpdateResult {
+		return data.Update(&BatteryState{
+			Station: 1, Container: 1, Pack: 1, Cell: 1,
+			Voltage: voltage, Timestamp: ts, Gateway: gateway,
+		})
+	}
+
+	assert.Equal(t, Applied, update("gw-1", 100, 3.3))
+	assert.Equal(t, Applied, update("gw-1", 105, 3.3))
+	assert.Equal(t, Duplicate, update("gw-1", 105, 3.3))
+	// a late reading from a retrying gateway doesn't change the live state
+	assert.Equal(t, Late, update("gw-2", 90, 2.5))
+	assert.Equal(t, Late, update("gw-2", 103, 2.5))
+	cell, ok := data.GetCell(1, 1, 1, 1)
+	require.True(t, ok)
+	assert.Equal(t, int64(105), cell.Timestamp)
+	assert.InDelta(t, 3.3, cell.Voltage, 1e-9)
+
+	assert.Equal(t, map[string]ReorderStats{
+		"gw-1": {Applied: 2, Duplicates: 1},
+		"gw-2": {Late: 2, MaxLateness: 15},
+	}, data.GatewayStats())
+}
@@ -0,0 +1,242 @@
+package data_model
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Parameters of the remaining time estimation.
+const (
+	// MaxChargeRate is the current of the constant current charge stage in
+	// C, the charge current is capped to it.
+	MaxChargeRate = 1.0
+	// SaturationSOC is the soc the constant current stage ends at, the
+	// current then tapers linearly with the soc down to 0 at 100%, see the
+	// charge curve of soc.ChargeCalculater.
+	SaturationSOC = 80.0
+	// FullSOC is the soc the charge ends at, the tapered current reaching
+	// C/20 of the constant current.
+	FullSOC = 99.0
+
+	// The charge current is derated linearly to 0 below
+	// MinChargeDeratingTemperature down to MinChargeTemperature and above
+	// MaxChargeDeratingTemperature up to MaxChargeTemperature.
+	MinChargeTemperature         = 0
+	MinChargeDeratingTemperature = 15
+	MaxChargeDeratingTemperature = 45
+	MaxChargeTemperature         = 55
+	// Below CapacityDeratingTemperature the capacity a cell delivers drops
+	// by CapacityDerating per degree, down to MinCapacityDerating.
+	CapacityDeratingTemperature = 25
+	CapacityDerating            = 0.006
+	MinCapacityDerating         = 0.5
+	// NeutralTemperature is the temperature of a cell with a faulty
+	// temperature sensor, derating neither its charge nor its capacity.
+	NeutralTemperature = CapacityDeratingTemperature
+)
+
+// ChargeState tells whether a group of cells charges.
+type ChargeState string
+
+const (
+	// ChargeNone means no cell charges.
+	ChargeNone ChargeState = "not_charging"
+	// ChargeActive means cells charge, TimeToFull is the time until full.
+	ChargeActive ChargeState = "charging"
+	// ChargeFull means the charging cells are full.
+	ChargeFull ChargeState = "full"
+	// ChargeBlocked means the temperature of a charging cell blocks its
+	// charge, the group won't be full.
+	ChargeBlocked ChargeState = "temperature_blocked"
+)
+
+// merge returns the state of a group of cells of the states s and o, a
+// blocked cell blocks the group and a charging one keeps it charging.
+func (s ChargeState) merge(o ChargeState) ChargeState {
+	for _, state := range []ChargeState{ChargeBlocked, ChargeActive, ChargeFull} {
+		if s == state || o == state {
+			return state
+		}
+	}
+	return ChargeNone
+}
+
+// RemainingTime is the estimated time until a group of cells is full or
+// empty at its current power.
+type RemainingTime struct {
+	// Power is the power of the cells in kW, positive charges.
+	Power float64 `json:"power"`
+	// Capacity is the capacity of the cells adjusted by their soh in
+	// ampere hours, SOC the state of charge of that capacity in percent.
+	Capacity float64 `json:"capacity"`
+	SOC      float64 `json:"soc"`
+	// TimeToFull is the time in hours until the last charging cell is
+	// full, TimeToEmpty until the first discharging cell is empty, 0 if no
+	// cell charges or discharges. Charge tells why TimeToFull is 0.
+	TimeToFull  float64     `json:"time_to_full,omitempty"`
+	TimeToEmpty float64     `json:"time_to_empty,omitempty"`
+	Charge      ChargeState `json:"charge"`
+}
+
+// add adds the cell at the temperature to the group.
+func (r *RemainingTime) add(cell *BatteryState, temperature float64) {
+	capacity := cell.MaxCapacity
+	if cell.SOH > 0 {
+		capacity *= cell.SOH / 100
+	}
+	r.Power += cell.Voltage * cell.Current / 1000
+	if total := r.Capacity + capacity; total > 0 {
+		r.SOC = (r.SOC*r.Capacity + cell.SOC*capacity) / total
+	}
+	r.Capacity += capacity
+	if capacity == 0 {
+		return
+	}
+	switch StateOf(cell.Current) {
+	case Charging:
+		hours, state := timeToFull(cell.SOC, cell.Current, capacity, temperature)
+		r.TimeToFull = math.Max(r.TimeToFull, hours)
+		r.Charge = r.Charge.merge(state)
+	case Discharging:
+		if t := timeToEmpty(cell.SOC, cell.Current, capacity, temperature); r.TimeToEmpty == 0 || t < r.TimeToEmpty {
+			r.TimeToEmpty = t
+		}
+	}
+}
+
+// merge adds the cells of o to the group.
+func (r *RemainingTime) merge(o RemainingTime) {
+	r.Power += o.Power
+	if total := r.Capacity + o.Capacity; total > 0 {
+		r.SOC = (r.SOC*r.Capacity + o.SOC*o.Capacity) / total
+	}
+	r.Capacity += o.Capacity
+	r.TimeToFull = math.Max(r.TimeToFull, o.TimeToFull)
+	r.Charge = r.Charge.merge(o.Charge)
+	if o.TimeToEmpty > 0 && (r.TimeToEmpty == 0 || o.TimeToEmpty < r.TimeToEmpty) {
+		r.TimeToEmpty = o.TimeToEmpty
+	}
+}
+
+// chargeDerating returns the fraction of the max charge current a cell
+// accepts at the temperature.
+func chargeDerating(temperature float64) float64 {
+	switch {
+	case temperature <= MinChargeTemperature || temperature >= MaxChargeTemperature:
+		return 0
+	case temperature < MinChargeDeratingTemperature:
+		return (temperature - MinChargeTemperature) / (MinChargeDeratingTemperature - MinChargeTemperature)
+	case temperature > MaxChargeDeratingTemperature:
+		return (MaxChargeTemperature - temperature) / (MaxChargeTemperature - MaxChargeDeratingTemperature)
+	}
+	return 1
+}
+
+// capacityDerating returns the fraction of its capacity a cell delivers at
+// the temperature.
+func capacityDerating(temperature float64) float64 {
+	if temperature >= CapacityDeratingTemperature {
+		return 1
+	}
+	return math.Max(MinCapacityDerating, 1-CapacityDerating*(CapacityDeratingTemperature-temperature))
+}
+
+// timeToFull returns the time in hours a cell charging at the current
+// takes to be full, following the constant current stage up to
+// SaturationSOC and the tapering current above, and its charge state.
+func timeToFull(soc, current, capacity, temperature float64) (float64, ChargeState) {
+	limit := MaxChargeRate * capacity * chargeDerating(temperature)
+	if limit <= 0 {
+		return 0, ChargeBlocked
+	}
+	if soc >= FullSOC {
+		return 0, ChargeFull
+	}
+	hours, cc := 0.0, math.Min(current, limit)
+	if soc < SaturationSOC {
+		hours = (SaturationSOC - soc) / 100 * capacity / cc
+		soc = SaturationSOC
+	} else {
+		// the current already tapers from the constant current
+		cc = math.Min(current*(100-SaturationSOC)/(100-soc), limit)
+	}
+	// the tapering current makes the soc approach 100% exponentially
+	tau := (100 - SaturationSOC) / 100 * capacity / cc
+	return hours + tau*math.Log((100-soc)/(100-FullSOC)), ChargeActive
+}
+
+// timeToEmpty returns the time in hours a cell discharging at the current
+// takes to be empty, a cold cell delivering less of its charge.
+func timeToEmpty(soc, current, capacity, temperature float64) float64 {
+	return soc / 100 * capacity * capacityDerating(temperature) / -current
+}
+
+// PackRemainingTime is the remaining time of a pack.
+type PackRemainingTime struct {
+	Pack int `json:"pack"`
+	RemainingTime
+}
+
+// ContainerRemainingTime is the remaining time of a container and its
+// packs.
+type ContainerRemainingTime struct {
+	Container int `json:"container"`
+	RemainingTime
+	Packs []PackRemainingTime `json:"packs"`
+}
+
+// StationRemainingTime is the remaining time of a station, its containers
+// and their packs.
+type StationRemainingTime struct {
+	Station int `json:"station"`
+	RemainingTime
+	Containers []ContainerRemainingTime `json:"containers"`
+}
+
+// RemainingTime estimates the time until the station, its containers and
+// their packs are full or empty from the latest readings of their cells,
+// the soc as of the last ReCalculate. Cells with a faulty voltage sensor
+// are excluded, cells with a faulty temperature sensor are taken at
+// NeutralTemperature.
+func (s *BatteriesData) RemainingTime(station int) (StationRemainingTime, bool) {
+	shard := s.shards[station%s.shardCnt]
+	shard.mu.RLock()
+	defer shard.mu.RUnlock()
+
+	stationData, ok := shard.stationData[station]
+	if !ok {
+		return StationRemainingTime{}, false
+	}
+	now := time.Now()
+	result := StationRemainingTime{Station: station}
+	result.Charge = ChargeNone
+	for container, containerData := range stationData.containerData {
+		c := ContainerRemainingTime{Container: container}
+		c.Charge = ChargeNone
+		for pack, packData := range containerData.packData {
+			p := PackRemainingTime{Pack: pack}
+			p.Charge = ChargeNone
+			for id, cell := range packData.cellData {
+				voltage, temperature := packData.cellHealth[id].report(packData.opts.health, now)
+				if voltage != 0 {
+					continue
+				}
+				if temperature != 0 {
+					p.add(cell, NeutralTemperature)
+				} else {
+					p.add(cell, cell.Temperature)
+				}
+			}
+			c.merge(p.RemainingTime)
+			c.Packs = append(c.Packs, p)
+		}
+		sort.Slice(c.Packs, func(i, j int) bool { return c.Packs[i].Pack < c.Packs[j].Pack })
+		result.merge(c.RemainingTime)
+		result.Containers = append(result.Containers, c)
+	}
+	sort.Slice(result.Containers, func(i, j int) bool {
+		return result.Containers[i].Container < result.Containers[j].Container
+	})
+	return result, true
+}
@@ -0,0 +1,105 @@
+package data_model
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemainingTime(t *testing.T) {
+	data := NewBatteriesData(DefaultDataShardCnt)
+	for _, state := range []*BatteryState{
+		// 50% soc discharging at 0.5C
+		{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.35, Current: -50, Temperature: 25, MaxCapacity: 100},
+		{Station: 1, Container: 1, Pack: 1, Cell: 2, Voltage: 3.35, Current: -50, Temperature: 25, MaxCapacity: 100},
+		// a cold aged cell
+		{Station: 1, Container: 1, Pack: 2, Cell: 1, Voltage: 3.35, Current: -50, Temperature: -5, SOH: 80, MaxCapacity: 100},
+		// 15% soc charging at 0.8C, derated to 0.5C at 50°C
+		{Station: 1, Container: 2, Pack: 1, Cell: 1, Voltage: 3.8, Current: 80, Temperature: 50, MaxCapacity: 100, State: Charging},
+		// 90% soc in the saturation stage
+		{Station: 1, Container: 2, Pack: 2, Cell: 1, Voltage: 4.1, Current: 0.5, Temperature: 25, MaxCapacity: 100, State: Charging},
+		// charging below freezing
+		{Station: 1, Container: 3, Pack: 1, Cell: 1, Voltage: 3.8, Current: 10, Temperature: -5, MaxCapacity: 100, State: Charging},
+		// the temperature sensor reads out of range
+		{Station: 1, Container: 4, Pack: 1, Cell: 1, Voltage: 3.35, Current: -50, Temperature: -50, MaxCapacity: 100},
+	} {
+		data.Update(state)
+	}
+	data.ReCalculate()
+
+	_, ok := data.RemainingTime(2)
+	assert.False(t, ok)
+	r, ok := data.RemainingTime(1)
+	require.True(t, ok)
+	require.Len(t, r.Containers, 4)
+	require.Len(t, r.Containers[0].Packs, 2)
+
+	pack := r.Containers[0].Packs[0]
+	assert.Equal(t, 1, pack.Pack)
+	assert.InDelta(t, 200, pack.Capacity, 1e-9)
+	assert.InDelta(t, 50, pack.SOC, 1e-6)
+	assert.InDelta(t, -2*3.35*50/1000, pack.Power, 1e-6)
+	assert.InDelta(t, 1, pack.TimeToEmpty, 1e-6)
+	assert.Zero(t, pack.TimeToFull)
+	assert.Equal(t, ChargeNone, pack.Charge)
+	// the cold cell delivers 82% of its 80Ah
+	pack = r.Containers[0].Packs[1]
+	assert.InDelta(t, 80, pack.Capacity, 1e-9)
+	assert.InDelta(t, 40*0.82/50, pack.TimeToEmpty, 1e-6)
+	assert.InDelta(t, 40*0.82/50, r.Containers[0].TimeToEmpty, 1e-6)
+
+	// the constant current stage up to 80% then the tapering current
+	pack = r.Containers[1].Packs[0]
+	assert.InDelta(t, 15, pack.SOC, 1e-6)
+	assert.InDelta(t, 0.65/0.5+0.4*math.Log(20), pack.TimeToFull, 1e-6)
+	assert.Equal(t, ChargeActive, pack.Charge)
+	pack = r.Containers[1].Packs[1]
+	assert.InDelta(t, 90, pack.SOC, 1e-6)
+	assert.InDelta(t, 20*math.Log(10), pack.TimeToFull, 1e-6)
+
+	assert.Equal(t, ChargeActive, r.Containers[1].Charge)
+
+	// the cold cell can't charge
+	pack = r.Containers[2].Packs[0]
+	assert.Zero(t, pack.TimeToFull)
+	assert.Equal(t, ChargeBlocked, pack.Charge)
+	assert.Equal(t, ChargeBlocked, r.Charge)
+	// the faulty temperature sensor doesn't derate the capacity
+	assert.InDelta(t, 1, r.Containers[3].TimeToEmpty, 1e-6)
+
+	assert.InDelta(t, 680, r.Capacity, 1e-9)
+	assert.InDelta(t, (200*50+80*50+100*15+100*90+100*15+100*50)/680.0, r.SOC, 1e-6)
+	assert.InDelta(t, 20*math.Log(10), r.TimeToFull, 1e-6)
+	assert.InDelta(t, 40*0.82/50, r.TimeToEmpty, 1e-6)
+}
+
+func TestTimeToFull(t *testing.T) {
+	// no charge below freezing nor above the max temperature
+	for _, c := range []struct {
+		soc, temperature float64
+		state            ChargeState
+	}{
+		{50, 0, ChargeBlocked},
+		{50, 60, ChargeBlocked},
+		{99.5, 25, ChargeFull},
+	} {
+		hours, state := timeToFull(c.soc, 10, 100, c.temperature)
+		assert.Zero(t, hours)
+		assert.Equal(t, c.state, state)
+	}
+	// half the current at 7.5°C
+	hours, state := timeToFull(50, 100, 100, 7.5)
+	assert.InDelta(t, 0.3/0.5+0.4*math.Log(20), hours, 1e-9)
+	assert.Equal(t, ChargeActive, state)
+	hours, _ = timeToFull(50, 10, 100, 7.5)
+	assert.InDelta(t, 0.3/0.1+2*math.Log(20), hours, 1e-9)
+}
+
+func TestChargeStateMerge(t *testing.T) {
+	assert.Equal(t, ChargeNone, ChargeNone.merge(ChargeNone))
+	assert.Equal(t, ChargeFull, ChargeNone.merge(ChargeFull))
+	assert.Equal(t, ChargeActive, ChargeFull.merge(ChargeActive))
+	assert.Equal(t, ChargeBlocked, ChargeBlocked.merge(ChargeActive))
+}
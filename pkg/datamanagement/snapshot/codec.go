@@ -0,0 +1,406 @@
+package snapshot
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+const (
+	// CompressionGzip compresses snapshot files with gzip before upload.
+	CompressionGzip = "gzip"
+
+	// EncryptionAES256GCM encrypts snapshot files with AES-256-GCM in
+	// segments, every segment is sealed with the same data key and a nonce
+	// derived from the nonce prefix, the segment index and a last flag, so a
+	// truncated or reordered file fails to decrypt.
+	EncryptionAES256GCM = "AES-256-GCM-SEGMENTED"
+
+	// DefaultSegmentSize is the plaintext size of an encrypted segment.
+	DefaultSegmentSize = 64 << 10
+
+	dataKeySize     = 32
+	noncePrefixSize = 7
+)
+
+// ErrDecrypt is returned when an encrypted snapshot file can't be decrypted,
+// e.g. it is corrupted, tampered with or encrypted by another key.
+var ErrDecrypt = errors.New("failed to decrypt snapshot file")
+
+// Encryption describes how a snapshot file is encrypted, it is recorded in
+// the manifest so the file can be decrypted with the key-encryption key.
+type Encryption struct {
+	// Algorithm is the encryption algorithm.
+	Algorithm string `json:"algorithm"`
+	// KeyID is the id of the key-encryption key which wraps the data key.
+	KeyID string `json:"key_id"`
+	// WrappedKey is the data key of the file wrapped by the key-encryption key.
+	WrappedKey []byte `json:"wrapped_key"`
+	// NoncePrefix is the random prefix of segment nonces.
+	NoncePrefix []byte `json:"nonce_prefix"`
+	// SegmentSize is the plaintext size of segments.
+	SegmentSize int `json:"segment_size"`
+}
+
+// KeyWrapper wraps per-file data keys with a key-encryption key (KEK), so
+// only the wrapped data key is stored next to the data. It can be backed by
+// a local key or a KMS.
+type KeyWrapper interface {
+	// KeyID returns the id of the key-encryption key used to wrap new keys.
+	KeyID() string
+	// WrapKey wraps the data key.
+	WrapKey(dataKey []byte) ([]byte, error)
+	// UnwrapKey unwraps a data key wrapped by the key-encryption key keyID.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// aesKeyWrapper wraps data keys with a local AES-256 key-encryption key.
+type aesKeyWrapper struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// NewAESKeyWrapper creates a key wrapper with a 32 bytes AES key-encryption key.
+func NewAESKeyWrapper(id string, kek []byte) (KeyWrapper, error) {
+	if id == "" {
+		return nil, errors.New("empty key id")
+	}
+	if len(kek) != dataKeySize {
+		return nil, fmt.Errorf("invalid key-encryption key size %d, expect %d", len(kek), dataKeySize)
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	return &aesKeyWrapper{id: id, aead: aead}, nil
+}
+
+// LoadAESKeyWrapper creates a key wrapper with the hex encoded AES
+// key-encryption key in the file.
+func LoadAESKeyWrapper(id, path string) (KeyWrapper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	kek, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key file: %w", err)
+	}
+	return NewAESKeyWrapper(id, kek)
+}
+
+func (w *aesKeyWrapper) KeyID() string {
+	return w.id
+}
+
+func (w *aesKeyWrapper) WrapKey(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, w.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	// the key id is authenticated, so a wrapped key can't be moved to another key
+	return w.aead.Seal(nonce, nonce, dataKey, []byte(w.id)), nil
+}
+
+func (w *aesKeyWrapper) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != w.id {
+		return nil, fmt.Errorf("%w: unknown key id %s", ErrDecrypt, keyID)
+	}
+	if len(wrapped) < w.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: invalid wrapped key", ErrDecrypt)
+	}
+	nonce := wrapped[:w.aead.NonceSize()]
+	dataKey, err := w.aead.Open(nil, nonce, wrapped[w.aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("%w: failed to unwrap data key: %v", ErrDecrypt, err)
+	}
+	return dataKey, nil
+}
+
+// EncodeOptions are the options to encode snapshot files for upload.
+type EncodeOptions struct {
+	// Compression is the compression, CompressionGzip or empty for none.
+	Compression string
+	// Keys wraps the data keys, nil means no encryption.
+	Keys KeyWrapper
+	// SegmentSize is the plaintext size of encrypted segments,
+	// zero means DefaultSegmentSize.
+	SegmentSize int
+}
+
+// Enabled returns whether the snapshot files need to be encoded at all.
+func (o *EncodeOptions) Enabled() bool {
+	return o != nil && (o.Compression != "" || o.Keys != nil)
+}
+
+// NewEncodeOptions creates the encode options from the configuration, the
+// key-encryption key is loaded from the key file.
+func NewEncodeOptions(cfg *config.SnapshotUploadConfig) (*EncodeOptions, error) {
+	opts := &EncodeOptions{Compression: cfg.Compression}
+	if opts.Compression != "" && opts.Compression != CompressionGzip {
+		return nil, fmt.Errorf("unsupported compression: %s", opts.Compression)
+	}
+	if cfg.KeyID != "" {
+		keys, err := LoadAESKeyWrapper(cfg.KeyID, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts.Keys = keys
+	}
+	return opts, nil
+}
+
+// Encode compresses and then encrypts the snapshot file read from src and
+// writes the result to dst, the encoding is recorded in the manifest. The
+// caller records the size and checksum of the result.
+func Encode(dst io.Writer, src io.Reader, m *Manifest, opts *EncodeOptions) error {
+	if opts.Compression != "" && opts.Compression != CompressionGzip {
+		return fmt.Errorf("unsupported compression: %s", opts.Compression)
+	}
+
+	var encryption *Encryption
+	w := io.WriteCloser(nopWriteCloser{dst})
+	if opts.Keys != nil {
+		dataKey := make([]byte, dataKeySize)
+		if _, err := rand.Read(dataKey); err != nil {
+			return fmt.Errorf("failed to generate data key: %w", err)
+		}
+		wrapped, err := opts.Keys.WrapKey(dataKey)
+		if err != nil {
+			return fmt.Errorf("failed to wrap data key: %w", err)
+		}
+		encryption = &Encryption{
+			Algorithm:   EncryptionAES256GCM,
+			KeyID:       opts.Keys.KeyID(),
+			WrappedKey:  wrapped,
+			NoncePrefix: make([]byte, noncePrefixSize),
+			SegmentSize: opts.SegmentSize,
+		}
+		if encryption.SegmentSize <= 0 {
+			encryption.SegmentSize = DefaultSegmentSize
+		}
+		if _, err := rand.Read(encryption.NoncePrefix); err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		if w, err = newSegmentWriter(dst, dataKey, encryption); err != nil {
+			return err
+		}
+	}
+
+	// compression must happen before encryption, ciphertext doesn't compress
+	var gz *gzip.Writer
+	out := io.Writer(w)
+	if opts.Compression == CompressionGzip {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	if _, err := io.Copy(out, src); err != nil {
+		return fmt.Errorf("failed to encode snapshot file: %w", err)
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			return fmt.Errorf("failed to compress snapshot file: %w", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	m.Compression = opts.Compression
+	m.Encryption = encryption
+	return nil
+}
+
+// Decode reverses Encode by the encoding recorded in the manifest, keys is
+// only required if the snapshot file is encrypted.
+func Decode(dst io.Writer, src io.Reader, m *Manifest, keys KeyWrapper) error {
+	r := src
+	if m.Encryption != nil {
+		if m.Encryption.Algorithm != EncryptionAES256GCM {
+			return fmt.Errorf("unsupported encryption: %s", m.Encryption.Algorithm)
+		}
+		if keys == nil {
+			return fmt.Errorf("%w: no key to decrypt with key id %s", ErrDecrypt, m.Encryption.KeyID)
+		}
+		dataKey, err := keys.UnwrapKey(m.Encryption.KeyID, m.Encryption.WrappedKey)
+		if err != nil {
+			return err
+		}
+		if r, err = newSegmentReader(src, dataKey, m.Encryption); err != nil {
+			return err
+		}
+	}
+
+	switch m.Compression {
+	case "":
+	case CompressionGzip:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("failed to decompress snapshot file: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return fmt.Errorf("unsupported compression: %s", m.Compression)
+	}
+
+	if _, err := io.Copy(dst, r); err != nil {
+		return fmt.Errorf("failed to decode snapshot file: %w", err)
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return aead, nil
+}
+
+// segmentNonce returns the nonce of a segment: the nonce prefix, the
+// big-endian segment index and a byte which is 1 only for the last segment.
+func segmentNonce(prefix []byte, index uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], index)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// segmentWriter encrypts the written data in segments. A full segment is
+// held back until more data arrives, since only Close knows the last one.
+type segmentWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	enc    *Encryption
+	buf    []byte
+	sealed []byte
+	index  uint32
+}
+
+func newSegmentWriter(dst io.Writer, dataKey []byte, enc *Encryption) (*segmentWriter, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentWriter{dst: dst, aead: aead, enc: enc, buf: make([]byte, 0, enc.SegmentSize)}, nil
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == w.enc.SegmentSize {
+			if err := w.seal(false); err != nil {
+				return 0, err
+			}
+		}
+		c := copy(w.buf[len(w.buf):w.enc.SegmentSize], p)
+		w.buf = w.buf[:len(w.buf)+c]
+		p = p[c:]
+	}
+	return n, nil
+}
+
+func (w *segmentWriter) Close() error {
+	return w.seal(true)
+}
+
+func (w *segmentWriter) seal(last bool) error {
+	nonce := segmentNonce(w.enc.NoncePrefix, w.index, last)
+	w.sealed = w.aead.Seal(w.sealed[:0], nonce, w.buf, nil)
+	if _, err := w.dst.Write(w.sealed); err != nil {
+		return fmt.Errorf("failed to write encrypted segment: %w", err)
+	}
+	w.index++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// segmentReader decrypts segments written by segmentWriter.
+type segmentReader struct {
+	src   *bufio.Reader
+	aead  cipher.AEAD
+	enc   *Encryption
+	buf   []byte
+	plain []byte
+	index uint32
+	done  bool
+}
+
+func newSegmentReader(src io.Reader, dataKey []byte, enc *Encryption) (*segmentReader, error) {
+	if enc.SegmentSize <= 0 || len(enc.NoncePrefix) != noncePrefixSize {
+		return nil, fmt.Errorf("%w: invalid encryption parameters", ErrDecrypt)
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{
+		src:  bufio.NewReader(src),
+		aead: aead,
+		enc:  enc,
+		buf:  make([]byte, enc.SegmentSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *segmentReader) open() error {
+	n, err := io.ReadFull(r.src, r.buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read encrypted segment: %w", err)
+	}
+	// a short segment is the last one, a full one is the last if nothing follows
+	last := n < len(r.buf)
+	if !last {
+		if _, err := r.src.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		}
+	}
+
+	nonce := segmentNonce(r.enc.NoncePrefix, r.index, last)
+	plain, err := r.aead.Open(r.buf[:0], nonce, r.buf[:n], nil)
+	if err != nil {
+		return fmt.Errorf("%w: segment %d: %v", ErrDecrypt, r.index, err)
+	}
+	r.plain = plain
+	r.index++
+	r.done = last
+	return nil
+}
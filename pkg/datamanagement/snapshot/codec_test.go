@@ -0,0 +1,111 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+func newTestKeys(t *testing.T, id string) KeyWrapper {
+	kek := make([]byte, 32)
+	_, err := rand.Read(kek)
+	require.NoError(t, err)
+	keys, err := NewAESKeyWrapper(id, kek)
+	require.NoError(t, err)
+	return keys
+}
+
+func TestEncodeDecode(t *testing.T) {
+	keys := newTestKeys(t, "kek-1")
+	data := bytes.Repeat([]byte(CsvHeader), 100)
+
+	for _, opts := range []*EncodeOptions{
+		{Compression: CompressionGzip},
+		{Keys: keys, SegmentSize: 100},
+		{Keys: keys, SegmentSize: len(data)},
+		{Compression: CompressionGzip, Keys: keys, SegmentSize: 64},
+	} {
+		var m Manifest
+		var encoded bytes.Buffer
+		require.NoError(t, Encode(&encoded, bytes.NewReader(data), &m, opts))
+		assert.True(t, m.Encoded())
+		assert.Equal(t, opts.Compression, m.Compression)
+		assert.Equal(t, opts.Keys != nil, m.Encryption != nil)
+		if opts.Compression != "" {
+			assert.Less(t, encoded.Len(), len(data))
+		}
+		assert.NotContains(t, encoded.String(), CsvHeader)
+
+		// the manifest survives a json round trip
+		raw, err := m.Marshal()
+		require.NoError(t, err)
+		decodedManifest, err := UnmarshalManifest(raw)
+		require.NoError(t, err)
+
+		var decoded bytes.Buffer
+		require.NoError(t, Decode(&decoded, bytes.NewReader(encoded.Bytes()), decodedManifest, keys))
+		assert.Equal(t, data, decoded.Bytes())
+	}
+}
+
+func TestDecodeTampered(t *testing.T) {
+	keys := newTestKeys(t, "kek-1")
+	data := bytes.Repeat([]byte("0123456789"), 100)
+
+	var m Manifest
+	var encoded bytes.Buffer
+	require.NoError(t, Encode(&encoded, bytes.NewReader(data), &m, &EncodeOptions{Keys: keys, SegmentSize: 100}))
+	// 10 segments of 100 bytes, each with a 16 bytes tag
+	segment := 100 + 16
+	require.Equal(t, 10*segment, encoded.Len())
+
+	decode := func(encoded []byte, keys KeyWrapper) error {
+		return Decode(&bytes.Buffer{}, bytes.NewReader(encoded), &m, keys)
+	}
+
+	// flipped bit
+	flipped := bytes.Clone(encoded.Bytes())
+	flipped[150] ^= 1
+	assert.ErrorIs(t, decode(flipped, keys), ErrDecrypt)
+
+	// truncated at a segment boundary
+	assert.ErrorIs(t, decode(encoded.Bytes()[:9*segment], keys), ErrDecrypt)
+
+	// reordered segments
+	reordered := bytes.Clone(encoded.Bytes())
+	copy(reordered[:segment], encoded.Bytes()[segment:2*segment])
+	copy(reordered[segment:2*segment], encoded.Bytes()[:segment])
+	assert.ErrorIs(t, decode(reordered, keys), ErrDecrypt)
+
+	// another key-encryption key, or no key at all
+	assert.ErrorIs(t, decode(encoded.Bytes(), newTestKeys(t, "kek-1")), ErrDecrypt)
+	assert.ErrorIs(t, decode(encoded.Bytes(), newTestKeys(t, "kek-2")), ErrDecrypt)
+	assert.ErrorIs(t, decode(encoded.Bytes(), nil), ErrDecrypt)
+}
+
+func TestNewEncodeOptions(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "kek")
+	require.NoError(t, os.WriteFile(keyFile, []byte(hex.EncodeToString(make([]byte, 32))+"\n"), 0600))
+
+	opts, err := NewEncodeOptions(&config.SnapshotUploadConfig{Compression: CompressionGzip, KeyID: "kek-1", KeyFile: keyFile})
+	require.NoError(t, err)
+	assert.True(t, opts.Enabled())
+	assert.Equal(t, "kek-1", opts.Keys.KeyID())
+
+	opts, err = NewEncodeOptions(&config.SnapshotUploadConfig{})
+	require.NoError(t, err)
+	assert.False(t, opts.Enabled())
+
+	_, err = NewEncodeOptions(&config.SnapshotUploadConfig{Compression: "lz4"})
+	assert.Error(t, err)
+	require.NoError(t, os.WriteFile(keyFile, []byte("abcd"), 0600))
+	_, err = NewEncodeOptions(&config.SnapshotUploadConfig{KeyID: "kek-1", KeyFile: keyFile})
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package snapshot
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// CsvHeader is the header line of csv snapshot files, delimiter is comma.
+const CsvHeader = "station,container,pack,cell,voltage,current,soc,temperature,state,timestamp\n"
+
+// FormatCsvRow formats a battery state as a csv snapshot row.
+func FormatCsvRow(state *data_model.BatteryState) string {
+	return fmt.Sprintf("%d,%d,%d,%d,%f,%f,%f,%f,%d,%d\n",
+		state.Station, state.Container, state.Pack, state.Cell,
+		state.Voltage, state.Current, state.SOC, state.Temperature, state.State, state.Timestamp)
+}
+
+// ReadCsv reads battery states from a csv snapshot file.
+func ReadCsv(r io.Reader) ([]data_model.BatteryState, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = strings.Count(CsvHeader, ",") + 1
+	reader.ReuseRecord = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read csv header: %w", err)
+	}
+	if strings.Join(header, ",")+"\n" != CsvHeader {
+		return nil, fmt.Errorf("unexpected csv header: %s", strings.Join(header, ","))
+	}
+
+	var states []data_model.BatteryState
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read csv row: %w", err)
+		}
+		state, err := parseCsvRow(record)
+		if err != nil {
+			line, _ := reader.FieldPos(0)
+			return nil, fmt.Errorf("invalid csv row at line %d: %w", line, err)
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+func parseCsvRow(record []string) (data_model.BatteryState, error) {
+	var (
+		state data_model.BatteryState
+		ints  [5]int
+		reals [4]float64
+		err   error
+	)
+	// station, container, pack, cell, ..., state
+	for i, field := range []string{record[0], record[1], record[2], record[3], record[8]} {
+		if ints[i], err = strconv.Atoi(field); err != nil {
+			return state, err
+		}
+	}
+	// voltage, current, soc, temperature
+	for i, field := range record[4:8] {
+		if reals[i], err = strconv.ParseFloat(field, 64); err != nil {
+			return state, err
+		}
+	}
+	if state.Timestamp, err = strconv.ParseInt(record[9], 10, 64); err != nil {
+		return state, err
+	}
+
+	state.Station, state.Container, state.Pack, state.Cell = ints[0], ints[1], ints[2], ints[3]
+	state.State = data_model.State(ints[4])
+	state.Voltage, state.Current, state.SOC, state.Temperature = reals[0], reals[1], reals[2], reals[3]
+	return state, nil
+}
@@ -0,0 +1,35 @@
+package snapshot
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+func TestCsvRoundTrip(t *testing.T) {
+	states := []data_model.BatteryState{
+		{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.7, Current: 0.5, SOC: 78.5, Temperature: 25.5, State: data_model.Charging, Timestamp: 1700000000},
+		{Station: 1, Container: 2, Pack: 3, Cell: 4, Voltage: 3.2, Current: -1.25, SOC: 12, Temperature: -5, State: data_model.Discharging, Timestamp: 1700000001},
+	}
+
+	var b strings.Builder
+	b.WriteString(CsvHeader)
+	for i := range states {
+		b.WriteString(FormatCsvRow(&states[i]))
+	}
+
+	got, err := ReadCsv(strings.NewReader(b.String()))
+	require.NoError(t, err)
+	assert.Equal(t, states, got)
+}
+
+func TestReadCsvInvalid(t *testing.T) {
+	_, err := ReadCsv(strings.NewReader("a,b,c\n"))
+	assert.Error(t, err)
+
+	_, err = ReadCsv(strings.NewReader(CsvHeader + "1,1,1,x,3.7,0.5,78.5,25.5,2,1700000000\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,171 @@
+package snapshot
+
+// layout.go
+// Snapshot files are laid out in Hive-style partitions, both in the local
+// snapshot directory and in the cloud storage:
+//
+//	station=<station>/date=<yyyy-mm-dd>/hour=<hh>/<unix timestamp>.<format>
+//
+// Date and hour are in UTC. Query engines like Spark and Athena recognize
+// the "key=value" directories as partition columns, so a query filtering on
+// station and date only reads the matching directories.
+//
+// A compressed or encrypted object has the extensions of its encoding
+// appended, e.g. "<unix timestamp>.csv.gz.enc", and the manifests are kept
+// under ManifestPrefix, so every object in the partitions is a snapshot file
+// readable by its extensions.
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stationPartition = "station="
+	datePartition    = "date="
+	hourPartition    = "hour="
+
+	dateLayout = "2006-01-02"
+)
+
+// Ref identifies a snapshot file by its key.
+type Ref struct {
+	// Key is the key of the snapshot file or object relative to the
+	// snapshot root, with the extensions of its encoding if any.
+	Key string
+	// Station is the station id of the snapshot.
+	Station int
+	// CreatedAt is the unix time when the snapshot was generated.
+	CreatedAt int64
+	// Format is the file format of the snapshot.
+	Format string
+}
+
+// FilePath returns the key of a snapshot file relative to the snapshot root.
+// The same layout is used by the local snapshot directory and the cloud storage.
+func FilePath(station int, createdAt int64, format string) string {
+	t := time.Unix(createdAt, 0).UTC()
+	return path.Join(
+		stationPartition+strconv.Itoa(station),
+		datePartition+t.Format(dateLayout),
+		fmt.Sprintf("%s%02d", hourPartition, t.Hour()),
+		fmt.Sprintf("%d.%s", createdAt, format),
+	)
+}
+
+// StationPrefix returns the key prefix of all snapshots of the station.
+func StationPrefix(station int) string {
+	return stationPartition + strconv.Itoa(station) + "/"
+}
+
+// DatePrefix returns the key prefix of the snapshots of the station in the
+// UTC date of t.
+func DatePrefix(station int, t time.Time) string {
+	return StationPrefix(station) + datePartition + t.UTC().Format(dateLayout) + "/"
+}
+
+// DatePrefixes returns the key prefixes of all date partitions of the station
+// which overlap [start, end].
+func DatePrefixes(station int, start, end time.Time) []string {
+	var prefixes []string
+	day := start.UTC().Truncate(24 * time.Hour)
+	for !day.After(end.UTC()) {
+		prefixes = append(prefixes, DatePrefix(station, day))
+		day = day.Add(24 * time.Hour)
+	}
+	return prefixes
+}
+
+// ParseKey parses the key of a snapshot file.
+func ParseKey(key string) (*Ref, error) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 ||
+		!strings.HasPrefix(parts[0], stationPartition) ||
+		!strings.HasPrefix(parts[1], datePartition) ||
+		!strings.HasPrefix(parts[2], hourPartition) {
+		return nil, fmt.Errorf("invalid snapshot key: %s", key)
+	}
+
+	station, err := strconv.Atoi(strings.TrimPrefix(parts[0], stationPartition))
+	if err != nil {
+		return nil, fmt.Errorf("invalid station in snapshot key %s: %w", key, err)
+	}
+	name, format, ok := strings.Cut(parts[3], ".")
+	format = strings.TrimSuffix(format, EncryptedExtension)
+	format = strings.TrimSuffix(format, GzipExtension)
+	if !ok || format == "" || strings.Contains(format, ".") {
+		return nil, fmt.Errorf("invalid file name in snapshot key: %s", key)
+	}
+	createdAt, err := strconv.ParseInt(name, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp in snapshot key %s: %w", key, err)
+	}
+
+	return &Ref{Key: key, Station: station, CreatedAt: createdAt, Format: format}, nil
+}
+
+// FileKey returns the key of the snapshot file, without the extensions of
+// the encoding of the object.
+func (r *Ref) FileKey() string {
+	return FilePath(r.Station, r.CreatedAt, r.Format)
+}
+
+// ManifestKey returns the key of the manifest of the snapshot.
+func (r *Ref) ManifestKey() string {
+	return ManifestKey(r.FileKey())
+}
+
+// FilterRefs parses the keys and returns the snapshots of the station created
+// in [start, end], ordered by creation time. Keys which are not snapshot
+// files are skipped.
+func FilterRefs(keys []string, station int, start, end time.Time) []*Ref {
+	var refs []*Ref
+	for _, key := range keys {
+		ref, err := ParseKey(key)
+		if err != nil || ref.Station != station {
+			continue
+		}
+		if ref.CreatedAt < start.Unix() || ref.CreatedAt > end.Unix() {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+
+	sort.Slice(refs, func(i, j int) bool {
+		return refs[i].CreatedAt < refs[j].CreatedAt
+	})
+	return refs
+}
+
+// ListDir lists the snapshot files of the station created in [start, end]
+// under the local snapshot directory.
+func ListDir(dir string, station int, start, end time.Time) ([]*Ref, error) {
+	var keys []string
+	for _, prefix := range DatePrefixes(station, start, end) {
+		root := filepath.Join(dir, filepath.FromSlash(prefix))
+		err := filepath.WalkDir(root, func(p string, d os.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, filepath.ToSlash(rel))
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to list snapshot directory: %w", err)
+		}
+	}
+	return FilterRefs(keys, station, start, end), nil
+}
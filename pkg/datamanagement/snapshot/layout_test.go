@@ -0,0 +1,74 @@
+package snapshot
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilePath(t *testing.T) {
+	// 2024-01-02 03:04:05 UTC
+	createdAt := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Unix()
+	key := FilePath(7, createdAt, "csv")
+	assert.Equal(t, "station=7/date=2024-01-02/hour=03/1704164645.csv", key)
+
+	ref, err := ParseKey(key)
+	require.NoError(t, err)
+	assert.Equal(t, &Ref{Key: key, Station: 7, CreatedAt: createdAt, Format: "csv"}, ref)
+
+	ref, err = ParseKey(key + ".gz.enc")
+	require.NoError(t, err)
+	assert.Equal(t, "csv", ref.Format)
+	assert.Equal(t, key, ref.FileKey())
+	assert.Equal(t, "_manifests/"+key+".manifest.json", ref.ManifestKey())
+
+	for _, invalid := range []string{
+		"7/20240102/1704164645.csv",
+		"station=x/date=2024-01-02/hour=03/1704164645.csv",
+		"station=7/date=2024-01-02/hour=03/1704164645.csv.tmp",
+		"station=7/date=2024-01-02/hour=03/snapshot.csv",
+		"station=7/date=2024-01-02/hour=03/1704164645.csv.manifest.json",
+	} {
+		_, err := ParseKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestDatePrefixes(t *testing.T) {
+	start := time.Date(2024, 1, 30, 23, 0, 0, 0, time.UTC)
+	end := time.Date(2024, 2, 1, 1, 0, 0, 0, time.UTC)
+	assert.Equal(t, []string{
+		"station=1/date=2024-01-30/",
+		"station=1/date=2024-01-31/",
+		"station=1/date=2024-02-01/",
+	}, DatePrefixes(1, start, end))
+}
+
+func TestListDir(t *testing.T) {
+	dir := t.TempDir()
+	base := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, time.Hour, 25 * time.Hour, 72 * time.Hour} {
+		for _, station := range []int{1, 2} {
+			key := FilePath(station, base.Add(offset).Unix(), "csv")
+			p := filepath.Join(dir, filepath.FromSlash(key))
+			require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+			require.NoError(t, os.WriteFile(p, []byte("data"), 0644))
+			require.NoError(t, os.WriteFile(p+ManifestSuffix, []byte("{}"), 0644))
+		}
+	}
+
+	refs, err := ListDir(dir, 1, base.Add(time.Hour), base.Add(48*time.Hour))
+	require.NoError(t, err)
+	require.Len(t, refs, 2)
+	assert.Equal(t, base.Add(time.Hour).Unix(), refs[0].CreatedAt)
+	assert.Equal(t, base.Add(25*time.Hour).Unix(), refs[1].CreatedAt)
+
+	// no partition in the time range
+	refs, err = ListDir(dir, 1, base.Add(100*time.Hour), base.Add(110*time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, refs)
+}
@@ -0,0 +1,168 @@
+package snapshot
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	// ManifestPrefix is the key prefix of the manifests in the cloud storage.
+	// Query engines skip the keys starting with "_", so the manifests stay
+	// out of the data partitions.
+	ManifestPrefix = "_manifests/"
+	// ManifestSuffix is appended to the key of a snapshot file to get the
+	// key of its manifest under ManifestPrefix.
+	ManifestSuffix = ".manifest.json"
+
+	// GzipExtension is appended to the object key of a compressed snapshot.
+	GzipExtension = ".gz"
+	// EncryptedExtension is appended to the object key of an encrypted
+	// snapshot, after GzipExtension if it is compressed too.
+	EncryptedExtension = ".enc"
+)
+
+// ManifestKey returns the key of the manifest of the snapshot file key.
+func ManifestKey(key string) string {
+	return ManifestPrefix + key + ManifestSuffix
+}
+
+// Manifest describes a snapshot file generated by the local store.
+// It is uploaded next to the snapshot file so that the cloud side can
+// tell what is inside a snapshot without downloading it.
+type Manifest struct {
+	// Station is the station id of the snapshot.
+	Station int `json:"station"`
+	// Format is the file format of the snapshot, "csv" or "parquet".
+	Format string `json:"format"`
+	// FileName is the base name of the snapshot file.
+	FileName string `json:"file_name"`
+	// Size is the size of the snapshot file in bytes.
+	Size int64 `json:"size"`
+	// RowCount is the number of battery states in the snapshot.
+	RowCount int `json:"row_count"`
+	// MinTimestamp is the oldest battery state timestamp in the snapshot.
+	MinTimestamp int64 `json:"min_timestamp"`
+	// MaxTimestamp is the newest battery state timestamp in the snapshot.
+	MaxTimestamp int64 `json:"max_timestamp"`
+	// CreatedAt is the unix time when the snapshot was generated.
+	CreatedAt int64 `json:"created_at"`
+	// Checksum is the crc32 (IEEE) checksum of the snapshot file.
+	Checksum uint32 `json:"checksum"`
+
+	// Compression is the compression of the uploaded object, empty for none.
+	Compression string `json:"compression,omitempty"`
+	// Encryption describes how the uploaded object is encrypted, nil for none.
+	Encryption *Encryption `json:"encryption,omitempty"`
+	// EncodedSize is the size of the uploaded object if it is compressed or encrypted.
+	EncodedSize int64 `json:"encoded_size,omitempty"`
+	// EncodedChecksum is the crc32 (IEEE) checksum of the uploaded object
+	// if it is compressed or encrypted.
+	EncodedChecksum uint32 `json:"encoded_checksum,omitempty"`
+
+	// LocalPath is the path of the snapshot file on local disk.
+	// It is only meaningful on the node which generated the snapshot.
+	LocalPath string `json:"-"`
+}
+
+// Key returns the key of the snapshot file.
+func (m *Manifest) Key() string {
+	return FilePath(m.Station, m.CreatedAt, m.Format)
+}
+
+// ObjectKey returns the key of the uploaded object, the key of the snapshot
+// file with the extensions of its compression and encryption.
+func (m *Manifest) ObjectKey() string {
+	key := m.Key()
+	if m.Compression == CompressionGzip {
+		key += GzipExtension
+	}
+	if m.Encryption != nil {
+		key += EncryptedExtension
+	}
+	return key
+}
+
+// ManifestKey returns the key of the manifest.
+func (m *Manifest) ManifestKey() string {
+	return ManifestKey(m.Key())
+}
+
+// Encoded returns whether the uploaded object is compressed or encrypted.
+func (m *Manifest) Encoded() bool {
+	return m.Compression != "" || m.Encryption != nil
+}
+
+// ObjectSize returns the size of the uploaded object.
+func (m *Manifest) ObjectSize() int64 {
+	if m.Encoded() {
+		return m.EncodedSize
+	}
+	return m.Size
+}
+
+// ObjectChecksum returns the crc32 (IEEE) checksum of the uploaded object.
+func (m *Manifest) ObjectChecksum() uint32 {
+	if m.Encoded() {
+		return m.EncodedChecksum
+	}
+	return m.Checksum
+}
+
+// Marshal encodes the manifest as json.
+func (m *Manifest) Marshal() ([]byte, error) {
+	return json.MarshalIndent(m, "", "  ")
+}
+
+// UnmarshalManifest decodes a manifest from json.
+func UnmarshalManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// WriteFile writes the manifest to the given path atomically.
+func (m *Manifest) WriteFile(path string) error {
+	data, err := m.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	return WriteFileAtomic(path, data)
+}
+
+// ReadManifestFile reads a manifest from the given path.
+func ReadManifestFile(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return UnmarshalManifest(data)
+}
+
+// WriteFileAtomic writes data to a temporary file, syncs it and renames it
+// to path, so readers never observe a partially written file even if the
+// process crashes in the middle.
+func WriteFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write file: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package wal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const offsetSuffix = ".offset"
+
+// Entry is a record read from the WAL.
+type Entry struct {
+	// Index is the index of the record.
+	Index uint64
+	// Data is the content of the record.
+	Data []byte
+}
+
+// Consumer reads the WAL from its committed offset. A consumer commits the
+// index of the last record it has processed, after a restart it replays the
+// records after it, so records are delivered at least once.
+//
+// A consumer is not safe for concurrent use.
+type Consumer struct {
+	w    *WAL
+	name string
+	// committed is the index of the last processed record.
+	committed atomic.Uint64
+
+	// pos is the index of the next record to read.
+	pos uint64
+	// the reader of the segment containing pos
+	file    *os.File
+	reader  *recordReader
+	segment *segment
+}
+
+// loadConsumers loads the committed offsets of all consumers, so segments
+// are retained for consumers which are not registered again yet.
+func (w *WAL) loadConsumers() error {
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), offsetSuffix) {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), offsetSuffix)
+		data, err := os.ReadFile(filepath.Join(w.cfg.Dir, entry.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read consumer offset: %w", err)
+		}
+		committed, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid offset of consumer %s: %w", name, err)
+		}
+		c := &Consumer{w: w, name: name, pos: committed + 1}
+		c.committed.Store(committed)
+		w.consumers[name] = c
+	}
+	return nil
+}
+
+// Consumer returns the consumer with the name, a new consumer starts from
+// the oldest retained record.
+func (w *WAL) Consumer(name string) (*Consumer, error) {
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return nil, fmt.Errorf("invalid consumer name %q", name)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if c, ok := w.consumers[name]; ok {
+		return c, nil
+	}
+
+	c := &Consumer{w: w, name: name, pos: w.segments[0].first}
+	c.committed.Store(w.segments[0].first - 1)
+	if err := c.saveOffset(c.Committed()); err != nil {
+		return nil, err
+	}
+	w.consumers[name] = c
+	return c, nil
+}
+
+// RemoveConsumer removes the consumer, it no longer holds back truncation.
+func (w *WAL) RemoveConsumer(name string) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	c, ok := w.consumers[name]
+	if !ok {
+		return nil
+	}
+	c.closeReader()
+	delete(w.consumers, name)
+	if err := os.Remove(c.offsetPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove consumer offset: %w", err)
+	}
+	return nil
+}
+
+// Name returns the name of the consumer.
+func (c *Consumer) Name() string {
+	return c.name
+}
+
+// Committed returns the index of the last committed record.
+func (c *Consumer) Committed() uint64 {
+	return c.committed.Load()
+}
+
+// Lag returns the number of records appended but not committed yet.
+func (c *Consumer) Lag() uint64 {
+	return c.w.LastIndex() - c.Committed()
+}
+
+// Read reads up to max records after the last read one, it returns no
+// records if the consumer has caught up. Records removed by truncation
+// before they are read are skipped.
+func (c *Consumer) Read(max int) ([]Entry, error) {
+	c.w.mu.Lock()
+	if c.w.closed {
+		c.w.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if first := c.w.segments[0].first; c.pos < first {
+		log.Warn("wal consumer fell behind retention, skip removed records",
+			zap.String("consumer", c.name), zap.Uint64("from", c.pos), zap.Uint64("to", first-1))
+		c.pos = first
+		c.closeReader()
+	}
+	next := c.w.next
+	var seg *segment
+	var end uint64
+	if c.pos < next {
+		seg, end = c.w.segmentFor(c.pos)
+	}
+	c.w.mu.Unlock()
+
+	var entries []Entry
+	for c.pos < next && len(entries) < max {
+		if c.segment != seg {
+			if err := c.openReader(seg); err != nil {
+				return entries, err
+			}
+		}
+		data, err := c.reader.next()
+		if err != nil {
+			c.closeReader()
+			if errors.Is(err, io.EOF) {
+				err = fmt.Errorf("%w: segment %s ends before record %d", ErrCorrupted, seg.path, c.pos)
+			}
+			return entries, err
+		}
+		entries = append(entries, Entry{Index: c.pos, Data: data})
+		c.pos++
+
+		if c.pos == end && c.pos < next {
+			c.w.mu.Lock()
+			seg, end = c.w.segmentFor(c.pos)
+			c.w.mu.Unlock()
+		}
+	}
+	return entries, nil
+}
+
+// openReader opens the segment and skips to the record at pos.
+func (c *Consumer) openReader(seg *segment) error {
+	c.closeReader()
+	file, err := os.Open(seg.path)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	c.file, c.reader, c.segment = file, newRecordReader(bufio.NewReader(file)), seg
+	for index := seg.first; index < c.pos; index++ {
+		if _, err := c.reader.next(); err != nil {
+			c.closeReader()
+			return fmt.Errorf("failed to seek to record %d: %w", c.pos, err)
+		}
+	}
+	return nil
+}
+
+func (c *Consumer) closeReader() {
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file, c.reader, c.segment = nil, nil, nil
+}
+
+// Commit commits the index of the last processed record, the offset is
+// persisted before Commit returns.
+func (c *Consumer) Commit(index uint64) error {
+	if index <= c.Committed() {
+		return nil
+	}
+	if last := c.w.LastIndex(); index > last {
+		return fmt.Errorf("commit index %d beyond the last index %d", index, last)
+	}
+	if err := c.saveOffset(index); err != nil {
+		return err
+	}
+	c.committed.Store(index)
+	return nil
+}
+
+// Reset moves the read position back to the record after the last
+// committed one, e.g. to retry records which failed to process.
+func (c *Consumer) Reset() {
+	c.pos = c.Committed() + 1
+	c.closeReader()
+}
+
+// Close closes the reader of the consumer, the committed offset is kept.
+func (c *Consumer) Close() {
+	c.closeReader()
+}
+
+func (c *Consumer) offsetPath() string {
+	return filepath.Join(c.w.cfg.Dir, c.name+offsetSuffix)
+}
+
+func (c *Consumer) saveOffset(index uint64) error {
+	path := c.offsetPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(index, 10)), 0644); err != nil {
+		return fmt.Errorf("failed to write consumer offset: %w", err)
+	}
+	file, err := os.Open(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to open consumer offset: %w", err)
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("failed to sync consumer offset: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to rename consumer offset: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,439 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultSegmentSize is the default size to roll over to a new segment.
+	DefaultSegmentSize = 64 << 20
+	// MaxRecordSize is the max size of a record.
+	MaxRecordSize = 16 << 20
+
+	segmentSuffix = ".wal"
+	// headerSize is the size of the record header: length and crc32.
+	headerSize = 8
+)
+
+var (
+	// ErrClosed is returned when the WAL is closed.
+	ErrClosed = errors.New("wal is closed")
+	// ErrCorrupted is returned when a sealed segment fails to decode.
+	ErrCorrupted = errors.New("wal is corrupted")
+	// ErrFailed is returned when a failed append can't be rolled back, the
+	// WAL has to be reopened to recover the tail of the active segment.
+	ErrFailed = errors.New("wal failed")
+)
+
+type segment struct {
+	// first is the index of the first record in the segment.
+	first uint64
+	path  string
+	size  int64
+	// lastWrite is the time of the last append.
+	lastWrite time.Time
+}
+
+// WAL is a segmented write-ahead log. Records are appended to the active
+// segment and synced before Append returns, so an acknowledged record
+// survives a crash. Records are indexed from 1.
+//
+// Named consumers read the log independently and commit their offsets, a
+// segment is removed once all consumers have committed past it, or when it
+// is beyond the size or age limits.
+type WAL struct {
+	cfg *config.WALConfig
+
+	mu       sync.Mutex
+	segments []*segment
+	active   *os.File
+	// next is the index of the next record to append.
+	next      uint64
+	consumers map[string]*Consumer
+	// notify is closed and replaced on every append.
+	notify chan struct{}
+	closed bool
+	// err is set once the WAL failed, see ErrFailed.
+	err error
+}
+
+// Open opens the WAL in the configured directory, a torn record at the
+// tail of the last segment left by a crash is truncated.
+func Open(cfg *config.WALConfig) (*WAL, error) {
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create wal directory: %w", err)
+	}
+
+	w := &WAL{
+		cfg:       cfg,
+		next:      1,
+		consumers: make(map[string]*Consumer),
+		notify:    make(chan struct{}),
+	}
+	if err := w.loadSegments(); err != nil {
+		return nil, err
+	}
+	if err := w.loadConsumers(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *WAL) loadSegments() error {
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		return fmt.Errorf("failed to read wal directory: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat segment: %w", err)
+		}
+		w.segments = append(w.segments, &segment{
+			first:     first,
+			path:      filepath.Join(w.cfg.Dir, name),
+			size:      info.Size(),
+			lastWrite: info.ModTime(),
+		})
+	}
+	sort.Slice(w.segments, func(i, j int) bool {
+		return w.segments[i].first < w.segments[j].first
+	})
+
+	if len(w.segments) == 0 {
+		return w.createSegment(1)
+	}
+
+	// recover the tail of the last segment
+	last := w.segments[len(w.segments)-1]
+	file, err := os.OpenFile(last.path, os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	count, size, err := scanSegment(file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if size < last.size {
+		log.Warn("truncate torn wal tail",
+			zap.String("segment", last.path), zap.Int64("size", last.size), zap.Int64("valid-size", size))
+		if err := file.Truncate(size); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to truncate segment: %w", err)
+		}
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to sync segment: %w", err)
+		}
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to seek segment: %w", err)
+	}
+	last.size = size
+	w.active = file
+	w.next = last.first + count
+	return nil
+}
+
+// scanSegment counts the valid records from the start of the file and
+// returns the size they take.
+func scanSegment(file *os.File) (uint64, int64, error) {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, fmt.Errorf("failed to seek segment: %w", err)
+	}
+	r := newRecordReader(file)
+	var count uint64
+	var size int64
+	for {
+		data, err := r.next()
+		if err != nil {
+			// io.EOF or a torn record, everything before it is valid
+			return count, size, nil
+		}
+		count++
+		size += headerSize + int64(len(data))
+	}
+}
+
+func (w *WAL) createSegment(first uint64) error {
+	path := filepath.Join(w.cfg.Dir, fmt.Sprintf("%020d%s", first, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := syncDir(w.cfg.Dir); err != nil {
+		file.Close()
+		return err
+	}
+	w.active = file
+	w.segments = append(w.segments, &segment{first: first, path: path, lastWrite: time.Now()})
+	return nil
+}
+
+// Append appends a record and syncs it, return the index of the record.
+func (w *WAL) Append(data []byte) (uint64, error) {
+	return w.AppendBatch([][]byte{data})
+}
+
+// AppendBatch appends the records with a single sync, return the index of
+// the first record. Records of a batch are always in the same segment.
+func (w *WAL) AppendBatch(records [][]byte) (uint64, error) {
+	var buf []byte
+	for _, data := range records {
+		if len(data) > MaxRecordSize {
+			return 0, fmt.Errorf("record size %d exceeds limit %d", len(data), MaxRecordSize)
+		}
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+		binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(data))
+		buf = append(buf, header[:]...)
+		buf = append(buf, data...)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	active := w.segments[len(w.segments)-1]
+	if active.size > 0 && active.size+int64(len(buf)) > w.cfg.SegmentSize {
+		if err := w.roll(); err != nil {
+			return 0, err
+		}
+		active = w.segments[len(w.segments)-1]
+	}
+
+	if _, err := w.active.Write(buf); err != nil {
+		w.rewind(active)
+		return 0, fmt.Errorf("failed to write wal: %w", err)
+	}
+	if err := w.active.Sync(); err != nil {
+		// The records may or may not be on disk, drop them so a record which
+		// is not acknowledged is never replayed.
+		w.rewind(active)
+		return 0, fmt.Errorf("failed to sync wal: %w", err)
+	}
+	active.size += int64(len(buf))
+	active.lastWrite = time.Now()
+
+	first := w.next
+	w.next += uint64(len(records))
+	close(w.notify)
+	w.notify = make(chan struct{})
+	return first, nil
+}
+
+// rewind drops what a failed append wrote to the active segment, so the
+// next append starts at a record boundary. If it fails too the WAL is
+// failed, see ErrFailed.
+func (w *WAL) rewind(active *segment) {
+	err := w.active.Truncate(active.size)
+	if err == nil {
+		_, err = w.active.Seek(active.size, io.SeekStart)
+	}
+	if err == nil {
+		err = w.active.Sync()
+	}
+	if err != nil {
+		log.Error("failed to rewind wal", zap.String("segment", active.path), zap.Error(err))
+		w.err = fmt.Errorf("%w: failed to rewind segment %s: %v", ErrFailed, active.path, err)
+	}
+}
+
+// roll seals the active segment and creates a new one.
+func (w *WAL) roll() error {
+	if err := w.active.Sync(); err != nil {
+		return fmt.Errorf("failed to sync segment: %w", err)
+	}
+	if err := w.active.Close(); err != nil {
+		return fmt.Errorf("failed to close segment: %w", err)
+	}
+	return w.createSegment(w.next)
+}
+
+// LastIndex returns the index of the last appended record, 0 if none.
+func (w *WAL) LastIndex() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.next - 1
+}
+
+// FirstIndex returns the index of the oldest record still retained.
+func (w *WAL) FirstIndex() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.segments[0].first
+}
+
+// Notify returns a channel which is closed when new records are appended.
+func (w *WAL) Notify() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.notify
+}
+
+// Size returns the total size of segments.
+func (w *WAL) Size() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var size int64
+	for _, s := range w.segments {
+		size += s.size
+	}
+	return size
+}
+
+// Truncate removes sealed segments which are consumed by all consumers, and
+// the oldest sealed segments beyond the size and age limits. The active
+// segment is never removed. Return the number of removed segments.
+func (w *WAL) Truncate() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// records up to minCommitted are consumed by everyone
+	minCommitted := w.next - 1
+	for _, c := range w.consumers {
+		if committed := c.Committed(); committed < minCommitted {
+			minCommitted = committed
+		}
+	}
+
+	var total int64
+	for _, s := range w.segments {
+		total += s.size
+	}
+
+	removed := 0
+	for len(w.segments) > 1 {
+		oldest, last := w.segments[0], w.segments[1].first-1
+		consumed := last <= minCommitted
+		oversize := w.cfg.MaxSize > 0 && total > w.cfg.MaxSize
+		expired := w.cfg.MaxAge > 0 && time.Since(oldest.lastWrite) > w.cfg.MaxAge
+		if !consumed && !oversize && !expired {
+			break
+		}
+		if !consumed {
+			log.Warn("remove unconsumed wal segment",
+				zap.String("segment", oldest.path),
+				zap.Uint64("first-index", oldest.first),
+				zap.Uint64("last-index", last),
+				zap.Uint64("min-committed", minCommitted),
+				zap.Bool("oversize", oversize),
+				zap.Bool("expired", expired))
+		}
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			return removed, fmt.Errorf("failed to remove segment: %w", err)
+		}
+		total -= oldest.size
+		w.segments = w.segments[1:]
+		removed++
+	}
+	return removed, nil
+}
+
+// Close syncs and closes the WAL.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	close(w.notify)
+
+	if err := w.active.Sync(); err != nil {
+		w.active.Close()
+		return fmt.Errorf("failed to sync wal: %w", err)
+	}
+	return w.active.Close()
+}
+
+// segmentFor returns the segment containing the record index and the index
+// of the record after the segment, index must be retained and appended.
+func (w *WAL) segmentFor(index uint64) (*segment, uint64) {
+	i := sort.Search(len(w.segments), func(i int) bool {
+		return w.segments[i].first > index
+	}) - 1
+	end := w.next
+	if i+1 < len(w.segments) {
+		end = w.segments[i+1].first
+	}
+	return w.segments[i], end
+}
+
+// recordReader reads records from a segment.
+type recordReader struct {
+	r      io.Reader
+	header [headerSize]byte
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: r}
+}
+
+// next reads the next record, it returns io.EOF at the end of the segment
+// and ErrCorrupted for a torn or corrupted record.
+func (r *recordReader) next() ([]byte, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	length := binary.BigEndian.Uint32(r.header[:4])
+	if length > MaxRecordSize {
+		return nil, fmt.Errorf("%w: record size %d exceeds limit", ErrCorrupted, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(r.header[4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+	}
+	return data, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
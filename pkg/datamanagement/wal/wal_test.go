@@ -0,0 +1,230 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+func record(i int) []byte {
+	return []byte(fmt.Sprintf("record-%03d", i))
+}
+
+// each record takes 18 bytes, 3 records per segment
+func newTestConfig(dir string) *config.WALConfig {
+	return &config.WALConfig{Dir: dir, SegmentSize: 60}
+}
+
+func appendRecords(t *testing.T, w *WAL, from, to int) {
+	for i := from; i <= to; i++ {
+		index, err := w.Append(record(i))
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), index)
+	}
+}
+
+func readAll(t *testing.T, c *Consumer) []Entry {
+	var all []Entry
+	for {
+		entries, err := c.Read(2)
+		require.NoError(t, err)
+		if len(entries) == 0 {
+			return all
+		}
+		all = append(all, entries...)
+	}
+}
+
+func TestWALAppendRead(t *testing.T) {
+	w, err := Open(newTestConfig(t.TempDir()))
+	require.NoError(t, err)
+	defer w.Close()
+
+	appendRecords(t, w, 1, 10)
+	assert.Equal(t, uint64(10), w.LastIndex())
+	assert.Len(t, w.segments, 4)
+
+	c, err := w.Consumer("store")
+	require.NoError(t, err)
+	entries := readAll(t, c)
+	require.Len(t, entries, 10)
+	for i, entry := range entries {
+		assert.Equal(t, uint64(i+1), entry.Index)
+		assert.Equal(t, record(i+1), entry.Data)
+	}
+
+	// the consumer picks up new records
+	notify := w.Notify()
+	first, err := w.AppendBatch([][]byte{record(11), record(12)})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(11), first)
+	<-notify
+	entries = readAll(t, c)
+	require.Len(t, entries, 2)
+	assert.Equal(t, record(12), entries[1].Data)
+
+	// read again from the last commit
+	require.NoError(t, c.Commit(5))
+	c.Reset()
+	entries, err = c.Read(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(6), entries[0].Index)
+	assert.Equal(t, uint64(7), c.Lag())
+}
+
+func TestWALReplayAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(newTestConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, w, 1, 7)
+	c, err := w.Consumer("store")
+	require.NoError(t, err)
+	entries, err := c.Read(4)
+	require.NoError(t, err)
+	require.NoError(t, c.Commit(entries[3].Index))
+	// crash without closing, and a torn record at the tail
+	active := w.segments[len(w.segments)-1].path
+	file, err := os.OpenFile(active, os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 10, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	w, err = Open(newTestConfig(dir))
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, uint64(7), w.LastIndex())
+
+	// records after the committed offset are replayed
+	c, err = w.Consumer("store")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(4), c.Committed())
+	entries = readAll(t, c)
+	require.Len(t, entries, 3)
+	assert.Equal(t, uint64(5), entries[0].Index)
+
+	// appends continue after the truncated tail
+	appendRecords(t, w, 8, 8)
+	entries = readAll(t, c)
+	require.Len(t, entries, 1)
+	assert.Equal(t, record(8), entries[0].Data)
+}
+
+func TestWALFailedAppend(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(newTestConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, w, 1, 2)
+
+	// the segment file can't be written nor rolled back
+	require.NoError(t, w.active.Close())
+	_, err = w.Append(record(3))
+	require.Error(t, err)
+	_, err = w.Append(record(3))
+	assert.ErrorIs(t, err, ErrFailed)
+	assert.Equal(t, uint64(2), w.LastIndex())
+
+	// reopening recovers the segment
+	w, err = Open(newTestConfig(dir))
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, uint64(2), w.LastIndex())
+	appendRecords(t, w, 3, 3)
+}
+
+func TestWALTruncate(t *testing.T) {
+	w, err := Open(newTestConfig(t.TempDir()))
+	require.NoError(t, err)
+	defer w.Close()
+	appendRecords(t, w, 1, 10)
+
+	store, err := w.Consumer("store")
+	require.NoError(t, err)
+	analytics, err := w.Consumer("analytics")
+	require.NoError(t, err)
+
+	// nothing is consumed by analytics yet
+	require.NoError(t, store.Commit(10))
+	removed, err := w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// segments [1,3] and [4,6] are consumed by both
+	require.NoError(t, analytics.Commit(7))
+	removed, err = w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, uint64(7), w.FirstIndex())
+
+	// the active segment is never removed
+	require.NoError(t, analytics.Commit(10))
+	removed, err = w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, uint64(10), w.FirstIndex())
+	_, err = os.Stat(filepath.Join(w.cfg.Dir, fmt.Sprintf("%020d%s", 10, segmentSuffix)))
+	assert.NoError(t, err)
+}
+
+func TestWALRetentionLimits(t *testing.T) {
+	cfg := newTestConfig(t.TempDir())
+	cfg.MaxSize = 100
+	w, err := Open(cfg)
+	require.NoError(t, err)
+	defer w.Close()
+	c, err := w.Consumer("uploader")
+	require.NoError(t, err)
+	appendRecords(t, w, 1, 10)
+
+	// 180 bytes in total, the oldest segments are removed though unconsumed
+	removed, err := w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 2, removed)
+	assert.LessOrEqual(t, w.Size(), cfg.MaxSize)
+
+	// the consumer skips the removed records
+	entries := readAll(t, c)
+	require.Len(t, entries, 4)
+	assert.Equal(t, uint64(7), entries[0].Index)
+
+	// expired segments are removed
+	w.cfg.MaxSize = 0
+	w.cfg.MaxAge = time.Minute
+	w.segments[0].lastWrite = time.Now().Add(-time.Hour)
+	removed, err = w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+}
+
+func TestWALConsumerOffsetPersisted(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Open(newTestConfig(dir))
+	require.NoError(t, err)
+	appendRecords(t, w, 1, 6)
+	c, err := w.Consumer("analytics")
+	require.NoError(t, err)
+	require.NoError(t, c.Commit(2))
+	require.Error(t, c.Commit(7))
+	require.NoError(t, w.Close())
+	_, err = w.Append(record(7))
+	assert.ErrorIs(t, err, ErrClosed)
+
+	// the consumer holds back truncation before it registers again
+	w, err = Open(newTestConfig(dir))
+	require.NoError(t, err)
+	defer w.Close()
+	removed, err := w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	require.NoError(t, w.RemoveConsumer("analytics"))
+	removed, err = w.Truncate()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+}
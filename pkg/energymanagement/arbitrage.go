@@ -0,0 +1,231 @@
+package energymanagement
+
+import (
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Defaults of the arbitrage optimizer.
+const (
+	DefaultDoDExponent = 2
+	DefaultSOCBuckets  = 100
+	// MaxSOCBuckets bounds the buckets once refined to the energy a slot
+	// may move.
+	MaxSOCBuckets = 10000
+)
+
+// ErrCoarseResolution is returned when the buckets of stored energy can't
+// be made as small as the energy the battery moves in a slot.
+var ErrCoarseResolution = errors.New("stored energy resolution is too coarse")
+
+// wear is the battery wear model, the wear of a cycle of depth of
+// discharge d is cost * d^exponent. Discharging from depth d1 to d2 wears
+// cost * (d2^exponent - d1^exponent), so the same energy costs more the
+// deeper the battery is discharged, charging doesn't wear.
+type wear struct {
+	cost     float64
+	exponent float64
+	// capacity is the energy in kWh of 0 depth of discharge
+	capacity float64
+}
+
+// of returns the wear of changing the stored energy from one level to
+// another.
+func (w wear) of(from, to float64) float64 {
+	if to >= from || w.cost == 0 {
+		return 0
+	}
+	depth := func(e float64) float64 { return math.Max(0, 1-e/w.capacity) }
+	return w.cost * (math.Pow(depth(to), w.exponent) - math.Pow(depth(from), w.exponent))
+}
+
+// arbitrage plans the slots by a dynamic program over buckets of stored
+// energy, maximizing the revenue of the prices net of the wear. The stored
+// energy at the end is not lower than the initial one.
+type arbitrage struct {
+	prices  []float64
+	l       limits
+	w       wear
+	buckets int
+
+	levels []float64
+	// value[t][i] is the best revenue of the slots from t on with the
+	// stored energy levels[i] at the start of slot t
+	value [][]float64
+}
+
+// newArbitrage creates the optimizer, the levels are spaced by a bucket
+// starting from the initial stored energy, so it is one of them. A bucket
+// is at most the energy the battery charges or discharges in a slot, else
+// no move would fit in a slot, up to MaxSOCBuckets.
+func newArbitrage(prices []float64, l limits, w wear, buckets int) (*arbitrage, error) {
+	a := &arbitrage{prices: prices, l: l, w: w, buckets: buckets}
+	lo, hi := math.Min(l.min, l.initial), math.Max(l.max, l.initial)
+	delta := (l.max - l.min) / float64(buckets)
+	if delta <= 0 {
+		a.levels = []float64{l.initial}
+		return a, nil
+	}
+	for _, step := range []float64{l.charge, l.discharge} {
+		if step > 0 && step < delta {
+			delta = step
+		}
+	}
+	if (hi-lo)/delta > MaxSOCBuckets {
+		return nil, fmt.Errorf("%w: %.4g kWh in buckets of %.4g kWh is over %d buckets",
+			ErrCoarseResolution, hi-lo, delta, MaxSOCBuckets)
+	}
+	for k := -math.Floor((l.initial-lo)/delta + epsilon); k <= math.Floor((hi-l.initial)/delta+epsilon); k++ {
+		a.levels = append(a.levels, l.initial+k*delta)
+	}
+	return a, nil
+}
+
+// start returns the index of the initial level.
+func (a *arbitrage) start() int {
+	for i, level := range a.levels {
+		if math.Abs(level-a.l.initial) < epsilon {
+			return i
+		}
+	}
+	return 0
+}
+
+// reach returns the index of the farthest level from level i the stored
+// energy reaches by changing it by at most e.
+func (a *arbitrage) reach(i int, e float64) int {
+	j := i
+	if e > 0 {
+		for j+1 < len(a.levels) && a.levels[j+1]-a.levels[i] <= e+epsilon {
+			j++
+		}
+	} else {
+		for j > 0 && a.levels[j-1]-a.levels[i] >= e-epsilon {
+			j--
+		}
+	}
+	return j
+}
+
+// allowed reports whether the stored energy may change from level i to j
+// in a slot. Out of the soc limits, e.g. after a change of the limits, it
+// may only move towards them.
+func (a *arbitrage) allowed(i, j int) bool {
+	from, to := a.levels[i], a.levels[j]
+	if to-from > a.l.charge+epsilon || from-to > a.l.discharge+epsilon {
+		return false
+	}
+	if to < a.l.min-epsilon {
+		return to >= from
+	}
+	if to > a.l.max+epsilon {
+		return to <= from
+	}
+	return true
+}
+
+// revenue returns the revenue and the wear of changing the stored energy
+// in the slot, the loss is taken when charging.
+func (a *arbitrage) revenue(t int, from, to float64) (revenue, wear float64) {
+	if to > from {
+		return -a.prices[t] * (to - from) / a.l.efficiency, 0
+	}
+	return a.prices[t] * (from - to), a.w.of(from, to)
+}
+
+// plan returns the energy gained by the battery in each slot, negative if
+// discharged, and why.
+func (a *arbitrage) plan() ([]float64, []string) {
+	n, m := len(a.prices), len(a.levels)
+	start := a.start()
+	a.value = make([][]float64, n+1)
+	next := make([][]int, n)
+	a.value[n] = make([]float64, m)
+	for i := range a.value[n] {
+		if a.levels[i] < a.l.initial-epsilon {
+			a.value[n][i] = math.Inf(-1)
+		}
+	}
+	for t := n - 1; t >= 0; t-- {
+		a.value[t] = make([]float64, m)
+		next[t] = make([]int, m)
+		for i := 0; i < m; i++ {
+			best, bestJ := math.Inf(-1), i
+			for j := a.reach(i, -a.l.discharge); j <= a.reach(i, a.l.charge); j++ {
+				if !a.allowed(i, j) || math.IsInf(a.value[t+1][j], -1) {
+					continue
+				}
+				revenue, wear := a.revenue(t, a.levels[i], a.levels[j])
+				// prefer the smaller change on ties
+				if v := revenue - wear + a.value[t+1][j]; v > best+epsilon || (v > best-epsilon && abs(j-i) < abs(bestJ-i)) {
+					best, bestJ = v, j
+				}
+			}
+			a.value[t][i], next[t][i] = best, bestJ
+		}
+	}
+
+	gained := make([]float64, n)
+	reasons := make([]string, n)
+	i := start
+	for t := 0; t < n; t++ {
+		j := next[t][i]
+		gained[t] = a.levels[j] - a.levels[i]
+		reasons[t] = a.explain(t, i, j)
+		i = j
+	}
+	return gained, reasons
+}
+
+// marginal returns the value per kWh of the bucket above level i at the
+// start of slot t, false if unknown.
+func (a *arbitrage) marginal(t, i int) (float64, bool) {
+	if i < 0 || i+1 >= len(a.levels) {
+		return 0, false
+	}
+	lower, upper := a.value[t][i], a.value[t][i+1]
+	if math.IsInf(lower, -1) || math.IsInf(upper, -1) {
+		return 0, false
+	}
+	return (upper - lower) / (a.levels[i+1] - a.levels[i]), true
+}
+
+// explain tells why the stored energy changes from level i to j in slot t,
+// comparing the price with the value of the energy in the later slots.
+func (a *arbitrage) explain(t, i, j int) string {
+	price := a.prices[t]
+	switch {
+	case j > i:
+		if later, ok := a.marginal(t+1, j-1); ok {
+			return fmt.Sprintf("charge: %.4g/kWh after losses is below the %.4g/kWh the energy is worth later",
+				price/a.l.efficiency, later)
+		}
+		return "charge: the energy is needed to end at the initial level"
+	case j < i:
+		perKWh := a.w.of(a.levels[i], a.levels[j]) / (a.levels[i] - a.levels[j])
+		if later, ok := a.marginal(t+1, j); ok {
+			return fmt.Sprintf("discharge: %.4g/kWh is above the %.4g/kWh the energy is worth later plus %.4g/kWh of wear",
+				price, later, perKWh)
+		}
+		return fmt.Sprintf("discharge: %.4g/kWh is above %.4g/kWh of wear", price, perKWh)
+	default:
+		later, ok := a.marginal(t+1, i)
+		if !ok {
+			// full, the value of the last bucket
+			later, ok = a.marginal(t+1, i-1)
+		}
+		if ok {
+			return fmt.Sprintf("idle: the energy is worth %.4g/kWh later, the price is %.4g/kWh and %.4g/kWh after losses",
+				later, price, price/a.l.efficiency)
+		}
+		return "idle: no move pays off within the limits"
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
@@ -0,0 +1,168 @@
+package energymanagement
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+// netRevenue returns the revenue net of the wear of the plan.
+func netRevenue(prices, gained []float64, l limits, w wear) float64 {
+	total, level := 0.0, l.initial
+	for t, e := range gained {
+		if e > 0 {
+			total -= prices[t] * e / l.efficiency
+		} else {
+			total += -prices[t]*e - w.of(level, level+e)
+		}
+		level += e
+	}
+	return total
+}
+
+// newTestArbitrage creates the optimizer, failing the test on an error.
+func newTestArbitrage(t *testing.T, prices []float64, l limits, w wear, buckets int) *arbitrage {
+	a, err := newArbitrage(prices, l, w, buckets)
+	require.NoError(t, err)
+	return a
+}
+
+func TestArbitrageOptimal(t *testing.T) {
+	prices := []float64{0.3, 0.1, 0.5, 0.2, 0.6}
+	l := limits{initial: 2, min: 0, max: 4, charge: 2, discharge: 2, efficiency: 0.9}
+	w := wear{cost: 0.5, exponent: 2, capacity: 4}
+	a := newTestArbitrage(t, prices, l, w, 4)
+	gained, reasons := a.plan()
+	require.Len(t, reasons, len(prices))
+
+	// every path over the levels 0, 1, 2, 3, 4 ending not below the start
+	best := math.Inf(-1)
+	var walk func(t int, level float64, path []float64)
+	walk = func(t int, level float64, path []float64) {
+		if t == len(prices) {
+			if level >= l.initial {
+				best = math.Max(best, netRevenue(prices, path, l, w))
+			}
+			return
+		}
+		for next := 0.0; next <= 4; next++ {
+			if math.Abs(next-level) <= 2 {
+				walk(t+1, next, append(path, next-level))
+			}
+		}
+	}
+	walk(0, l.initial, nil)
+	assert.InDelta(t, best, netRevenue(prices, gained, l, w), 1e-9)
+	assert.InDelta(t, best, a.value[0][a.start()], 1e-9)
+}
+
+func TestArbitrageWear(t *testing.T) {
+	prices := []float64{0.1, 0.1, 0.1, 0.1, 0.4, 0.4, 0.4, 0.4}
+	l := limits{initial: 0, min: 0, max: 10, charge: 5, discharge: 5, efficiency: 0.9}
+	final := func(gained []float64) float64 {
+		level := l.initial
+		for _, e := range gained {
+			level += e
+		}
+		return level
+	}
+
+	free, _ := newTestArbitrage(t, prices, l, wear{capacity: 10}, 100).plan()
+	assert.InDelta(t, 0, final(free), 1e-9)
+
+	// the wear of the deepest discharge doesn't pay off, at 3 per cycle
+	// the wear of the last kWh at depth d is 0.6d, the price 0.4
+	w := wear{cost: 3, exponent: 2, capacity: 10}
+	worn, reasons := newTestArbitrage(t, prices, l, w, 100).plan()
+	assert.InDelta(t, 10.0/3, final(worn), 0.1)
+	assert.Greater(t, netRevenue(prices, worn, l, w), netRevenue(prices, free, l, w))
+	var moves []string
+	for _, reason := range reasons {
+		if !strings.HasPrefix(reason, "idle: ") {
+			moves = append(moves, reason)
+		}
+	}
+	require.NotEmpty(t, moves)
+	assert.True(t, strings.HasPrefix(moves[0], "charge: "), moves[0])
+	assert.True(t, strings.HasPrefix(moves[len(moves)-1], "discharge: "), moves[len(moves)-1])
+	assert.Contains(t, moves[len(moves)-1], "of wear")
+
+	// too expensive to cycle at all
+	idle, reasons := newTestArbitrage(t, prices, l, wear{cost: 100, exponent: 2, capacity: 10}, 100).plan()
+	for i, e := range idle {
+		assert.Zero(t, e)
+		assert.True(t, strings.HasPrefix(reasons[i], "idle: "), reasons[i])
+	}
+}
+
+func TestArbitrageSmallSteps(t *testing.T) {
+	// a slot moves less than a bucket of the configured resolution
+	prices := []float64{0.1, 0.1, 0.1, 0.1, 0.5, 0.5, 0.5, 0.5}
+	l := limits{initial: 50, min: 0, max: 100, charge: 0.25, discharge: 0.5, efficiency: 0.9}
+	a := newTestArbitrage(t, prices, l, wear{capacity: 100}, 4)
+	gained, _ := a.plan()
+	for i, e := range gained[:4] {
+		assert.InDelta(t, 0.25, e, 1e-9, i)
+	}
+	assert.InDelta(t, 1, -(gained[4] + gained[5] + gained[6] + gained[7]), 1e-9)
+	for _, e := range gained[4:] {
+		assert.GreaterOrEqual(t, -e, 0.0)
+		assert.LessOrEqual(t, -e, 0.5+1e-9)
+	}
+
+	// too fine to plan
+	_, err := newArbitrage(prices, limits{max: 100, charge: 0.001, discharge: 0.001, efficiency: 0.9}, wear{}, 4)
+	assert.ErrorIs(t, err, ErrCoarseResolution)
+}
+
+func TestSchedulerArbitrage(t *testing.T) {
+	station := config.StationEnergyConfig{ID: 1, MaxChargePower: 1, MaxDischargePower: 1, CycleCost: 0.5}
+	prices := []float64{0.1, 0.12, 0.1, 0.2, 0.3, 0.3, 0.5, 0.35}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	schedule := func(arbitrage bool) *Schedule {
+		station.Arbitrage = arbitrage
+		s := NewScheduler(&config.EnergyManagementConfig{Stations: []config.StationEnergyConfig{station}}, newStation(t, 1, 95))
+		require.NoError(t, s.SetForecast(hourlyForecast(ForecastPrice, start, prices...)))
+		schedule, err := s.Schedule(1, start)
+		require.NoError(t, err)
+		return schedule
+	}
+
+	shift, optimized := schedule(false), schedule(true)
+	assert.Equal(t, PlannerShift, shift.Planner)
+	assert.Equal(t, PlannerArbitrage, optimized.Planner)
+	// the optimizer leaves no money on the table
+	assert.GreaterOrEqual(t, optimized.Revenue-optimized.Wear, shift.Revenue-shift.Wear-1e-9)
+	assert.Greater(t, optimized.Revenue-optimized.Wear, 0.0)
+
+	var revenue float64
+	for _, slot := range optimized.Slots {
+		assert.NotEmpty(t, slot.Reason)
+		assert.LessOrEqual(t, math.Abs(slot.Power), 1+1e-9)
+		assert.GreaterOrEqual(t, slot.SOC, DefaultMinSOC-1e-9)
+		assert.LessOrEqual(t, slot.SOC, DefaultMaxSOC+1e-9)
+		revenue += slot.Revenue
+	}
+	assert.InDelta(t, optimized.Revenue, revenue, 1e-9)
+	assert.GreaterOrEqual(t, optimized.Slots[len(prices)-1].SOC, 50-1e-6)
+}
+
+func TestSchedulerArbitrageBackupReserve(t *testing.T) {
+	station := config.StationEnergyConfig{ID: 1, MaxChargePower: 1, MaxDischargePower: 1, Arbitrage: true, BackupReserve: 30}
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := NewScheduler(&config.EnergyManagementConfig{Stations: []config.StationEnergyConfig{station}}, newStation(t, 1, 95))
+	require.NoError(t, s.SetForecast(hourlyForecast(ForecastPrice, start, 0.5, 0.5, 0.5, 0.1)))
+	schedule, err := s.Schedule(1, start)
+	require.NoError(t, err)
+
+	// the pricey slots discharge down to the reserve instead of the min soc
+	assert.InDelta(t, 30, schedule.Slots[2].SOC, 0.5)
+	for _, slot := range schedule.Slots {
+		assert.GreaterOrEqual(t, slot.SOC, 30-1e-6)
+	}
+}
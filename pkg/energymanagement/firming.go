@@ -0,0 +1,198 @@
+package energymanagement
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+// DefaultFirmingInterval is the default control interval of firming.
+const DefaultFirmingInterval = 10 * time.Second
+
+// Commander commands the power of the stations.
+type Commander interface {
+	// SetPower sets the power of the station in kW, positive charges.
+	SetPower(station int, power float64) error
+}
+
+// Headroom is the energy the battery needs for the rest of the day to keep
+// the forecast generation on the committed profile, against what it has.
+type Headroom struct {
+	// Charge is the peak energy in kWh absorbed until the end of the day,
+	// ChargeAvailable the room below the max soc.
+	Charge          float64 `json:"charge"`
+	ChargeAvailable float64 `json:"charge_available"`
+	// Discharge is the peak energy in kWh delivered until the end of the
+	// day, DischargeAvailable the energy above the min soc.
+	Discharge          float64 `json:"discharge"`
+	DischargeAvailable float64 `json:"discharge_available"`
+}
+
+// Short reports whether the battery can't follow the profile until the
+// end of the day.
+func (h *Headroom) Short() bool {
+	return h.Charge > h.ChargeAvailable+epsilon || h.Discharge > h.DischargeAvailable+epsilon
+}
+
+// FirmingCommand is the result of a control step of firming.
+type FirmingCommand struct {
+	Time time.Time `json:"time"`
+	// Generation is the measured generation in kW.
+	Generation float64 `json:"generation"`
+	// Target is the net output in kW aimed at, the committed profile
+	// within the ramp rate.
+	Target float64 `json:"target"`
+	// Power is the commanded power of the station in kW, positive charges.
+	Power float64 `json:"power"`
+	// Output is the net output in kW, the generation minus the power.
+	Output float64 `json:"output"`
+	// SOC is the state of charge of the station in percent.
+	SOC      float64  `json:"soc"`
+	Headroom Headroom `json:"headroom"`
+	// Limited tells why the target is missed, if so.
+	Limited string `json:"limited,omitempty"`
+}
+
+// Firming charges and discharges a station to keep the net output of its
+// renewable generation on the committed profile and within the ramp rate.
+// Without a commitment it follows the generation forecast, without a
+// forecast it only limits the ramps of the generation.
+type Firming struct {
+	station   config.StationEnergyConfig
+	rampRate  float64
+	interval  time.Duration
+	scheduler *Scheduler
+	commander Commander
+
+	mu sync.Mutex
+	// latest net output and its time
+	last     *FirmingCommand
+	lastTime time.Time
+}
+
+// NewFirming creates a new Firming of the station of cfg, the station must
+// be configured in the scheduler.
+func NewFirming(cfg *config.FirmingConfig, scheduler *Scheduler, commander Commander) (*Firming, error) {
+	station, ok := scheduler.stations[cfg.Station]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownStation, cfg.Station)
+	}
+	f := &Firming{
+		station:   station,
+		rampRate:  cfg.RampRate,
+		interval:  cfg.Interval,
+		scheduler: scheduler,
+		commander: commander,
+	}
+	if f.interval <= 0 {
+		f.interval = DefaultFirmingInterval
+	}
+	return f, nil
+}
+
+// Station returns the id of the station.
+func (f *Firming) Station() int {
+	return f.station.ID
+}
+
+// profile returns the net output aimed at t and whether it is known.
+func (f *Firming) profile(t time.Time) (float64, bool) {
+	for _, kind := range []ForecastKind{ForecastCommitment, ForecastGeneration} {
+		if forecast := f.scheduler.Forecast(f.station.ID, kind); forecast != nil {
+			if v, ok := forecast.valueAt(t); ok {
+				return v, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// headroom returns the energy needed from now until the end of the day to
+// keep the forecast generation on the committed profile.
+func (f *Firming) headroom(now time.Time, level, minLevel, maxLevel float64) Headroom {
+	h := Headroom{
+		ChargeAvailable:    math.Max(0, maxLevel-level),
+		DischargeAvailable: math.Max(0, level-minLevel),
+	}
+	generation := f.scheduler.Forecast(f.station.ID, ForecastGeneration)
+	commitment := f.scheduler.Forecast(f.station.ID, ForecastCommitment)
+	if generation == nil || commitment == nil {
+		return h
+	}
+	y, m, d := now.Date()
+	end := time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+	var stored float64
+	for t := now; t.Before(end); t = t.Add(f.interval) {
+		g, ok1 := generation.valueAt(t)
+		c, ok2 := commitment.valueAt(t)
+		if !ok1 || !ok2 {
+			continue
+		}
+		if surplus := (g - c) * f.interval.Hours(); surplus > 0 {
+			stored += surplus * f.station.Efficiency
+		} else {
+			stored += surplus
+		}
+		h.Charge = math.Max(h.Charge, stored)
+		h.Discharge = math.Max(h.Discharge, -stored)
+	}
+	return h
+}
+
+// Step commands the station for the measured generation in kW and returns
+// the command.
+func (f *Firming) Step(now time.Time, generation float64) (*FirmingCommand, error) {
+	summary, ok := f.scheduler.data.Station(f.station.ID)
+	if !ok || summary.MaxCapacity == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoStationData, f.station.ID)
+	}
+	capacity := summary.MaxCapacity * f.station.CellVoltage / 1000
+	level := summary.CurrentCapacity * f.station.CellVoltage / 1000
+	minLevel, maxLevel := capacity*dischargeFloor(f.station)/100, capacity*f.station.MaxSOC/100
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	cmd := &FirmingCommand{
+		Time:       now,
+		Generation: generation,
+		SOC:        summary.SOC(),
+		Headroom:   f.headroom(now, level, minLevel, maxLevel),
+	}
+	target, ok := f.profile(now)
+	if !ok {
+		target = generation
+	}
+	if f.last != nil && f.rampRate > 0 {
+		ramp := f.rampRate * now.Sub(f.lastTime).Minutes()
+		target = math.Max(f.last.Output-ramp, math.Min(f.last.Output+ramp, target))
+	}
+	cmd.Target = target
+
+	// the power and the energy of the next interval are limited
+	hours := f.interval.Hours()
+	power := generation - target
+	switch {
+	case power > f.station.MaxChargePower:
+		power, cmd.Limited = f.station.MaxChargePower, "max charge power"
+	case power < -f.station.MaxDischargePower:
+		power, cmd.Limited = -f.station.MaxDischargePower, "max discharge power"
+	}
+	if limit := math.Max(0, maxLevel-level) / f.station.Efficiency / hours; power > limit {
+		power, cmd.Limited = limit, "max soc"
+	}
+	if limit := math.Max(0, level-minLevel) / hours; -power > limit {
+		power, cmd.Limited = -limit, "min soc"
+	}
+	cmd.Power = power
+	cmd.Output = generation - power
+
+	if err := f.commander.SetPower(f.station.ID, power); err != nil {
+		return nil, fmt.Errorf("failed to command station %d: %w", f.station.ID, err)
+	}
+	f.last, f.lastTime = cmd, now
+	return cmd, nil
+}
@@ -0,0 +1,107 @@
+package energymanagement
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+// fakeCommander records the commanded power.
+type fakeCommander struct {
+	power map[int]float64
+	err   error
+	// fail fails the commands of the stations
+	fail map[int]error
+}
+
+func (c *fakeCommander) SetPower(station int, power float64) error {
+	if c.err != nil {
+		return c.err
+	}
+	if err := c.fail[station]; err != nil {
+		return err
+	}
+	c.power[station] = power
+	return nil
+}
+
+func newFirming(t *testing.T, interval time.Duration) (*Firming, *Scheduler, *fakeCommander) {
+	cfg := &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 2, MaxDischargePower: 2}},
+	}
+	scheduler := NewScheduler(cfg, newStation(t, 1, 95))
+	commander := &fakeCommander{power: make(map[int]float64)}
+	f, err := NewFirming(&config.FirmingConfig{Station: 1, RampRate: 0.5, Interval: interval}, scheduler, commander)
+	require.NoError(t, err)
+	return f, scheduler, commander
+}
+
+func TestFirmingRampRate(t *testing.T) {
+	f, _, commander := newFirming(t, time.Second)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	cmd, err := f.Step(now, 5)
+	require.NoError(t, err)
+	assert.Zero(t, cmd.Power)
+	assert.Equal(t, 5.0, cmd.Output)
+
+	// a cloud halves the generation, the battery covers the ramp beyond
+	// 0.5kW per minute
+	cmd, err = f.Step(now.Add(time.Minute), 2.5)
+	require.NoError(t, err)
+	assert.InDelta(t, 4.5, cmd.Target, 1e-9)
+	assert.InDelta(t, -2, cmd.Power, 1e-9)
+	assert.InDelta(t, 4.5, cmd.Output, 1e-9)
+	assert.Equal(t, -2.0, commander.power[1])
+	assert.Empty(t, cmd.Limited)
+
+	cmd, err = f.Step(now.Add(2*time.Minute), 1)
+	require.NoError(t, err)
+	assert.InDelta(t, 4, cmd.Target, 1e-9)
+	assert.InDelta(t, -2, cmd.Power, 1e-9)
+	assert.InDelta(t, 3, cmd.Output, 1e-9)
+	assert.Equal(t, "max discharge power", cmd.Limited)
+
+	// the output ramps from the actual output
+	cmd, err = f.Step(now.Add(3*time.Minute), 1)
+	require.NoError(t, err)
+	assert.InDelta(t, 2.5, cmd.Target, 1e-9)
+
+	_, err = NewFirming(&config.FirmingConfig{Station: 2}, f.scheduler, commander)
+	assert.ErrorIs(t, err, ErrUnknownStation)
+	commander.err = errors.New("offline")
+	_, err = f.Step(now.Add(4*time.Minute), 1)
+	assert.ErrorContains(t, err, "offline")
+}
+
+func TestFirmingCommitment(t *testing.T) {
+	f, scheduler, _ := newFirming(t, time.Hour)
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	// committed to 4kW, the forecast is 1kW more in the afternoon
+	require.NoError(t, scheduler.SetForecast(hourlyForecast(ForecastCommitment, now, 4, 4, 4, 4, 4, 4)))
+	require.NoError(t, scheduler.SetForecast(&Forecast{Kind: ForecastGeneration, Station: 1, Points: []Point{
+		{Time: now, Value: 5}, {Time: now.Add(3 * time.Hour), Value: 5}, {Time: now.Add(6 * time.Hour), Value: 5},
+	}}))
+
+	cmd, err := f.Step(now, 5)
+	require.NoError(t, err)
+	assert.Equal(t, 4.0, cmd.Target)
+	assert.InDelta(t, 1, cmd.Power, 1e-9)
+	assert.InDelta(t, 4, cmd.Output, 1e-9)
+	// 6h of 1kW surplus after losses, 1.28kWh room below the max soc
+	assert.InDelta(t, 5.4, cmd.Headroom.Charge, 1e-9)
+	assert.InDelta(t, 1.28, cmd.Headroom.ChargeAvailable, 1e-9)
+	assert.Zero(t, cmd.Headroom.Discharge)
+	assert.InDelta(t, 1.28, cmd.Headroom.DischargeAvailable, 1e-9)
+	assert.True(t, cmd.Headroom.Short())
+
+	// the energy of an hour is limited by the soc
+	cmd, err = f.Step(now.Add(time.Hour), 0)
+	require.NoError(t, err)
+	assert.InDelta(t, -1.28, cmd.Power, 1e-9)
+	assert.Equal(t, "min soc", cmd.Limited)
+}
@@ -0,0 +1,279 @@
+package energymanagement
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"go.uber.org/zap"
+)
+
+// Defaults of the fleet dispatch.
+const (
+	DefaultFleetInterval     = time.Minute
+	DefaultDerateTemperature = 40
+	DefaultMaxTemperature    = 50
+	DefaultBalanceCycles     = 1
+)
+
+// reasonNoData is the reason of a station which never reported, it is not
+// commanded.
+const reasonNoData = "excluded: no data"
+
+// reasonFailed prefixes the reason of a station which failed to be
+// commanded, its share is split over the other stations.
+const reasonFailed = "excluded: failed to command"
+
+// StationDispatch is the share of a station of a fleet setpoint.
+type StationDispatch struct {
+	Station int `json:"station"`
+	// Power is the commanded power in kW, positive charges.
+	Power float64 `json:"power"`
+	// Weight is the share of the station before the power limits.
+	Weight float64 `json:"weight"`
+	// Available is the energy in kWh the station can deliver or absorb
+	// within its soc limits, Limit the power it can take over the interval.
+	Available float64 `json:"available"`
+	Limit     float64 `json:"limit"`
+	SOC       float64 `json:"soc"`
+	SOH       float64 `json:"soh"`
+	// Temperature is the max cell temperature.
+	Temperature float64 `json:"temperature"`
+	// Cycles is the number of equivalent full cycles done by the station
+	// since the dispatcher started.
+	Cycles float64 `json:"cycles"`
+	// Reason tells how the share was decided.
+	Reason string `json:"reason"`
+}
+
+// FleetDispatch is the split of a fleet setpoint over the stations.
+type FleetDispatch struct {
+	Time time.Time `json:"time"`
+	// Setpoint is the fleet power in kW, positive charges.
+	Setpoint float64 `json:"setpoint"`
+	// Unmet is the part of the setpoint the fleet can't take.
+	Unmet    float64           `json:"unmet"`
+	Stations []StationDispatch `json:"stations"`
+}
+
+// Dispatcher splits fleet-wide power setpoints over the stations by their
+// available energy, state of health and temperature. It tracks the cycles
+// of the stations and shifts the shares to the least cycled ones, so no
+// station is cycled much harder than the others.
+type Dispatcher struct {
+	cfg       config.FleetConfig
+	scheduler *Scheduler
+	commander Commander
+
+	mu sync.Mutex
+	// station -> charged and discharged energy in kWh at the battery
+	throughput map[int]float64
+	latest     *FleetDispatch
+}
+
+// NewDispatcher creates a new Dispatcher of the stations of the scheduler.
+func NewDispatcher(cfg *config.FleetConfig, scheduler *Scheduler, commander Commander) *Dispatcher {
+	d := &Dispatcher{
+		cfg:        *cfg,
+		scheduler:  scheduler,
+		commander:  commander,
+		throughput: make(map[int]float64),
+	}
+	if d.cfg.Interval <= 0 {
+		d.cfg.Interval = DefaultFleetInterval
+	}
+	if d.cfg.DerateTemperature == 0 {
+		d.cfg.DerateTemperature = DefaultDerateTemperature
+	}
+	if d.cfg.MaxTemperature <= d.cfg.DerateTemperature {
+		d.cfg.MaxTemperature = math.Max(DefaultMaxTemperature, d.cfg.DerateTemperature+1)
+	}
+	if d.cfg.BalanceCycles <= 0 {
+		d.cfg.BalanceCycles = DefaultBalanceCycles
+	}
+	return d
+}
+
+// Latest returns the latest dispatch, nil if none.
+func (d *Dispatcher) Latest() *FleetDispatch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.latest
+}
+
+// Dispatch splits the fleet setpoint in kW over the stations and commands
+// them. Stations which never reported, or whose state of health is below
+// their min, get no share, and neither do stations which fail to be
+// commanded, they are recorded with no power.
+func (d *Dispatcher) Dispatch(now time.Time, setpoint float64) *FleetDispatch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// the stations kept the latest power until now
+	if d.latest != nil {
+		hours := now.Sub(d.latest.Time).Hours()
+		for _, s := range d.latest.Stations {
+			d.throughput[s.Station] += math.Abs(s.Power) * hours
+		}
+	}
+
+	ids := make([]int, 0, len(d.scheduler.stations))
+	for id := range d.scheduler.stations {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	dispatch := &FleetDispatch{Time: now, Setpoint: setpoint}
+	charge := setpoint > 0
+	hours := d.cfg.Interval.Hours()
+	var capacities []float64
+	for _, id := range ids {
+		cfg := d.scheduler.stations[id]
+		s := StationDispatch{Station: id}
+		summary, ok := d.scheduler.data.Station(id)
+		if !ok || summary.MaxCapacity == 0 {
+			s.Reason = reasonNoData
+			dispatch.Stations = append(dispatch.Stations, s)
+			capacities = append(capacities, 0)
+			continue
+		}
+		capacity := summary.MaxCapacity * cfg.CellVoltage / 1000
+		level := summary.CurrentCapacity * cfg.CellVoltage / 1000
+		s.SOC, s.SOH, s.Temperature = summary.SOC(), summary.SOH, summary.MaxTemperature
+		s.Cycles = d.throughput[id] / (2 * capacity)
+		capacities = append(capacities, capacity)
+		if charge {
+			s.Available = math.Max(0, capacity*cfg.MaxSOC/100-level)
+			s.Limit = math.Min(cfg.MaxChargePower, s.Available/cfg.Efficiency/hours)
+		} else {
+			s.Available = math.Max(0, level-capacity*dischargeFloor(cfg)/100)
+			s.Limit = math.Min(cfg.MaxDischargePower, s.Available/hours)
+		}
+		switch {
+		case summary.SOH > 0 && summary.SOH < cfg.MinSOH:
+			s.Limit = 0
+			s.Reason = fmt.Sprintf("excluded: state of health %.1f%% is below %.1f%%", summary.SOH, cfg.MinSOH)
+		case summary.TemperatureSensors == 0:
+			// the temperature derating can't be trusted
+			s.Limit = 0
+			s.Reason = "excluded: no healthy temperature sensor"
+		}
+		dispatch.Stations = append(dispatch.Stations, s)
+	}
+
+	// the cycles are compared with the capacity weighted fleet average
+	var cycles, total float64
+	for i, s := range dispatch.Stations {
+		cycles += s.Cycles * capacities[i]
+		total += capacities[i]
+	}
+	if total > 0 {
+		cycles /= total
+	}
+
+	weights := make([]float64, len(dispatch.Stations))
+	limits := make([]float64, len(dispatch.Stations))
+	for i := range dispatch.Stations {
+		s := &dispatch.Stations[i]
+		if s.Reason != "" {
+			continue
+		}
+		soh := 1.0
+		if s.SOH > 0 {
+			soh = s.SOH / 100
+		}
+		temperature := math.Min(1, math.Max(0,
+			(d.cfg.MaxTemperature-s.Temperature)/(d.cfg.MaxTemperature-d.cfg.DerateTemperature)))
+		balance := math.Exp(-(s.Cycles - cycles) / d.cfg.BalanceCycles)
+		s.Weight = s.Available * soh * temperature * balance
+		weights[i], limits[i] = s.Weight, s.Limit
+
+		var factors []string
+		factors = append(factors, fmt.Sprintf("%.1f kWh available", s.Available))
+		if soh < 1 {
+			factors = append(factors, fmt.Sprintf("x%.2f for %.1f%% state of health", soh, s.SOH))
+		}
+		if temperature < 1 {
+			factors = append(factors, fmt.Sprintf("x%.2f for %.1f°C", temperature, s.Temperature))
+		}
+		factors = append(factors, fmt.Sprintf("x%.2f for %+.2f cycles against the fleet", balance, s.Cycles-cycles))
+		s.Reason = strings.Join(factors, ", ")
+	}
+
+	// a station failing to take its share is dropped and the setpoint is
+	// split again over the others, which are commanded their new shares
+	reasons := make([]string, len(dispatch.Stations))
+	for i, s := range dispatch.Stations {
+		reasons[i] = s.Reason
+	}
+	for failed := true; failed; {
+		failed = false
+		shares, unmet := split(math.Abs(setpoint), weights, limits)
+		dispatch.Unmet = math.Copysign(unmet, setpoint)
+		for i := range dispatch.Stations {
+			s := &dispatch.Stations[i]
+			if reasons[i] == reasonNoData || strings.HasPrefix(reasons[i], reasonFailed) {
+				continue
+			}
+			s.Power, s.Reason = math.Copysign(shares[i], setpoint), reasons[i]
+			if shares[i] == 0 {
+				s.Power = 0
+			} else if shares[i] >= s.Limit-epsilon {
+				s.Reason += fmt.Sprintf(", capped at %.1f kW", s.Limit)
+			}
+			if err := d.commander.SetPower(s.Station, s.Power); err != nil {
+				log.Warn("failed to command station, split its share over the others",
+					zap.Int("station", s.Station), zap.Float64("power", s.Power), zap.Error(err))
+				reasons[i] = fmt.Sprintf("%s: %v", reasonFailed, err)
+				s.Power, s.Reason = 0, reasons[i]
+				weights[i], limits[i] = 0, 0
+				failed = true
+			}
+		}
+	}
+	d.latest = dispatch
+	return dispatch
+}
+
+// split splits the power proportionally to the weights, a share above its
+// limit is capped and the rest is split again over the other ones. It
+// returns the shares and the power left.
+func split(power float64, weights, limits []float64) ([]float64, float64) {
+	shares := make([]float64, len(weights))
+	var active []int
+	for i, w := range weights {
+		if w > 0 && limits[i] > 0 {
+			active = append(active, i)
+		}
+	}
+	for power > epsilon && len(active) > 0 {
+		var total float64
+		for _, i := range active {
+			total += weights[i]
+		}
+		var rest []int
+		var capped float64
+		for _, i := range active {
+			if power*weights[i]/total < limits[i] {
+				rest = append(rest, i)
+			} else {
+				shares[i] = limits[i]
+				capped += limits[i]
+			}
+		}
+		if len(rest) == len(active) {
+			for _, i := range active {
+				shares[i] = power * weights[i] / total
+			}
+			return shares, 0
+		}
+		power -= capped
+		active = rest
+	}
+	return shares, math.Max(0, power)
+}
@@ -0,0 +1,132 @@
+package energymanagement
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+func TestSplit(t *testing.T) {
+	shares, unmet := split(8, []float64{1, 1, 2}, []float64{10, 1, 10})
+	assert.InDeltaSlice(t, []float64{7.0 / 3, 1, 14.0 / 3}, shares, 1e-9)
+	assert.Zero(t, unmet)
+
+	shares, unmet = split(30, []float64{1, 1, 0}, []float64{10, 1, 10})
+	assert.InDeltaSlice(t, []float64{10, 1, 0}, shares, 1e-9)
+	assert.InDelta(t, 19, unmet, 1e-9)
+}
+
+func TestDispatcher(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	for _, s := range []struct {
+		station          int
+		soh, temperature float64
+	}{{1, 95, 25}, {2, 95, 45}, {3, 50, 25}} {
+		// 10 cells of 100Ah at 50% soc, 3.2kWh
+		for cell := 1; cell <= 10; cell++ {
+			data.Update(&data_model.BatteryState{
+				Station: s.station, Container: 1, Pack: 1, Cell: cell,
+				Voltage: 3.35, Temperature: s.temperature, MaxCapacity: 100, SOH: s.soh, Timestamp: time.Now().Unix(),
+			})
+		}
+	}
+	data.ReCalculate()
+
+	var stations []config.StationEnergyConfig
+	for id := 1; id <= 4; id++ {
+		stations = append(stations, config.StationEnergyConfig{ID: id, MaxChargePower: 2, MaxDischargePower: 2})
+	}
+	scheduler := NewScheduler(&config.EnergyManagementConfig{Stations: stations}, data)
+	commander := &fakeCommander{power: make(map[int]float64)}
+	d := NewDispatcher(&config.FleetConfig{}, scheduler, commander)
+	assert.Nil(t, d.Latest())
+
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	dispatch := d.Dispatch(now, -2)
+	require.Len(t, dispatch.Stations, 4)
+	// the hot station takes half the share of the cool one
+	s1, s2, s3, s4 := dispatch.Stations[0], dispatch.Stations[1], dispatch.Stations[2], dispatch.Stations[3]
+	assert.InDelta(t, -4.0/3, s1.Power, 1e-9)
+	assert.InDelta(t, -2.0/3, s2.Power, 1e-9)
+	assert.InDelta(t, 1.28, s1.Available, 1e-9)
+	assert.Contains(t, s2.Reason, "x0.50 for 45.0°C")
+	assert.Contains(t, s3.Reason, "state of health")
+	assert.Zero(t, s3.Power)
+	assert.Equal(t, reasonNoData, s4.Reason)
+	assert.Zero(t, dispatch.Unmet)
+	assert.Equal(t, map[int]float64{1: s1.Power, 2: s2.Power, 3: 0}, commander.power)
+	assert.Same(t, dispatch, d.Latest())
+
+	// the setpoint beyond the limits is unmet
+	dispatch = d.Dispatch(now.Add(time.Hour), -5)
+	assert.InDelta(t, -1, dispatch.Unmet, 1e-9)
+	assert.Contains(t, dispatch.Stations[0].Reason, "capped at 2.0 kW")
+
+	// the most cycled station takes a smaller share
+	dispatch = d.Dispatch(now.Add(2*time.Hour), 1)
+	s1, s2 = dispatch.Stations[0], dispatch.Stations[1]
+	assert.Greater(t, s1.Cycles, s2.Cycles)
+	assert.Less(t, s1.Power/s2.Power, 2.0)
+	assert.Greater(t, s1.Power, 0.0)
+}
+
+func TestDispatcherWithoutTemperature(t *testing.T) {
+	data := newStation(t, 1, 95)
+	// the temperature sensors of the second station read out of range
+	for cell := 1; cell <= 10; cell++ {
+		data.Update(&data_model.BatteryState{
+			Station: 2, Container: 1, Pack: 1, Cell: cell,
+			Voltage: 3.35, Temperature: 130, MaxCapacity: 100, SOH: 95, Timestamp: time.Now().Unix(),
+		})
+	}
+	data.ReCalculate()
+
+	stations := []config.StationEnergyConfig{
+		{ID: 1, MaxChargePower: 2, MaxDischargePower: 2},
+		{ID: 2, MaxChargePower: 2, MaxDischargePower: 2},
+	}
+	commander := &fakeCommander{power: make(map[int]float64)}
+	d := NewDispatcher(&config.FleetConfig{}, NewScheduler(&config.EnergyManagementConfig{Stations: stations}, data), commander)
+	dispatch := d.Dispatch(time.Now(), -1)
+	require.Len(t, dispatch.Stations, 2)
+	assert.InDelta(t, -1, dispatch.Stations[0].Power, 1e-9)
+	assert.Zero(t, dispatch.Stations[1].Power)
+	assert.Equal(t, "excluded: no healthy temperature sensor", dispatch.Stations[1].Reason)
+}
+
+func TestDispatcherCommandFailure(t *testing.T) {
+	data := newStation(t, 1, 95)
+	for _, station := range []int{2, 3} {
+		for cell := 1; cell <= 10; cell++ {
+			data.Update(&data_model.BatteryState{
+				Station: station, Container: 1, Pack: 1, Cell: cell,
+				Voltage: 3.35, Temperature: 25, MaxCapacity: 100, SOH: 95, Timestamp: time.Now().Unix(),
+			})
+		}
+	}
+	data.ReCalculate()
+
+	var stations []config.StationEnergyConfig
+	for id := 1; id <= 3; id++ {
+		stations = append(stations, config.StationEnergyConfig{ID: id, MaxChargePower: 2, MaxDischargePower: 2})
+	}
+	commander := &fakeCommander{power: make(map[int]float64), fail: map[int]error{3: errors.New("rejected")}}
+	d := NewDispatcher(&config.FleetConfig{}, NewScheduler(&config.EnergyManagementConfig{Stations: stations}, data), commander)
+
+	// the share of the failed station goes to the others, which were
+	// commanded before it failed
+	dispatch := d.Dispatch(time.Now(), -3)
+	require.Len(t, dispatch.Stations, 3)
+	assert.InDelta(t, -1.5, dispatch.Stations[0].Power, 1e-9)
+	assert.InDelta(t, -1.5, dispatch.Stations[1].Power, 1e-9)
+	assert.Zero(t, dispatch.Stations[2].Power)
+	assert.Equal(t, "excluded: failed to command: rejected", dispatch.Stations[2].Reason)
+	assert.Zero(t, dispatch.Unmet)
+	assert.Equal(t, map[int]float64{1: -1.5, 2: -1.5}, commander.power)
+	assert.Same(t, dispatch, d.Latest())
+}
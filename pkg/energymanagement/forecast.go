@@ -0,0 +1,131 @@
+package energymanagement
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ForecastKind is the kind of a forecast.
+type ForecastKind string
+
+const (
+	// ForecastDemand is a forecast of the electricity demand, like the
+	// predictions of ml/elec_comsumption.py.
+	ForecastDemand ForecastKind = "demand"
+	// ForecastPrice is a forecast of the electricity price.
+	ForecastPrice ForecastKind = "price"
+	// ForecastGeneration is a forecast of the renewable generation of a
+	// station in kW.
+	ForecastGeneration ForecastKind = "generation"
+	// ForecastCommitment is the net output in kW committed to the grid
+	// by a station firming its renewable generation.
+	ForecastCommitment ForecastKind = "commitment"
+)
+
+// timeLayouts are the accepted time layouts of forecast CSV files, the
+// second one is the layout of the demand datasets of the ml directory.
+var timeLayouts = []string{time.RFC3339, "02Jan2006 15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04"}
+
+// Point is a forecast value, it holds from its time until the next point.
+type Point struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// Forecast is a demand or price forecast.
+type Forecast struct {
+	Kind ForecastKind `json:"kind"`
+	// Station is the station the forecast applies to, 0 for all stations.
+	Station int `json:"station,omitempty"`
+	// Points are ordered by time.
+	Points []Point `json:"points"`
+}
+
+// ParseForecastCSV parses a forecast from CSV rows of a time and a value,
+// an optional header is skipped. Times without a zone are in loc, and
+// thousands separators of values are ignored.
+func ParseForecastCSV(r io.Reader, kind ForecastKind, loc *time.Location) (*Forecast, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	f := &Forecast{Kind: kind}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read forecast: %w", err)
+		}
+		t, err := parseTime(record[0], loc)
+		if err != nil {
+			if line == 1 {
+				// header
+				continue
+			}
+			return nil, fmt.Errorf("invalid time at line %d: %w", line, err)
+		}
+		v, err := strconv.ParseFloat(strings.ReplaceAll(record[1], ",", ""), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value at line %d: %w", line, err)
+		}
+		f.Points = append(f.Points, Point{Time: t, Value: v})
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func parseTime(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unknown time format: %q", s)
+}
+
+// Validate checks the forecast and orders its points by time.
+func (f *Forecast) Validate() error {
+	switch f.Kind {
+	case ForecastDemand, ForecastPrice, ForecastGeneration, ForecastCommitment:
+	default:
+		return fmt.Errorf("unknown forecast kind: %q", f.Kind)
+	}
+	if len(f.Points) == 0 {
+		return errors.New("empty forecast")
+	}
+	sort.Slice(f.Points, func(i, j int) bool { return f.Points[i].Time.Before(f.Points[j].Time) })
+	for i := 1; i < len(f.Points); i++ {
+		if f.Points[i].Time.Equal(f.Points[i-1].Time) {
+			return fmt.Errorf("duplicate forecast time: %s", f.Points[i].Time)
+		}
+	}
+	return nil
+}
+
+// end returns the end of the forecast, the last point holds as long as the
+// interval before it.
+func (f *Forecast) end() time.Time {
+	n := len(f.Points)
+	if n == 1 {
+		return f.Points[0].Time.Add(time.Hour)
+	}
+	return f.Points[n-1].Time.Add(f.Points[n-1].Time.Sub(f.Points[n-2].Time))
+}
+
+// valueAt returns the forecast value at t, false if t is not covered.
+func (f *Forecast) valueAt(t time.Time) (float64, bool) {
+	if t.Before(f.Points[0].Time) || !t.Before(f.end()) {
+		return 0, false
+	}
+	i := sort.Search(len(f.Points), func(i int) bool { return f.Points[i].Time.After(t) })
+	return f.Points[i-1].Value, true
+}
@@ -0,0 +1,48 @@
+package energymanagement
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseForecastCSV(t *testing.T) {
+	// the layout of the demand datasets
+	f, err := ParseForecastCSV(strings.NewReader(`Local Time,Demand
+01Jan2024 1:00:00,"26,788"
+01Jan2024 0:00:00,"27,628"
+`), ForecastDemand, time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, []Point{
+		{Time: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), Value: 27628},
+		{Time: time.Date(2024, 1, 1, 1, 0, 0, 0, time.UTC), Value: 26788},
+	}, f.Points)
+
+	v, ok := f.valueAt(time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, 27628.0, v)
+	// the last point holds for an interval
+	v, ok = f.valueAt(time.Date(2024, 1, 1, 1, 59, 0, 0, time.UTC))
+	assert.True(t, ok)
+	assert.Equal(t, 26788.0, v)
+	_, ok = f.valueAt(time.Date(2024, 1, 1, 2, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+	_, ok = f.valueAt(time.Date(2023, 12, 31, 23, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+
+	f, err = ParseForecastCSV(strings.NewReader("2024-01-01T00:00:00+08:00,0.12\n"), ForecastPrice, time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, 0.12, f.Points[0].Value)
+
+	_, err = ParseForecastCSV(strings.NewReader("time,value\n2024-01-01 00:00,x\n"), ForecastPrice, time.UTC)
+	assert.ErrorContains(t, err, "line 2")
+	_, err = ParseForecastCSV(strings.NewReader("time,value\n"), ForecastPrice, time.UTC)
+	assert.Error(t, err)
+	_, err = ParseForecastCSV(strings.NewReader("2024-01-01 00:00,1\n2024-01-01 00:00,2\n"), ForecastPrice, time.UTC)
+	assert.ErrorContains(t, err, "duplicate")
+	_, err = ParseForecastCSV(strings.NewReader("2024-01-01 00:00,1\n"), "weather", time.UTC)
+	assert.ErrorContains(t, err, "unknown forecast kind")
+}
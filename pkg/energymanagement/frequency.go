@@ -0,0 +1,259 @@
+package energymanagement
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"go.uber.org/zap"
+)
+
+// Defaults of the frequency response.
+const (
+	DefaultNominalFrequency  = 50
+	DefaultDeadband          = 0.015
+	DefaultDroop             = 0.4
+	DefaultFrequencyInterval = 200 * time.Millisecond
+	DefaultTargetSOC         = 50
+	DefaultMaxFailedReads    = 5
+
+	// recoveryBand is the deviation of the soc from the target in percent
+	// tolerated by the recovery.
+	recoveryBand = 1
+)
+
+// Modes of a frequency response step.
+const (
+	ModeDeadband = "deadband"
+	ModeResponse = "response"
+	ModeRecovery = "recovery"
+	// ModeNoSignal means the frequency can't be read and the station is
+	// commanded 0.
+	ModeNoSignal = "no_signal"
+)
+
+// FrequencySource reads the grid frequency in Hz.
+type FrequencySource interface {
+	Frequency() (float64, error)
+}
+
+// SimulatedFrequency is a simulated grid frequency, a noise reverting to
+// the nominal frequency plus a sustained deviation like the trip of a
+// generator.
+type SimulatedFrequency struct {
+	nominal, sigma float64
+
+	mu        sync.Mutex
+	rng       *rand.Rand
+	noise     float64
+	deviation float64
+}
+
+// NewSimulatedFrequency creates a new simulated frequency around the
+// nominal frequency with a noise of standard deviation sigma in Hz.
+func NewSimulatedFrequency(nominal, sigma float64, seed int64) *SimulatedFrequency {
+	return &SimulatedFrequency{nominal: nominal, sigma: sigma, rng: rand.New(rand.NewSource(seed))}
+}
+
+// SetDeviation sets the sustained deviation in Hz, 0 clears it.
+func (s *SimulatedFrequency) SetDeviation(deviation float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deviation = deviation
+}
+
+// Frequency implements FrequencySource, every read advances the noise.
+func (s *SimulatedFrequency) Frequency() (float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the stationary deviation of the noise is sigma
+	s.noise = 0.9*s.noise + math.Sqrt(1-0.9*0.9)*s.sigma*s.rng.NormFloat64()
+	return s.nominal + s.noise + s.deviation, nil
+}
+
+// FrequencyCommand is the result of a control step of the frequency
+// response.
+type FrequencyCommand struct {
+	Time time.Time `json:"time"`
+	// Frequency is the measured frequency in Hz.
+	Frequency float64 `json:"frequency"`
+	Mode      string  `json:"mode"`
+	// Response is the power in kW of the droop curve, Power the commanded
+	// power within the limits, positive charges.
+	Response float64 `json:"response"`
+	Power    float64 `json:"power"`
+	SOC      float64 `json:"soc"`
+	// Limited tells why the power differs from the response, if so.
+	Limited string `json:"limited,omitempty"`
+}
+
+// FrequencyResponse modulates the power of a station with the grid
+// frequency: beyond the deadband the power follows the droop curve,
+// charging on over frequency and discharging on under frequency. Within
+// the deadband the soc recovers toward the target.
+type FrequencyResponse struct {
+	cfg       config.FrequencyResponseConfig
+	station   config.StationEnergyConfig
+	scheduler *Scheduler
+	source    FrequencySource
+	commander Commander
+
+	// failed is the number of consecutive failed reads, only used by Step
+	failed int
+
+	mu     sync.Mutex
+	latest *FrequencyCommand
+}
+
+// NewFrequencyResponse creates a new FrequencyResponse of the station of
+// cfg reading the frequency from source, the station must be configured
+// in the scheduler.
+func NewFrequencyResponse(cfg *config.FrequencyResponseConfig, scheduler *Scheduler, source FrequencySource, commander Commander) (*FrequencyResponse, error) {
+	station, ok := scheduler.stations[cfg.Station]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownStation, cfg.Station)
+	}
+	c := *cfg
+	if c.Nominal <= 0 {
+		c.Nominal = DefaultNominalFrequency
+	}
+	if c.Deadband < 0 {
+		c.Deadband = 0
+	} else if c.Deadband == 0 {
+		c.Deadband = DefaultDeadband
+	}
+	if c.Droop <= 0 {
+		c.Droop = DefaultDroop
+	}
+	if c.Capacity <= 0 {
+		c.Capacity = station.MaxDischargePower
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultFrequencyInterval
+	}
+	if c.TargetSOC <= 0 {
+		c.TargetSOC = DefaultTargetSOC
+	}
+	if c.MaxFailedReads <= 0 {
+		c.MaxFailedReads = DefaultMaxFailedReads
+	}
+	return &FrequencyResponse{cfg: c, station: station, scheduler: scheduler, source: source, commander: commander}, nil
+}
+
+// Station returns the id of the station.
+func (f *FrequencyResponse) Station() int {
+	return f.station.ID
+}
+
+// Latest returns the latest command, nil before the first step.
+func (f *FrequencyResponse) Latest() *FrequencyCommand {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.latest
+}
+
+// droop returns the power of the droop curve at the frequency.
+func (f *FrequencyResponse) droop(frequency float64) float64 {
+	deviation := frequency - f.cfg.Nominal
+	if math.Abs(deviation) <= f.cfg.Deadband {
+		return 0
+	}
+	beyond := math.Abs(deviation) - f.cfg.Deadband
+	power := math.Min(1, beyond/(f.cfg.Droop/100*f.cfg.Nominal)) * f.cfg.Capacity
+	return math.Copysign(power, deviation)
+}
+
+// Step reads the frequency, commands the station and returns the command.
+// The station keeps its power if the frequency can't be read, and is
+// commanded 0 after MaxFailedReads consecutive failed reads, the command
+// is returned with the read error.
+func (f *FrequencyResponse) Step(now time.Time) (*FrequencyCommand, error) {
+	frequency, err := f.source.Frequency()
+	if err != nil {
+		f.failed++
+		err = fmt.Errorf("failed to read frequency: %w", err)
+		if f.failed < f.cfg.MaxFailedReads {
+			return nil, err
+		}
+		return f.stop(now, err)
+	}
+	f.failed = 0
+	summary, ok := f.scheduler.data.Station(f.station.ID)
+	if !ok || summary.MaxCapacity == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoStationData, f.station.ID)
+	}
+	capacity := summary.MaxCapacity * f.station.CellVoltage / 1000
+	level := summary.CurrentCapacity * f.station.CellVoltage / 1000
+	minLevel, maxLevel := capacity*dischargeFloor(f.station)/100, capacity*f.station.MaxSOC/100
+	hours := f.cfg.Interval.Hours()
+
+	cmd := &FrequencyCommand{Time: now, Frequency: frequency, SOC: summary.SOC(), Mode: ModeDeadband}
+	cmd.Response = f.droop(frequency)
+	power := cmd.Response
+	if power != 0 {
+		cmd.Mode = ModeResponse
+	} else if f.cfg.RecoveryPower > 0 && math.Abs(cmd.SOC-f.cfg.TargetSOC) > recoveryBand {
+		// move the soc back to the target without overshooting it
+		cmd.Mode = ModeRecovery
+		target := capacity * f.cfg.TargetSOC / 100
+		power = math.Max(-f.cfg.RecoveryPower, math.Min(f.cfg.RecoveryPower, (target-level)/hours))
+	}
+
+	switch {
+	case power > f.station.MaxChargePower:
+		power, cmd.Limited = f.station.MaxChargePower, "max charge power"
+	case power < -f.station.MaxDischargePower:
+		power, cmd.Limited = -f.station.MaxDischargePower, "max discharge power"
+	}
+	if limit := math.Max(0, maxLevel-level) / f.station.Efficiency / hours; power > limit {
+		power, cmd.Limited = limit, "max soc"
+	}
+	if limit := math.Max(0, level-minLevel) / hours; -power > limit {
+		power, cmd.Limited = -limit, "min soc"
+	}
+	cmd.Power = power
+
+	if err := f.commander.SetPower(f.station.ID, power); err != nil {
+		return nil, fmt.Errorf("failed to command station %d: %w", f.station.ID, err)
+	}
+	f.mu.Lock()
+	f.latest = cmd
+	f.mu.Unlock()
+	return cmd, nil
+}
+
+// stop commands the station 0 as the frequency can't be read.
+func (f *FrequencyResponse) stop(now time.Time, readErr error) (*FrequencyCommand, error) {
+	cmd := &FrequencyCommand{Time: now, Mode: ModeNoSignal, Limited: fmt.Sprintf("%d failed frequency reads", f.failed)}
+	if summary, ok := f.scheduler.data.Station(f.station.ID); ok {
+		cmd.SOC = summary.SOC()
+	}
+	if err := f.commander.SetPower(f.station.ID, 0); err != nil {
+		return nil, fmt.Errorf("failed to command station %d: %w", f.station.ID, err)
+	}
+	f.mu.Lock()
+	f.latest = cmd
+	f.mu.Unlock()
+	return cmd, readErr
+}
+
+// Run steps the frequency response every interval until ctx is done.
+func (f *FrequencyResponse) Run(ctx context.Context) error {
+	ticker := time.NewTicker(f.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if _, err := f.Step(now); err != nil {
+				log.Warn("frequency response step failed", zap.Int("station", f.station.ID), zap.Error(err))
+			}
+		}
+	}
+}
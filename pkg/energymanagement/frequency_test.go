@@ -0,0 +1,134 @@
+package energymanagement
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+func newFrequencyResponse(t *testing.T, station config.StationEnergyConfig, cfg config.FrequencyResponseConfig) (*FrequencyResponse, *SimulatedFrequency, *fakeCommander) {
+	scheduler := NewScheduler(&config.EnergyManagementConfig{Stations: []config.StationEnergyConfig{station}}, newStation(t, 1, 95))
+	source := NewSimulatedFrequency(50, 0, 1)
+	commander := &fakeCommander{power: make(map[int]float64)}
+	cfg.Station = 1
+	f, err := NewFrequencyResponse(&cfg, scheduler, source, commander)
+	require.NoError(t, err)
+	return f, source, commander
+}
+
+func TestDroop(t *testing.T) {
+	f, _, _ := newFrequencyResponse(t, config.StationEnergyConfig{ID: 1, MaxChargePower: 2, MaxDischargePower: 2}, config.FrequencyResponseConfig{})
+	// full response 0.2Hz beyond the deadband of 0.015Hz
+	for _, c := range []struct{ frequency, power float64 }{
+		{50, 0},
+		{50.015, 0},
+		{49.985, 0},
+		{50.115, 1},
+		{49.885, -1},
+		{50.215, 2},
+		{48, -2},
+	} {
+		assert.InDelta(t, c.power, f.droop(c.frequency), 1e-9, "frequency %v", c.frequency)
+	}
+}
+
+func TestFrequencyResponse(t *testing.T) {
+	station := config.StationEnergyConfig{ID: 1, MaxChargePower: 2, MaxDischargePower: 2}
+	f, source, commander := newFrequencyResponse(t, station, config.FrequencyResponseConfig{Capacity: 3})
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	assert.Nil(t, f.Latest())
+
+	cmd, err := f.Step(now)
+	require.NoError(t, err)
+	assert.Equal(t, ModeDeadband, cmd.Mode)
+	assert.Zero(t, cmd.Power)
+
+	// under frequency discharges, the response is capped by the station
+	source.SetDeviation(-0.5)
+	cmd, err = f.Step(now.Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, ModeResponse, cmd.Mode)
+	assert.InDelta(t, -3, cmd.Response, 1e-9)
+	assert.InDelta(t, -2, cmd.Power, 1e-9)
+	assert.Equal(t, "max discharge power", cmd.Limited)
+	assert.Equal(t, map[int]float64{1: -2}, commander.power)
+	assert.Same(t, cmd, f.Latest())
+
+	// a read failure keeps the power until too many reads failed
+	f.source = failingSource{}
+	for i := 1; i < DefaultMaxFailedReads; i++ {
+		_, err = f.Step(now.Add(time.Duration(1+i) * time.Second))
+		assert.Error(t, err)
+		assert.Same(t, cmd, f.Latest())
+		assert.Equal(t, map[int]float64{1: -2}, commander.power)
+	}
+	stopped, err := f.Step(now.Add(10 * time.Second))
+	assert.Error(t, err)
+	require.NotNil(t, stopped)
+	assert.Equal(t, ModeNoSignal, stopped.Mode)
+	assert.Equal(t, "5 failed frequency reads", stopped.Limited)
+	assert.Same(t, stopped, f.Latest())
+	assert.Equal(t, map[int]float64{1: 0}, commander.power)
+
+	// the response resumes once the frequency is read again
+	f.source = source
+	cmd, err = f.Step(now.Add(11 * time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, ModeResponse, cmd.Mode)
+	_, err = f.Step(now.Add(12 * time.Second))
+	require.NoError(t, err)
+	f.source = failingSource{}
+	_, err = f.Step(now.Add(13 * time.Second))
+	assert.Error(t, err)
+	assert.Equal(t, map[int]float64{1: -2}, commander.power)
+
+	_, err = NewFrequencyResponse(&config.FrequencyResponseConfig{Station: 2}, f.scheduler, source, commander)
+	assert.ErrorIs(t, err, ErrUnknownStation)
+}
+
+type failingSource struct{}
+
+func (failingSource) Frequency() (float64, error) {
+	return 0, errors.New("meter offline")
+}
+
+func TestFrequencyRecovery(t *testing.T) {
+	// 3.2kWh at 50% soc
+	station := config.StationEnergyConfig{ID: 1, MaxChargePower: 2, MaxDischargePower: 2, MinSOC: 45}
+	f, source, _ := newFrequencyResponse(t, station, config.FrequencyResponseConfig{
+		Interval: time.Hour, RecoveryPower: 0.5, TargetSOC: 60,
+	})
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	// the soc recovers toward the target within the deadband
+	cmd, err := f.Step(now)
+	require.NoError(t, err)
+	assert.Equal(t, ModeRecovery, cmd.Mode)
+	assert.InDelta(t, 0.32, cmd.Power, 1e-6)
+
+	// the response is limited by the energy above the min soc
+	source.SetDeviation(-0.3)
+	cmd, err = f.Step(now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.InDelta(t, -0.16, cmd.Power, 1e-6)
+	assert.Equal(t, "min soc", cmd.Limited)
+}
+
+func TestSimulatedFrequency(t *testing.T) {
+	s := NewSimulatedFrequency(60, 0.01, 1)
+	var sum, sq float64
+	n := 10000
+	for i := 0; i < n; i++ {
+		f, err := s.Frequency()
+		require.NoError(t, err)
+		sum += f - 60
+		sq += (f - 60) * (f - 60)
+	}
+	assert.InDelta(t, 0, sum/float64(n), 0.002)
+	assert.InDelta(t, 0.01, math.Sqrt(sq/float64(n)), 0.002)
+}
@@ -0,0 +1,79 @@
+package energymanagement
+
+import (
+	"sync"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/modbus"
+)
+
+// meter reads a point of a meter over Modbus TCP. It connects on the first
+// read and reconnects after a failed one.
+type meter struct {
+	cfg   config.MeterConfig
+	point config.ModbusPoint
+
+	mu     sync.Mutex
+	client *modbus.Client
+}
+
+func (m *meter) read() (float64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		c, err := modbus.Dial(m.cfg.Addr, m.cfg.Timeout)
+		if err != nil {
+			return 0, err
+		}
+		m.client = c
+	}
+	v, err := m.client.ReadPoint(m.cfg.UnitID, &m.point)
+	if err != nil {
+		m.client.Close()
+		m.client = nil
+		return 0, err
+	}
+	return v, nil
+}
+
+// Close closes the connection.
+func (m *meter) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.client == nil {
+		return nil
+	}
+	err := m.client.Close()
+	m.client = nil
+	return err
+}
+
+// Meter reads the grid frequency from a meter over Modbus TCP.
+type Meter struct {
+	meter
+}
+
+// NewMeter creates a new meter of the grid frequency.
+func NewMeter(cfg *config.FrequencyMeterConfig) *Meter {
+	return &Meter{meter{cfg: cfg.MeterConfig, point: cfg.Frequency}}
+}
+
+// Frequency implements FrequencySource.
+func (m *Meter) Frequency() (float64, error) {
+	return m.read()
+}
+
+// LoadMeter reads the load of a site from a meter over Modbus TCP.
+type LoadMeter struct {
+	meter
+}
+
+// NewLoadMeter creates a new meter of the site load.
+func NewLoadMeter(cfg *config.LoadMeterConfig) *LoadMeter {
+	return &LoadMeter{meter{cfg: cfg.MeterConfig, point: cfg.Load}}
+}
+
+// Load implements LoadSource.
+func (m *LoadMeter) Load() (float64, error) {
+	return m.read()
+}
@@ -0,0 +1,41 @@
+package energymanagement
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/modbus"
+)
+
+func TestMeter(t *testing.T) {
+	s := modbus.NewSimulator()
+	require.NoError(t, s.Start("127.0.0.1:0"))
+	defer s.Close()
+
+	point := config.ModbusPoint{Table: modbus.TableInput, Address: 10, Type: modbus.TypeUint16, Scale: 0.001}
+	require.NoError(t, s.SetPoint(1, &point, 10, 49.95))
+	m := NewMeter(&config.FrequencyMeterConfig{MeterConfig: config.MeterConfig{Addr: s.Addr(), UnitID: 1}, Frequency: point})
+	defer m.Close()
+	f, err := m.Frequency()
+	require.NoError(t, err)
+	assert.InDelta(t, 49.95, f, 1e-9)
+
+	load := config.ModbusPoint{Address: 20, Type: modbus.TypeInt32, Scale: 0.1}
+	require.NoError(t, s.SetPoint(1, &load, 20, -12.5))
+	lm := NewLoadMeter(&config.LoadMeterConfig{MeterConfig: config.MeterConfig{Addr: s.Addr(), UnitID: 1}, Load: load})
+	defer lm.Close()
+	v, err := lm.Load()
+	require.NoError(t, err)
+	assert.InDelta(t, -12.5, v, 1e-9)
+
+	// the unknown unit fails and the meter reconnects
+	m.cfg.UnitID = 2
+	_, err = m.Frequency()
+	assert.Error(t, err)
+	assert.Nil(t, m.client)
+	m.cfg.UnitID = 1
+	_, err = m.Frequency()
+	assert.NoError(t, err)
+}
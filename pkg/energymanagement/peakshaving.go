@@ -0,0 +1,421 @@
+package energymanagement
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"go.uber.org/zap"
+)
+
+// Defaults of the peak shaving.
+const (
+	DefaultDemandInterval      = 15 * time.Minute
+	DefaultPeakShavingInterval = 10 * time.Second
+
+	// targetPrecision is the precision in kW of the learned peak target.
+	targetPrecision = 0.01
+	// historyWindows is the number of closed billing windows reported.
+	historyWindows = 12
+)
+
+// StateStore persists the state of the controllers, the local store
+// implements it.
+type StateStore interface {
+	SaveState(key string, value []byte) error
+	LoadState(key string) ([]byte, error)
+}
+
+// peakShavingState is the persisted state of a PeakShaving, the billed
+// peaks of the window and the demand interval being metered.
+type peakShavingState struct {
+	Window       PeakShavingWindow   `json:"window"`
+	History      []PeakShavingWindow `json:"history,omitempty"`
+	DemandStart  time.Time           `json:"demand_start"`
+	ImportEnergy float64             `json:"import_energy"`
+	LoadEnergy   float64             `json:"load_energy"`
+	Metered      time.Time           `json:"metered"`
+}
+
+// LoadSource reads the load of a site in kW.
+type LoadSource interface {
+	Load() (float64, error)
+}
+
+// PeakShavingCommand is the result of a control step of the peak shaving.
+type PeakShavingCommand struct {
+	Time time.Time `json:"time"`
+	// Load is the measured site load in kW.
+	Load float64 `json:"load"`
+	// Target is the peak target in kW, 0 until it is known.
+	Target float64 `json:"target"`
+	// Power is the commanded power of the station in kW, positive charges.
+	Power float64 `json:"power"`
+	// Import is the grid import in kW, the load plus the power.
+	Import float64 `json:"import"`
+	SOC    float64 `json:"soc"`
+	// Limited tells why the import exceeds the target, if so.
+	Limited string `json:"limited,omitempty"`
+}
+
+// PeakShavingWindow is a billing window.
+type PeakShavingWindow struct {
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Target float64   `json:"target"`
+	// Peak is the billed peak in kW, the max demand of the grid import,
+	// and SitePeak the max demand of the site load without the battery.
+	Peak     float64 `json:"peak"`
+	SitePeak float64 `json:"site_peak"`
+	// Savings is the demand charge saved by the battery.
+	Savings float64 `json:"savings"`
+}
+
+// PeakShavingReport is the current billing window of a station and the
+// previous ones.
+type PeakShavingReport struct {
+	Station int               `json:"station"`
+	Window  PeakShavingWindow `json:"window"`
+	// Reserve is the energy in kWh the load forecast needs above the
+	// target for the rest of the window, Available the energy above the
+	// min soc.
+	Reserve   float64 `json:"reserve"`
+	Available float64 `json:"available"`
+	// History are the closed windows, oldest first.
+	History []PeakShavingWindow `json:"history,omitempty"`
+}
+
+// PeakShaving discharges a behind the meter station to hold the grid
+// import of its site below the peak target of the billing window, and
+// recharges it below the target. The target is learned as the lowest peak
+// the battery can hold over the load forecast of the rest of the window,
+// keeping the reserve energy the forecast peaks need. Once the import
+// exceeds the target the demand charge is set and the target rises to the
+// billed peak.
+type PeakShaving struct {
+	cfg       config.PeakShavingConfig
+	station   config.StationEnergyConfig
+	scheduler *Scheduler
+	commander Commander
+	store     StateStore
+
+	mu      sync.Mutex
+	window  PeakShavingWindow
+	history []PeakShavingWindow
+	reserve float64
+	// the demand interval being metered, its energies in kWh metered
+	// until metered and the latest measurement
+	demandStart  time.Time
+	importEnergy float64
+	loadEnergy   float64
+	metered      time.Time
+	last         *PeakShavingCommand
+}
+
+// NewPeakShaving creates a new PeakShaving of the station of cfg, the
+// station must be configured in the scheduler. The state is saved to store
+// on every step and restored from it, so a restart keeps the billed peak
+// of the window, nil doesn't save it.
+func NewPeakShaving(cfg *config.PeakShavingConfig, scheduler *Scheduler, commander Commander, store StateStore) (*PeakShaving, error) {
+	station, ok := scheduler.stations[cfg.Station]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownStation, cfg.Station)
+	}
+	c := *cfg
+	if c.DemandInterval <= 0 {
+		c.DemandInterval = DefaultDemandInterval
+	}
+	if c.Interval <= 0 {
+		c.Interval = DefaultPeakShavingInterval
+	}
+	if c.BillingDay < 1 || c.BillingDay > 28 {
+		c.BillingDay = 1
+	}
+	p := &PeakShaving{cfg: c, station: station, scheduler: scheduler, commander: commander, store: store}
+	if err := p.restore(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// stateKey is the key of the state in the store.
+func (p *PeakShaving) stateKey() string {
+	return fmt.Sprintf("peak_shaving/%d", p.station.ID)
+}
+
+// restore restores the saved state. The load while stopped is unknown,
+// the demand interval is metered from the next step on.
+func (p *PeakShaving) restore() error {
+	if p.store == nil {
+		return nil
+	}
+	value, err := p.store.LoadState(p.stateKey())
+	if err != nil || value == nil {
+		return err
+	}
+	var state peakShavingState
+	if err := json.Unmarshal(value, &state); err != nil {
+		return fmt.Errorf("failed to decode peak shaving state: %w", err)
+	}
+	p.window, p.history = state.Window, state.History
+	p.demandStart, p.importEnergy, p.loadEnergy, p.metered = state.DemandStart, state.ImportEnergy, state.LoadEnergy, state.Metered
+	log.Info("restored peak shaving state", zap.Int("station", p.station.ID),
+		zap.Time("window", p.window.Start), zap.Float64("peak", p.window.Peak), zap.Float64("target", p.window.Target))
+	return nil
+}
+
+// save saves the state, a failure is logged as the shaving goes on.
+func (p *PeakShaving) save() {
+	if p.store == nil {
+		return
+	}
+	value, err := json.Marshal(peakShavingState{
+		Window:       p.window,
+		History:      p.history,
+		DemandStart:  p.demandStart,
+		ImportEnergy: p.importEnergy,
+		LoadEnergy:   p.loadEnergy,
+		Metered:      p.metered,
+	})
+	if err == nil {
+		err = p.store.SaveState(p.stateKey(), value)
+	}
+	if err != nil {
+		log.Warn("failed to save peak shaving state", zap.Int("station", p.station.ID), zap.Error(err))
+	}
+}
+
+// Station returns the id of the station.
+func (p *PeakShaving) Station() int {
+	return p.station.ID
+}
+
+// billingWindow returns the billing window of t.
+func (p *PeakShaving) billingWindow(t time.Time) (time.Time, time.Time) {
+	y, m, _ := t.Date()
+	start := time.Date(y, m, p.cfg.BillingDay, 0, 0, 0, 0, t.Location())
+	if t.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start, start.AddDate(0, 1, 0)
+}
+
+// advance meters the latest measurement until t, billing the demand
+// intervals and closing the billing windows t is past. It returns whether
+// a demand interval was billed and whether a window started.
+func (p *PeakShaving) advance(t time.Time) (billed, started bool) {
+	if p.window.End.IsZero() {
+		p.startWindow(t)
+		p.demandStart, p.metered = t.Truncate(p.cfg.DemandInterval), t
+		return false, true
+	}
+	for {
+		end := p.demandStart.Add(p.cfg.DemandInterval)
+		if t.Before(end) {
+			p.accumulate(t)
+			return billed, started
+		}
+		p.accumulate(end)
+		p.closeDemand()
+		p.demandStart, billed = end, true
+		if !end.Before(p.window.End) {
+			p.history = append(p.history, p.window)
+			if len(p.history) > historyWindows {
+				p.history = p.history[1:]
+			}
+			p.startWindow(end)
+			started = true
+		}
+	}
+}
+
+// startWindow starts the billing window of t.
+func (p *PeakShaving) startWindow(t time.Time) {
+	start, end := p.billingWindow(t)
+	p.window = PeakShavingWindow{Start: start, End: end, Target: p.cfg.Target}
+}
+
+// accumulate adds the energies of the latest measurement until t.
+func (p *PeakShaving) accumulate(t time.Time) {
+	if p.last != nil && t.After(p.metered) {
+		hours := t.Sub(p.metered).Hours()
+		p.importEnergy += math.Max(0, p.last.Import) * hours
+		p.loadEnergy += math.Max(0, p.last.Load) * hours
+	}
+	if t.After(p.metered) {
+		p.metered = t
+	}
+}
+
+// closeDemand bills the demand of the metered interval.
+func (p *PeakShaving) closeDemand() {
+	hours := p.cfg.DemandInterval.Hours()
+	p.window.Peak = math.Max(p.window.Peak, p.importEnergy/hours)
+	p.window.SitePeak = math.Max(p.window.SitePeak, p.loadEnergy/hours)
+	p.window.Savings = math.Max(0, p.window.SitePeak-p.window.Peak) * p.cfg.DemandCharge
+	p.importEnergy, p.loadEnergy = 0, 0
+}
+
+// forecastLoads returns the forecast load of every demand interval from
+// now until the end of the window, nil without forecast.
+func (p *PeakShaving) forecastLoads(now time.Time) []float64 {
+	forecast := p.scheduler.Forecast(p.station.ID, ForecastDemand)
+	if forecast == nil {
+		return nil
+	}
+	var loads []float64
+	for t := now; t.Before(p.window.End); t = t.Add(p.cfg.DemandInterval) {
+		if v, ok := forecast.valueAt(t); ok {
+			loads = append(loads, v)
+		}
+	}
+	return loads
+}
+
+// need returns the energy in kWh the loads need above the target, the
+// battery recharging below it, and whether the battery can hold the
+// target within its power and usable capacity.
+func (p *PeakShaving) need(loads []float64, target, usable float64) (float64, bool) {
+	hours := p.cfg.DemandInterval.Hours()
+	need := 0.0
+	for i := len(loads) - 1; i >= 0; i-- {
+		if over := loads[i] - target; over > 0 {
+			if over > p.station.MaxDischargePower+epsilon {
+				return need, false
+			}
+			need += over * hours
+		} else {
+			need = math.Max(0, need-math.Min(-over, p.station.MaxChargePower)*hours*p.station.Efficiency)
+		}
+		if need > usable+epsilon {
+			return need, false
+		}
+	}
+	return need, true
+}
+
+// learn returns the lowest target not below the billed peak the battery
+// can hold over the loads with the available energy.
+func (p *PeakShaving) learn(loads []float64, available, usable float64) float64 {
+	lo, hi := p.window.Peak, p.window.Peak
+	for _, l := range loads {
+		hi = math.Max(hi, l)
+	}
+	if need, ok := p.need(loads, lo, usable); ok && need <= available+epsilon {
+		return lo
+	}
+	for hi-lo > targetPrecision {
+		mid := (lo + hi) / 2
+		if need, ok := p.need(loads, mid, usable); ok && need <= available+epsilon {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi
+}
+
+// Step commands the station for the measured site load in kW and returns
+// the command.
+func (p *PeakShaving) Step(now time.Time, load float64) (*PeakShavingCommand, error) {
+	summary, ok := p.scheduler.data.Station(p.station.ID)
+	if !ok || summary.MaxCapacity == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoStationData, p.station.ID)
+	}
+	capacity := summary.MaxCapacity * p.station.CellVoltage / 1000
+	level := summary.CurrentCapacity * p.station.CellVoltage / 1000
+	minLevel, maxLevel := capacity*dischargeFloor(p.station)/100, capacity*p.station.MaxSOC/100
+	available, usable := math.Max(0, level-minLevel), maxLevel-minLevel
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	billed, started := p.advance(now)
+	loads := p.forecastLoads(now)
+	switch {
+	case p.cfg.Target > 0 || !billed && !started:
+	case loads != nil:
+		p.window.Target = p.learn(loads, available, usable)
+	case p.window.SitePeak > 0:
+		// without forecast the battery shaves the peak of the site so far
+		p.window.Target = math.Max(0, p.window.SitePeak-p.station.MaxDischargePower)
+	}
+	p.window.Target = math.Max(p.window.Target, p.window.Peak)
+	p.reserve, _ = p.need(loads, p.window.Target, math.Inf(1))
+
+	cmd := &PeakShavingCommand{Time: now, Load: load, Target: p.window.Target, SOC: summary.SOC()}
+	hours := p.cfg.Interval.Hours()
+	if cmd.Target > 0 {
+		if over := load - cmd.Target; over > 0 {
+			power := over
+			if power > p.station.MaxDischargePower {
+				power, cmd.Limited = p.station.MaxDischargePower, "max discharge power"
+			}
+			if limit := available / hours; power > limit {
+				power, cmd.Limited = limit, "min soc"
+			}
+			cmd.Power = -power
+		} else {
+			// recharge without raising the import over the target
+			room := math.Max(0, maxLevel-level) / p.station.Efficiency / hours
+			cmd.Power = math.Min(-over, math.Min(p.station.MaxChargePower, room))
+		}
+	}
+	cmd.Import = load + cmd.Power
+
+	if err := p.commander.SetPower(p.station.ID, cmd.Power); err != nil {
+		p.save()
+		return nil, fmt.Errorf("failed to command station %d: %w", p.station.ID, err)
+	}
+	p.last = cmd
+	p.save()
+	return cmd, nil
+}
+
+// Report returns the report of the current billing window, nil before the
+// first step.
+func (p *PeakShaving) Report() *PeakShavingReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.window.End.IsZero() {
+		return nil
+	}
+	report := &PeakShavingReport{
+		Station: p.station.ID,
+		Window:  p.window,
+		Reserve: p.reserve,
+		History: append([]PeakShavingWindow(nil), p.history...),
+	}
+	if summary, ok := p.scheduler.data.Station(p.station.ID); ok {
+		capacity := summary.MaxCapacity * p.station.CellVoltage / 1000
+		report.Available = math.Max(0, summary.CurrentCapacity*p.station.CellVoltage/1000-capacity*dischargeFloor(p.station)/100)
+	}
+	return report
+}
+
+// Run reads the site load from source and steps the peak shaving every
+// interval until ctx is done.
+func (p *PeakShaving) Run(ctx context.Context, source LoadSource) error {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			load, err := source.Load()
+			if err != nil {
+				log.Warn("failed to read site load", zap.Int("station", p.station.ID), zap.Error(err))
+				continue
+			}
+			if _, err := p.Step(now, load); err != nil {
+				log.Warn("peak shaving step failed", zap.Int("station", p.station.ID), zap.Error(err))
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package energymanagement
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+func newPeakShaving(t *testing.T, cfg config.PeakShavingConfig) (*PeakShaving, *Scheduler, *fakeCommander) {
+	// 3.2kWh at 50% soc, 1.28kWh above the min soc
+	scheduler := NewScheduler(&config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 2, MaxDischargePower: 2}},
+	}, newStation(t, 1, 95))
+	commander := &fakeCommander{power: make(map[int]float64)}
+	cfg.Station = 1
+	p, err := NewPeakShaving(&cfg, scheduler, commander, nil)
+	require.NoError(t, err)
+	return p, scheduler, commander
+}
+
+func TestPeakShaving(t *testing.T) {
+	p, scheduler, commander := newPeakShaving(t, config.PeakShavingConfig{Interval: 15 * time.Minute, DemandCharge: 10})
+	now := time.Date(2024, 6, 30, 20, 0, 0, 0, time.UTC)
+	require.NoError(t, scheduler.SetForecast(hourlyForecast(ForecastDemand, now, 5, 6, 4, 3)))
+	assert.Nil(t, p.Report())
+
+	// the peaks of 5 and 6kW need 11-2T kWh above the target T
+	cmd, err := p.Step(now, 5)
+	require.NoError(t, err)
+	assert.InDelta(t, 4.86, cmd.Target, 0.01)
+	assert.InDelta(t, cmd.Target-5, cmd.Power, 1e-9)
+	assert.InDelta(t, cmd.Target, cmd.Import, 1e-9)
+	assert.Equal(t, map[int]float64{1: cmd.Power}, commander.power)
+	report := p.Report()
+	require.NotNil(t, report)
+	assert.Equal(t, time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC), report.Window.Start)
+	assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), report.Window.End)
+	assert.InDelta(t, 1.28, report.Reserve, 0.02)
+	assert.InDelta(t, 1.28, report.Available, 1e-6)
+	target := cmd.Target
+
+	// the demand of the interval is billed
+	cmd, err = p.Step(now.Add(15*time.Minute), 5)
+	require.NoError(t, err)
+	report = p.Report()
+	assert.InDelta(t, target, report.Window.Peak, 1e-9)
+	assert.InDelta(t, 5, report.Window.SitePeak, 1e-9)
+	assert.InDelta(t, (5-target)*10, report.Window.Savings, 1e-9)
+	assert.InDelta(t, target, cmd.Target, 1e-9)
+
+	// the target rises to the missed peak
+	cmd, err = p.Step(now.Add(30*time.Minute), 8)
+	require.NoError(t, err)
+	assert.Equal(t, "max discharge power", cmd.Limited)
+	assert.InDelta(t, 6, cmd.Import, 1e-9)
+	cmd, err = p.Step(now.Add(45*time.Minute), 5)
+	require.NoError(t, err)
+	assert.InDelta(t, 6, cmd.Target, 1e-9)
+	// the battery recharges below the target
+	cmd, err = p.Step(now.Add(time.Hour), 5.5)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.5, cmd.Power, 1e-9)
+
+	// the next window starts over
+	_, err = p.Step(now.Add(4*time.Hour+5*time.Minute), 3)
+	require.NoError(t, err)
+	report = p.Report()
+	require.Len(t, report.History, 1)
+	assert.InDelta(t, 6, report.History[0].Peak, 1e-9)
+	assert.InDelta(t, 8, report.History[0].SitePeak, 1e-9)
+	assert.InDelta(t, 20, report.History[0].Savings, 1e-9)
+	assert.Equal(t, time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC), report.Window.Start)
+	assert.Zero(t, report.Window.Peak)
+}
+
+func TestPeakShavingTarget(t *testing.T) {
+	p, _, _ := newPeakShaving(t, config.PeakShavingConfig{Target: 4, Interval: time.Hour, BillingDay: 15})
+	now := time.Date(2024, 6, 3, 8, 0, 0, 0, time.UTC)
+
+	cmd, err := p.Step(now, 3)
+	require.NoError(t, err)
+	assert.InDelta(t, 1, cmd.Power, 1e-9)
+	assert.InDelta(t, 4, cmd.Import, 1e-9)
+	report := p.Report()
+	assert.Equal(t, time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC), report.Window.Start)
+
+	// the discharge is limited by the energy above the min soc
+	cmd, err = p.Step(now.Add(time.Minute), 12)
+	require.NoError(t, err)
+	assert.InDelta(t, -1.28, cmd.Power, 1e-6)
+	assert.Equal(t, "min soc", cmd.Limited)
+}
+
+func TestPeakShavingWithoutForecast(t *testing.T) {
+	p, _, _ := newPeakShaving(t, config.PeakShavingConfig{DemandInterval: time.Minute})
+	now := time.Date(2024, 6, 3, 8, 0, 0, 0, time.UTC)
+
+	// the target is unknown until a demand interval is metered
+	cmd, err := p.Step(now, 5)
+	require.NoError(t, err)
+	assert.Zero(t, cmd.Target)
+	assert.Zero(t, cmd.Power)
+	cmd, err = p.Step(now.Add(time.Minute), 6)
+	require.NoError(t, err)
+	assert.InDelta(t, 5, cmd.Target, 1e-9)
+	assert.InDelta(t, -1, cmd.Power, 1e-9)
+}
+
+// memStore is a StateStore in memory.
+type memStore map[string][]byte
+
+func (m memStore) SaveState(key string, value []byte) error {
+	m[key] = value
+	return nil
+}
+
+func (m memStore) LoadState(key string) ([]byte, error) {
+	return m[key], nil
+}
+
+func TestPeakShavingRestore(t *testing.T) {
+	store := memStore{}
+	p, scheduler, commander := newPeakShaving(t, config.PeakShavingConfig{DemandInterval: time.Minute})
+	p.store = store
+	now := time.Date(2024, 6, 3, 8, 0, 0, 0, time.UTC)
+	_, err := p.Step(now, 5)
+	require.NoError(t, err)
+	_, err = p.Step(now.Add(time.Minute), 6)
+	require.NoError(t, err)
+	_, err = p.Step(now.Add(90*time.Second), 6)
+	require.NoError(t, err)
+	require.Contains(t, store, "peak_shaving/1")
+
+	// after a restart the billed peak and the target of the window are kept
+	restarted, err := NewPeakShaving(&config.PeakShavingConfig{Station: 1, DemandInterval: time.Minute}, scheduler, commander, store)
+	require.NoError(t, err)
+	report := restarted.Report()
+	require.NotNil(t, report)
+	assert.Equal(t, p.Report().Window, report.Window)
+	assert.InDelta(t, 5, report.Window.Peak, 1e-9)
+	cmd, err := restarted.Step(now.Add(100*time.Second), 7)
+	require.NoError(t, err)
+	assert.InDelta(t, 5, cmd.Target, 1e-9)
+	assert.InDelta(t, -2, cmd.Power, 1e-9)
+
+	store["peak_shaving/1"] = []byte("{")
+	_, err = NewPeakShaving(&config.PeakShavingConfig{Station: 1}, scheduler, commander, store)
+	assert.Error(t, err)
+}
+
+func TestPeakShavingBackupReserve(t *testing.T) {
+	// 1.6kWh at 50% soc, 0.64kWh above the 30% backup reserve
+	scheduler := NewScheduler(&config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 2, MaxDischargePower: 2, BackupReserve: 30}},
+	}, newStation(t, 1, 95))
+	p, err := NewPeakShaving(&config.PeakShavingConfig{Station: 1, Interval: time.Hour}, scheduler, &fakeCommander{power: make(map[int]float64)}, nil)
+	require.NoError(t, err)
+	now := time.Date(2024, 6, 30, 20, 0, 0, 0, time.UTC)
+	require.NoError(t, scheduler.SetForecast(hourlyForecast(ForecastDemand, now, 5, 6, 4, 3)))
+
+	// the target is learned with the energy above the reserve, the peaks of
+	// 5 and 6kW need 11-2T kWh above the target T
+	cmd, err := p.Step(now, 5)
+	require.NoError(t, err)
+	assert.InDelta(t, 5.18, cmd.Target, 0.02)
+	report := p.Report()
+	assert.InDelta(t, 0.64, report.Available, 1e-6)
+
+	// the discharge stops at the reserve
+	cmd, err = p.Step(now.Add(time.Minute), 12)
+	require.NoError(t, err)
+	assert.InDelta(t, -0.64, cmd.Power, 1e-6)
+	assert.Equal(t, "min soc", cmd.Limited)
+}
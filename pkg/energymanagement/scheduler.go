@@ -0,0 +1,337 @@
+package energymanagement
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// Defaults of the scheduling.
+const (
+	DefaultHorizon     = 24 * time.Hour
+	MaxHorizon         = 48 * time.Hour
+	DefaultStep        = time.Hour
+	DefaultCellVoltage = 3.2
+	DefaultMinSOC      = 10
+	DefaultMaxSOC      = 90
+	DefaultMinSOH      = 60
+	DefaultEfficiency  = 0.9
+
+	// epsilon is the min energy in kWh worth scheduling.
+	epsilon = 1e-6
+)
+
+var (
+	// ErrUnknownStation is returned for a station without energy config.
+	ErrUnknownStation = errors.New("unknown station")
+	// ErrNoStationData is returned for a station which never reported.
+	ErrNoStationData = errors.New("no data of the station")
+	// ErrNoForecast is returned when no forecast covers the schedule.
+	ErrNoForecast = errors.New("no forecast")
+)
+
+// Slot is a slot of a schedule.
+type Slot struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Value is the forecast value of the slot.
+	Value float64 `json:"value"`
+	// Power is the power in kW at the grid side, positive charges.
+	Power float64 `json:"power"`
+	// SOC is the planned state of charge in percent at the end of the slot.
+	SOC float64 `json:"soc"`
+	// Revenue is the revenue of the power at the forecast price and Wear
+	// is the wear cost of the battery, for price forecasts only.
+	Revenue float64 `json:"revenue,omitempty"`
+	Wear    float64 `json:"wear,omitempty"`
+	// Reason tells why the optimizer chose the power.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Planners of schedules.
+const (
+	// PlannerShift shifts energy from the lowest valued slots to the
+	// highest valued ones.
+	PlannerShift = "shift"
+	// PlannerArbitrage maximizes the revenue of prices net of the wear.
+	PlannerArbitrage = "arbitrage"
+)
+
+// Schedule is a charge and discharge schedule of a station.
+type Schedule struct {
+	Station   int          `json:"station"`
+	Kind      ForecastKind `json:"kind"`
+	Planner   string       `json:"planner"`
+	CreatedAt time.Time    `json:"created_at"`
+	Slots     []Slot       `json:"slots"`
+	// Revenue and Wear are the totals of the slots.
+	Revenue float64 `json:"revenue,omitempty"`
+	Wear    float64 `json:"wear,omitempty"`
+	// Reason tells why the station stays idle, if so.
+	Reason string `json:"reason,omitempty"`
+}
+
+// limits are the energy limits of a station in kWh over the slots.
+type limits struct {
+	// initial, min and max stored energy
+	initial, min, max float64
+	// max energy gained and lost by the battery in a slot
+	charge, discharge float64
+	efficiency        float64
+}
+
+// Scheduler plans the charge and discharge of the stations from demand or
+// price forecasts, bounded by the live energy of the stations.
+type Scheduler struct {
+	horizon  time.Duration
+	step     time.Duration
+	stations map[int]config.StationEnergyConfig
+	data     *data_model.BatteriesData
+
+	mu sync.Mutex
+	// station, 0 for all -> kind -> latest forecast
+	forecasts map[int]map[ForecastKind]*Forecast
+}
+
+// NewScheduler creates a new Scheduler.
+func NewScheduler(cfg *config.EnergyManagementConfig, data *data_model.BatteriesData) *Scheduler {
+	s := &Scheduler{
+		horizon:   cfg.Horizon,
+		step:      cfg.Step,
+		stations:  make(map[int]config.StationEnergyConfig, len(cfg.Stations)),
+		data:      data,
+		forecasts: make(map[int]map[ForecastKind]*Forecast),
+	}
+	if s.horizon <= 0 {
+		s.horizon = DefaultHorizon
+	}
+	if s.horizon > MaxHorizon {
+		s.horizon = MaxHorizon
+	}
+	if s.step <= 0 {
+		s.step = DefaultStep
+	}
+	for _, station := range cfg.Stations {
+		s.stations[station.ID] = WithStationDefaults(station)
+	}
+	return s
+}
+
+// WithStationDefaults returns the station config with the defaults filled
+// in, the PCS pipeline validates setpoints against the same limits.
+func WithStationDefaults(c config.StationEnergyConfig) config.StationEnergyConfig {
+	if c.CellVoltage <= 0 {
+		c.CellVoltage = DefaultCellVoltage
+	}
+	if c.MinSOC <= 0 {
+		c.MinSOC = DefaultMinSOC
+	}
+	if c.MaxSOC <= 0 {
+		c.MaxSOC = DefaultMaxSOC
+	}
+	if c.MinSOH <= 0 {
+		c.MinSOH = DefaultMinSOH
+	}
+	if c.Efficiency <= 0 || c.Efficiency > 1 {
+		c.Efficiency = DefaultEfficiency
+	}
+	if c.DoDExponent <= 0 {
+		c.DoDExponent = DefaultDoDExponent
+	}
+	if c.SOCBuckets <= 0 {
+		c.SOCBuckets = DefaultSOCBuckets
+	}
+	return c
+}
+
+// dischargeFloor returns the soc in percent the station may be discharged
+// down to, the backup reserve when it is above the min soc.
+func dischargeFloor(c config.StationEnergyConfig) float64 {
+	return math.Max(c.MinSOC, c.BackupReserve)
+}
+
+// SetForecast replaces the forecast of the same kind and station.
+func (s *Scheduler) SetForecast(f *Forecast) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.forecasts[f.Station]; !ok {
+		s.forecasts[f.Station] = make(map[ForecastKind]*Forecast)
+	}
+	s.forecasts[f.Station][f.Kind] = f
+	return nil
+}
+
+// Forecast returns the forecast of the kind for the station, the one of
+// the station is preferred over the one of all stations, nil if none.
+func (s *Scheduler) Forecast(station int, kind ForecastKind) *Forecast {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range []int{station, 0} {
+		if f, ok := s.forecasts[id][kind]; ok {
+			return f
+		}
+	}
+	return nil
+}
+
+// forecastOf returns the forecast scheduling the station, price forecasts
+// are preferred over demand ones.
+func (s *Scheduler) forecastOf(station int) *Forecast {
+	for _, kind := range []ForecastKind{ForecastPrice, ForecastDemand} {
+		if f := s.Forecast(station, kind); f != nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// Schedule plans the station from the slot containing now until the end
+// of the horizon or of the forecast, whichever is earlier.
+func (s *Scheduler) Schedule(station int, now time.Time) (*Schedule, error) {
+	cfg, ok := s.stations[station]
+	if !ok {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownStation, station)
+	}
+	summary, ok := s.data.Station(station)
+	if !ok || summary.MaxCapacity == 0 {
+		return nil, fmt.Errorf("%w: %d", ErrNoStationData, station)
+	}
+	f := s.forecastOf(station)
+	if f == nil {
+		return nil, ErrNoForecast
+	}
+
+	schedule := &Schedule{Station: station, Kind: f.Kind, Planner: PlannerShift, CreatedAt: now}
+	start := now.Truncate(s.step)
+	var values []float64
+	for t := start; t.Before(start.Add(s.horizon)); t = t.Add(s.step) {
+		v, ok := f.valueAt(t)
+		if !ok {
+			if t.Before(f.Points[0].Time) {
+				continue
+			}
+			break
+		}
+		schedule.Slots = append(schedule.Slots, Slot{Start: t, End: t.Add(s.step), Value: v})
+		values = append(values, v)
+	}
+	if len(values) == 0 {
+		return nil, ErrNoForecast
+	}
+
+	// energy of the healthy cells in kWh
+	capacity := summary.MaxCapacity * cfg.CellVoltage / 1000
+	hours := s.step.Hours()
+	l := limits{
+		initial:    summary.CurrentCapacity * cfg.CellVoltage / 1000,
+		min:        capacity * dischargeFloor(cfg) / 100,
+		max:        capacity * cfg.MaxSOC / 100,
+		charge:     cfg.MaxChargePower * hours * cfg.Efficiency,
+		discharge:  cfg.MaxDischargePower * hours,
+		efficiency: cfg.Efficiency,
+	}
+	w := wear{cost: cfg.CycleCost, exponent: cfg.DoDExponent, capacity: capacity}
+	gained := make([]float64, len(values))
+	var reasons []string
+	switch {
+	case summary.SOH > 0 && summary.SOH < cfg.MinSOH:
+		schedule.Reason = fmt.Sprintf("state of health %.1f%% is below %.1f%%", summary.SOH, cfg.MinSOH)
+	case cfg.Arbitrage && f.Kind == ForecastPrice:
+		schedule.Planner = PlannerArbitrage
+		a, err := newArbitrage(values, l, w, cfg.SOCBuckets)
+		if err != nil {
+			schedule.Reason = err.Error()
+			break
+		}
+		gained, reasons = a.plan()
+	default:
+		gained = plan(values, l)
+	}
+
+	level := l.initial
+	for i := range schedule.Slots {
+		slot := &schedule.Slots[i]
+		if gained[i] > 0 {
+			slot.Power = gained[i] / l.efficiency / hours
+		} else {
+			slot.Power = gained[i] / hours
+		}
+		if f.Kind == ForecastPrice {
+			slot.Revenue = -slot.Power * hours * slot.Value
+			slot.Wear = w.of(level, level+gained[i])
+			schedule.Revenue += slot.Revenue
+			schedule.Wear += slot.Wear
+		}
+		if reasons != nil {
+			slot.Reason = reasons[i]
+		}
+		level += gained[i]
+		slot.SOC = level / capacity * 100
+	}
+	return schedule, nil
+}
+
+// plan returns the energy gained by the battery in each slot, negative if
+// discharged. It shifts energy from the lowest valued slots to the highest
+// valued ones while that pays off the round trip loss, the stored energy
+// at the end is the initial one. The loss is taken when charging.
+func plan(values []float64, l limits) []float64 {
+	n := len(values)
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return values[order[i]] < values[order[j]] })
+
+	gained := make([]float64, n)
+	// level[k] is the stored energy at the start of slot k
+	level := make([]float64, n+1)
+	for k := range level {
+		level[k] = l.initial
+	}
+	for hi := n - 1; hi >= 0; hi-- {
+		h := order[hi]
+		for _, c := range order {
+			if values[h]*l.efficiency <= values[c] {
+				break
+			}
+			if gained[h] > 0 || gained[c] < 0 {
+				// a slot either charges or discharges
+				continue
+			}
+			e := math.Min(l.discharge+gained[h], l.charge-gained[c])
+			if c < h {
+				// stored between the slots
+				for k := c + 1; k <= h; k++ {
+					e = math.Min(e, l.max-level[k])
+				}
+			} else {
+				// borrowed between the slots
+				for k := h + 1; k <= c; k++ {
+					e = math.Min(e, level[k]-l.min)
+				}
+			}
+			if e < epsilon {
+				continue
+			}
+			gained[c] += e
+			gained[h] -= e
+			for k := c + 1; k <= n; k++ {
+				level[k] += e
+			}
+			for k := h + 1; k <= n; k++ {
+				level[k] -= e
+			}
+		}
+	}
+	return gained
+}
@@ -0,0 +1,122 @@
+package energymanagement
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// newStation creates a station of 10 cells of 100Ah at 50% soc, 3.2kWh.
+func newStation(t *testing.T, station int, soh float64) *data_model.BatteriesData {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	for cell := 1; cell <= 10; cell++ {
+		data.Update(&data_model.BatteryState{
+			Station: station, Container: 1, Pack: 1, Cell: cell,
+			Voltage: 3.35, Temperature: 25, MaxCapacity: 100, SOH: soh, Timestamp: time.Now().Unix(),
+		})
+	}
+	data.ReCalculate()
+	summary, ok := data.Station(station)
+	require.True(t, ok)
+	require.InDelta(t, 50, summary.SOC(), 1e-6)
+	return data
+}
+
+func hourlyForecast(kind ForecastKind, start time.Time, values ...float64) *Forecast {
+	f := &Forecast{Kind: kind}
+	for i, v := range values {
+		f.Points = append(f.Points, Point{Time: start.Add(time.Duration(i) * time.Hour), Value: v})
+	}
+	return f
+}
+
+func TestScheduler(t *testing.T) {
+	cfg := &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 1, MaxDischargePower: 1}},
+	}
+	s := NewScheduler(cfg, newStation(t, 1, 95))
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	_, err := s.Schedule(1, start)
+	assert.ErrorIs(t, err, ErrNoForecast)
+	_, err = s.Schedule(2, start)
+	assert.ErrorIs(t, err, ErrUnknownStation)
+
+	// cheap at night, expensive in the evening
+	prices := []float64{0.1, 0.1, 0.1, 0.2, 0.2, 0.3, 0.3, 0.5}
+	require.NoError(t, s.SetForecast(hourlyForecast(ForecastDemand, start, 1, 1, 1, 1, 1, 1, 1, 1)))
+	require.NoError(t, s.SetForecast(hourlyForecast(ForecastPrice, start, prices...)))
+	schedule, err := s.Schedule(1, start.Add(10*time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, ForecastPrice, schedule.Kind)
+	require.Len(t, schedule.Slots, len(prices))
+	assert.Equal(t, start, schedule.Slots[0].Start)
+
+	var stored float64
+	for i, slot := range schedule.Slots {
+		assert.Equal(t, prices[i], slot.Value)
+		assert.LessOrEqual(t, slot.Power, 1+1e-9)
+		assert.GreaterOrEqual(t, slot.Power, -1-1e-9)
+		assert.GreaterOrEqual(t, slot.SOC, DefaultMinSOC-1e-9)
+		assert.LessOrEqual(t, slot.SOC, DefaultMaxSOC+1e-9)
+		if slot.Power > 0 {
+			stored += slot.Power * DefaultEfficiency
+			assert.Less(t, slot.Value, 0.2)
+		} else {
+			stored += slot.Power
+		}
+	}
+	// charged at full power in the cheap slots, the most expensive slot is
+	// discharged first, the next one only by what's left of the 1.28kWh
+	// headroom below the max soc
+	assert.InDelta(t, 1, schedule.Slots[0].Power, 1e-9)
+	assert.InDelta(t, -1, schedule.Slots[7].Power, 1e-9)
+	assert.InDelta(t, -0.28, schedule.Slots[6].Power, 1e-9)
+	// energy neutral over the horizon
+	assert.InDelta(t, 0, stored, 1e-9)
+	assert.InDelta(t, 50, schedule.Slots[len(prices)-1].SOC, 1e-6)
+
+	// a flat price doesn't pay off the losses
+	require.NoError(t, s.SetForecast(hourlyForecast(ForecastPrice, start, 0.2, 0.2, 0.21, 0.2)))
+	schedule, err = s.Schedule(1, start)
+	require.NoError(t, err)
+	for _, slot := range schedule.Slots {
+		assert.Zero(t, slot.Power)
+	}
+}
+
+func TestSchedulerEnergyLimits(t *testing.T) {
+	// 3.2kWh between 10% and 90% soc leaves 1.28kWh to discharge and to charge
+	l := limits{initial: 1.6, min: 0.32, max: 2.88, charge: 10, discharge: 10, efficiency: 1}
+	gained := plan([]float64{5, 1, 1, 5}, l)
+	level, lowest, highest := l.initial, l.initial, l.initial
+	for _, e := range gained {
+		level += e
+		lowest = min(lowest, level)
+		highest = max(highest, level)
+	}
+	assert.InDelta(t, l.min, lowest, 1e-9)
+	assert.InDelta(t, l.max, highest, 1e-9)
+	assert.InDelta(t, l.initial, level, 1e-9)
+	assert.InDelta(t, -1.28, gained[0], 1e-9)
+}
+
+func TestSchedulerSOH(t *testing.T) {
+	cfg := &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 1, MaxDischargePower: 1, MinSOH: 80}},
+	}
+	s := NewScheduler(cfg, newStation(t, 1, 70))
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, s.SetForecast(hourlyForecast(ForecastPrice, start, 0.1, 0.5)))
+	schedule, err := s.Schedule(1, start)
+	require.NoError(t, err)
+	assert.Contains(t, schedule.Reason, "state of health")
+	for _, slot := range schedule.Slots {
+		assert.Zero(t, slot.Power)
+		assert.InDelta(t, 50, slot.SOC, 1e-6)
+	}
+}
@@ -0,0 +1,385 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultQueueSize is the default max number of queued readings.
+	DefaultQueueSize = 10000
+	// DefaultAlarmMinVoltage, DefaultAlarmMaxVoltage and
+	// DefaultAlarmMaxTemperature are the default alarm thresholds of LFP cells.
+	DefaultAlarmMinVoltage     = 2.5
+	DefaultAlarmMaxVoltage     = 3.65
+	DefaultAlarmMaxTemperature = 55
+	// retryAfterOverloaded is the hint to retry after the queue is full.
+	retryAfterOverloaded = time.Second
+)
+
+var (
+	// ErrRateLimited is returned when a gateway exceeds its rate.
+	ErrRateLimited = errors.New("gateway exceeds its rate limit")
+	// ErrOverloaded is returned when readings are shed under overload.
+	ErrOverloaded = errors.New("ingestion is overloaded")
+	// ErrAdmissionStopped is returned when the admission controller stopped
+	// before the readings were ingested.
+	ErrAdmissionStopped = errors.New("admission controller stopped")
+	// ErrBatchTooLarge is returned for a batch with more readings than the
+	// queue holds, it would never be admitted and must be split.
+	ErrBatchTooLarge = errors.New("batch exceeds the queue size")
+)
+
+// RejectedError is returned for readings which are not admitted, the
+// sender should retry after RetryAfter.
+type RejectedError struct {
+	// Err is ErrRateLimited or ErrOverloaded.
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", e.Err, e.RetryAfter)
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Ingester accepts readings, it returns nil only after the readings are
+// durable, it is implemented by Pipeline.
+type Ingester interface {
+	Ingest(states ...*data_model.BatteryState) error
+}
+
+// Priority is the priority of readings under overload.
+type Priority int
+
+const (
+	// PriorityRoutine is the priority of readings within the alarm thresholds.
+	PriorityRoutine Priority = iota
+	// PriorityAlarm is the priority of readings beyond the alarm thresholds,
+	// they are shed only for other alarms.
+	PriorityAlarm
+
+	numPriorities
+)
+
+// AdmissionConfig is the admission control configuration of ingestion.
+type AdmissionConfig struct {
+	// Rate is the max readings per second of a gateway, 0 means unlimited.
+	Rate float64
+	// Burst is the max readings a gateway may send at once, 0 means one
+	// second of Rate.
+	Burst int
+	// QueueSize is the max number of readings waiting to be ingested.
+	QueueSize int
+	// BatchSize is the max number of readings ingested at once.
+	BatchSize int
+	// AlarmMinVoltage, AlarmMaxVoltage and AlarmMaxTemperature are the
+	// thresholds of alarm-relevant readings.
+	AlarmMinVoltage     float64
+	AlarmMaxVoltage     float64
+	AlarmMaxTemperature float64
+}
+
+// tokenBucket limits the rate of a gateway.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take takes n tokens, or returns how long until they are available.
+func (b *tokenBucket) take(n, rate, burst float64, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	// a batch larger than the burst is admitted by a full bucket
+	n = math.Min(n, burst)
+	if n <= b.tokens {
+		b.tokens -= n
+		return true, 0
+	}
+	wait := (n - b.tokens) / rate
+	return false, time.Duration(math.Ceil(wait * float64(time.Second)))
+}
+
+// request is a batch of readings waiting to be ingested.
+type request struct {
+	states []*data_model.BatteryState
+	done   chan error
+}
+
+// Admission is the admission control in front of an Ingester. Every
+// gateway is limited by a token bucket, admitted readings wait in a bounded
+// queue which is drained by Run, so a flood from one gateway can't starve
+// the others. When the queue is full, routine readings are shed in favor
+// of alarm-relevant ones.
+type Admission struct {
+	cfg  *AdmissionConfig
+	next Ingester
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// FIFO queues by priority
+	queues  [numPriorities][]*request
+	queued  int
+	stopped bool
+	notify  chan struct{}
+}
+
+// NewAdmission creates the admission control of the ingester.
+func NewAdmission(cfg *AdmissionConfig, next Ingester) *Admission {
+	if cfg.Burst <= 0 {
+		cfg.Burst = int(math.Ceil(cfg.Rate))
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = DefaultQueueSize
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.AlarmMinVoltage == 0 {
+		cfg.AlarmMinVoltage = DefaultAlarmMinVoltage
+	}
+	if cfg.AlarmMaxVoltage == 0 {
+		cfg.AlarmMaxVoltage = DefaultAlarmMaxVoltage
+	}
+	if cfg.AlarmMaxTemperature == 0 {
+		cfg.AlarmMaxTemperature = DefaultAlarmMaxTemperature
+	}
+	return &Admission{
+		cfg:     cfg,
+		next:    next,
+		buckets: make(map[string]*tokenBucket),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Classify returns the priority of a reading, a reading beyond the alarm
+// thresholds is an alarm. Unreported values are zero and ignored.
+func (a *Admission) Classify(s *data_model.BatteryState) Priority {
+	if s.Voltage != 0 && (s.Voltage < a.cfg.AlarmMinVoltage || s.Voltage > a.cfg.AlarmMaxVoltage) {
+		return PriorityAlarm
+	}
+	if s.Temperature > a.cfg.AlarmMaxTemperature {
+		return PriorityAlarm
+	}
+	return PriorityRoutine
+}
+
+// Admit ingests the readings of the gateway. Like Ingest it returns nil
+// only after the readings are durable, a *RejectedError means they were not
+// admitted or were shed, and the gateway should send them again later.
+func (a *Admission) Admit(gateway string, states ...*data_model.BatteryState) error {
+	if err := a.checkSize(len(states)); err != nil {
+		return err
+	}
+	if err := a.Allow(gateway, len(states)); err != nil {
+		return err
+	}
+	return a.Ingest(states...)
+}
+
+// Allow takes n readings from the token bucket of the gateway, it returns
+// a *RejectedError if the gateway exceeds its rate.
+func (a *Admission) Allow(gateway string, n int) error {
+	if a.cfg.Rate <= 0 || n == 0 {
+		return nil
+	}
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	b, ok := a.buckets[gateway]
+	if !ok {
+		b = &tokenBucket{tokens: float64(a.cfg.Burst), last: now}
+		a.buckets[gateway] = b
+	}
+	if ok, wait := b.take(float64(n), a.cfg.Rate, float64(a.cfg.Burst), now); !ok {
+		log.Debug("reject readings over the rate limit",
+			zap.String("gateway", gateway), zap.Int("count", n), zap.Duration("retry-after", wait))
+		return &RejectedError{Err: ErrRateLimited, RetryAfter: wait}
+	}
+	return nil
+}
+
+// Ingest queues the readings without rate limiting and waits until they
+// are durable, so Admission is an Ingester itself, e.g. of MQTTServer. It
+// returns a *RejectedError if they are shed, ErrBatchTooLarge if they never
+// fit in the queue. The readings are queued by their own priorities, so
+// the alarms of a batch may be ingested even if its routine readings are
+// shed, the sender then sends the whole batch again.
+func (a *Admission) Ingest(states ...*data_model.BatteryState) error {
+	if len(states) == 0 {
+		return nil
+	}
+	if err := a.checkSize(len(states)); err != nil {
+		return err
+	}
+
+	var split [numPriorities]*request
+	for _, s := range states {
+		p := a.Classify(s)
+		if split[p] == nil {
+			split[p] = &request{done: make(chan error, 1)}
+		}
+		split[p].states = append(split[p].states, s)
+	}
+	reqs, err := a.enqueue(split)
+	for _, req := range reqs {
+		if rerr := <-req.done; err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// checkSize returns ErrBatchTooLarge if n readings don't fit in the queue.
+func (a *Admission) checkSize(n int) error {
+	if n > a.cfg.QueueSize {
+		return fmt.Errorf("%w: %d readings, queue size %d", ErrBatchTooLarge, n, a.cfg.QueueSize)
+	}
+	return nil
+}
+
+// enqueue queues the requests by priority, highest first, and returns the
+// queued ones. It stops at the first request which is rejected.
+func (a *Admission) enqueue(reqs [numPriorities]*request) ([]*request, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.stopped {
+		return nil, ErrAdmissionStopped
+	}
+
+	var (
+		queued []*request
+		err    error
+	)
+	for p := numPriorities - 1; p >= 0 && err == nil; p-- {
+		if reqs[p] == nil {
+			continue
+		}
+		if err = a.push(p, reqs[p]); err == nil {
+			queued = append(queued, reqs[p])
+		}
+	}
+	if len(queued) > 0 {
+		select {
+		case a.notify <- struct{}{}:
+		default:
+		}
+	}
+	return queued, err
+}
+
+// push queues the request, shedding the newest readings of lower priorities
+// to make room.
+func (a *Admission) push(p Priority, req *request) error {
+	n := len(req.states)
+	for a.queued+n > a.cfg.QueueSize {
+		victim := a.shed(p)
+		if victim == nil {
+			log.Debug("reject readings under overload", zap.Int("count", n), zap.Int("priority", int(p)))
+			return &RejectedError{Err: ErrOverloaded, RetryAfter: retryAfterOverloaded}
+		}
+		victim.done <- &RejectedError{Err: ErrOverloaded, RetryAfter: retryAfterOverloaded}
+	}
+	a.queues[p] = append(a.queues[p], req)
+	a.queued += n
+	return nil
+}
+
+// shed removes and returns the newest request of the lowest priority below
+// p, nil if there is none.
+func (a *Admission) shed(p Priority) *request {
+	for lower := Priority(0); lower < p; lower++ {
+		q := a.queues[lower]
+		if len(q) == 0 {
+			continue
+		}
+		req := q[len(q)-1]
+		q[len(q)-1] = nil
+		a.queues[lower] = q[:len(q)-1]
+		a.queued -= len(req.states)
+		log.Debug("shed readings for higher priority", zap.Int("count", len(req.states)), zap.Int("priority", int(lower)))
+		return req
+	}
+	return nil
+}
+
+// dequeue takes requests of up to BatchSize readings, highest priority
+// first. A single request larger than BatchSize is taken alone.
+func (a *Admission) dequeue() []*request {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var reqs []*request
+	n := 0
+	for p := numPriorities - 1; p >= 0; p-- {
+		for len(a.queues[p]) > 0 {
+			req := a.queues[p][0]
+			if len(reqs) > 0 && n+len(req.states) > a.cfg.BatchSize {
+				return reqs
+			}
+			a.queues[p][0] = nil
+			a.queues[p] = a.queues[p][1:]
+			a.queued -= len(req.states)
+			reqs = append(reqs, req)
+			n += len(req.states)
+		}
+	}
+	return reqs
+}
+
+// Queued returns the number of readings waiting to be ingested.
+func (a *Admission) Queued() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.queued
+}
+
+// Run ingests the admitted readings until ctx is done, readings still
+// queued then fail with ErrAdmissionStopped.
+func (a *Admission) Run(ctx context.Context) error {
+	defer a.stop()
+	for ctx.Err() == nil {
+		reqs := a.dequeue()
+		if len(reqs) == 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-a.notify:
+			}
+			continue
+		}
+
+		var states []*data_model.BatteryState
+		for _, req := range reqs {
+			states = append(states, req.states...)
+		}
+		err := a.next.Ingest(states...)
+		for _, req := range reqs {
+			req.done <- err
+		}
+	}
+	return nil
+}
+
+func (a *Admission) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.stopped = true
+	for p := range a.queues {
+		for _, req := range a.queues[p] {
+			req.done <- ErrAdmissionStopped
+		}
+		a.queues[p] = nil
+	}
+	a.queued = 0
+}
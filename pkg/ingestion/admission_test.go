@@ -0,0 +1,155 @@
+package ingestion
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// gatedIngester blocks until the gate is opened.
+type gatedIngester struct {
+	gate    chan struct{}
+	mu      sync.Mutex
+	batches [][]*data_model.BatteryState
+}
+
+func (g *gatedIngester) Ingest(states ...*data_model.BatteryState) error {
+	<-g.gate
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.batches = append(g.batches, states)
+	return nil
+}
+
+func readings(n int, voltage float64) []*data_model.BatteryState {
+	states := make([]*data_model.BatteryState, n)
+	for i := range states {
+		states[i] = &data_model.BatteryState{Cell: i + 1, Voltage: voltage}
+	}
+	return states
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := &tokenBucket{tokens: 10, last: now}
+	ok, _ := b.take(8, 5, 10, now)
+	assert.True(t, ok)
+	ok, wait := b.take(4, 5, 10, now)
+	assert.False(t, ok)
+	assert.Equal(t, 400*time.Millisecond, wait)
+	ok, _ = b.take(4, 5, 10, now.Add(400*time.Millisecond))
+	assert.True(t, ok)
+	// the bucket never holds more than the burst, which admits a larger batch
+	ok, _ = b.take(20, 5, 10, now.Add(time.Hour))
+	assert.True(t, ok)
+	ok, wait = b.take(1, 5, 10, now.Add(time.Hour))
+	assert.False(t, ok)
+	assert.Equal(t, 200*time.Millisecond, wait)
+}
+
+func TestAdmissionRateLimit(t *testing.T) {
+	a := NewAdmission(&AdmissionConfig{Rate: 10}, nil)
+	require.NoError(t, a.Allow("gw-1", 10))
+	err := a.Allow("gw-1", 1)
+	var rejected *RejectedError
+	require.ErrorAs(t, err, &rejected)
+	assert.ErrorIs(t, err, ErrRateLimited)
+	assert.Greater(t, rejected.RetryAfter, time.Duration(0))
+	// other gateways have their own buckets
+	require.NoError(t, a.Allow("gw-2", 10))
+
+	a = NewAdmission(&AdmissionConfig{}, nil)
+	require.NoError(t, a.Allow("gw-1", 1000000))
+}
+
+func TestAdmissionShedding(t *testing.T) {
+	next := &gatedIngester{gate: make(chan struct{})}
+	a := NewAdmission(&AdmissionConfig{QueueSize: 4, BatchSize: 4}, next)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	assert.Equal(t, PriorityRoutine, a.Classify(&data_model.BatteryState{Voltage: 3.3}))
+	assert.Equal(t, PriorityRoutine, a.Classify(&data_model.BatteryState{}))
+	assert.Equal(t, PriorityAlarm, a.Classify(&data_model.BatteryState{Voltage: 2.0}))
+	assert.Equal(t, PriorityAlarm, a.Classify(&data_model.BatteryState{Voltage: 3.3, Temperature: 60}))
+
+	admit := func(states []*data_model.BatteryState) chan error {
+		errc := make(chan error, 1)
+		go func() { errc <- a.Ingest(states...) }()
+		return errc
+	}
+	// the first batch blocks in the ingester, the next ones fill the queue
+	first := admit(readings(1, 3.3))
+	require.Eventually(t, func() bool { return a.Queued() == 0 }, time.Second, time.Millisecond)
+	routine1 := admit(readings(2, 3.3))
+	require.Eventually(t, func() bool { return a.Queued() == 2 }, time.Second, time.Millisecond)
+	routine2 := admit(readings(2, 3.3))
+	require.Eventually(t, func() bool { return a.Queued() == 4 }, time.Second, time.Millisecond)
+
+	// a routine batch is rejected when the queue is full
+	assert.ErrorIs(t, a.Ingest(readings(1, 3.3)...), ErrOverloaded)
+	// an alarm batch larger than the queue is rejected without shedding
+	assert.ErrorIs(t, a.Ingest(readings(5, 2.0)...), ErrBatchTooLarge)
+	assert.ErrorIs(t, a.Admit("gw-1", readings(5, 2.0)...), ErrBatchTooLarge)
+	assert.Equal(t, 4, a.Queued())
+	// an alarm sheds the newest routine batch
+	alarm := admit(readings(2, 2.0))
+	assert.ErrorIs(t, <-routine2, ErrOverloaded)
+
+	close(next.gate)
+	require.NoError(t, <-first)
+	require.NoError(t, <-alarm)
+	require.NoError(t, <-routine1)
+	// the alarm is ingested before the older routine batch
+	next.mu.Lock()
+	require.Len(t, next.batches, 2)
+	assert.Equal(t, 2.0, next.batches[1][0].Voltage)
+	assert.Equal(t, 3.3, next.batches[1][2].Voltage)
+	next.mu.Unlock()
+
+	cancel()
+	require.NoError(t, <-done)
+	assert.ErrorIs(t, a.Ingest(readings(1, 3.3)...), ErrAdmissionStopped)
+}
+
+func TestAdmissionMixedBatch(t *testing.T) {
+	next := &gatedIngester{gate: make(chan struct{})}
+	a := NewAdmission(&AdmissionConfig{QueueSize: 4, BatchSize: 4}, next)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+
+	admit := func(states []*data_model.BatteryState) chan error {
+		errc := make(chan error, 1)
+		go func() { errc <- a.Ingest(states...) }()
+		return errc
+	}
+	first := admit(readings(1, 3.3))
+	require.Eventually(t, func() bool { return a.Queued() == 0 }, time.Second, time.Millisecond)
+	routine := admit(readings(2, 3.3))
+	require.Eventually(t, func() bool { return a.Queued() == 2 }, time.Second, time.Millisecond)
+
+	// the alarm of a mixed batch doesn't promote its routine readings, they
+	// are rejected instead of shedding the older routine batch
+	mixed := admit(append(readings(2, 3.3), &data_model.BatteryState{Cell: 3, Voltage: 2.0}))
+	require.Eventually(t, func() bool { return a.Queued() == 3 }, time.Second, time.Millisecond)
+
+	close(next.gate)
+	require.NoError(t, <-first)
+	require.NoError(t, <-routine)
+	assert.ErrorIs(t, <-mixed, ErrOverloaded)
+	next.mu.Lock()
+	require.Len(t, next.batches, 2)
+	require.Len(t, next.batches[1], 3)
+	assert.Equal(t, 2.0, next.batches[1][0].Voltage)
+	next.mu.Unlock()
+
+	cancel()
+	require.NoError(t, <-done)
+}
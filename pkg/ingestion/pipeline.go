@@ -0,0 +1,233 @@
+package ingestion
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	localstore "github.com/zhangjinpeng87/openbms/pkg/datamanagement/local"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/wal"
+	"go.uber.org/zap"
+)
+
+// Names of the WAL consumers.
+const (
+	// ConsumerStore applies readings to the local store and the in-memory
+	// batteries data.
+	ConsumerStore = "store"
+	// ConsumerUploader feeds readings to the cloud uploader.
+	ConsumerUploader = "uploader"
+	// ConsumerAnalytics feeds readings to analytics.
+	ConsumerAnalytics = "analytics"
+)
+
+const (
+	// DefaultBatchSize is the default max number of readings handled at once.
+	DefaultBatchSize = 256
+	// DefaultRetryInterval is the default interval to retry a failed batch.
+	DefaultRetryInterval = time.Second
+	// DefaultTruncateInterval is the default interval to truncate the WAL.
+	DefaultTruncateInterval = time.Minute
+)
+
+// Handler handles a batch of readings read from the WAL. The batch is
+// committed after the handler returns nil, otherwise it is retried, and
+// batches after the last commit are replayed after a restart, so handlers
+// must be idempotent.
+type Handler func(states []*data_model.BatteryState) error
+
+// Config is the ingestion pipeline configuration.
+type Config struct {
+	// BatchSize is the max number of readings handled at once.
+	BatchSize int
+	// RetryInterval is the interval to retry a failed batch.
+	RetryInterval time.Duration
+	// TruncateInterval is the interval to truncate the WAL.
+	TruncateInterval time.Duration
+}
+
+// Pipeline is the store-and-forward path of sensor readings. Accepted
+// readings are appended to the WAL before they are acknowledged, then every
+// consumer reads them from the WAL at its own pace, so a crash or a slow
+// consumer never loses readings.
+type Pipeline struct {
+	cfg *Config
+	wal *wal.WAL
+
+	mu       sync.Mutex
+	handlers map[string]Handler
+}
+
+// NewPipeline creates a new ingestion pipeline on the WAL.
+func NewPipeline(cfg *Config, w *wal.WAL) *Pipeline {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = DefaultBatchSize
+	}
+	if cfg.RetryInterval <= 0 {
+		cfg.RetryInterval = DefaultRetryInterval
+	}
+	if cfg.TruncateInterval <= 0 {
+		cfg.TruncateInterval = DefaultTruncateInterval
+	}
+	return &Pipeline{
+		cfg:      cfg,
+		wal:      w,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// AddConsumer registers a handler as the named WAL consumer, it must be
+// called before Run.
+func (p *Pipeline) AddConsumer(name string, h Handler) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.handlers[name] = h
+}
+
+// StoreHandler returns the handler which upserts readings into the local
+// store and updates the in-memory batteries data, either can be nil.
+func StoreHandler(store localstore.LocalStore, data *data_model.BatteriesData) Handler {
+	return func(states []*data_model.BatteryState) error {
+		for _, state := range states {
+			if store != nil {
+				if err := store.Upsert(state); err != nil {
+					return fmt.Errorf("failed to upsert battery state: %w", err)
+				}
+			}
+			if data != nil {
+				data.Update(state)
+			}
+		}
+		return nil
+	}
+}
+
+// Ingest appends the readings to the WAL, they are durable when it returns
+// nil and only then may be acknowledged to the sender.
+func (p *Pipeline) Ingest(states ...*data_model.BatteryState) error {
+	if len(states) == 0 {
+		return nil
+	}
+	records := make([][]byte, 0, len(states))
+	for _, state := range states {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return fmt.Errorf("failed to encode battery state: %w", err)
+		}
+		records = append(records, data)
+	}
+	if _, err := p.wal.AppendBatch(records); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Run runs all consumers and truncates the WAL periodically until ctx is
+// done. Consumers first replay the readings after their committed offsets.
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.mu.Lock()
+	consumers := make(map[*wal.Consumer]Handler, len(p.handlers))
+	for name, h := range p.handlers {
+		c, err := p.wal.Consumer(name)
+		if err != nil {
+			p.mu.Unlock()
+			return err
+		}
+		consumers[c] = h
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for c, h := range consumers {
+		wg.Add(1)
+		go func(c *wal.Consumer, h Handler) {
+			defer wg.Done()
+			defer c.Close()
+			p.consume(ctx, c, h)
+		}(c, h)
+	}
+
+	ticker := time.NewTicker(p.cfg.TruncateInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		case <-ticker.C:
+			if removed, err := p.wal.Truncate(); err != nil {
+				log.Warn("failed to truncate wal", zap.Error(err))
+			} else if removed > 0 {
+				log.Debug("truncated wal", zap.Int("segments", removed))
+			}
+		}
+	}
+}
+
+func (p *Pipeline) consume(ctx context.Context, c *wal.Consumer, h Handler) {
+	if lag := c.Lag(); lag > 0 {
+		log.Info("replay wal", zap.String("consumer", c.Name()), zap.Uint64("records", lag))
+	}
+	for {
+		// take the notify channel before reading, so no append is missed
+		notify := p.wal.Notify()
+		n, err := p.consumeBatch(c, h)
+		if err != nil {
+			log.Warn("failed to consume wal, will retry",
+				zap.String("consumer", c.Name()), zap.Duration("retry-interval", p.cfg.RetryInterval), zap.Error(err))
+			c.Reset()
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(p.cfg.RetryInterval):
+			}
+			continue
+		}
+		if n > 0 {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-notify:
+		}
+	}
+}
+
+// consumeBatch handles a batch of readings and commits it, return the
+// number of readings.
+func (p *Pipeline) consumeBatch(c *wal.Consumer, h Handler) (int, error) {
+	entries, err := c.Read(p.cfg.BatchSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	states := make([]*data_model.BatteryState, 0, len(entries))
+	for _, entry := range entries {
+		var state data_model.BatteryState
+		if err := json.Unmarshal(entry.Data, &state); err != nil {
+			// a record which passed the checksum but can't be decoded won't
+			// get better by retrying
+			log.Error("skip undecodable wal record",
+				zap.String("consumer", c.Name()), zap.Uint64("index", entry.Index), zap.Error(err))
+			continue
+		}
+		states = append(states, &state)
+	}
+	if len(states) > 0 {
+		if err := h(states); err != nil {
+			return 0, err
+		}
+	}
+	if err := c.Commit(entries[len(entries)-1].Index); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
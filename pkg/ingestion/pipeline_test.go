@@ -0,0 +1,105 @@
+package ingestion
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/wal"
+)
+
+// recorder records the handled readings, it fails while failing is set.
+type recorder struct {
+	mu      sync.Mutex
+	states  []data_model.BatteryState
+	failing bool
+}
+
+func (r *recorder) handle(states []*data_model.BatteryState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.failing {
+		return errors.New("disk is slow")
+	}
+	for _, state := range states {
+		r.states = append(r.states, *state)
+	}
+	return nil
+}
+
+func (r *recorder) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.states)
+}
+
+func runPipeline(t *testing.T, p *Pipeline) (cancel func()) {
+	ctx, cancelFn := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, p.Run(ctx))
+	}()
+	return func() {
+		cancelFn()
+		<-done
+	}
+}
+
+func TestPipelineAtLeastOnce(t *testing.T) {
+	dir := t.TempDir()
+	w, err := wal.Open(&config.WALConfig{Dir: dir})
+	require.NoError(t, err)
+
+	store := &recorder{}
+	analytics := &recorder{failing: true}
+	p := NewPipeline(&Config{BatchSize: 2, RetryInterval: 10 * time.Millisecond}, w)
+	p.AddConsumer(ConsumerStore, store.handle)
+	p.AddConsumer(ConsumerAnalytics, analytics.handle)
+	cancel := runPipeline(t, p)
+
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, p.Ingest(&data_model.BatteryState{Station: 1, Cell: i, Timestamp: int64(i)}))
+	}
+	require.Eventually(t, func() bool { return store.count() == 5 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, analytics.count())
+
+	// crash while analytics is still failing
+	cancel()
+	require.NoError(t, w.Close())
+
+	// after the restart analytics replays everything, store nothing
+	w, err = wal.Open(&config.WALConfig{Dir: dir})
+	require.NoError(t, err)
+	defer w.Close()
+	store2 := &recorder{}
+	analytics.failing = false
+	p = NewPipeline(&Config{BatchSize: 2}, w)
+	p.AddConsumer(ConsumerStore, store2.handle)
+	p.AddConsumer(ConsumerAnalytics, analytics.handle)
+	cancel = runPipeline(t, p)
+	defer cancel()
+
+	require.Eventually(t, func() bool { return analytics.count() == 5 }, time.Second, 5*time.Millisecond)
+	for i, state := range analytics.states {
+		assert.Equal(t, i+1, state.Cell)
+	}
+	assert.Equal(t, 0, store2.count())
+}
+
+func TestStoreHandler(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	h := StoreHandler(nil, data)
+	require.NoError(t, h([]*data_model.BatteryState{
+		{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.7, Timestamp: 1},
+	}))
+	cell, ok := data.GetCell(1, 1, 1, 1)
+	require.True(t, ok)
+	assert.Equal(t, int64(1), cell.Timestamp)
+}
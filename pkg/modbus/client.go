@@ -0,0 +1,140 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the default timeout of a request.
+const DefaultTimeout = 3 * time.Second
+
+// Client is a Modbus TCP client. Requests are sent one at a time, the
+// connection is closed on any I/O error and the client must be dialed
+// again.
+type Client struct {
+	timeout time.Duration
+
+	mu          sync.Mutex
+	conn        net.Conn
+	r           *bufio.Reader
+	transaction uint16
+}
+
+// Dial connects to a Modbus TCP device.
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to modbus device: %w", err)
+	}
+	return &Client{timeout: timeout, conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// ReadHoldingRegisters reads count holding registers from addr.
+func (c *Client) ReadHoldingRegisters(unit byte, addr, count uint16) ([]uint16, error) {
+	return c.readRegisters(unit, FuncReadHoldingRegisters, addr, count)
+}
+
+// ReadInputRegisters reads count input registers from addr.
+func (c *Client) ReadInputRegisters(unit byte, addr, count uint16) ([]uint16, error) {
+	return c.readRegisters(unit, FuncReadInputRegisters, addr, count)
+}
+
+// WriteSingleRegister writes a holding register.
+func (c *Client) WriteSingleRegister(unit byte, addr, value uint16) error {
+	pdu := []byte{FuncWriteSingleRegister}
+	pdu = binary.BigEndian.AppendUint16(pdu, addr)
+	pdu = binary.BigEndian.AppendUint16(pdu, value)
+	resp, err := c.do(unit, pdu)
+	if err != nil {
+		return err
+	}
+	if len(resp) != 5 || binary.BigEndian.Uint16(resp[1:]) != addr {
+		return fmt.Errorf("%w: unexpected write single register response", ErrMalformedFrame)
+	}
+	return nil
+}
+
+// WriteMultipleRegisters writes consecutive holding registers from addr.
+func (c *Client) WriteMultipleRegisters(unit byte, addr uint16, values []uint16) error {
+	if len(values) == 0 || len(values) > MaxWriteRegisters {
+		return fmt.Errorf("invalid register count %d", len(values))
+	}
+	pdu := []byte{FuncWriteMultipleRegisters}
+	pdu = binary.BigEndian.AppendUint16(pdu, addr)
+	pdu = binary.BigEndian.AppendUint16(pdu, uint16(len(values)))
+	pdu = append(pdu, byte(len(values)*2))
+	pdu = appendRegisters(pdu, values)
+	resp, err := c.do(unit, pdu)
+	if err != nil {
+		return err
+	}
+	if len(resp) != 5 || binary.BigEndian.Uint16(resp[1:]) != addr || int(binary.BigEndian.Uint16(resp[3:])) != len(values) {
+		return fmt.Errorf("%w: unexpected write multiple registers response", ErrMalformedFrame)
+	}
+	return nil
+}
+
+func (c *Client) readRegisters(unit, function byte, addr, count uint16) ([]uint16, error) {
+	if count == 0 || count > MaxReadRegisters {
+		return nil, fmt.Errorf("invalid register count %d", count)
+	}
+	pdu := []byte{function}
+	pdu = binary.BigEndian.AppendUint16(pdu, addr)
+	pdu = binary.BigEndian.AppendUint16(pdu, count)
+	resp, err := c.do(unit, pdu)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 2 || int(resp[1]) != len(resp)-2 || int(resp[1]) != int(count)*2 {
+		return nil, fmt.Errorf("%w: expect %d registers", ErrMalformedFrame, count)
+	}
+	return decodeRegisters(resp[2:]), nil
+}
+
+// do sends a request PDU and returns the response PDU, an exception
+// response is returned as *Exception.
+func (c *Client) do(unit byte, pdu []byte) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.transaction++
+	req := &frame{transaction: c.transaction, unit: unit, pdu: pdu}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write(req.encode()); err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("failed to send modbus request: %w", err)
+	}
+	resp, err := readFrame(c.r)
+	if err != nil {
+		c.conn.Close()
+		return nil, fmt.Errorf("failed to read modbus response: %w", err)
+	}
+	if resp.transaction != req.transaction || resp.unit != unit {
+		// the stream is out of sync, e.g. a late response of a timed out request
+		c.conn.Close()
+		return nil, fmt.Errorf("%w: unexpected transaction %d of unit %d", ErrMalformedFrame, resp.transaction, resp.unit)
+	}
+	function := resp.pdu[0]
+	if function == pdu[0]|0x80 {
+		if len(resp.pdu) != 2 {
+			return nil, fmt.Errorf("%w: invalid exception response", ErrMalformedFrame)
+		}
+		return nil, &Exception{Function: pdu[0], Code: resp.pdu[1]}
+	}
+	if function != pdu[0] {
+		return nil, fmt.Errorf("%w: unexpected function %#02x", ErrMalformedFrame, function)
+	}
+	return resp.pdu, nil
+}
@@ -0,0 +1,106 @@
+package modbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+func startSimulator(t *testing.T) *Simulator {
+	s := NewSimulator()
+	require.NoError(t, s.Start("127.0.0.1:0"))
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestClient(t *testing.T) {
+	s := startSimulator(t)
+	s.SetHoldingRegisters(1, 100, 1, 2, 3)
+	s.SetInputRegisters(1, 200, 0xffff)
+
+	c, err := Dial(s.Addr(), 0)
+	require.NoError(t, err)
+	defer c.Close()
+
+	values, err := c.ReadHoldingRegisters(1, 100, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{1, 2, 3}, values)
+	values, err = c.ReadInputRegisters(1, 200, 1)
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{0xffff}, values)
+
+	require.NoError(t, c.WriteSingleRegister(1, 100, 10))
+	require.NoError(t, c.WriteMultipleRegisters(1, 101, []uint16{20, 30, 40}))
+	assert.Equal(t, []uint16{10, 20, 30, 40}, s.HoldingRegisters(1, 100, 4))
+
+	// unmapped register
+	_, err = c.ReadHoldingRegisters(1, 102, 5)
+	var exception *Exception
+	require.ErrorAs(t, err, &exception)
+	assert.Equal(t, ExceptionIllegalDataAddress, exception.Code)
+	assert.Equal(t, FuncReadHoldingRegisters, exception.Function)
+	// unknown unit
+	_, err = c.ReadHoldingRegisters(2, 100, 1)
+	require.ErrorAs(t, err, &exception)
+	assert.Equal(t, ExceptionGatewayTargetFailed, exception.Code)
+	// the connection is still usable after exceptions
+	_, err = c.ReadHoldingRegisters(1, 100, 1)
+	require.NoError(t, err)
+
+	_, err = c.ReadHoldingRegisters(1, 100, MaxReadRegisters+1)
+	assert.Error(t, err)
+}
+
+func TestValueEncoding(t *testing.T) {
+	cases := []struct {
+		point config.ModbusPoint
+		regs  []uint16
+		value float64
+	}{
+		{config.ModbusPoint{}, []uint16{3700}, 3700},
+		{config.ModbusPoint{Scale: 0.001}, []uint16{3700}, 3.7},
+		{config.ModbusPoint{Type: TypeInt16, Scale: 0.1}, []uint16{0xff9c}, -10},
+		{config.ModbusPoint{Type: TypeInt16, Scale: 0.1, Offset: -40}, []uint16{650}, 25},
+		{config.ModbusPoint{Type: TypeUint32}, []uint16{0x0001, 0x0002}, 65538},
+		{config.ModbusPoint{Type: TypeUint32, WordOrder: WordOrderLittle}, []uint16{0x0002, 0x0001}, 65538},
+		{config.ModbusPoint{Type: TypeInt32, Scale: 0.01}, []uint16{0xffff, 0xfc18}, -10},
+		{config.ModbusPoint{Type: TypeFloat32}, []uint16{0x406c, 0xcccd}, float64(float32(3.7))},
+		{config.ModbusPoint{Type: TypeFloat32, WordOrder: WordOrderLittle}, []uint16{0xcccd, 0x406c}, float64(float32(3.7))},
+	}
+	for _, c := range cases {
+		v, err := DecodeValue(&c.point, c.regs)
+		require.NoError(t, err)
+		assert.InDelta(t, c.value, v, 1e-9, "%+v", c.point)
+		regs, err := EncodeValue(&c.point, c.value)
+		require.NoError(t, err)
+		assert.Equal(t, c.regs, regs, "%+v", c.point)
+	}
+
+	_, err := EncodeValue(&config.ModbusPoint{}, -1)
+	assert.Error(t, err)
+	_, err = EncodeValue(&config.ModbusPoint{Type: TypeInt16}, 40000)
+	assert.Error(t, err)
+	_, err = DecodeValue(&config.ModbusPoint{Type: "int64"}, []uint16{0})
+	assert.Error(t, err)
+	_, err = DecodeValue(&config.ModbusPoint{Type: TypeInt32}, []uint16{0})
+	assert.Error(t, err)
+}
+
+func TestPlanReads(t *testing.T) {
+	addrs := map[string][]uint16{
+		TableHolding: {5, 3, 4, 4, 10},
+		TableInput:   {0},
+	}
+	for i := uint16(0); i < 130; i++ {
+		addrs[TableInput] = append(addrs[TableInput], 1000+i)
+	}
+	assert.Equal(t, []readRange{
+		{TableHolding, 3, 3},
+		{TableHolding, 10, 1},
+		{TableInput, 0, 1},
+		{TableInput, 1000, MaxReadRegisters},
+		{TableInput, 1000 + MaxReadRegisters, 5},
+	}, planReads(addrs))
+}
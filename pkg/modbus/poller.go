@@ -0,0 +1,264 @@
+package modbus
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"go.uber.org/zap"
+)
+
+// DefaultPollInterval is the default polling interval of devices.
+const DefaultPollInterval = time.Second
+
+// Ingester accepts polled readings, it is implemented by ingestion.Pipeline.
+type Ingester interface {
+	Ingest(states ...*data_model.BatteryState) error
+}
+
+// IngesterFunc adapts a function to Ingester, e.g. to feed BatteriesData
+// directly without the ingestion pipeline.
+type IngesterFunc func(states ...*data_model.BatteryState) error
+
+// Ingest calls f(states...).
+func (f IngesterFunc) Ingest(states ...*data_model.BatteryState) error {
+	return f(states...)
+}
+
+// Poller polls the register maps of Modbus TCP devices on a schedule and
+// feeds the readings to the ingester as battery states.
+type Poller struct {
+	cfg      *config.ModbusConfig
+	ingester Ingester
+	devices  []*device
+}
+
+// device is a polled device with its read plan.
+type device struct {
+	cfg      *config.ModbusDeviceConfig
+	timeout  time.Duration
+	interval time.Duration
+	reads    []readRange
+	// gateway is the gateway of the readings of the device
+	gateway string
+
+	// client is reconnected after a failed poll
+	client *Client
+}
+
+// NewPoller creates a new poller, the register maps are validated.
+func NewPoller(cfg *config.ModbusConfig, ingester Ingester) (*Poller, error) {
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultPollInterval
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	p := &Poller{cfg: cfg, ingester: ingester}
+	for i := range cfg.Devices {
+		d, err := newDevice(&cfg.Devices[i], cfg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid register map of device %s: %w", cfg.Devices[i].Name, err)
+		}
+		p.devices = append(p.devices, d)
+	}
+	return p, nil
+}
+
+func newDevice(cfg *config.ModbusDeviceConfig, pc *config.ModbusConfig) (*device, error) {
+	d := &device{cfg: cfg, timeout: pc.Timeout, interval: cfg.Interval, gateway: "modbus:" + cfg.Name}
+	if cfg.Name == "" {
+		d.gateway = "modbus:" + cfg.Addr
+	}
+	if d.interval <= 0 {
+		d.interval = pc.Interval
+	}
+	addrs := make(map[string][]uint16)
+	for _, b := range cfg.Blocks {
+		if b.Count <= 0 {
+			return nil, fmt.Errorf("invalid cell count %d", b.Count)
+		}
+		points := blockPoints(&b)
+		if len(points) == 0 {
+			return nil, fmt.Errorf("no point of cells %d-%d", b.FirstCell, b.FirstCell+b.Count-1)
+		}
+		for _, point := range points {
+			width, err := validatePoint(point)
+			if err != nil {
+				return nil, err
+			}
+			if b.Stride == 0 && b.Count > 1 && !point.Shared {
+				return nil, fmt.Errorf("zero stride of cells %d-%d, all cells would read the same registers",
+					b.FirstCell, b.FirstCell+b.Count-1)
+			}
+			for i := 0; i < b.Count; i++ {
+				addr := cellAddress(&b, point, i)
+				if addr+width > math.MaxUint16+1 {
+					return nil, fmt.Errorf("register address %d of cell %d out of range", addr, b.FirstCell+i)
+				}
+				for j := 0; j < width; j++ {
+					addrs[pointTable(point)] = append(addrs[pointTable(point)], uint16(addr+j))
+				}
+				if point.Shared {
+					break
+				}
+			}
+		}
+	}
+	d.reads = planReads(addrs)
+	return d, nil
+}
+
+func blockPoints(b *config.ModbusCellBlock) []*config.ModbusPoint {
+	var points []*config.ModbusPoint
+	for _, point := range []*config.ModbusPoint{b.Voltage, b.Current, b.SOC, b.Temperature, b.State} {
+		if point != nil {
+			points = append(points, point)
+		}
+	}
+	return points
+}
+
+// cellAddress returns the address of the point of the i-th cell of the block.
+func cellAddress(b *config.ModbusCellBlock, point *config.ModbusPoint, i int) int {
+	if point.Shared {
+		return int(point.Address)
+	}
+	return int(point.Address) + i*int(b.Stride)
+}
+
+// Run polls all devices on their schedules until ctx is done. A failed
+// poll is logged and the device is reconnected on the next poll.
+func (p *Poller) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+	for _, d := range p.devices {
+		wg.Add(1)
+		go func(d *device) {
+			defer wg.Done()
+			p.runDevice(ctx, d)
+		}(d)
+	}
+	wg.Wait()
+	return nil
+}
+
+func (p *Poller) runDevice(ctx context.Context, d *device) {
+	defer d.close()
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		states, err := d.poll()
+		if err != nil {
+			log.Warn("failed to poll modbus device",
+				zap.String("device", d.cfg.Name), zap.String("addr", d.cfg.Addr), zap.Error(err))
+		} else if err := p.ingester.Ingest(states...); err != nil {
+			log.Warn("failed to ingest polled readings",
+				zap.String("device", d.cfg.Name), zap.Int("count", len(states)), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll reads the register map of the device once.
+func (d *device) poll() ([]*data_model.BatteryState, error) {
+	if d.client == nil {
+		client, err := Dial(d.cfg.Addr, d.timeout)
+		if err != nil {
+			return nil, err
+		}
+		d.client = client
+	}
+
+	regs := make(registers)
+	for _, r := range d.reads {
+		var values []uint16
+		var err error
+		if r.table == TableInput {
+			values, err = d.client.ReadInputRegisters(d.cfg.UnitID, r.start, r.count)
+		} else {
+			values, err = d.client.ReadHoldingRegisters(d.cfg.UnitID, r.start, r.count)
+		}
+		if err != nil {
+			// the connection may be out of sync after an error, start over
+			d.close()
+			return nil, fmt.Errorf("failed to read %d %s registers from %d: %w", r.count, r.table, r.start, err)
+		}
+		if regs[r.table] == nil {
+			regs[r.table] = make(map[uint16]uint16)
+		}
+		set(regs[r.table], r.start, values)
+	}
+
+	now := time.Now().Unix()
+	var states []*data_model.BatteryState
+	for bi := range d.cfg.Blocks {
+		b := &d.cfg.Blocks[bi]
+		for i := 0; i < b.Count; i++ {
+			state := &data_model.BatteryState{
+				Station:   b.Station,
+				Container: b.Container,
+				Pack:      b.Pack,
+				Cell:      b.FirstCell + i,
+				Timestamp: now,
+				Gateway:   d.gateway,
+			}
+			fields := []struct {
+				point *config.ModbusPoint
+				value *float64
+			}{
+				{b.Voltage, &state.Voltage},
+				{b.Current, &state.Current},
+				{b.SOC, &state.SOC},
+				{b.Temperature, &state.Temperature},
+			}
+			for _, f := range fields {
+				if f.point == nil {
+					continue
+				}
+				v, err := readPoint(regs, b, f.point, i)
+				if err != nil {
+					return nil, err
+				}
+				*f.value = v
+			}
+			if b.State != nil {
+				v, err := readPoint(regs, b, b.State, i)
+				if err != nil {
+					return nil, err
+				}
+				state.State = data_model.State(v)
+			} else {
+				state.State = data_model.StateOf(state.Current)
+			}
+			states = append(states, state)
+		}
+	}
+	return states, nil
+}
+
+func readPoint(regs registers, b *config.ModbusCellBlock, point *config.ModbusPoint, i int) (float64, error) {
+	width, _ := validatePoint(point)
+	addr := uint16(cellAddress(b, point, i))
+	values, ok := regs.get(pointTable(point), addr, width)
+	if !ok {
+		return 0, fmt.Errorf("register %d is not read", addr)
+	}
+	return DecodeValue(point, values)
+}
+
+func (d *device) close() {
+	if d.client != nil {
+		d.client.Close()
+		d.client = nil
+	}
+}
@@ -0,0 +1,152 @@
+package modbus
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+)
+
+// testBlock is a BMU layout: per cell voltage in mV, signed temperature in
+// 0.1 C and SOC as a float32 with the low word first, and a shared pack
+// current as a signed 32 bits value in 0.01 A.
+func testBlock() config.ModbusCellBlock {
+	return config.ModbusCellBlock{
+		Station:     1,
+		Container:   2,
+		Pack:        3,
+		FirstCell:   1,
+		Count:       4,
+		Stride:      4,
+		Voltage:     &config.ModbusPoint{Address: 100, Scale: 0.001},
+		Temperature: &config.ModbusPoint{Address: 101, Type: TypeInt16, Scale: 0.1},
+		SOC:         &config.ModbusPoint{Address: 102, Type: TypeFloat32, WordOrder: WordOrderLittle},
+		Current:     &config.ModbusPoint{Table: TableInput, Address: 10, Type: TypeInt32, Scale: 0.01, Shared: true},
+	}
+}
+
+func setCells(t *testing.T, s *Simulator, b *config.ModbusCellBlock, current float64) {
+	require.NoError(t, s.SetPoint(1, b.Current, b.Current.Address, current))
+	for i := 0; i < b.Count; i++ {
+		offset := uint16(i) * b.Stride
+		require.NoError(t, s.SetPoint(1, b.Voltage, b.Voltage.Address+offset, 3.2+float64(i)*0.1))
+		require.NoError(t, s.SetPoint(1, b.Temperature, b.Temperature.Address+offset, -5+float64(i)*10))
+		require.NoError(t, s.SetPoint(1, b.SOC, b.SOC.Address+offset, 50+float64(i)))
+	}
+}
+
+func TestPoll(t *testing.T) {
+	s := startSimulator(t)
+	b := testBlock()
+	setCells(t, s, &b, -12.5)
+
+	p, err := NewPoller(&config.ModbusConfig{Devices: []config.ModbusDeviceConfig{
+		{Name: "bmu-1", Addr: s.Addr(), UnitID: 1, Blocks: []config.ModbusCellBlock{b}},
+	}}, nil)
+	require.NoError(t, err)
+	d := p.devices[0]
+	// cells are read in one request, the current in another one
+	assert.Equal(t, []readRange{{TableHolding, 100, 16}, {TableInput, 10, 2}}, d.reads)
+
+	states, err := d.poll()
+	require.NoError(t, err)
+	require.Len(t, states, 4)
+	for i, state := range states {
+		assert.Equal(t, 1, state.Station)
+		assert.Equal(t, 2, state.Container)
+		assert.Equal(t, 3, state.Pack)
+		assert.Equal(t, i+1, state.Cell)
+		assert.Equal(t, "modbus:bmu-1", state.Gateway)
+		assert.InDelta(t, 3.2+float64(i)*0.1, state.Voltage, 1e-9)
+		assert.InDelta(t, -5+float64(i)*10, state.Temperature, 1e-9)
+		assert.InDelta(t, 50+float64(i), state.SOC, 1e-9)
+		assert.InDelta(t, -12.5, state.Current, 1e-9)
+		assert.Equal(t, data_model.Discharging, state.State)
+		assert.NotZero(t, state.Timestamp)
+	}
+
+	// a failed poll reconnects on the next one
+	d.client.Close()
+	_, err = d.poll()
+	assert.Error(t, err)
+	assert.Nil(t, d.client)
+	states, err = d.poll()
+	require.NoError(t, err)
+	assert.Len(t, states, 4)
+}
+
+func TestInvalidRegisterMap(t *testing.T) {
+	b := testBlock()
+	b.Voltage = &config.ModbusPoint{Address: 100, Type: "uint8"}
+	_, err := NewPoller(&config.ModbusConfig{Devices: []config.ModbusDeviceConfig{{Blocks: []config.ModbusCellBlock{b}}}}, nil)
+	assert.Error(t, err)
+
+	b = testBlock()
+	b.Voltage.Address = 65530
+	_, err = NewPoller(&config.ModbusConfig{Devices: []config.ModbusDeviceConfig{{Blocks: []config.ModbusCellBlock{b}}}}, nil)
+	assert.Error(t, err)
+
+	_, err = NewPoller(&config.ModbusConfig{Devices: []config.ModbusDeviceConfig{{Blocks: []config.ModbusCellBlock{{Count: 1}}}}}, nil)
+	assert.Error(t, err)
+
+	// only shared points can be read without a stride
+	b = testBlock()
+	b.Stride = 0
+	_, err = NewPoller(&config.ModbusConfig{Devices: []config.ModbusDeviceConfig{{Blocks: []config.ModbusCellBlock{b}}}}, nil)
+	assert.Error(t, err)
+	b = config.ModbusCellBlock{Count: 4, Current: &config.ModbusPoint{Address: 10, Shared: true}}
+	_, err = NewPoller(&config.ModbusConfig{Devices: []config.ModbusDeviceConfig{{Blocks: []config.ModbusCellBlock{b}}}}, nil)
+	assert.NoError(t, err)
+}
+
+func TestPollerRun(t *testing.T) {
+	s := startSimulator(t)
+	b := testBlock()
+	b.State = &config.ModbusPoint{Address: 50, Shared: true}
+	setCells(t, s, &b, 0)
+	s.SetHoldingRegisters(1, 50, uint16(data_model.Charging))
+
+	data := data_model.NewBatteriesData(4)
+	var mu sync.Mutex
+	polls := 0
+	ingester := IngesterFunc(func(states ...*data_model.BatteryState) error {
+		mu.Lock()
+		defer mu.Unlock()
+		polls++
+		for _, state := range states {
+			data.Update(state)
+		}
+		return nil
+	})
+	p, err := NewPoller(&config.ModbusConfig{
+		Interval: 10 * time.Millisecond,
+		Devices: []config.ModbusDeviceConfig{
+			{Name: "bmu-1", Addr: s.Addr(), UnitID: 1, Blocks: []config.ModbusCellBlock{b}},
+		},
+	}, ingester)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return polls >= 3
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	<-done
+
+	cell, ok := data.GetCell(1, 2, 3, 4)
+	require.True(t, ok)
+	assert.InDelta(t, 3.5, cell.Voltage, 1e-9)
+	assert.Equal(t, data_model.Charging, cell.State)
+}
@@ -0,0 +1,107 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Function codes supported by the client and the simulator.
+const (
+	FuncReadHoldingRegisters   byte = 0x03
+	FuncReadInputRegisters     byte = 0x04
+	FuncWriteSingleRegister    byte = 0x06
+	FuncWriteMultipleRegisters byte = 0x10
+)
+
+// Exception codes.
+const (
+	ExceptionIllegalFunction     byte = 0x01
+	ExceptionIllegalDataAddress  byte = 0x02
+	ExceptionIllegalDataValue    byte = 0x03
+	ExceptionServerDeviceFailure byte = 0x04
+	ExceptionGatewayTargetFailed byte = 0x0b
+)
+
+const (
+	// MaxReadRegisters is the max number of registers read by a request.
+	MaxReadRegisters = 125
+	// MaxWriteRegisters is the max number of registers written by a request.
+	MaxWriteRegisters = 123
+
+	// mbapHeaderSize is the size of the MBAP header including the unit id.
+	mbapHeaderSize = 7
+	// maxPDUSize is the max size of a PDU.
+	maxPDUSize = 253
+)
+
+// ErrMalformedFrame is returned when a frame can't be decoded.
+var ErrMalformedFrame = errors.New("malformed modbus frame")
+
+// Exception is the exception response of a device.
+type Exception struct {
+	Function byte
+	Code     byte
+}
+
+func (e *Exception) Error() string {
+	return fmt.Sprintf("modbus exception %#02x on function %#02x", e.Code, e.Function)
+}
+
+// frame is a Modbus TCP application data unit.
+type frame struct {
+	transaction uint16
+	unit        byte
+	pdu         []byte
+}
+
+func (f *frame) encode() []byte {
+	buf := make([]byte, 0, mbapHeaderSize+len(f.pdu))
+	buf = binary.BigEndian.AppendUint16(buf, f.transaction)
+	// protocol id 0 is Modbus
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(f.pdu)+1))
+	buf = append(buf, f.unit)
+	return append(buf, f.pdu...)
+}
+
+func readFrame(r io.Reader) (*frame, error) {
+	var header [mbapHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	protocol := binary.BigEndian.Uint16(header[2:])
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if protocol != 0 || length < 2 || length-1 > maxPDUSize {
+		return nil, fmt.Errorf("%w: protocol %d, length %d", ErrMalformedFrame, protocol, length)
+	}
+	pdu := make([]byte, length-1)
+	if _, err := io.ReadFull(r, pdu); err != nil {
+		return nil, err
+	}
+	return &frame{
+		transaction: binary.BigEndian.Uint16(header[0:]),
+		unit:        header[6],
+		pdu:         pdu,
+	}, nil
+}
+
+func exceptionPDU(function, code byte) []byte {
+	return []byte{function | 0x80, code}
+}
+
+func appendRegisters(buf []byte, values []uint16) []byte {
+	for _, v := range values {
+		buf = binary.BigEndian.AppendUint16(buf, v)
+	}
+	return buf
+}
+
+func decodeRegisters(data []byte) []uint16 {
+	values := make([]uint16, len(data)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[i*2:])
+	}
+	return values
+}
@@ -0,0 +1,220 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+)
+
+// Register tables.
+const (
+	TableHolding = "holding"
+	TableInput   = "input"
+)
+
+// Value types of points.
+const (
+	TypeUint16  = "uint16"
+	TypeInt16   = "int16"
+	TypeUint32  = "uint32"
+	TypeInt32   = "int32"
+	TypeFloat32 = "float32"
+)
+
+// Word orders of 32 bits values.
+const (
+	WordOrderBig    = "big"
+	WordOrderLittle = "little"
+)
+
+// validatePoint checks the point and returns its number of registers.
+func validatePoint(p *config.ModbusPoint) (int, error) {
+	switch p.Table {
+	case "", TableHolding, TableInput:
+	default:
+		return 0, fmt.Errorf("unknown register table %q", p.Table)
+	}
+	switch p.WordOrder {
+	case "", WordOrderBig, WordOrderLittle:
+	default:
+		return 0, fmt.Errorf("unknown word order %q", p.WordOrder)
+	}
+	switch p.Type {
+	case "", TypeUint16, TypeInt16:
+		return 1, nil
+	case TypeUint32, TypeInt32, TypeFloat32:
+		return 2, nil
+	default:
+		return 0, fmt.Errorf("unknown value type %q", p.Type)
+	}
+}
+
+func pointTable(p *config.ModbusPoint) string {
+	if p.Table == "" {
+		return TableHolding
+	}
+	return p.Table
+}
+
+func pointScale(p *config.ModbusPoint) float64 {
+	if p.Scale == 0 {
+		return 1
+	}
+	return p.Scale
+}
+
+// DecodeValue decodes the value of the point from its registers.
+func DecodeValue(p *config.ModbusPoint, regs []uint16) (float64, error) {
+	width, err := validatePoint(p)
+	if err != nil {
+		return 0, err
+	}
+	if len(regs) != width {
+		return 0, fmt.Errorf("point of type %s needs %d registers, got %d", p.Type, width, len(regs))
+	}
+	var raw float64
+	switch p.Type {
+	case "", TypeUint16:
+		raw = float64(regs[0])
+	case TypeInt16:
+		raw = float64(int16(regs[0]))
+	default:
+		hi, lo := regs[0], regs[1]
+		if p.WordOrder == WordOrderLittle {
+			hi, lo = lo, hi
+		}
+		v := uint32(hi)<<16 | uint32(lo)
+		switch p.Type {
+		case TypeUint32:
+			raw = float64(v)
+		case TypeInt32:
+			raw = float64(int32(v))
+		case TypeFloat32:
+			raw = float64(math.Float32frombits(v))
+		}
+	}
+	return raw*pointScale(p) + p.Offset, nil
+}
+
+// EncodeValue encodes the value of the point into registers, it is the
+// inverse of DecodeValue and is used to write setpoints and by the
+// simulator.
+func EncodeValue(p *config.ModbusPoint, value float64) ([]uint16, error) {
+	if _, err := validatePoint(p); err != nil {
+		return nil, err
+	}
+	raw := (value - p.Offset) / pointScale(p)
+	var v uint32
+	switch p.Type {
+	case "", TypeUint16:
+		if raw = math.Round(raw); raw < 0 || raw > math.MaxUint16 {
+			return nil, fmt.Errorf("value %v out of range of %s", value, TypeUint16)
+		}
+		return []uint16{uint16(raw)}, nil
+	case TypeInt16:
+		if raw = math.Round(raw); raw < math.MinInt16 || raw > math.MaxInt16 {
+			return nil, fmt.Errorf("value %v out of range of %s", value, TypeInt16)
+		}
+		return []uint16{uint16(int16(raw))}, nil
+	case TypeUint32:
+		if raw = math.Round(raw); raw < 0 || raw > math.MaxUint32 {
+			return nil, fmt.Errorf("value %v out of range of %s", value, TypeUint32)
+		}
+		v = uint32(raw)
+	case TypeInt32:
+		if raw = math.Round(raw); raw < math.MinInt32 || raw > math.MaxInt32 {
+			return nil, fmt.Errorf("value %v out of range of %s", value, TypeInt32)
+		}
+		v = uint32(int32(raw))
+	case TypeFloat32:
+		v = math.Float32bits(float32(raw))
+	}
+	hi, lo := uint16(v>>16), uint16(v)
+	if p.WordOrder == WordOrderLittle {
+		hi, lo = lo, hi
+	}
+	return []uint16{hi, lo}, nil
+}
+
+// ReadPoint reads the value of the point from the device.
+func (c *Client) ReadPoint(unit byte, p *config.ModbusPoint) (float64, error) {
+	width, err := validatePoint(p)
+	if err != nil {
+		return 0, err
+	}
+	var regs []uint16
+	if pointTable(p) == TableInput {
+		regs, err = c.ReadInputRegisters(unit, p.Address, uint16(width))
+	} else {
+		regs, err = c.ReadHoldingRegisters(unit, p.Address, uint16(width))
+	}
+	if err != nil {
+		return 0, err
+	}
+	return DecodeValue(p, regs)
+}
+
+// WritePoint writes the value of the point to the device, the point must
+// be in the holding registers.
+func (c *Client) WritePoint(unit byte, p *config.ModbusPoint, value float64) error {
+	if pointTable(p) != TableHolding {
+		return fmt.Errorf("can't write point in %s registers", p.Table)
+	}
+	regs, err := EncodeValue(p, value)
+	if err != nil {
+		return err
+	}
+	if len(regs) == 1 {
+		return c.WriteSingleRegister(unit, p.Address, regs[0])
+	}
+	return c.WriteMultipleRegisters(unit, p.Address, regs)
+}
+
+// readRange is a range of registers read by one request.
+type readRange struct {
+	table string
+	start uint16
+	count uint16
+}
+
+// planReads merges the addresses of each table into as few requests as
+// possible. Only consecutive addresses are merged, since devices may
+// reject reads of unmapped registers in the gaps.
+func planReads(addrs map[string][]uint16) []readRange {
+	var ranges []readRange
+	for _, table := range []string{TableHolding, TableInput} {
+		list := append([]uint16(nil), addrs[table]...)
+		sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+		for i, addr := range list {
+			if i > 0 && addr == list[i-1] {
+				continue
+			}
+			last := len(ranges) - 1
+			if last >= 0 && ranges[last].table == table &&
+				uint32(ranges[last].start)+uint32(ranges[last].count) == uint32(addr) &&
+				ranges[last].count < MaxReadRegisters {
+				ranges[last].count++
+				continue
+			}
+			ranges = append(ranges, readRange{table: table, start: addr, count: 1})
+		}
+	}
+	return ranges
+}
+
+// registers are the values of the registers read in a poll.
+type registers map[string]map[uint16]uint16
+
+func (r registers) get(table string, addr uint16, count int) ([]uint16, bool) {
+	values := make([]uint16, count)
+	for i := range values {
+		v, ok := r[table][addr+uint16(i)]
+		if !ok {
+			return nil, false
+		}
+		values[i] = v
+	}
+	return values, true
+}
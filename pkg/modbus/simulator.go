@@ -0,0 +1,231 @@
+package modbus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"go.uber.org/zap"
+)
+
+// Simulator is a local Modbus TCP slave serving in-memory register tables
+// of any number of units, it stands in for BMUs and PCS devices in tests
+// and demos. Reading a register which is not set returns the illegal data
+// address exception like a real device, and a unit which is not set
+// returns the gateway target failed exception.
+type Simulator struct {
+	mu     sync.Mutex
+	units  map[byte]*unitRegisters
+	l      net.Listener
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+type unitRegisters struct {
+	holding map[uint16]uint16
+	input   map[uint16]uint16
+}
+
+// NewSimulator creates a new simulator.
+func NewSimulator() *Simulator {
+	return &Simulator{
+		units: make(map[byte]*unitRegisters),
+		conns: make(map[net.Conn]struct{}),
+	}
+}
+
+// Start listens on the address and serves requests in background.
+func (s *Simulator) Start(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.l = l
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			if s.closed {
+				s.mu.Unlock()
+				conn.Close()
+				return
+			}
+			s.conns[conn] = struct{}{}
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the simulator listens on.
+func (s *Simulator) Addr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.l.Addr().String()
+}
+
+// Close closes the listener and all connections.
+func (s *Simulator) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	if s.l != nil {
+		s.l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// SetHoldingRegisters sets consecutive holding registers of the unit.
+func (s *Simulator) SetHoldingRegisters(unit byte, addr uint16, values ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set(s.unit(unit).holding, addr, values)
+}
+
+// SetInputRegisters sets consecutive input registers of the unit.
+func (s *Simulator) SetInputRegisters(unit byte, addr uint16, values ...uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set(s.unit(unit).input, addr, values)
+}
+
+// HoldingRegisters returns consecutive holding registers of the unit, unset
+// registers are 0.
+func (s *Simulator) HoldingRegisters(unit byte, addr, count uint16) []uint16 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := make([]uint16, count)
+	for i := range values {
+		values[i] = s.unit(unit).holding[addr+uint16(i)]
+	}
+	return values
+}
+
+// SetPoint encodes the value of the point into the registers of the unit.
+func (s *Simulator) SetPoint(unit byte, p *config.ModbusPoint, addr uint16, value float64) error {
+	regs, err := EncodeValue(p, value)
+	if err != nil {
+		return err
+	}
+	if pointTable(p) == TableInput {
+		s.SetInputRegisters(unit, addr, regs...)
+	} else {
+		s.SetHoldingRegisters(unit, addr, regs...)
+	}
+	return nil
+}
+
+func (s *Simulator) unit(unit byte) *unitRegisters {
+	u, ok := s.units[unit]
+	if !ok {
+		u = &unitRegisters{holding: make(map[uint16]uint16), input: make(map[uint16]uint16)}
+		s.units[unit] = u
+	}
+	return u
+}
+
+func set(table map[uint16]uint16, addr uint16, values []uint16) {
+	for i, v := range values {
+		table[addr+uint16(i)] = v
+	}
+}
+
+func (s *Simulator) serve(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readFrame(r)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debug("modbus simulator connection closed", zap.Error(err))
+			}
+			return
+		}
+		resp := &frame{transaction: req.transaction, unit: req.unit, pdu: s.handle(req.unit, req.pdu)}
+		if _, err := conn.Write(resp.encode()); err != nil {
+			return
+		}
+	}
+}
+
+func (s *Simulator) handle(unit byte, pdu []byte) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	function := pdu[0]
+	u, ok := s.units[unit]
+	if !ok {
+		return exceptionPDU(function, ExceptionGatewayTargetFailed)
+	}
+
+	switch function {
+	case FuncReadHoldingRegisters, FuncReadInputRegisters:
+		if len(pdu) != 5 {
+			return exceptionPDU(function, ExceptionIllegalDataValue)
+		}
+		addr, count := binary.BigEndian.Uint16(pdu[1:]), binary.BigEndian.Uint16(pdu[3:])
+		if count == 0 || count > MaxReadRegisters {
+			return exceptionPDU(function, ExceptionIllegalDataValue)
+		}
+		table := u.holding
+		if function == FuncReadInputRegisters {
+			table = u.input
+		}
+		resp := []byte{function, byte(count * 2)}
+		for i := uint16(0); i < count; i++ {
+			if uint32(addr)+uint32(i) > 0xffff {
+				return exceptionPDU(function, ExceptionIllegalDataAddress)
+			}
+			v, ok := table[addr+i]
+			if !ok {
+				return exceptionPDU(function, ExceptionIllegalDataAddress)
+			}
+			resp = binary.BigEndian.AppendUint16(resp, v)
+		}
+		return resp
+	case FuncWriteSingleRegister:
+		if len(pdu) != 5 {
+			return exceptionPDU(function, ExceptionIllegalDataValue)
+		}
+		u.holding[binary.BigEndian.Uint16(pdu[1:])] = binary.BigEndian.Uint16(pdu[3:])
+		return pdu
+	case FuncWriteMultipleRegisters:
+		if len(pdu) < 6 {
+			return exceptionPDU(function, ExceptionIllegalDataValue)
+		}
+		addr, count := binary.BigEndian.Uint16(pdu[1:]), int(binary.BigEndian.Uint16(pdu[3:]))
+		if count == 0 || count > MaxWriteRegisters || int(pdu[5]) != count*2 || len(pdu) != 6+count*2 {
+			return exceptionPDU(function, ExceptionIllegalDataValue)
+		}
+		set(u.holding, addr, decodeRegisters(pdu[6:]))
+		return pdu[:5]
+	default:
+		return exceptionPDU(function, ExceptionIllegalFunction)
+	}
+}
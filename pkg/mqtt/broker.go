@@ -0,0 +1,364 @@
+package mqtt
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
+)
+
+const (
+	// maxQueuedMessages is the max number of unacknowledged QoS 1 messages
+	// kept for a session, the oldest are dropped beyond it.
+	maxQueuedMessages = 10000
+	// brokerWriteTimeout is the timeout to write a packet to a client.
+	brokerWriteTimeout = 5 * time.Second
+)
+
+// Broker is a minimal embedded MQTT 3.1.1 broker. It supports QoS 0 and 1,
+// persistent sessions and wildcard subscriptions, which is enough for tests
+// and for small sites without a broker. Sessions live in memory only.
+type Broker struct {
+	// Authenticate checks the credentials of connecting clients, nil accepts all.
+	Authenticate func(username, password string) bool
+	// Authorize checks whether the client of the username may publish to
+	// the topic, nil allows all. A client publishing to a forbidden topic
+	// is disconnected without an acknowledgement.
+	Authorize func(username, topic string) bool
+	// Admit checks whether a publish of the client of the username is
+	// admitted, nil admits all. A QoS 1 message which is not admitted is
+	// negatively acknowledged by disconnecting the client without a
+	// PUBACK, so it backs off and publishes the message again, a QoS 0
+	// message is dropped.
+	Admit func(username string, msg *Message) bool
+
+	mu       sync.Mutex
+	l        net.Listener
+	sessions map[string]*session
+	conns    map[*brokerConn]struct{}
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+type session struct {
+	id    string
+	clean bool
+	subs  map[string]byte
+	conn  *brokerConn
+	// unacknowledged QoS 1 messages in order
+	queue  []*Message
+	nextID uint16
+}
+
+type brokerConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+}
+
+func (c *brokerConn) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(brokerWriteTimeout))
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// NewBroker creates a new broker.
+func NewBroker() *Broker {
+	return &Broker{
+		sessions: make(map[string]*session),
+		conns:    make(map[*brokerConn]struct{}),
+	}
+}
+
+// Start listens on the address and serves clients in background.
+func (b *Broker) Start(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.l = l
+	b.mu.Unlock()
+
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b.wg.Add(1)
+			go func() {
+				defer b.wg.Done()
+				b.serve(conn)
+			}()
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the broker listens on.
+func (b *Broker) Addr() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.l.Addr().String()
+}
+
+// Close closes the listener and all client connections.
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	if b.l != nil {
+		b.l.Close()
+	}
+	for c := range b.conns {
+		c.conn.Close()
+	}
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+// Publish publishes a message to the subscribers.
+func (b *Broker) Publish(topic string, payload []byte, qos byte) {
+	b.route(&Message{Topic: topic, Payload: payload, QoS: qos})
+}
+
+// Queued returns the number of unacknowledged QoS 1 messages of the session.
+func (b *Broker) Queued(clientID string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.sessions[clientID]; ok {
+		return len(s.queue)
+	}
+	return 0
+}
+
+func (b *Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	c := &brokerConn{conn: conn}
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	p, err := readPacket(r)
+	if err != nil || p.typ != packetConnect {
+		return
+	}
+	connect, code, err := decodeConnect(p)
+	if err != nil {
+		return
+	}
+	if code == connAccepted && connect.clientID == "" && !connect.cleanSession {
+		code = connRefusedIdentifier
+	}
+	if code == connAccepted && b.Authenticate != nil && !b.Authenticate(connect.username, connect.password) {
+		code = connRefusedAuth
+	}
+	if code != connAccepted {
+		c.write(encodeConnack(false, code))
+		return
+	}
+	if connect.clientID == "" {
+		connect.clientID = randomClientID()
+	}
+
+	s, present, ok := b.attach(c, connect)
+	if !ok {
+		return
+	}
+	defer b.detach(c, s)
+
+	keepAlive := time.Duration(connect.keepAlive) * time.Second
+	for {
+		if keepAlive > 0 {
+			conn.SetReadDeadline(time.Now().Add(keepAlive * 3 / 2))
+		} else {
+			conn.SetReadDeadline(time.Time{})
+		}
+		p, err := readPacket(r)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Debug("mqtt client disconnected", zap.String("client-id", s.id), zap.Bool("session-present", present), zap.Error(err))
+			}
+			return
+		}
+
+		switch p.typ {
+		case packetPublish:
+			msg, err := decodePublish(p)
+			if err != nil {
+				return
+			}
+			if b.Authorize != nil && !b.Authorize(connect.username, msg.Topic) {
+				return
+			}
+			if b.Admit != nil && !b.Admit(connect.username, msg) {
+				if msg.QoS == 1 {
+					return
+				}
+				continue
+			}
+			b.route(msg)
+			if msg.QoS == 1 {
+				if err := c.write(encodePacketID(packetPuback, 0, msg.packetID)); err != nil {
+					return
+				}
+			}
+		case packetPuback:
+			id, err := decodePacketID(p)
+			if err != nil {
+				return
+			}
+			b.ack(s, id)
+		case packetSubscribe:
+			id, subs, err := decodeSubscribe(p)
+			if err != nil {
+				return
+			}
+			codes := b.subscribe(s, subs)
+			if err := c.write(encodeSuback(id, codes)); err != nil {
+				return
+			}
+		case packetPingreq:
+			if err := c.write((&packet{typ: packetPingresp}).encode()); err != nil {
+				return
+			}
+		case packetDisconnect:
+			return
+		default:
+			return
+		}
+	}
+}
+
+// attach attaches the connection to the session of the client, an existing
+// connection of the same client is taken over. Unacknowledged messages are
+// sent again.
+func (b *Broker) attach(c *brokerConn, connect *connectPacket) (*session, bool, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, false, false
+	}
+
+	s, present := b.sessions[connect.clientID]
+	if present && s.conn != nil {
+		s.conn.conn.Close()
+	}
+	if !present || connect.cleanSession {
+		s = &session{id: connect.clientID, subs: make(map[string]byte)}
+		b.sessions[connect.clientID] = s
+		present = false
+	}
+	s.clean = connect.cleanSession
+	s.conn = c
+	b.conns[c] = struct{}{}
+
+	if err := c.write(encodeConnack(present, connAccepted)); err != nil {
+		return nil, false, false
+	}
+	for _, msg := range s.queue {
+		msg.Duplicate = true
+		if err := c.write(msg.encode()); err != nil {
+			break
+		}
+	}
+	return s, present, true
+}
+
+func (b *Broker) detach(c *brokerConn, s *session) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.conns, c)
+	if s.conn == c {
+		s.conn = nil
+		if s.clean {
+			delete(b.sessions, s.id)
+		}
+	}
+}
+
+func (b *Broker) subscribe(s *session, subs []Subscription) []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	codes := make([]byte, 0, len(subs))
+	for _, sub := range subs {
+		if sub.Filter == "" {
+			codes = append(codes, subackFailure)
+			continue
+		}
+		qos := sub.QoS
+		if qos > 1 {
+			qos = 1
+		}
+		s.subs[sub.Filter] = qos
+		codes = append(codes, qos)
+	}
+	return codes
+}
+
+func (b *Broker) ack(s *session, id uint16) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, msg := range s.queue {
+		if msg.packetID == id {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *Broker) route(msg *Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.sessions {
+		qos, matched := byte(0), false
+		for filter, subQoS := range s.subs {
+			if MatchTopic(filter, msg.Topic) {
+				matched = true
+				if subQoS > qos {
+					qos = subQoS
+				}
+			}
+		}
+		if !matched {
+			continue
+		}
+		if msg.QoS < qos {
+			qos = msg.QoS
+		}
+
+		out := &Message{Topic: msg.Topic, Payload: msg.Payload, QoS: qos}
+		if qos == 1 {
+			s.nextID++
+			if s.nextID == 0 {
+				s.nextID = 1
+			}
+			out.packetID = s.nextID
+			if len(s.queue) >= maxQueuedMessages {
+				log.Warn("mqtt session queue is full, drop the oldest message", zap.String("client-id", s.id))
+				s.queue = s.queue[1:]
+			}
+			s.queue = append(s.queue, out)
+		}
+		if s.conn != nil {
+			if err := s.conn.write(out.encode()); err != nil {
+				s.conn.conn.Close()
+			}
+		}
+	}
+}
+
+func randomClientID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return "auto-" + hex.EncodeToString(id)
+}
@@ -0,0 +1,289 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultKeepAlive is the default keep alive interval.
+const DefaultKeepAlive = 30 * time.Second
+
+// ErrConnectionClosed is returned when the connection is closed.
+var ErrConnectionClosed = errors.New("mqtt connection closed")
+
+// Handler handles a message received by the client. A QoS 1 message is
+// acknowledged only if the handler returns nil, otherwise the connection is
+// closed so the broker redelivers the message after reconnecting.
+type Handler func(msg *Message) error
+
+// ClientConfig is the MQTT client configuration.
+type ClientConfig struct {
+	// Addr is the address of the broker, host:port.
+	Addr string
+	// ClientID identifies the session on the broker.
+	ClientID string
+	// Username is the username, empty for none.
+	Username string
+	// Password is the password, empty for none.
+	Password string
+	// CleanSession discards the session on the broker when connecting,
+	// otherwise subscriptions and unacknowledged QoS 1 messages are kept
+	// while the client is offline.
+	CleanSession bool
+	// KeepAlive is the keep alive interval.
+	KeepAlive time.Duration
+	// DialTimeout is the timeout to connect to the broker.
+	DialTimeout time.Duration
+}
+
+// Client is a minimal MQTT 3.1.1 client supporting QoS 0 and 1. Received
+// messages are handled one by one in order on the reading goroutine.
+type Client struct {
+	cfg     *ClientConfig
+	conn    net.Conn
+	handler Handler
+
+	// SessionPresent is set if the broker resumed an existing session.
+	SessionPresent bool
+
+	writeMu sync.Mutex
+	mu      sync.Mutex
+	nextID  uint16
+	// waiting acks of outgoing packets by packet id
+	waiting map[uint16]chan *packet
+
+	done    chan struct{}
+	errOnce sync.Once
+	err     error
+}
+
+// Dial connects to the broker, handler handles the received messages.
+func Dial(cfg *ClientConfig, handler Handler) (*Client, error) {
+	if cfg.KeepAlive <= 0 {
+		cfg.KeepAlive = DefaultKeepAlive
+	}
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = 10 * time.Second
+	}
+	if handler == nil {
+		handler = func(*Message) error { return nil }
+	}
+	conn, err := net.DialTimeout("tcp", cfg.Addr, cfg.DialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mqtt broker: %w", err)
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		conn:    conn,
+		handler: handler,
+		waiting: make(map[uint16]chan *packet),
+		done:    make(chan struct{}),
+	}
+	connect := &connectPacket{
+		clientID:     cfg.ClientID,
+		username:     cfg.Username,
+		password:     cfg.Password,
+		cleanSession: cfg.CleanSession,
+		keepAlive:    uint16(cfg.KeepAlive / time.Second),
+	}
+	conn.SetDeadline(time.Now().Add(cfg.DialTimeout))
+	if _, err := conn.Write(connect.encode()); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send connect: %w", err)
+	}
+	r := bufio.NewReader(conn)
+	p, err := readPacket(r)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read connack: %w", err)
+	}
+	if p.typ != packetConnack || len(p.body) != 2 {
+		conn.Close()
+		return nil, fmt.Errorf("%w: expect connack, got type %d", ErrMalformedPacket, p.typ)
+	}
+	if code := p.body[1]; code != connAccepted {
+		conn.Close()
+		return nil, fmt.Errorf("mqtt connection refused, code %d", code)
+	}
+	conn.SetDeadline(time.Time{})
+	c.SessionPresent = p.body[0]&1 == 1
+
+	go c.readLoop(r)
+	go c.keepAlive()
+	return c, nil
+}
+
+// Subscribe subscribes to the topic filters and waits for the broker to
+// acknowledge them.
+func (c *Client) Subscribe(subs ...Subscription) error {
+	id, ack := c.register()
+	if err := c.write(encodeSubscribe(id, subs)); err != nil {
+		return err
+	}
+	p, err := c.wait(id, ack)
+	if err != nil {
+		return err
+	}
+	codes := p.body[2:]
+	if len(codes) != len(subs) {
+		return fmt.Errorf("%w: suback has %d codes, expect %d", ErrMalformedPacket, len(codes), len(subs))
+	}
+	for i, code := range codes {
+		if code == subackFailure {
+			return fmt.Errorf("subscription to %s is rejected", subs[i].Filter)
+		}
+	}
+	return nil
+}
+
+// Publish publishes a message, a QoS 1 message is waited until the broker
+// acknowledges it.
+func (c *Client) Publish(topic string, payload []byte, qos byte) error {
+	if qos > 1 {
+		return fmt.Errorf("unsupported qos %d", qos)
+	}
+	msg := &Message{Topic: topic, Payload: payload, QoS: qos}
+	if qos == 0 {
+		return c.write(msg.encode())
+	}
+	id, ack := c.register()
+	msg.packetID = id
+	if err := c.write(msg.encode()); err != nil {
+		return err
+	}
+	_, err := c.wait(id, ack)
+	return err
+}
+
+// Done returns a channel which is closed when the connection is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error which closed the connection.
+func (c *Client) Err() error {
+	<-c.done
+	return c.err
+}
+
+// Close disconnects from the broker.
+func (c *Client) Close() error {
+	c.write((&packet{typ: packetDisconnect}).encode())
+	c.fail(ErrConnectionClosed)
+	return nil
+}
+
+func (c *Client) register() (uint16, chan *packet) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.nextID++
+	if c.nextID == 0 {
+		c.nextID = 1
+	}
+	ack := make(chan *packet, 1)
+	c.waiting[c.nextID] = ack
+	return c.nextID, ack
+}
+
+func (c *Client) wait(id uint16, ack chan *packet) (*packet, error) {
+	select {
+	case p := <-ack:
+		return p, nil
+	case <-c.done:
+		c.mu.Lock()
+		delete(c.waiting, id)
+		c.mu.Unlock()
+		return nil, c.err
+	}
+}
+
+func (c *Client) write(data []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.KeepAlive))
+	if _, err := c.conn.Write(data); err != nil {
+		c.fail(fmt.Errorf("failed to write mqtt packet: %w", err))
+		return c.err
+	}
+	return nil
+}
+
+func (c *Client) fail(err error) {
+	c.errOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		// the broker must send something within 1.5 keep alive intervals
+		c.conn.SetReadDeadline(time.Now().Add(c.cfg.KeepAlive * 3 / 2))
+		p, err := readPacket(r)
+		if err != nil {
+			c.fail(fmt.Errorf("failed to read mqtt packet: %w", err))
+			return
+		}
+
+		switch p.typ {
+		case packetPublish:
+			msg, err := decodePublish(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			if err := c.handler(msg); err != nil {
+				c.fail(fmt.Errorf("failed to handle message on %s: %w", msg.Topic, err))
+				return
+			}
+			if msg.QoS == 1 {
+				if err := c.write(encodePacketID(packetPuback, 0, msg.packetID)); err != nil {
+					return
+				}
+			}
+		case packetPuback, packetSuback:
+			id, err := decodePacketID(p)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			c.mu.Lock()
+			ack, ok := c.waiting[id]
+			delete(c.waiting, id)
+			c.mu.Unlock()
+			if ok {
+				ack <- p
+			}
+		case packetPingresp:
+		default:
+			c.fail(fmt.Errorf("%w: unexpected packet type %d", ErrMalformedPacket, p.typ))
+			return
+		}
+	}
+}
+
+func (c *Client) keepAlive() {
+	ticker := time.NewTicker(c.cfg.KeepAlive / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.write((&packet{typ: packetPingreq}).encode()); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package mqtt
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		filter, topic string
+		match         bool
+	}{
+		{"a/b/c", "a/b/c", true},
+		{"a/b/c", "a/b", false},
+		{"a/b", "a/b/c", false},
+		{"a/+/c", "a/b/c", true},
+		{"a/+/c", "a/b/d", false},
+		{"+/+", "a/b", true},
+		{"a/#", "a/b/c", true},
+		{"a/#", "a", true},
+		{"#", "a/b", true},
+		{"a/+", "a/", true},
+		{"b/#", "a/b", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, MatchTopic(c.filter, c.topic), "%s %s", c.filter, c.topic)
+	}
+}
+
+func TestPacketEncoding(t *testing.T) {
+	msg := &Message{Topic: "a/b", Payload: make([]byte, 300), QoS: 1, Duplicate: true, packetID: 7}
+	p := &packet{}
+	data := msg.encode()
+	// 300 bytes needs 2 bytes of remaining length
+	assert.Equal(t, byte(0x80|(2+3+2+300)&0x7f), data[1])
+	p.typ, p.flags, p.body = data[0]>>4, data[0]&0x0f, data[3:]
+	got, err := decodePublish(p)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	connect := &connectPacket{clientID: "c1", username: "u", password: "p", keepAlive: 30}
+	data = connect.encode()
+	got2, code, err := decodeConnect(&packet{typ: packetConnect, body: data[2:]})
+	require.NoError(t, err)
+	assert.Equal(t, connAccepted, code)
+	assert.Equal(t, connect, got2)
+
+	_, _, err = decodeConnect(&packet{typ: packetConnect, body: data[2:5]})
+	assert.ErrorIs(t, err, ErrMalformedPacket)
+}
+
+func startBroker(t *testing.T) *Broker {
+	b := NewBroker()
+	require.NoError(t, b.Start("127.0.0.1:0"))
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	b := startBroker(t)
+	received := make(chan *Message, 10)
+	sub, err := Dial(&ClientConfig{Addr: b.Addr(), ClientID: "sub", CleanSession: true}, func(msg *Message) error {
+		received <- msg
+		return nil
+	})
+	require.NoError(t, err)
+	defer sub.Close()
+	require.NoError(t, sub.Subscribe(Subscription{Filter: "bess/+/temp", QoS: 1}))
+
+	pub, err := Dial(&ClientConfig{Addr: b.Addr(), ClientID: "pub", CleanSession: true}, nil)
+	require.NoError(t, err)
+	defer pub.Close()
+	require.NoError(t, pub.Publish("bess/1/temp", []byte("25"), 1))
+	require.NoError(t, pub.Publish("bess/1/volt", []byte("3.7"), 1))
+	require.NoError(t, pub.Publish("bess/2/temp", []byte("26"), 0))
+
+	for _, want := range []string{"25", "26"} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, want, string(msg.Payload))
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not received")
+		}
+	}
+	require.Eventually(t, func() bool { return b.Queued("sub") == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestPersistentSession(t *testing.T) {
+	b := startBroker(t)
+	cfg := &ClientConfig{Addr: b.Addr(), ClientID: "adapter", KeepAlive: time.Second}
+
+	var failures atomic.Int32
+	failures.Store(1)
+	received := make(chan *Message, 10)
+	handler := func(msg *Message) error {
+		if failures.Add(-1) >= 0 {
+			return errors.New("ingest failed")
+		}
+		received <- msg
+		return nil
+	}
+	c, err := Dial(cfg, handler)
+	require.NoError(t, err)
+	assert.False(t, c.SessionPresent)
+	require.NoError(t, c.Subscribe(Subscription{Filter: "bess/#", QoS: 1}))
+
+	// the handler fails, the message is not acknowledged
+	b.Publish("bess/1", []byte("m1"), 1)
+	<-c.Done()
+	assert.Error(t, c.Err())
+	// published while the client is offline
+	b.Publish("bess/2", []byte("m2"), 1)
+	require.Equal(t, 2, b.Queued("adapter"))
+
+	c, err = Dial(cfg, handler)
+	require.NoError(t, err)
+	defer c.Close()
+	assert.True(t, c.SessionPresent)
+	for _, want := range []string{"m1", "m2"} {
+		select {
+		case msg := <-received:
+			assert.Equal(t, want, string(msg.Payload))
+			assert.True(t, msg.Duplicate)
+		case <-time.After(5 * time.Second):
+			t.Fatal("message is not redelivered")
+		}
+	}
+	require.Eventually(t, func() bool { return b.Queued("adapter") == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// keep alive holds the idle connection
+	time.Sleep(2 * time.Second)
+	select {
+	case <-c.Done():
+		t.Fatalf("connection is closed: %v", c.Err())
+	default:
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	b := startBroker(t)
+	b.Authenticate = func(username, password string) bool {
+		return username == "gw" && password == "secret"
+	}
+	_, err := Dial(&ClientConfig{Addr: b.Addr(), ClientID: "c", Username: "gw", Password: "wrong"}, nil)
+	assert.Error(t, err)
+	c, err := Dial(&ClientConfig{Addr: b.Addr(), ClientID: "c", Username: "gw", Password: "secret"}, nil)
+	require.NoError(t, err)
+	c.Close()
+}
@@ -0,0 +1,339 @@
+package mqtt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types of MQTT 3.1.1, only the ones needed for QoS 0 and 1.
+const (
+	packetConnect    byte = 1
+	packetConnack    byte = 2
+	packetPublish    byte = 3
+	packetPuback     byte = 4
+	packetSubscribe  byte = 8
+	packetSuback     byte = 9
+	packetPingreq    byte = 12
+	packetPingresp   byte = 13
+	packetDisconnect byte = 14
+)
+
+const (
+	protocolName  = "MQTT"
+	protocolLevel = 4
+
+	// maxPacketSize is the max remaining length of a packet we accept.
+	maxPacketSize = 1 << 20
+
+	connectFlagCleanSession = 0x02
+	connectFlagPassword     = 0x40
+	connectFlagUsername     = 0x80
+
+	publishFlagDup = 0x08
+
+	// subackFailure is the return code of a rejected subscription.
+	subackFailure = 0x80
+)
+
+// Connack return codes.
+const (
+	connAccepted          byte = 0
+	connRefusedProtocol   byte = 1
+	connRefusedIdentifier byte = 2
+	connRefusedAuth       byte = 4
+)
+
+// ErrMalformedPacket is returned when a packet can't be decoded.
+var ErrMalformedPacket = errors.New("malformed mqtt packet")
+
+// packet is a raw control packet.
+type packet struct {
+	typ   byte
+	flags byte
+	body  []byte
+}
+
+func readPacket(r *bufio.Reader) (*packet, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	// remaining length is encoded in up to 4 bytes, 7 bits each
+	var length, shift int
+	for i := 0; ; i++ {
+		if i == 4 {
+			return nil, fmt.Errorf("%w: invalid remaining length", ErrMalformedPacket)
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		length |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("%w: packet size %d exceeds limit", ErrMalformedPacket, length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return &packet{typ: first >> 4, flags: first & 0x0f, body: body}, nil
+}
+
+func (p *packet) encode() []byte {
+	buf := []byte{p.typ<<4 | p.flags}
+	length := len(p.body)
+	for {
+		b := byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b |= 0x80
+		}
+		buf = append(buf, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(buf, p.body...)
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(s)))
+	return append(buf, s...)
+}
+
+func appendBytes(buf []byte, b []byte) []byte {
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
+
+// decoder reads fields from a packet body.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.buf) < 2 {
+		d.err = ErrMalformedPacket
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.buf)
+	d.buf = d.buf[2:]
+	return v
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.err = ErrMalformedPacket
+		return 0
+	}
+	v := d.buf[0]
+	d.buf = d.buf[1:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.buf) < n {
+		d.err = ErrMalformedPacket
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+// connectPacket is the CONNECT packet.
+type connectPacket struct {
+	clientID     string
+	username     string
+	password     string
+	cleanSession bool
+	keepAlive    uint16
+}
+
+func (c *connectPacket) encode() []byte {
+	var flags byte
+	if c.cleanSession {
+		flags |= connectFlagCleanSession
+	}
+	if c.username != "" {
+		flags |= connectFlagUsername
+	}
+	if c.password != "" {
+		flags |= connectFlagPassword
+	}
+	body := appendString(nil, protocolName)
+	body = append(body, protocolLevel, flags)
+	body = binary.BigEndian.AppendUint16(body, c.keepAlive)
+	body = appendString(body, c.clientID)
+	if c.username != "" {
+		body = appendString(body, c.username)
+	}
+	if c.password != "" {
+		body = appendString(body, c.password)
+	}
+	return (&packet{typ: packetConnect, body: body}).encode()
+}
+
+// decodeConnect decodes a CONNECT packet, will messages are not supported.
+func decodeConnect(p *packet) (*connectPacket, byte, error) {
+	d := &decoder{buf: p.body}
+	name, level, flags := d.string(), d.byte(), d.byte()
+	c := &connectPacket{keepAlive: d.uint16()}
+	c.clientID = d.string()
+	if flags&connectFlagUsername != 0 {
+		c.username = d.string()
+	}
+	if flags&connectFlagPassword != 0 {
+		c.password = d.string()
+	}
+	if d.err != nil {
+		return nil, 0, d.err
+	}
+	if name != protocolName || level != protocolLevel {
+		return nil, connRefusedProtocol, nil
+	}
+	c.cleanSession = flags&connectFlagCleanSession != 0
+	return c, connAccepted, nil
+}
+
+func encodeConnack(sessionPresent bool, code byte) []byte {
+	var flags byte
+	if sessionPresent {
+		flags = 1
+	}
+	return (&packet{typ: packetConnack, body: []byte{flags, code}}).encode()
+}
+
+// Message is an application message.
+type Message struct {
+	// Topic is the topic the message is published to.
+	Topic string
+	// Payload is the message payload.
+	Payload []byte
+	// QoS is the quality of service level, 0 or 1.
+	QoS byte
+	// Duplicate is set if the message may have been delivered before.
+	Duplicate bool
+
+	packetID uint16
+}
+
+func (m *Message) encode() []byte {
+	flags := m.QoS << 1
+	if m.Duplicate {
+		flags |= publishFlagDup
+	}
+	body := appendString(nil, m.Topic)
+	if m.QoS > 0 {
+		body = binary.BigEndian.AppendUint16(body, m.packetID)
+	}
+	body = append(body, m.Payload...)
+	return (&packet{typ: packetPublish, flags: flags, body: body}).encode()
+}
+
+func decodePublish(p *packet) (*Message, error) {
+	m := &Message{QoS: (p.flags >> 1) & 0x03, Duplicate: p.flags&publishFlagDup != 0}
+	if m.QoS > 1 {
+		return nil, fmt.Errorf("%w: unsupported qos %d", ErrMalformedPacket, m.QoS)
+	}
+	d := &decoder{buf: p.body}
+	m.Topic = d.string()
+	if m.QoS > 0 {
+		m.packetID = d.uint16()
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	m.Payload = d.buf
+	return m, nil
+}
+
+func encodePacketID(typ, flags byte, id uint16) []byte {
+	return (&packet{typ: typ, flags: flags, body: binary.BigEndian.AppendUint16(nil, id)}).encode()
+}
+
+func decodePacketID(p *packet) (uint16, error) {
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+	return id, d.err
+}
+
+// Subscription is a topic filter with the max QoS to receive messages at.
+type Subscription struct {
+	// Filter is the topic filter, it may contain wildcards + and #.
+	Filter string
+	// QoS is the max quality of service level, 0 or 1.
+	QoS byte
+}
+
+func encodeSubscribe(id uint16, subs []Subscription) []byte {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	for _, sub := range subs {
+		body = appendString(body, sub.Filter)
+		body = append(body, sub.QoS)
+	}
+	// SUBSCRIBE has reserved flags 0010
+	return (&packet{typ: packetSubscribe, flags: 0x02, body: body}).encode()
+}
+
+func decodeSubscribe(p *packet) (uint16, []Subscription, error) {
+	d := &decoder{buf: p.body}
+	id := d.uint16()
+	var subs []Subscription
+	for d.err == nil && len(d.buf) > 0 {
+		subs = append(subs, Subscription{Filter: d.string(), QoS: d.byte()})
+	}
+	if d.err != nil || len(subs) == 0 {
+		return 0, nil, ErrMalformedPacket
+	}
+	return id, subs, nil
+}
+
+func encodeSuback(id uint16, codes []byte) []byte {
+	body := binary.BigEndian.AppendUint16(nil, id)
+	return (&packet{typ: packetSuback, body: append(body, codes...)}).encode()
+}
+
+// MatchTopic reports whether the topic matches the filter, the filter may
+// contain the single level wildcard + and the multi level wildcard #.
+func MatchTopic(filter, topic string) bool {
+	for {
+		fi, ti := indexLevel(filter), indexLevel(topic)
+		f, t := filter[:fi], topic[:ti]
+		if f == "#" {
+			return true
+		}
+		if f != "+" && f != t {
+			return false
+		}
+		lastF, lastT := fi == len(filter), ti == len(topic)
+		if lastF || lastT {
+			// "a/#" also matches "a"
+			return lastF && lastT || (lastT && filter[fi+1:] == "#")
+		}
+		filter, topic = filter[fi+1:], topic[ti+1:]
+	}
+}
+
+func indexLevel(s string) int {
+	for i := 0; i < len(s); i++ {
+		if s[i] == '/' {
+			return i
+		}
+	}
+	return len(s)
+}
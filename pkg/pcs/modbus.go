@@ -0,0 +1,147 @@
+package pcs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/modbus"
+)
+
+// conn is a Modbus TCP connection, it connects on the first request and
+// reconnects after a failed one.
+type conn struct {
+	addr    string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	client *modbus.Client
+}
+
+// do runs f with a connected client, the client is closed if f fails.
+func (c *conn) do(f func(c *modbus.Client) error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		client, err := modbus.Dial(c.addr, c.timeout)
+		if err != nil {
+			return err
+		}
+		c.client = client
+	}
+	if err := f(c.client); err != nil {
+		c.client.Close()
+		c.client = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.client == nil {
+		return nil
+	}
+	err := c.client.Close()
+	c.client = nil
+	return err
+}
+
+// Modbus is a PCS driven over Modbus TCP. The bits of its fault register
+// are the Fault bits.
+type Modbus struct {
+	conn
+	cfg *config.PCSModbusConfig
+}
+
+// NewModbus creates a new PCS driven over Modbus TCP.
+func NewModbus(cfg *config.PCSModbusConfig) *Modbus {
+	return &Modbus{conn: conn{addr: cfg.Addr, timeout: cfg.Timeout}, cfg: cfg}
+}
+
+func (m *Modbus) write(p *config.ModbusPoint, value float64) error {
+	return m.do(func(c *modbus.Client) error {
+		return c.WritePoint(m.cfg.UnitID, p, value)
+	})
+}
+
+// SetActivePower implements PCS.
+func (m *Modbus) SetActivePower(power float64) error {
+	return m.write(&m.cfg.ActivePower, power)
+}
+
+// SetReactivePower implements PCS.
+func (m *Modbus) SetReactivePower(power float64) error {
+	return m.write(&m.cfg.ReactivePower, power)
+}
+
+// Start implements PCS.
+func (m *Modbus) Start() error {
+	return m.write(&m.cfg.Run, 1)
+}
+
+// Stop implements PCS.
+func (m *Modbus) Stop() error {
+	return m.write(&m.cfg.Run, 0)
+}
+
+// SetGridForming implements PCS.
+func (m *Modbus) SetGridForming(on bool) error {
+	if on {
+		return m.write(&m.cfg.GridForming, 1)
+	}
+	return m.write(&m.cfg.GridForming, 0)
+}
+
+// Status implements PCS.
+func (m *Modbus) Status() (Status, error) {
+	var status Status
+	err := m.do(func(c *modbus.Client) error {
+		var running, gridForming, faults float64
+		for _, r := range []struct {
+			p *config.ModbusPoint
+			v *float64
+		}{
+			{&m.cfg.ActivePowerFeedback, &status.ActivePower},
+			{&m.cfg.ReactivePowerFeedback, &status.ReactivePower},
+			{&m.cfg.Running, &running},
+			{&m.cfg.GridForming, &gridForming},
+			{&m.cfg.Faults, &faults},
+		} {
+			v, err := c.ReadPoint(m.cfg.UnitID, r.p)
+			if err != nil {
+				return err
+			}
+			*r.v = v
+		}
+		status.Running = running != 0
+		status.GridForming = gridForming != 0
+		status.Faults = Fault(faults)
+		return nil
+	})
+	return status, err
+}
+
+// GridMeter detects the loss of the grid from the voltage reported by a
+// meter over Modbus TCP.
+type GridMeter struct {
+	conn
+	cfg *config.GridMeterConfig
+}
+
+// NewGridMeter creates a new GridMeter.
+func NewGridMeter(cfg *config.GridMeterConfig) *GridMeter {
+	return &GridMeter{conn: conn{addr: cfg.Addr, timeout: cfg.Timeout}, cfg: cfg}
+}
+
+// GridAvailable implements GridSignal.
+func (m *GridMeter) GridAvailable() (bool, error) {
+	var voltage float64
+	err := m.do(func(c *modbus.Client) (err error) {
+		voltage, err = c.ReadPoint(m.cfg.UnitID, &m.cfg.Voltage)
+		return err
+	})
+	return voltage >= m.cfg.MinVoltage, err
+}
@@ -0,0 +1,87 @@
+// Package pcs controls the power conversion systems (inverters) of the
+// stations. Setpoints go through a Pipeline which validates them against
+// the power limits computed from the battery data and the safety rules
+// before dispatching them to the PCS, and tracks their acknowledgement.
+package pcs
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PCS is a power conversion system. Powers are in kW and kvar, a positive
+// active power charges the battery.
+type PCS interface {
+	// SetActivePower sets the active power setpoint.
+	SetActivePower(power float64) error
+	// SetReactivePower sets the reactive power setpoint.
+	SetReactivePower(power float64) error
+	// Start starts converting, a stopped PCS doesn't follow its setpoints.
+	Start() error
+	// Stop stops converting.
+	Stop() error
+	// SetGridForming switches the PCS to form the grid of the site, it
+	// then supplies the site loads whatever its setpoints, or back to
+	// follow the grid.
+	SetGridForming(on bool) error
+	// Status reads the state of the PCS.
+	Status() (Status, error)
+}
+
+// GridSignal tells whether the grid is available.
+type GridSignal interface {
+	GridAvailable() (bool, error)
+}
+
+// LoadShedder sheds the non critical loads of a site, e.g. through the
+// contactors of their feeders.
+type LoadShedder interface {
+	ShedLoads(on bool) error
+}
+
+// Status is the state of a PCS.
+type Status struct {
+	Running bool `json:"running"`
+	// GridForming means the PCS forms the grid of the site.
+	GridForming bool `json:"grid_forming,omitempty"`
+	// ActivePower and ReactivePower are the measured powers.
+	ActivePower   float64 `json:"active_power"`
+	ReactivePower float64 `json:"reactive_power"`
+	Faults        Fault   `json:"faults"`
+}
+
+// Fault is a set of faults of a PCS.
+type Fault uint16
+
+const (
+	// FaultGrid means the grid voltage or frequency is out of range.
+	FaultGrid Fault = 1 << iota
+	// FaultOverTemperature means the PCS is overheating.
+	FaultOverTemperature
+	// FaultDCOverVoltage and FaultDCUnderVoltage mean the battery side
+	// voltage is out of range.
+	FaultDCOverVoltage
+	FaultDCUnderVoltage
+	// FaultOverCurrent means the current exceeded the rating.
+	FaultOverCurrent
+	// FaultInsulation means an insulation fault was detected.
+	FaultInsulation
+)
+
+var faultNames = []string{"grid", "over_temperature", "dc_over_voltage", "dc_under_voltage", "over_current", "insulation"}
+
+func (f Fault) String() string {
+	if f == 0 {
+		return "none"
+	}
+	var names []string
+	for i, name := range faultNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if unknown := f &^ (1<<len(faultNames) - 1); unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint16(unknown)))
+	}
+	return strings.Join(names, "|")
+}
@@ -0,0 +1,766 @@
+package pcs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/energymanagement"
+	"go.uber.org/zap"
+)
+
+// Defaults of the pipeline.
+const (
+	DefaultAckTimeout     = 10 * time.Second
+	DefaultPollInterval   = time.Second
+	DefaultTolerance      = 1
+	DefaultMaxTemperature = 55
+	DefaultReconnectDelay = 5 * time.Minute
+
+	// historySize is the number of recent commands kept per station.
+	historySize = 64
+	// epsilon absorbs the rounding of powers in kW.
+	epsilon = 1e-6
+)
+
+var (
+	// ErrUnknownStation is returned for a station without PCS.
+	ErrUnknownStation = errors.New("unknown station")
+	// ErrNotAttached is returned for a station whose PCS is not attached.
+	ErrNotAttached = errors.New("pcs not attached")
+	// ErrRejected is returned for a setpoint violating the power limits
+	// or the safety rules.
+	ErrRejected = errors.New("setpoint rejected")
+)
+
+// CommandState is the state of a command.
+type CommandState string
+
+const (
+	// CommandPending means the setpoint is dispatched and not yet
+	// reported by the PCS.
+	CommandPending CommandState = "pending"
+	// CommandAcknowledged means the PCS reported the setpoint.
+	CommandAcknowledged CommandState = "acknowledged"
+	// CommandRejected means the setpoint failed the validation and was
+	// not dispatched.
+	CommandRejected CommandState = "rejected"
+	// CommandFailed means the setpoint couldn't be dispatched.
+	CommandFailed CommandState = "failed"
+	// CommandTimedOut means the PCS didn't report the setpoint in time.
+	CommandTimedOut CommandState = "timed_out"
+	// CommandSuperseded means a newer setpoint was dispatched before the
+	// PCS reported this one.
+	CommandSuperseded CommandState = "superseded"
+)
+
+// Command is a setpoint submitted to the pipeline.
+type Command struct {
+	ID      uint64 `json:"id"`
+	Station int    `json:"station"`
+	// ActivePower and ReactivePower are the setpoints in kW and kvar,
+	// positive charges.
+	ActivePower   float64      `json:"active_power"`
+	ReactivePower float64      `json:"reactive_power"`
+	State         CommandState `json:"state"`
+	// Reason tells why the command was rejected, failed or superseded, or
+	// why the pipeline issued it.
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	// Acknowledged is when the PCS was seen following the setpoint.
+	Acknowledged time.Time `json:"acknowledged,omitempty"`
+}
+
+// Limits are the power limits of a station in kW computed from its
+// battery data.
+type Limits struct {
+	Charge    float64 `json:"charge"`
+	Discharge float64 `json:"discharge"`
+	// Reason tells why a limit is 0, if so.
+	Reason string `json:"reason,omitempty"`
+}
+
+// GridState is the grid connection of a station.
+type GridState struct {
+	// Islanded means the grid is lost and the PCS forms the grid of the
+	// site since Since.
+	Islanded bool      `json:"islanded"`
+	Since    time.Time `json:"since,omitempty"`
+	// Runtime is the estimated time the battery supplies the site loads
+	// at the current power until the min soc.
+	Runtime time.Duration `json:"runtime,omitempty"`
+	// Exhausted means the battery reached the min soc while islanded and
+	// the PCS is stopped until the grid is back.
+	Exhausted bool `json:"exhausted,omitempty"`
+	// Shedding means the site load exceeded the critical load while
+	// islanded and the non critical loads are shed until the grid is back.
+	Shedding bool `json:"shedding,omitempty"`
+}
+
+// station is a station and its PCS.
+type station struct {
+	id                      int
+	rating                  float64
+	maxCharge, maxDischarge float64
+	minSOC, maxSOC          float64
+	// reserve is the backup reserve soc
+	reserve float64
+	// criticalLoad is the load supplied while islanded, 0 for no limit
+	criticalLoad float64
+	cellVoltage  float64
+
+	// mu serializes the commands of the station
+	mu      sync.Mutex
+	pcs     PCS
+	grid    GridSignal
+	shedder LoadShedder
+	history []*Command
+	pending *Command
+	// active and reactive are the powers of the latest dispatched setpoint
+	active   float64
+	reactive float64
+	// islanded is set since the grid is lost until it is back for the
+	// reconnect delay, restored is when it came back
+	islanded  bool
+	since     time.Time
+	restored  time.Time
+	exhausted bool
+	shedding  bool
+}
+
+// Pipeline validates the setpoints of the stations against their power
+// limits and the safety rules, dispatches them to the PCS and tracks
+// their acknowledgement. It implements energymanagement.Commander.
+type Pipeline struct {
+	cfg      config.PCSConfig
+	data     *data_model.BatteriesData
+	stations map[int]*station
+	nextID   atomic.Uint64
+}
+
+// NewPipeline creates a new pipeline of the stations of cfg, their power
+// and soc limits are the ones of energy. The PCS driven over Modbus are
+// attached, the others must be attached with Attach. The loss of the grid
+// is detected from the grid meter of a station, or else from the grid
+// fault of its PCS.
+func NewPipeline(cfg *config.PCSConfig, energy *config.EnergyManagementConfig, data *data_model.BatteriesData) *Pipeline {
+	c := *cfg
+	if c.AckTimeout <= 0 {
+		c.AckTimeout = DefaultAckTimeout
+	}
+	if c.PollInterval <= 0 {
+		c.PollInterval = DefaultPollInterval
+	}
+	if c.Tolerance <= 0 {
+		c.Tolerance = DefaultTolerance
+	}
+	if c.MaxTemperature == 0 {
+		c.MaxTemperature = DefaultMaxTemperature
+	}
+	if c.ReconnectDelay <= 0 {
+		c.ReconnectDelay = DefaultReconnectDelay
+	}
+	limits := make(map[int]config.StationEnergyConfig)
+	if energy != nil {
+		for _, s := range energy.Stations {
+			limits[s.ID] = s
+		}
+	}
+
+	p := &Pipeline{cfg: c, data: data, stations: make(map[int]*station)}
+	for _, s := range c.Stations {
+		// the limits are those the energy management plans with
+		l := energymanagement.WithStationDefaults(limits[s.Station])
+		st := &station{
+			id:           s.Station,
+			rating:       s.Rating,
+			maxCharge:    l.MaxChargePower,
+			maxDischarge: l.MaxDischargePower,
+			minSOC:       l.MinSOC,
+			maxSOC:       l.MaxSOC,
+			reserve:      l.BackupReserve,
+			criticalLoad: s.CriticalLoad,
+			cellVoltage:  l.CellVoltage,
+		}
+		if st.maxCharge <= 0 {
+			st.maxCharge = s.Rating
+		}
+		if st.maxDischarge <= 0 {
+			st.maxDischarge = s.Rating
+		}
+		if s.Modbus != nil {
+			st.pcs = NewModbus(s.Modbus)
+		}
+		if s.GridMeter != nil {
+			st.grid = NewGridMeter(s.GridMeter)
+		}
+		p.stations[s.Station] = st
+	}
+	return p
+}
+
+// Attach attaches the PCS of the station.
+func (p *Pipeline) Attach(id int, pcs PCS) error {
+	st, ok := p.stations[id]
+	if !ok {
+		return ErrUnknownStation
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.pcs = pcs
+	return nil
+}
+
+// SetGridSignal sets the signal detecting the loss of the grid of the
+// station, nil detects it from the grid fault of its PCS.
+func (p *Pipeline) SetGridSignal(id int, signal GridSignal) error {
+	st, ok := p.stations[id]
+	if !ok {
+		return ErrUnknownStation
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.grid = signal
+	return nil
+}
+
+// SetLoadShedder sets the shedder of the non critical loads of the
+// station, nil only signals the shedding in the grid state.
+func (p *Pipeline) SetLoadShedder(id int, shedder LoadShedder) error {
+	st, ok := p.stations[id]
+	if !ok {
+		return ErrUnknownStation
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.shedder = shedder
+	return nil
+}
+
+func (p *Pipeline) station(id int) (*station, error) {
+	st, ok := p.stations[id]
+	if !ok {
+		return nil, ErrUnknownStation
+	}
+	return st, nil
+}
+
+// Limits returns the power limits of the station.
+func (p *Pipeline) Limits(id int) (Limits, error) {
+	st, err := p.station(id)
+	if err != nil {
+		return Limits{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	return p.limits(st), nil
+}
+
+// limits returns the power limits of the station, the backup reserve is
+// kept while the grid is available.
+func (p *Pipeline) limits(st *station) Limits {
+	summary, ok := p.data.Station(st.id)
+	switch {
+	case st.islanded:
+		return Limits{Reason: "station islanded"}
+	case !ok:
+		return Limits{Reason: "no battery data"}
+	case summary.UnhealthyCells > p.cfg.MaxUnhealthyCells:
+		return Limits{Reason: fmt.Sprintf("%d unhealthy cells", summary.UnhealthyCells)}
+	case summary.TemperatureSensors == 0:
+		return Limits{Reason: "no healthy temperature sensor"}
+	case summary.MaxTemperature >= p.cfg.MaxTemperature:
+		return Limits{Reason: fmt.Sprintf("cell temperature %.1f°C reached %.1f°C", summary.MaxTemperature, p.cfg.MaxTemperature)}
+	}
+	l := Limits{Charge: st.maxCharge, Discharge: st.maxDischarge}
+	if soc := summary.SOC(); soc >= st.maxSOC {
+		l.Charge, l.Reason = 0, fmt.Sprintf("soc %.1f%% reached max %.1f%%", soc, st.maxSOC)
+	} else if soc <= st.minSOC {
+		l.Discharge, l.Reason = 0, fmt.Sprintf("soc %.1f%% reached min %.1f%%", soc, st.minSOC)
+	} else if soc <= st.reserve {
+		l.Discharge, l.Reason = 0, fmt.Sprintf("soc %.1f%% reached backup reserve %.1f%%", soc, st.reserve)
+	}
+	return l
+}
+
+// validate returns why the setpoint can't be dispatched, empty if it can.
+// A zero active and reactive power is the safe state and always valid,
+// unless the station is islanded and its PCS supplies the site loads.
+func (p *Pipeline) validate(st *station, active, reactive float64) (string, error) {
+	if st.islanded {
+		return "station islanded", nil
+	}
+	if active == 0 && reactive == 0 {
+		return "", nil
+	}
+	if st.rating > 0 && math.Hypot(active, reactive) > st.rating+epsilon {
+		return fmt.Sprintf("apparent power %.1fkVA over rating %.1fkVA", math.Hypot(active, reactive), st.rating), nil
+	}
+	status, err := st.pcs.Status()
+	if err != nil {
+		return "", fmt.Errorf("failed to read pcs status: %w", err)
+	}
+	if status.Faults != 0 {
+		return fmt.Sprintf("pcs faults %s", status.Faults), nil
+	}
+
+	l := p.limits(st)
+	limit, direction := l.Charge, "charge"
+	if active < 0 {
+		limit, direction = l.Discharge, "discharge"
+	}
+	switch {
+	case active == 0:
+		return "", nil
+	case limit == 0 && l.Reason != "":
+		return fmt.Sprintf("can't %s: %s", direction, l.Reason), nil
+	case math.Abs(active) > limit+epsilon:
+		return fmt.Sprintf("%s power %.1fkW over limit %.1fkW", direction, math.Abs(active), limit), nil
+	}
+	return "", nil
+}
+
+// Submit validates the setpoint of the station and dispatches it to its
+// PCS. A rejected setpoint returns an error wrapping ErrRejected, the
+// command is recorded either way.
+func (p *Pipeline) Submit(id int, active, reactive float64) (Command, error) {
+	st, err := p.station(id)
+	if err != nil {
+		return Command{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pcs == nil {
+		return Command{}, ErrNotAttached
+	}
+
+	cmd := &Command{
+		ID:            p.nextID.Add(1),
+		Station:       id,
+		ActivePower:   active,
+		ReactivePower: reactive,
+		State:         CommandPending,
+		Created:       time.Now(),
+	}
+	st.record(cmd)
+	reason, err := p.validate(st, active, reactive)
+	if err != nil {
+		cmd.State, cmd.Reason = CommandFailed, err.Error()
+		return *cmd, err
+	}
+	if reason != "" {
+		cmd.State, cmd.Reason = CommandRejected, reason
+		log.Warn("pcs setpoint rejected", zap.Int("station", id), zap.Uint64("command", cmd.ID),
+			zap.Float64("active", active), zap.Float64("reactive", reactive), zap.String("reason", reason))
+		return *cmd, fmt.Errorf("%w: %s", ErrRejected, reason)
+	}
+
+	if st.pending != nil {
+		st.pending.State = CommandSuperseded
+	}
+	st.pending = cmd
+	if err := st.pcs.SetActivePower(active); err != nil {
+		return *st.fail(err), fmt.Errorf("failed to dispatch active power: %w", err)
+	}
+	st.active = active
+	if err := st.pcs.SetReactivePower(reactive); err != nil {
+		return *st.fail(err), fmt.Errorf("failed to dispatch reactive power: %w", err)
+	}
+	st.reactive = reactive
+	return *cmd, nil
+}
+
+// record appends the command to the history of the station.
+func (st *station) record(cmd *Command) {
+	if len(st.history) == historySize {
+		copy(st.history, st.history[1:])
+		st.history = st.history[:historySize-1]
+	}
+	st.history = append(st.history, cmd)
+}
+
+// fail marks the pending command failed and returns it.
+func (st *station) fail(err error) *Command {
+	cmd := st.pending
+	cmd.State, cmd.Reason = CommandFailed, err.Error()
+	st.pending = nil
+	return cmd
+}
+
+// SetPower sets the active power of the station keeping its reactive
+// power.
+func (p *Pipeline) SetPower(id int, power float64) error {
+	st, err := p.station(id)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	reactive := st.reactive
+	st.mu.Unlock()
+	_, err = p.Submit(id, power, reactive)
+	return err
+}
+
+// Start starts the PCS of the station, a faulted PCS isn't started.
+func (p *Pipeline) Start(id int) error {
+	st, err := p.station(id)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pcs == nil {
+		return ErrNotAttached
+	}
+	status, err := st.pcs.Status()
+	if err != nil {
+		return fmt.Errorf("failed to read pcs status: %w", err)
+	}
+	if status.Faults != 0 {
+		return fmt.Errorf("%w: pcs faults %s", ErrRejected, status.Faults)
+	}
+	if err := st.pcs.Start(); err != nil {
+		return fmt.Errorf("failed to start pcs: %w", err)
+	}
+	return nil
+}
+
+// Stop stops the PCS of the station.
+func (p *Pipeline) Stop(id int) error {
+	st, err := p.station(id)
+	if err != nil {
+		return err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pcs == nil {
+		return ErrNotAttached
+	}
+	if err := st.pcs.Stop(); err != nil {
+		return fmt.Errorf("failed to stop pcs: %w", err)
+	}
+	return nil
+}
+
+// Status reads the status of the PCS of the station.
+func (p *Pipeline) Status(id int) (Status, error) {
+	st, err := p.station(id)
+	if err != nil {
+		return Status{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pcs == nil {
+		return Status{}, ErrNotAttached
+	}
+	return st.pcs.Status()
+}
+
+// Commands returns the recent commands of the station, oldest first.
+func (p *Pipeline) Commands(id int) ([]Command, error) {
+	st, err := p.station(id)
+	if err != nil {
+		return nil, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	commands := make([]Command, len(st.history))
+	for i, cmd := range st.history {
+		commands[i] = *cmd
+	}
+	return commands, nil
+}
+
+// Command returns the command of the id if it is still recent.
+func (p *Pipeline) Command(id uint64) (Command, bool) {
+	for _, st := range p.stations {
+		st.mu.Lock()
+		i := sort.Search(len(st.history), func(i int) bool { return st.history[i].ID >= id })
+		if i < len(st.history) && st.history[i].ID == id {
+			cmd := *st.history[i]
+			st.mu.Unlock()
+			return cmd, true
+		}
+		st.mu.Unlock()
+	}
+	return Command{}, false
+}
+
+// Poll checks the grid of the stations, re-checks their running setpoints
+// against their current limits and reads the status of the PCS with a
+// pending command, the command is acknowledged once the measured powers
+// are within the tolerance of the setpoint, or times out.
+func (p *Pipeline) Poll(now time.Time) {
+	for _, st := range p.stations {
+		p.checkGrid(st, now)
+		p.enforce(st, now)
+		p.poll(st, now)
+	}
+}
+
+// enforce clamps the running setpoint of the station to its limits, they
+// change with the soc, the temperature and the health of the cells after
+// the setpoint was validated. The clamped setpoint is a new command
+// superseding the pending one.
+func (p *Pipeline) enforce(st *station, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pcs == nil || st.islanded || st.active == 0 {
+		return
+	}
+	l := p.limits(st)
+	limit, direction := l.Charge, "charge"
+	if st.active < 0 {
+		limit, direction = l.Discharge, "discharge"
+	}
+	if math.Abs(st.active) <= limit+epsilon {
+		return
+	}
+	reason := l.Reason
+	if limit > 0 || reason == "" {
+		reason = fmt.Sprintf("%s power %.1fkW over limit %.1fkW", direction, math.Abs(st.active), limit)
+	}
+	active := 0.0
+	if limit > 0 {
+		active = math.Copysign(limit, st.active)
+	}
+
+	cmd := &Command{
+		ID:            p.nextID.Add(1),
+		Station:       st.id,
+		ActivePower:   active,
+		ReactivePower: st.reactive,
+		State:         CommandPending,
+		Reason:        "clamped: " + reason,
+		Created:       now,
+	}
+	st.record(cmd)
+	if st.pending != nil {
+		st.pending.State, st.pending.Reason = CommandSuperseded, reason
+	}
+	st.pending = cmd
+	log.Warn("pcs setpoint over the limits, clamped", zap.Int("station", st.id), zap.Uint64("command", cmd.ID),
+		zap.Float64("from", st.active), zap.Float64("to", active), zap.String("reason", reason))
+	if err := st.pcs.SetActivePower(active); err != nil {
+		st.fail(err)
+		log.Error("failed to dispatch active power", zap.Int("station", st.id), zap.Error(err))
+		return
+	}
+	st.active = active
+}
+
+// gridAvailable reads the grid signal of the station.
+func (st *station) gridAvailable() (bool, error) {
+	if st.grid != nil {
+		return st.grid.GridAvailable()
+	}
+	status, err := st.pcs.Status()
+	if err != nil {
+		return false, fmt.Errorf("failed to read pcs status: %w", err)
+	}
+	return status.Faults&FaultGrid == 0, nil
+}
+
+// checkGrid islands the station when the grid is lost and reconnects it
+// once the grid is back for the reconnect delay. Islanded, the PCS forms
+// the grid and supplies the site loads with all the energy above the min
+// soc, the backup reserve included, and is stopped at the min soc. Once
+// the site load exceeds the critical load the non critical loads are shed
+// until the grid is back.
+func (p *Pipeline) checkGrid(st *station, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.pcs == nil {
+		return
+	}
+	available, err := st.gridAvailable()
+	if err != nil {
+		log.Warn("failed to read grid state", zap.Int("station", st.id), zap.Error(err))
+		return
+	}
+	switch {
+	case !available && !st.islanded:
+		if err := st.island(); err != nil {
+			log.Error("failed to island station", zap.Int("station", st.id), zap.Error(err))
+			return
+		}
+		st.islanded, st.since, st.restored = true, now, time.Time{}
+		log.Warn("grid lost, station islanded", zap.Int("station", st.id))
+	case !available:
+		st.restored = time.Time{}
+	case !st.islanded:
+		if st.shedding {
+			// the loads failed to be restored on reconnect
+			st.shed(false)
+		}
+		return
+	case st.restored.IsZero():
+		st.restored = now
+	case now.Sub(st.restored) >= p.cfg.ReconnectDelay:
+		if err := st.reconnect(); err != nil {
+			log.Error("failed to reconnect station", zap.Int("station", st.id), zap.Error(err))
+			return
+		}
+		st.islanded, st.exhausted = false, false
+		if st.shedding {
+			st.shed(false)
+		}
+		log.Info("grid back, station reconnected", zap.Int("station", st.id),
+			zap.Duration("islanded", now.Sub(st.since)))
+		return
+	}
+
+	summary, ok := p.data.Station(st.id)
+	if st.islanded && !st.exhausted && ok && summary.SOC() <= st.minSOC {
+		if err := st.pcs.Stop(); err != nil {
+			log.Error("failed to stop pcs", zap.Int("station", st.id), zap.Error(err))
+			return
+		}
+		st.exhausted = true
+		log.Warn("islanded station reached min soc, pcs stopped", zap.Int("station", st.id),
+			zap.Float64("soc", summary.SOC()))
+	}
+	if st.islanded && !st.exhausted && !st.shedding && st.criticalLoad > 0 {
+		status, err := st.pcs.Status()
+		if err != nil {
+			log.Warn("failed to read pcs status", zap.Int("station", st.id), zap.Error(err))
+			return
+		}
+		if -status.ActivePower > st.criticalLoad+epsilon {
+			log.Warn("islanded site load over the critical load, shedding loads", zap.Int("station", st.id),
+				zap.Float64("load", -status.ActivePower), zap.Float64("critical", st.criticalLoad))
+			st.shed(true)
+		}
+	}
+}
+
+// shed signals the shedding of the non critical loads and drives the
+// shedder of the station, if any. A failure is logged and retried on the
+// next check.
+func (st *station) shed(on bool) {
+	if st.shedder != nil {
+		if err := st.shedder.ShedLoads(on); err != nil {
+			log.Error("failed to shed loads", zap.Int("station", st.id), zap.Bool("shed", on), zap.Error(err))
+			return
+		}
+	}
+	st.shedding = on
+}
+
+// island drops the setpoints of the station and switches its PCS to form
+// the grid.
+func (st *station) island() error {
+	if st.pending != nil {
+		st.pending.State, st.pending.Reason = CommandSuperseded, "station islanded"
+		st.pending = nil
+	}
+	if err := st.pcs.SetActivePower(0); err != nil {
+		return fmt.Errorf("failed to dispatch active power: %w", err)
+	}
+	st.active = 0
+	if err := st.pcs.SetReactivePower(0); err != nil {
+		return fmt.Errorf("failed to dispatch reactive power: %w", err)
+	}
+	st.reactive = 0
+	if err := st.pcs.SetGridForming(true); err != nil {
+		return fmt.Errorf("failed to switch pcs to grid forming: %w", err)
+	}
+	if err := st.pcs.Start(); err != nil {
+		return fmt.Errorf("failed to start pcs: %w", err)
+	}
+	return nil
+}
+
+// reconnect switches the PCS of the station back to follow the grid, an
+// exhausted PCS is started again to recharge.
+func (st *station) reconnect() error {
+	if err := st.pcs.SetGridForming(false); err != nil {
+		return fmt.Errorf("failed to switch pcs to grid following: %w", err)
+	}
+	if st.exhausted {
+		if err := st.pcs.Start(); err != nil {
+			return fmt.Errorf("failed to start pcs: %w", err)
+		}
+	}
+	return nil
+}
+
+// Grid returns the grid connection of the station.
+func (p *Pipeline) Grid(id int) (GridState, error) {
+	st, err := p.station(id)
+	if err != nil {
+		return GridState{}, err
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if !st.islanded {
+		return GridState{}, nil
+	}
+	state := GridState{Islanded: true, Since: st.since, Exhausted: st.exhausted, Shedding: st.shedding}
+	if st.exhausted {
+		return state, nil
+	}
+	status, err := st.pcs.Status()
+	if err != nil {
+		return state, fmt.Errorf("failed to read pcs status: %w", err)
+	}
+	summary, ok := p.data.Station(st.id)
+	if ok && status.ActivePower < 0 {
+		energy := (summary.CurrentCapacity - summary.MaxCapacity*st.minSOC/100) * st.cellVoltage / 1000
+		hours := math.Max(0, energy) / -status.ActivePower
+		state.Runtime = time.Duration(hours * float64(time.Hour))
+	}
+	return state, nil
+}
+
+func (p *Pipeline) poll(st *station, now time.Time) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	cmd := st.pending
+	if cmd == nil {
+		return
+	}
+	status, err := st.pcs.Status()
+	if err != nil {
+		log.Warn("failed to read pcs status", zap.Int("station", st.id), zap.Error(err))
+	} else if math.Abs(status.ActivePower-cmd.ActivePower) <= p.cfg.Tolerance &&
+		math.Abs(status.ReactivePower-cmd.ReactivePower) <= p.cfg.Tolerance {
+		cmd.State, cmd.Acknowledged = CommandAcknowledged, now
+		st.pending = nil
+		return
+	}
+	if now.Sub(cmd.Created) > p.cfg.AckTimeout {
+		cmd.State = CommandTimedOut
+		if err == nil {
+			cmd.Reason = fmt.Sprintf("pcs reports %.1fkW %.1fkvar", status.ActivePower, status.ReactivePower)
+			if !status.Running {
+				cmd.Reason = "pcs not running"
+			}
+		}
+		st.pending = nil
+		log.Warn("pcs setpoint not acknowledged", zap.Int("station", st.id), zap.Uint64("command", cmd.ID),
+			zap.Float64("active", cmd.ActivePower), zap.Float64("reactive", cmd.ReactivePower), zap.String("reason", cmd.Reason))
+	}
+}
+
+// Run polls the PCS with pending commands until ctx is done.
+func (p *Pipeline) Run(ctx context.Context) error {
+	ticker := time.NewTicker(p.cfg.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			p.Poll(now)
+		}
+	}
+}
@@ -0,0 +1,547 @@
+package pcs
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/energymanagement"
+	"github.com/zhangjinpeng87/openbms/pkg/modbus"
+)
+
+// recorder feeds the readings to the batteries data and keeps a copy of
+// the latest, the batteries data filters them in place.
+type recorder struct {
+	data *data_model.BatteriesData
+
+	mu     sync.Mutex
+	latest []*data_model.BatteryState
+}
+
+func (r *recorder) Ingest(states ...*data_model.BatteryState) error {
+	latest := make([]*data_model.BatteryState, len(states))
+	for i, state := range states {
+		reading := *state
+		latest[i] = &reading
+		r.data.Update(state)
+	}
+	r.data.ReCalculate()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latest = latest
+	return nil
+}
+
+// newSimulated creates a simulated PCS of a station of 10 cells of 100Ah
+// at 50% soc.
+func newSimulated(t *testing.T, r *recorder, station int, temperature float64, now time.Time) *Simulated {
+	var cells []data_model.BatteryState
+	for cell := 1; cell <= 10; cell++ {
+		cells = append(cells, data_model.BatteryState{
+			Station: station, Container: 1, Pack: 1, Cell: cell,
+			SOC: 50, MaxCapacity: 100, Temperature: temperature,
+		})
+	}
+	s := NewSimulated(cells, r, 0)
+	require.NoError(t, s.Step(now))
+	return s
+}
+
+func TestPipeline(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	now := time.Now()
+	sim := newSimulated(t, r, 1, 25, now)
+	hot := newSimulated(t, r, 2, 60, now)
+
+	p := NewPipeline(&config.PCSConfig{
+		Tolerance: 0.1,
+		Stations:  []config.PCSStationConfig{{Station: 1, Rating: 10}, {Station: 2, Rating: 10}, {Station: 3}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 5, MaxDischargePower: 5, MinSOC: 10, MaxSOC: 90}},
+	}, r.data)
+	require.NoError(t, p.Attach(1, sim))
+	require.NoError(t, p.Attach(2, hot))
+	assert.ErrorIs(t, p.Attach(4, sim), ErrUnknownStation)
+	_, err := p.Submit(3, 1, 0)
+	assert.ErrorIs(t, err, ErrNotAttached)
+	require.NoError(t, p.Start(1))
+
+	limits, err := p.Limits(1)
+	require.NoError(t, err)
+	assert.Equal(t, Limits{Charge: 5, Discharge: 5}, limits)
+	limits, err = p.Limits(2)
+	require.NoError(t, err)
+	assert.Zero(t, limits.Charge)
+	assert.Contains(t, limits.Reason, "cell temperature 60.0°C")
+
+	// the setpoint is acknowledged once the pcs follows it
+	cmd, err := p.Submit(1, -3, 1)
+	require.NoError(t, err)
+	assert.Equal(t, CommandPending, cmd.State)
+	p.Poll(now)
+	cmd, ok := p.Command(cmd.ID)
+	require.True(t, ok)
+	assert.Equal(t, CommandPending, cmd.State)
+	require.NoError(t, sim.Step(now.Add(time.Second)))
+	p.Poll(now.Add(time.Second))
+	cmd, _ = p.Command(cmd.ID)
+	assert.Equal(t, CommandAcknowledged, cmd.State)
+
+	// setpoints violating the limits or the safety rules aren't dispatched
+	for _, c := range []struct {
+		station          int
+		active, reactive float64
+		reason           string
+	}{
+		{1, -6, 0, "discharge power 6.0kW over limit 5.0kW"},
+		{1, 8, 8, "apparent power 11.3kVA over rating 10.0kVA"},
+		{2, -1, 0, "can't discharge: cell temperature 60.0°C reached 55.0°C"},
+	} {
+		cmd, err := p.Submit(c.station, c.active, c.reactive)
+		assert.ErrorIs(t, err, ErrRejected)
+		assert.Equal(t, CommandRejected, cmd.State)
+		assert.Equal(t, c.reason, cmd.Reason)
+	}
+	status, err := p.Status(1)
+	require.NoError(t, err)
+	assert.Equal(t, Status{Running: true, ActivePower: -3, ReactivePower: 1}, status)
+
+	// the reactive power is kept and a newer setpoint supersedes a pending one
+	require.NoError(t, p.SetPower(1, -1))
+	require.NoError(t, p.SetPower(1, -2))
+	commands, err := p.Commands(1)
+	require.NoError(t, err)
+	require.Len(t, commands, 5)
+	assert.Equal(t, CommandSuperseded, commands[3].State)
+	assert.Equal(t, 1.0, commands[4].ReactivePower)
+
+	// the discharge of the simulated cells for half an hour
+	require.NoError(t, sim.Step(now.Add(2*time.Second)))
+	p.Poll(now.Add(2 * time.Second))
+	r.mu.Lock()
+	before := r.latest
+	r.mu.Unlock()
+	require.NoError(t, sim.Step(now.Add(2*time.Second+30*time.Minute)))
+	r.mu.Lock()
+	for i, state := range r.latest {
+		// 10 cells of 100Ah, the soc drops by half the current in percent
+		assert.InDelta(t, -2000.0/10/before[i].Voltage, before[i].Current, 1e-9)
+		assert.InDelta(t, before[i].SOC+before[i].Current/2, state.SOC, 1e-9)
+		assert.Equal(t, data_model.Discharging, state.State)
+		assert.Less(t, state.Voltage, before[i].Voltage)
+	}
+	r.mu.Unlock()
+
+	// a stopped pcs doesn't acknowledge
+	require.NoError(t, p.Stop(1))
+	require.NoError(t, p.SetPower(1, -1))
+	require.NoError(t, sim.Step(now.Add(31*time.Minute)))
+	p.Poll(now.Add(31*time.Minute + DefaultAckTimeout))
+	commands, _ = p.Commands(1)
+	assert.Equal(t, CommandTimedOut, commands[len(commands)-1].State)
+	assert.Equal(t, "pcs not running", commands[len(commands)-1].Reason)
+
+	// a faulted pcs only accepts the safe state
+	sim.SetFaults(FaultGrid | FaultInsulation)
+	_, err = p.Submit(1, -1, 0)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Contains(t, err.Error(), "pcs faults grid|insulation")
+	_, err = p.Submit(1, 0, 0)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, p.Start(1), ErrRejected)
+}
+
+func TestLimitsWithoutTemperature(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	// all temperature sensors read out of range
+	sim := newSimulated(t, r, 1, 130, time.Now())
+	p := NewPipeline(&config.PCSConfig{
+		MaxUnhealthyCells: 10,
+		Stations:          []config.PCSStationConfig{{Station: 1}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 5, MaxDischargePower: 5}},
+	}, r.data)
+	require.NoError(t, p.Attach(1, sim))
+
+	summary, _ := r.data.Station(1)
+	assert.Zero(t, summary.TemperatureSensors)
+	limits, err := p.Limits(1)
+	require.NoError(t, err)
+	assert.Equal(t, Limits{Reason: "no healthy temperature sensor"}, limits)
+}
+
+func TestEnforceLimits(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	now := time.Now()
+	sim := newSimulated(t, r, 1, 25, now)
+	p := NewPipeline(&config.PCSConfig{
+		Tolerance: 0.1,
+		Stations:  []config.PCSStationConfig{{Station: 1, Rating: 10}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 5, MaxDischargePower: 5}},
+	}, r.data)
+	require.NoError(t, p.Attach(1, sim))
+	require.NoError(t, p.Start(1))
+
+	running, err := p.Submit(1, -3, 0)
+	require.NoError(t, err)
+	require.NoError(t, sim.Step(now.Add(time.Second)))
+	p.Poll(now.Add(time.Second))
+	running, _ = p.Command(running.ID)
+	assert.Equal(t, CommandAcknowledged, running.State)
+
+	// the cells overheat while the setpoint runs, the jump of their
+	// temperature also flags them unhealthy
+	r.mu.Lock()
+	hot := make([]*data_model.BatteryState, len(r.latest))
+	for i, state := range r.latest {
+		reading := *state
+		reading.Temperature, reading.Timestamp = 60, now.Add(2*time.Second).Unix()
+		hot[i] = &reading
+	}
+	r.mu.Unlock()
+	require.NoError(t, r.Ingest(hot...))
+	pending, err := p.Submit(1, -2, 0)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, CommandRejected, pending.State)
+
+	limits, err := p.Limits(1)
+	require.NoError(t, err)
+	assert.Zero(t, limits.Discharge)
+	p.Poll(now.Add(2 * time.Second))
+	commands, err := p.Commands(1)
+	require.NoError(t, err)
+	clamped := commands[len(commands)-1]
+	assert.Equal(t, CommandPending, clamped.State)
+	assert.Zero(t, clamped.ActivePower)
+	assert.Equal(t, "clamped: "+limits.Reason, clamped.Reason)
+	require.NoError(t, sim.Step(now.Add(3*time.Second)))
+	p.Poll(now.Add(3 * time.Second))
+	clamped, _ = p.Command(clamped.ID)
+	assert.Equal(t, CommandAcknowledged, clamped.State)
+	status, err := p.Status(1)
+	require.NoError(t, err)
+	assert.Zero(t, status.ActivePower)
+
+	// a pending setpoint over the lowered limit is superseded
+	cool := make([]*data_model.BatteryState, len(hot))
+	for i, state := range hot {
+		reading := *state
+		reading.Temperature, reading.Timestamp = 25, now.Add(4*time.Second).Unix()
+		cool[i] = &reading
+	}
+	require.NoError(t, r.Ingest(cool...))
+	pending, err = p.Submit(1, 4, 0)
+	require.NoError(t, err)
+	p.Poll(now.Add(4 * time.Second))
+	pending, _ = p.Command(pending.ID)
+	assert.Equal(t, CommandPending, pending.State)
+	for _, state := range hot {
+		state.Timestamp = now.Add(5 * time.Second).Unix()
+	}
+	require.NoError(t, r.Ingest(hot...))
+	p.Poll(now.Add(5 * time.Second))
+	pending, _ = p.Command(pending.ID)
+	assert.Equal(t, CommandSuperseded, pending.State)
+	limits, _ = p.Limits(1)
+	assert.Zero(t, limits.Charge)
+	assert.Equal(t, limits.Reason, pending.Reason)
+}
+
+func TestBackupReserve(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	now := time.Now()
+	sim := newSimulated(t, r, 1, 25, now)
+	p := NewPipeline(&config.PCSConfig{
+		Tolerance:      0.1,
+		ReconnectDelay: time.Minute,
+		Stations:       []config.PCSStationConfig{{Station: 1, Rating: 10}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MinSOC: 10, BackupReserve: 50}},
+	}, r.data)
+	require.NoError(t, p.Attach(1, sim))
+	require.NoError(t, p.Start(1))
+
+	// the reserve isn't discharged while the grid is available
+	limits, err := p.Limits(1)
+	require.NoError(t, err)
+	assert.Equal(t, Limits{Charge: 10, Reason: "soc 50.0% reached backup reserve 50.0%"}, limits)
+	cmd, err := p.Submit(1, -1, 0)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, "can't discharge: soc 50.0% reached backup reserve 50.0%", cmd.Reason)
+	pending, err := p.Submit(1, 1, 0)
+	require.NoError(t, err)
+	state, err := p.Grid(1)
+	require.NoError(t, err)
+	assert.Equal(t, GridState{}, state)
+
+	// the grid is lost, the pcs forms the grid and supplies the site load
+	sim.SetFaults(FaultGrid)
+	sim.SetLoad(3.2)
+	p.Poll(now)
+	pending, _ = p.Command(pending.ID)
+	assert.Equal(t, CommandSuperseded, pending.State)
+	cmd, err = p.Submit(1, 0, 0)
+	assert.ErrorIs(t, err, ErrRejected)
+	assert.Equal(t, "station islanded", cmd.Reason)
+	require.NoError(t, sim.Step(now.Add(time.Second)))
+	status, err := p.Status(1)
+	require.NoError(t, err)
+	assert.Equal(t, Status{Running: true, GridForming: true, ActivePower: -3.2, Faults: FaultGrid}, status)
+	state, err = p.Grid(1)
+	require.NoError(t, err)
+	assert.True(t, state.Islanded)
+	assert.Equal(t, now, state.Since)
+	// 40% of 3.2kWh above the min soc at 3.2kW
+	assert.InDelta(t, (24 * time.Minute).Seconds(), state.Runtime.Seconds(), 30)
+
+	// the pcs is stopped at the min soc
+	for m := 1; m <= 40 && !state.Exhausted; m++ {
+		require.NoError(t, sim.Step(now.Add(time.Duration(m)*time.Minute)))
+		p.Poll(now.Add(time.Duration(m) * time.Minute))
+		state, err = p.Grid(1)
+		require.NoError(t, err)
+	}
+	summary, _ := r.data.Station(1)
+	assert.LessOrEqual(t, summary.SOC(), 10.0)
+	assert.Greater(t, summary.SOC(), 5.0)
+	assert.True(t, state.Exhausted)
+	status, _ = p.Status(1)
+	assert.False(t, status.Running)
+
+	// the station reconnects once the grid is back for the delay
+	sim.SetFaults(0)
+	p.Poll(now.Add(50 * time.Minute))
+	p.Poll(now.Add(50*time.Minute + 30*time.Second))
+	state, _ = p.Grid(1)
+	assert.True(t, state.Islanded)
+	p.Poll(now.Add(51 * time.Minute))
+	state, _ = p.Grid(1)
+	assert.Equal(t, GridState{}, state)
+	status, _ = p.Status(1)
+	assert.True(t, status.Running)
+	assert.False(t, status.GridForming)
+	_, err = p.Submit(1, 1, 0)
+	assert.NoError(t, err)
+}
+
+func TestGridMeter(t *testing.T) {
+	s := modbus.NewSimulator()
+	require.NoError(t, s.Start("127.0.0.1:0"))
+	defer s.Close()
+	cfg := &config.GridMeterConfig{
+		MeterConfig: config.MeterConfig{Addr: s.Addr(), UnitID: 1},
+		Voltage:     config.ModbusPoint{Table: modbus.TableInput, Type: modbus.TypeFloat32},
+		MinVoltage:  200,
+	}
+	require.NoError(t, s.SetPoint(1, &cfg.Voltage, 0, 230))
+	m := NewGridMeter(cfg)
+	defer m.Close()
+
+	available, err := m.GridAvailable()
+	require.NoError(t, err)
+	assert.True(t, available)
+	require.NoError(t, s.SetPoint(1, &cfg.Voltage, 0, 0))
+	available, err = m.GridAvailable()
+	require.NoError(t, err)
+	assert.False(t, available)
+}
+
+func TestFaultString(t *testing.T) {
+	assert.Equal(t, "none", Fault(0).String())
+	assert.Equal(t, "over_temperature|dc_under_voltage", (FaultOverTemperature | FaultDCUnderVoltage).String())
+	assert.Equal(t, "grid|0x8000", (FaultGrid | 1<<15).String())
+}
+
+func TestModbus(t *testing.T) {
+	s := modbus.NewSimulator()
+	require.NoError(t, s.Start("127.0.0.1:0"))
+	defer s.Close()
+	s.SetHoldingRegisters(1, 0, 0)
+
+	cfg := &config.PCSModbusConfig{
+		Addr:                  s.Addr(),
+		UnitID:                1,
+		ActivePower:           config.ModbusPoint{Address: 0, Type: modbus.TypeInt32, Scale: 0.1},
+		ReactivePower:         config.ModbusPoint{Address: 2, Type: modbus.TypeInt16, Scale: 0.1},
+		Run:                   config.ModbusPoint{Address: 3},
+		GridForming:           config.ModbusPoint{Address: 4},
+		ActivePowerFeedback:   config.ModbusPoint{Table: modbus.TableInput, Address: 0, Type: modbus.TypeFloat32},
+		ReactivePowerFeedback: config.ModbusPoint{Table: modbus.TableInput, Address: 2, Type: modbus.TypeFloat32},
+		Running:               config.ModbusPoint{Table: modbus.TableInput, Address: 4},
+		Faults:                config.ModbusPoint{Table: modbus.TableInput, Address: 5},
+	}
+	m := NewModbus(cfg)
+	defer m.Close()
+
+	require.NoError(t, m.SetActivePower(-250.5))
+	require.NoError(t, m.SetReactivePower(12.3))
+	require.NoError(t, m.Start())
+	require.NoError(t, m.SetGridForming(true))
+	regs := s.HoldingRegisters(1, 0, 5)
+	active, err := modbus.DecodeValue(&cfg.ActivePower, regs[:2])
+	require.NoError(t, err)
+	assert.InDelta(t, -250.5, active, 1e-9)
+	reactive, err := modbus.DecodeValue(&cfg.ReactivePower, regs[2:3])
+	require.NoError(t, err)
+	assert.InDelta(t, 12.3, reactive, 1e-9)
+	assert.Equal(t, uint16(1), regs[3])
+	assert.Equal(t, uint16(1), regs[4])
+
+	require.NoError(t, s.SetPoint(1, &cfg.ActivePowerFeedback, 0, -250.5))
+	require.NoError(t, s.SetPoint(1, &cfg.ReactivePowerFeedback, 2, 12.25))
+	s.SetInputRegisters(1, 4, 1, uint16(FaultOverCurrent))
+	status, err := m.Status()
+	require.NoError(t, err)
+	assert.Equal(t, Status{Running: true, GridForming: true, ActivePower: -250.5, ReactivePower: 12.25, Faults: FaultOverCurrent}, status)
+
+	require.NoError(t, m.Stop())
+	assert.Equal(t, []uint16{0}, s.HoldingRegisters(1, 3, 1))
+
+	// input registers can't be written
+	cfg.ActivePower.Table = modbus.TableInput
+	assert.Error(t, m.SetActivePower(1))
+	// the client reconnects after a failed request
+	assert.NoError(t, m.Start())
+}
+
+func TestReserveWhileDischarging(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	now := time.Now()
+	sim := newSimulated(t, r, 1, 25, now)
+	p := NewPipeline(&config.PCSConfig{
+		Tolerance: 0.1,
+		Stations:  []config.PCSStationConfig{{Station: 1, Rating: 10}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MinSOC: 10, BackupReserve: 40}},
+	}, r.data)
+	require.NoError(t, p.Attach(1, sim))
+	require.NoError(t, p.Start(1))
+
+	// the discharge validated above the reserve runs down to it
+	_, err := p.Submit(1, -3, 0)
+	require.NoError(t, err)
+	var status Status
+	for s := 1; s <= 60*60; s += 10 {
+		at := now.Add(time.Duration(s) * time.Second)
+		require.NoError(t, sim.Step(at))
+		p.Poll(at)
+		status, err = p.Status(1)
+		require.NoError(t, err)
+		if status.ActivePower == 0 {
+			break
+		}
+	}
+	assert.Zero(t, status.ActivePower)
+	summary, _ := r.data.Station(1)
+	assert.LessOrEqual(t, summary.SOC(), 40.0)
+	assert.Greater(t, summary.SOC(), 39.0)
+	commands, err := p.Commands(1)
+	require.NoError(t, err)
+	require.Len(t, commands, 2)
+	assert.Zero(t, commands[1].ActivePower)
+	assert.Contains(t, commands[1].Reason, "clamped: soc")
+	assert.Contains(t, commands[1].Reason, "reached backup reserve 40.0%")
+
+	// it stays within the reserve
+	require.NoError(t, sim.Step(now.Add(2*time.Hour)))
+	p.Poll(now.Add(2 * time.Hour))
+	status, _ = p.Status(1)
+	assert.Zero(t, status.ActivePower)
+	after, _ := r.data.Station(1)
+	assert.Greater(t, after.SOC(), 39.0)
+}
+
+// shedder records the shedding of the loads.
+type shedder struct {
+	shed []bool
+}
+
+func (s *shedder) ShedLoads(on bool) error {
+	s.shed = append(s.shed, on)
+	return nil
+}
+
+func TestCriticalLoad(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	now := time.Now()
+	sim := newSimulated(t, r, 1, 25, now)
+	p := NewPipeline(&config.PCSConfig{
+		ReconnectDelay: time.Minute,
+		Stations:       []config.PCSStationConfig{{Station: 1, Rating: 10, CriticalLoad: 2}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MinSOC: 10}},
+	}, r.data)
+	require.NoError(t, p.Attach(1, sim))
+	loads := &shedder{}
+	require.NoError(t, p.SetLoadShedder(1, loads))
+	assert.ErrorIs(t, p.SetLoadShedder(2, loads), ErrUnknownStation)
+
+	// the critical loads are supplied
+	sim.SetFaults(FaultGrid)
+	sim.SetLoad(1.5)
+	p.Poll(now)
+	require.NoError(t, sim.Step(now.Add(time.Second)))
+	p.Poll(now.Add(time.Second))
+	state, err := p.Grid(1)
+	require.NoError(t, err)
+	assert.True(t, state.Islanded)
+	assert.False(t, state.Shedding)
+	assert.Empty(t, loads.shed)
+
+	// the site load over the critical load sheds the other loads until
+	// the grid is back
+	sim.SetLoad(3)
+	require.NoError(t, sim.Step(now.Add(2*time.Second)))
+	p.Poll(now.Add(2 * time.Second))
+	state, _ = p.Grid(1)
+	assert.True(t, state.Shedding)
+	sim.SetLoad(1.5)
+	require.NoError(t, sim.Step(now.Add(3*time.Second)))
+	p.Poll(now.Add(3 * time.Second))
+	state, _ = p.Grid(1)
+	assert.True(t, state.Shedding)
+	assert.Equal(t, []bool{true}, loads.shed)
+
+	sim.SetFaults(0)
+	p.Poll(now.Add(4 * time.Second))
+	p.Poll(now.Add(2 * time.Minute))
+	state, _ = p.Grid(1)
+	assert.Equal(t, GridState{}, state)
+	assert.Equal(t, []bool{true, false}, loads.shed)
+}
+
+func TestDefaultSOCLimits(t *testing.T) {
+	r := &recorder{data: data_model.NewBatteriesData(data_model.DefaultDataShardCnt)}
+	now := time.Now()
+	for station, soc := range map[int]float64{1: 95, 2: 5} {
+		var cells []data_model.BatteryState
+		for cell := 1; cell <= 10; cell++ {
+			cells = append(cells, data_model.BatteryState{
+				Station: station, Container: 1, Pack: 1, Cell: cell,
+				SOC: soc, MaxCapacity: 100, Temperature: 25,
+			})
+		}
+		require.NoError(t, NewSimulated(cells, r, 0).Step(now))
+	}
+
+	// the soc limits default to the ones the energy management plans with
+	p := NewPipeline(&config.PCSConfig{
+		Stations: []config.PCSStationConfig{{Station: 1, Rating: 10}, {Station: 2, Rating: 10}},
+	}, &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1}},
+	}, r.data)
+	limits, err := p.Limits(1)
+	require.NoError(t, err)
+	assert.Zero(t, limits.Charge)
+	assert.Contains(t, limits.Reason, fmt.Sprintf("reached max %.1f%%", float64(energymanagement.DefaultMaxSOC)))
+	limits, err = p.Limits(2)
+	require.NoError(t, err)
+	assert.Zero(t, limits.Discharge)
+	assert.Contains(t, limits.Reason, fmt.Sprintf("reached min %.1f%%", float64(energymanagement.DefaultMinSOC)))
+}
@@ -0,0 +1,209 @@
+package pcs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/batterymanagement/state_of_charge/soc"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/modbus"
+	"go.uber.org/zap"
+)
+
+// Simulated is a simulated PCS driving simulated cells. The active power
+// is split evenly over the cells, the resulting currents integrate into
+// their soc and their voltage follows the open circuit voltage of the soc.
+// The cell readings are fed to the ingester on every step. Forming the grid
+// it supplies the simulated site load. It models the cells itself instead
+// of driving the mock sensors of pkg/simulation, those don't build and
+// draw random states unrelated to any power.
+type Simulated struct {
+	ingester modbus.Ingester
+	// delay is the response time of the PCS to a new setpoint
+	delay time.Duration
+
+	mu          sync.Mutex
+	cells       []data_model.BatteryState
+	running     bool
+	gridForming bool
+	load        float64
+	faults      Fault
+	setActive   float64
+	setReactive float64
+	setAt       time.Time
+	active      float64
+	reactive    float64
+	last        time.Time
+}
+
+// NewSimulated creates a new simulated PCS of the cells, their voltage,
+// current and state are derived from their SOC and MaxCapacity. The PCS
+// follows a new setpoint after delay.
+func NewSimulated(cells []data_model.BatteryState, ingester modbus.Ingester, delay time.Duration) *Simulated {
+	s := &Simulated{ingester: ingester, delay: delay, cells: make([]data_model.BatteryState, len(cells))}
+	copy(s.cells, cells)
+	for i := range s.cells {
+		s.cells[i].Current = 0
+		s.cells[i].State = data_model.Idle
+		s.cells[i].Voltage = openCircuitVoltage(s.cells[i].SOC)
+	}
+	return s
+}
+
+// openCircuitVoltage is the voltage of a cell at the soc, the inverse of
+// the default discharge curve.
+func openCircuitVoltage(s float64) float64 {
+	switch {
+	case s >= 90:
+		return soc.DisLiMidHighVoltage + (s-90)/10*(soc.DisLiMaxVoltage-soc.DisLiMidHighVoltage)
+	case s >= 10:
+		return soc.DisLiMidLowVoltage + (s-10)/80*(soc.DisLiMidHighVoltage-soc.DisLiMidLowVoltage)
+	default:
+		return soc.DisLiMinVoltage + s/10*(soc.DisLiMidLowVoltage-soc.DisLiMinVoltage)
+	}
+}
+
+// SetFaults sets the faults of the PCS, a faulted PCS stops converting
+// unless the grid is lost and it forms the grid.
+func (s *Simulated) SetFaults(faults Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = faults
+}
+
+// SetLoad sets the site load in kW supplied when forming the grid.
+func (s *Simulated) SetLoad(load float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.load = load
+}
+
+// faulted reports whether the faults stop the PCS.
+func (s *Simulated) faulted() bool {
+	faults := s.faults
+	if s.gridForming {
+		faults &^= FaultGrid
+	}
+	return faults != 0
+}
+
+// SetActivePower implements PCS.
+func (s *Simulated) SetActivePower(power float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setActive, s.setAt = power, time.Now()
+	return nil
+}
+
+// SetReactivePower implements PCS.
+func (s *Simulated) SetReactivePower(power float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setReactive, s.setAt = power, time.Now()
+	return nil
+}
+
+// Start implements PCS.
+func (s *Simulated) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.faulted() {
+		return errors.New("pcs faulted")
+	}
+	s.running = true
+	return nil
+}
+
+// Stop implements PCS.
+func (s *Simulated) Stop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running = false
+	return nil
+}
+
+// SetGridForming implements PCS.
+func (s *Simulated) SetGridForming(on bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gridForming = on
+	return nil
+}
+
+// Status implements PCS.
+func (s *Simulated) Status() (Status, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return Status{
+		Running:       s.running,
+		GridForming:   s.gridForming,
+		ActivePower:   s.active,
+		ReactivePower: s.reactive,
+		Faults:        s.faults,
+	}, nil
+}
+
+// Step advances the simulation to now and ingests the cell readings.
+func (s *Simulated) Step(now time.Time) error {
+	s.mu.Lock()
+	if s.faulted() {
+		s.running = false
+	}
+	// the powers of the previous step drove the cells until now
+	if !s.last.IsZero() && now.After(s.last) {
+		hours := now.Sub(s.last).Hours()
+		for i := range s.cells {
+			c := &s.cells[i]
+			if c.MaxCapacity > 0 {
+				c.SOC = min(max(c.SOC+c.Current*hours/c.MaxCapacity*100, 0), 100)
+			}
+		}
+	}
+	s.last = now
+
+	s.active, s.reactive = 0, 0
+	switch {
+	case s.running && s.gridForming:
+		s.active = -s.load
+	case s.running && now.Sub(s.setAt) >= s.delay:
+		s.active, s.reactive = s.setActive, s.setReactive
+	}
+	// a full battery can't charge and an empty one can't discharge
+	for _, c := range s.cells {
+		if s.active > 0 && c.SOC >= 100 || s.active < 0 && c.SOC <= 0 {
+			s.active = 0
+		}
+	}
+
+	states := make([]*data_model.BatteryState, len(s.cells))
+	for i := range s.cells {
+		c := &s.cells[i]
+		c.Voltage = openCircuitVoltage(c.SOC)
+		c.Current = s.active * 1000 / float64(len(s.cells)) / c.Voltage
+		c.State = data_model.StateOf(c.Current)
+		c.Timestamp = now.Unix()
+		state := *c
+		states[i] = &state
+	}
+	s.mu.Unlock()
+	return s.ingester.Ingest(states...)
+}
+
+// Run steps the simulation every interval until ctx is done.
+func (s *Simulated) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := s.Step(now); err != nil {
+				log.Warn("failed to ingest simulated readings", zap.Int("cells", len(s.cells)), zap.Error(err))
+			}
+		}
+	}
+}
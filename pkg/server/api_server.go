@@ -0,0 +1,387 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/auth"
+	"github.com/zhangjinpeng87/openbms/pkg/batterymanagement/grading"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/energymanagement"
+	"go.uber.org/zap"
+)
+
+// APIServer is an HTTP server exposing the live batteries data.
+type APIServer struct {
+	c         *config.ServerConfig
+	data      *data_model.BatteriesData
+	scheduler *energymanagement.Scheduler
+	firming   map[int]*energymanagement.Firming
+	fleet     *energymanagement.Dispatcher
+	shaving   map[int]*energymanagement.PeakShaving
+	grader    *grading.Grader
+	auth      *auth.Authenticator
+
+	l   net.Listener
+	srv *http.Server
+}
+
+// NewAPIServer creates a new APIServer.
+func NewAPIServer(cfg *config.ServerConfig, data *data_model.BatteriesData) *APIServer {
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+	return &APIServer{c: cfg, data: data}
+}
+
+// SetAuthenticator requires an operator token for the control endpoints,
+// which put forecasts, measurements, setpoints and intake tests. Without
+// it they reject every request. It must be called before Start.
+func (s *APIServer) SetAuthenticator(a *auth.Authenticator) {
+	s.auth = a
+}
+
+// SetScheduler enables the forecast and schedule endpoints, it must be
+// called before Start.
+func (s *APIServer) SetScheduler(scheduler *energymanagement.Scheduler) {
+	s.scheduler = scheduler
+}
+
+// SetFirming enables the generation endpoint of the firming stations, it
+// must be called before Start.
+func (s *APIServer) SetFirming(firming ...*energymanagement.Firming) {
+	s.firming = make(map[int]*energymanagement.Firming, len(firming))
+	for _, f := range firming {
+		s.firming[f.Station()] = f
+	}
+}
+
+// SetDispatcher enables the fleet endpoints, it must be called before
+// Start.
+func (s *APIServer) SetDispatcher(fleet *energymanagement.Dispatcher) {
+	s.fleet = fleet
+}
+
+// SetPeakShaving enables the peak shaving report of the stations, it must
+// be called before Start.
+func (s *APIServer) SetPeakShaving(shaving ...*energymanagement.PeakShaving) {
+	s.shaving = make(map[int]*energymanagement.PeakShaving, len(shaving))
+	for _, p := range shaving {
+		s.shaving[p.Station()] = p
+	}
+}
+
+// SetGrader enables the intake grading of second-life modules, it must be
+// called before Start.
+func (s *APIServer) SetGrader(grader *grading.Grader) {
+	s.grader = grader
+}
+
+// Start starts the server.
+func (s *APIServer) Start() error {
+	l, err := net.Listen("tcp", net.JoinHostPort(s.c.Host, strconv.Itoa(s.c.Port)))
+	if err != nil {
+		return fmt.Errorf("failed to create listener: %w", err)
+	}
+	s.l = l
+
+	r := mux.NewRouter()
+	r.HandleFunc("/health/cells", s.handleUnhealthyCells).Methods(http.MethodGet)
+	r.HandleFunc("/health/cells/{station:[0-9]+}/{container:[0-9]+}/{pack:[0-9]+}/{cell:[0-9]+}", s.handleCellHealth).Methods(http.MethodGet)
+	r.HandleFunc("/stats/gateways", s.handleGatewayStats).Methods(http.MethodGet)
+	r.HandleFunc("/remaining-time/{station:[0-9]+}", s.handleRemainingTime).Methods(http.MethodGet)
+	if s.scheduler != nil {
+		r.HandleFunc("/forecasts/{kind:demand|price|generation|commitment}", s.operator(s.handlePutForecast)).Methods(http.MethodPut)
+		r.HandleFunc("/schedules/{station:[0-9]+}", s.handleSchedule).Methods(http.MethodGet)
+	}
+	if s.firming != nil {
+		r.HandleFunc("/firming/{station:[0-9]+}/generation", s.operator(s.handleGeneration)).Methods(http.MethodPost)
+	}
+	if s.fleet != nil {
+		r.HandleFunc("/fleet/setpoint", s.operator(s.handleFleetSetpoint)).Methods(http.MethodPut)
+		r.HandleFunc("/fleet/dispatch", s.handleFleetDispatch).Methods(http.MethodGet)
+	}
+	if s.shaving != nil {
+		r.HandleFunc("/peak-shaving/{station:[0-9]+}", s.handlePeakShaving).Methods(http.MethodGet)
+	}
+	if s.grader != nil {
+		r.HandleFunc("/grading/intake", s.operator(s.handleIntake)).Methods(http.MethodPost)
+	}
+	s.srv = &http.Server{Handler: r}
+
+	go func() {
+		if err := s.srv.Serve(s.l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("api server stopped", zap.Error(err))
+		}
+	}()
+	log.Info("api server started", zap.String("addr", s.l.Addr().String()))
+	return nil
+}
+
+// Stop stops the server.
+func (s *APIServer) Stop() error {
+	if s.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// Addr returns the address the server listens on.
+func (s *APIServer) Addr() net.Addr {
+	return s.l.Addr()
+}
+
+// operator wraps a control endpoint, requests without valid credentials get
+// 401, and requests of identities which are not operators get 403. The body
+// is limited to MaxBodySize.
+func (s *APIServer) operator(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.auth == nil {
+			http.Error(w, "operator authentication is not configured", http.StatusForbidden)
+			return
+		}
+		_, err := s.auth.AuthenticateOperator(r)
+		if errors.Is(err, auth.ErrUnauthenticated) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, s.c.MaxBodySize)
+		h(w, r)
+	}
+}
+
+// badBody replies 413 if the body is over MaxBodySize, else 400 with msg.
+func badBody(w http.ResponseWriter, err error, msg string) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	http.Error(w, msg, http.StatusBadRequest)
+}
+
+// handleUnhealthyCells lists the cells with a faulty sensor.
+func (s *APIServer) handleUnhealthyCells(w http.ResponseWriter, r *http.Request) {
+	cells := s.data.UnhealthyCells()
+	if cells == nil {
+		cells = []data_model.CellHealth{}
+	}
+	writeJSON(w, cells)
+}
+
+// handleCellHealth returns the health of a cell, 404 if it never reported.
+func (s *APIServer) handleCellHealth(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var ids [4]int
+	for i, name := range []string{"station", "container", "pack", "cell"} {
+		id, err := strconv.Atoi(vars[name])
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ids[i] = id
+	}
+	health, ok := s.data.CellHealth(ids[0], ids[1], ids[2], ids[3])
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, health)
+}
+
+// handleGatewayStats returns the reorder stats by gateway.
+func (s *APIServer) handleGatewayStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.data.GatewayStats())
+}
+
+// handleRemainingTime returns the time until the station, its containers
+// and their packs are full or empty, 404 for an unknown station.
+func (s *APIServer) handleRemainingTime(w http.ResponseWriter, r *http.Request) {
+	station, err := strconv.Atoi(mux.Vars(r)["station"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	remaining, ok := s.data.RemainingTime(station)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, remaining)
+}
+
+// handlePutForecast replaces the forecast of the kind, the body is CSV if
+// its content type is text/csv, else a JSON array of points. The station
+// query parameter restricts it to a station.
+func (s *APIServer) handlePutForecast(w http.ResponseWriter, r *http.Request) {
+	kind := energymanagement.ForecastKind(mux.Vars(r)["kind"])
+	var station int
+	if v := r.URL.Query().Get("station"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "invalid station", http.StatusBadRequest)
+			return
+		}
+		station = id
+	}
+
+	var f *energymanagement.Forecast
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		var err error
+		if f, err = energymanagement.ParseForecastCSV(r.Body, kind, time.Local); err != nil {
+			badBody(w, err, err.Error())
+			return
+		}
+	} else {
+		f = &energymanagement.Forecast{Kind: kind}
+		if err := json.NewDecoder(r.Body).Decode(&f.Points); err != nil {
+			badBody(w, err, err.Error())
+			return
+		}
+	}
+	f.Station = station
+	if err := s.scheduler.SetForecast(f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSchedule plans the station from now.
+func (s *APIServer) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	station, err := strconv.Atoi(mux.Vars(r)["station"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	schedule, err := s.scheduler.Schedule(station, time.Now())
+	switch {
+	case errors.Is(err, energymanagement.ErrUnknownStation), errors.Is(err, energymanagement.ErrNoStationData):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, energymanagement.ErrNoForecast):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	default:
+		writeJSON(w, schedule)
+	}
+}
+
+// handleFleetSetpoint splits the fleet setpoint, the body is {"power": kW},
+// and returns the split.
+func (s *APIServer) handleFleetSetpoint(w http.ResponseWriter, r *http.Request) {
+	var setpoint struct {
+		Power *float64 `json:"power"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&setpoint); err != nil || setpoint.Power == nil {
+		badBody(w, err, "invalid setpoint")
+		return
+	}
+	writeJSON(w, s.fleet.Dispatch(time.Now(), *setpoint.Power))
+}
+
+// handleFleetDispatch returns the latest split, 404 if none.
+func (s *APIServer) handleFleetDispatch(w http.ResponseWriter, r *http.Request) {
+	dispatch := s.fleet.Latest()
+	if dispatch == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, dispatch)
+}
+
+// handleGeneration runs a firming step with the measured generation of the
+// station, the body is {"power": kW}, and returns the command.
+func (s *APIServer) handleGeneration(w http.ResponseWriter, r *http.Request) {
+	station, err := strconv.Atoi(mux.Vars(r)["station"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	f, ok := s.firming[station]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var measurement struct {
+		Power *float64 `json:"power"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&measurement); err != nil || measurement.Power == nil {
+		badBody(w, err, "invalid measurement")
+		return
+	}
+	cmd, err := f.Step(time.Now(), *measurement.Power)
+	switch {
+	case errors.Is(err, energymanagement.ErrNoStationData):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		writeJSON(w, cmd)
+	}
+}
+
+// handlePeakShaving returns the billing window of the station and the
+// demand charge savings, 404 before the first step.
+func (s *APIServer) handlePeakShaving(w http.ResponseWriter, r *http.Request) {
+	station, err := strconv.Atoi(mux.Vars(r)["station"])
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	p, ok := s.shaving[station]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	report := p.Report()
+	if report == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, report)
+}
+
+// handleIntake grades the modules of the JSON array of intake tests and
+// returns their tiers and recommended groups.
+func (s *APIServer) handleIntake(w http.ResponseWriter, r *http.Request) {
+	var tests []grading.Test
+	if err := json.NewDecoder(r.Body).Decode(&tests); err != nil || len(tests) == 0 {
+		badBody(w, err, "invalid tests")
+		return
+	}
+	report, err := s.grader.Grade(tests)
+	if errors.Is(err, grading.ErrInvalidTest) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, report)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("failed to write response", zap.Error(err))
+	}
+}
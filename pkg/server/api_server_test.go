@@ -0,0 +1,351 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/batterymanagement/grading"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/energymanagement"
+)
+
+// startAPIServer starts the server until the end of the test.
+func startAPIServer(t *testing.T, s *APIServer) {
+	require.NoError(t, s.Start())
+	t.Cleanup(func() {
+		// a connection dialed but never used delays the shutdown
+		http.DefaultClient.CloseIdleConnections()
+		s.Stop()
+	})
+}
+
+// operatorRequest sends the request with the operator token of
+// testAuthenticator.
+func operatorRequest(t *testing.T, method, url, contentType, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Authorization", "Bearer operator:secret-op")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestAPIServer(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	data.Update(&data_model.BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 4, Voltage: 3.3, Temperature: 25, Gateway: "gw-1"})
+	data.Update(&data_model.BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 5, Voltage: 0.1, Temperature: 25, Gateway: "gw-1"})
+	data.Update(&data_model.BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 5, Voltage: 0.1, Temperature: 25, Gateway: "gw-1"})
+
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	startAPIServer(t, s)
+	get := func(path string, v any) int {
+		resp, err := http.Get("http://" + s.Addr().String() + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(v))
+		}
+		return resp.StatusCode
+	}
+
+	var cells []map[string]any
+	require.Equal(t, http.StatusOK, get("/health/cells", &cells))
+	require.Len(t, cells, 1)
+	assert.Equal(t, 5.0, cells[0]["cell"])
+	assert.Equal(t, "implausible", cells[0]["voltage"])
+	assert.NotContains(t, cells[0], "temperature")
+
+	var health map[string]any
+	require.Equal(t, http.StatusOK, get("/health/cells/1/2/3/4", &health))
+	assert.NotContains(t, health, "voltage")
+	assert.Equal(t, http.StatusNotFound, get("/health/cells/1/2/3/6", nil))
+
+	var stats map[string]data_model.ReorderStats
+	require.Equal(t, http.StatusOK, get("/stats/gateways", &stats))
+	assert.Equal(t, data_model.ReorderStats{Applied: 2, Duplicates: 1}, stats["gw-1"])
+}
+
+func TestAPIServerRemainingTime(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	data.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.35, Current: -50, Temperature: 25, MaxCapacity: 100})
+	data.ReCalculate()
+
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	startAPIServer(t, s)
+	resp, err := http.Get("http://" + s.Addr().String() + "/remaining-time/1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var remaining data_model.StationRemainingTime
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&remaining))
+	assert.Equal(t, 1, remaining.Station)
+	assert.InDelta(t, 1, remaining.TimeToEmpty, 1e-6)
+	assert.Zero(t, remaining.TimeToFull)
+	require.Len(t, remaining.Containers, 1)
+	require.Len(t, remaining.Containers[0].Packs, 1)
+	assert.InDelta(t, 1, remaining.Containers[0].Packs[0].TimeToEmpty, 1e-6)
+
+	resp, err = http.Get("http://" + s.Addr().String() + "/remaining-time/2")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAPIServerIntake(t *testing.T) {
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data_model.NewBatteriesData(data_model.DefaultDataShardCnt))
+	s.SetGrader(grading.NewGrader(&config.GradingConfig{GroupSize: 2}, nil))
+	s.SetAuthenticator(testAuthenticator(t, io.Discard))
+	startAPIServer(t, s)
+	post := func(body string) *http.Response {
+		resp := operatorRequest(t, http.MethodPost, "http://"+s.Addr().String()+"/grading/intake", "application/json", body)
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	resp := post(`[
+		{"serial": "a", "rated_capacity": 100, "capacity": 90, "pulse_current": 100, "pulse_voltage_drop": 0.1, "rest_voltage_drop": 2, "rest_hours": 24},
+		{"serial": "b", "rated_capacity": 100, "capacity": 88, "pulse_current": 100, "pulse_voltage_drop": 0.1, "rest_voltage_drop": 2, "rest_hours": 24},
+		{"serial": "c", "rated_capacity": 100, "capacity": 40, "pulse_current": 100, "pulse_voltage_drop": 0.3, "rest_voltage_drop": 2, "rest_hours": 24}
+	]`)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report grading.Report
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	require.Len(t, report.Modules, 3)
+	assert.Equal(t, 1, report.Modules[0].Tier)
+	assert.Zero(t, report.Modules[2].Tier)
+	require.Len(t, report.Groups, 1)
+	assert.Equal(t, []string{"a", "b"}, report.Groups[0].Serials)
+
+	assert.Equal(t, http.StatusBadRequest, post(`[{"serial": "a"}]`).StatusCode)
+	assert.Equal(t, http.StatusBadRequest, post(`[]`).StatusCode)
+}
+
+func TestAPIServerSchedule(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	data.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.35, Temperature: 25, MaxCapacity: 1000})
+	data.ReCalculate()
+	cfg := &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 1, MaxDischargePower: 1}},
+	}
+
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	s.SetScheduler(energymanagement.NewScheduler(cfg, data))
+	s.SetAuthenticator(testAuthenticator(t, io.Discard))
+	startAPIServer(t, s)
+	url := "http://" + s.Addr().String()
+	put := func(path, contentType, body string) int {
+		resp := operatorRequest(t, http.MethodPut, url+path, contentType, body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	resp, err := http.Get(url + "/schedules/1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	now := time.Now().Truncate(time.Hour)
+	var csv strings.Builder
+	csv.WriteString("time,price\n")
+	for i := 0; i < 24; i++ {
+		price := 0.1
+		if i >= 12 {
+			price = 0.4
+		}
+		fmt.Fprintf(&csv, "%s,%g\n", now.Add(time.Duration(i)*time.Hour).Format(time.RFC3339), price)
+	}
+	assert.Equal(t, http.StatusNoContent, put("/forecasts/price", "text/csv", csv.String()))
+	assert.Equal(t, http.StatusBadRequest, put("/forecasts/price", "text/csv", "time,price\n"))
+	assert.Equal(t, http.StatusBadRequest, put("/forecasts/demand?station=x", "application/json", "[]"))
+	assert.Equal(t, http.StatusNoContent, put("/forecasts/demand?station=1", "application/json",
+		`[{"time":"`+now.Format(time.RFC3339)+`","value":1}]`))
+
+	resp, err = http.Get(url + "/schedules/1")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var schedule energymanagement.Schedule
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&schedule))
+	assert.Equal(t, energymanagement.ForecastPrice, schedule.Kind)
+	require.Len(t, schedule.Slots, 24)
+	assert.Greater(t, schedule.Slots[0].Power, 0.0)
+	assert.Less(t, schedule.Slots[23].Power, 0.0)
+
+	resp, err = http.Get(url + "/schedules/2")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+// commanded records the commanded power.
+type commanded map[int]float64
+
+func (c commanded) SetPower(station int, power float64) error {
+	c[station] = power
+	return nil
+}
+
+func TestAPIServerFirming(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	data.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.35, Temperature: 25, MaxCapacity: 1000})
+	data.ReCalculate()
+	cfg := &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 1, MaxDischargePower: 1}},
+	}
+	scheduler := energymanagement.NewScheduler(cfg, data)
+	require.NoError(t, scheduler.SetForecast(&energymanagement.Forecast{
+		Kind: energymanagement.ForecastCommitment, Station: 1,
+		Points: []energymanagement.Point{{Time: time.Now().Add(-time.Minute), Value: 3}, {Time: time.Now().Add(time.Hour), Value: 3}},
+	}))
+	commands := commanded{}
+	firming, err := energymanagement.NewFirming(&config.FirmingConfig{Station: 1}, scheduler, commands)
+	require.NoError(t, err)
+
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	s.SetFirming(firming)
+	s.SetAuthenticator(testAuthenticator(t, io.Discard))
+	startAPIServer(t, s)
+	post := func(path, body string) *http.Response {
+		return operatorRequest(t, http.MethodPost, "http://"+s.Addr().String()+path, "application/json", body)
+	}
+
+	resp := post("/firming/1/generation", `{"power": 3.5}`)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var cmd energymanagement.FirmingCommand
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&cmd))
+	assert.InDelta(t, 0.5, cmd.Power, 1e-9)
+	assert.InDelta(t, 3, cmd.Output, 1e-9)
+	assert.InDelta(t, 0.5, commands[1], 1e-9)
+
+	resp = post("/firming/1/generation", `{}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = post("/firming/2/generation", `{"power": 1}`)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAPIServerPeakShaving(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	data.Update(&data_model.BatteryState{Station: 1, Container: 1, Pack: 1, Cell: 1, Voltage: 3.35, Temperature: 25, MaxCapacity: 1000})
+	data.ReCalculate()
+	cfg := &config.EnergyManagementConfig{
+		Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 1, MaxDischargePower: 1}},
+	}
+	scheduler := energymanagement.NewScheduler(cfg, data)
+	shaving, err := energymanagement.NewPeakShaving(&config.PeakShavingConfig{Station: 1, Target: 5, DemandCharge: 10}, scheduler, commanded{}, nil)
+	require.NoError(t, err)
+
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	s.SetPeakShaving(shaving)
+	startAPIServer(t, s)
+	get := func(path string) *http.Response {
+		resp, err := http.Get("http://" + s.Addr().String() + path)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := get("/peak-shaving/1")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	_, err = shaving.Step(time.Now(), 5.5)
+	require.NoError(t, err)
+	resp = get("/peak-shaving/1")
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var report energymanagement.PeakShavingReport
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&report))
+	assert.Equal(t, 1, report.Station)
+	assert.InDelta(t, 5, report.Window.Target, 1e-9)
+
+	resp = get("/peak-shaving/2")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAPIServerFleet(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	for station := 1; station <= 2; station++ {
+		data.Update(&data_model.BatteryState{Station: station, Container: 1, Pack: 1, Cell: 1, Voltage: 3.35, Temperature: 25, MaxCapacity: 1000})
+	}
+	data.ReCalculate()
+	cfg := &config.EnergyManagementConfig{Stations: []config.StationEnergyConfig{
+		{ID: 1, MaxChargePower: 1, MaxDischargePower: 1},
+		{ID: 2, MaxChargePower: 1, MaxDischargePower: 1},
+	}}
+	commands := commanded{}
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	s.SetDispatcher(energymanagement.NewDispatcher(&cfg.Fleet, energymanagement.NewScheduler(cfg, data), commands))
+	s.SetAuthenticator(testAuthenticator(t, io.Discard))
+	startAPIServer(t, s)
+	url := "http://" + s.Addr().String()
+
+	resp, err := http.Get(url + "/fleet/dispatch")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp = operatorRequest(t, http.MethodPut, url+"/fleet/setpoint", "application/json", `{"power": -1.5}`)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, commanded{1: -0.75, 2: -0.75}, commands)
+
+	resp, err = http.Get(url + "/fleet/dispatch")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var dispatch energymanagement.FleetDispatch
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&dispatch))
+	assert.Equal(t, -1.5, dispatch.Setpoint)
+	require.Len(t, dispatch.Stations, 2)
+	assert.Contains(t, dispatch.Stations[0].Reason, "kWh available")
+}
+
+func TestAPIServerOperator(t *testing.T) {
+	data := data_model.NewBatteriesData(data_model.DefaultDataShardCnt)
+	cfg := &config.EnergyManagementConfig{Stations: []config.StationEnergyConfig{{ID: 1, MaxChargePower: 1, MaxDischargePower: 1}}}
+	commands := commanded{}
+	dispatcher := energymanagement.NewDispatcher(&cfg.Fleet, energymanagement.NewScheduler(cfg, data), commands)
+	put := func(s *APIServer, token, body string) int {
+		req, err := http.NewRequest(http.MethodPut, "http://"+s.Addr().String()+"/fleet/setpoint", strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// the control endpoints are closed without an authenticator
+	s := NewAPIServer(&config.ServerConfig{Host: "127.0.0.1"}, data)
+	s.SetDispatcher(dispatcher)
+	startAPIServer(t, s)
+	assert.Equal(t, http.StatusForbidden, put(s, "operator:secret-op", `{"power": 1}`))
+
+	var audit lockedBuffer
+	s = NewAPIServer(&config.ServerConfig{Host: "127.0.0.1", MaxBodySize: 64}, data)
+	s.SetDispatcher(dispatcher)
+	s.SetAuthenticator(testAuthenticator(t, &audit))
+	startAPIServer(t, s)
+	assert.Equal(t, http.StatusUnauthorized, put(s, "", `{"power": 1}`))
+	assert.Equal(t, http.StatusUnauthorized, put(s, "operator:wrong", `{"power": 1}`))
+	// a gateway can't command the fleet
+	assert.Equal(t, http.StatusForbidden, put(s, "gw-1:secret", `{"power": 1}`))
+	assert.Contains(t, audit.String(), "not an operator for /fleet/setpoint")
+	assert.Equal(t, http.StatusRequestEntityTooLarge, put(s, "operator:secret-op", `{"power": 1`+strings.Repeat(" ", 64)+`}`))
+	assert.Empty(t, commands)
+	assert.Equal(t, http.StatusOK, put(s, "operator:secret-op", `{"power": 1}`))
+}
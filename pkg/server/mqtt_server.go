@@ -0,0 +1,373 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/auth"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/ingestion"
+	"github.com/zhangjinpeng87/openbms/pkg/mqtt"
+	"go.uber.org/zap"
+)
+
+const (
+	// DefaultMQTTTopic is the default topic template of sensor data.
+	DefaultMQTTTopic = "bess/{station}/{container}/{pack}/{cell}"
+	// DefaultMQTTReconnectInterval is the default interval to reconnect.
+	DefaultMQTTReconnectInterval = 5 * time.Second
+
+	// BinaryPayloadSize is the size of a binary payload, all fields are big
+	// endian: voltage, current, soc and temperature as float32, state as
+	// uint8 and timestamp as int64 unix seconds.
+	BinaryPayloadSize = 4*4 + 1 + 8
+)
+
+// errInvalidPayload marks messages which will never be decoded, they are
+// acknowledged and dropped instead of being redelivered forever.
+var errInvalidPayload = errors.New("invalid sensor payload")
+
+// ErrServerStopped is returned when the server is stopped.
+var ErrServerStopped = errors.New("server stopped")
+
+// MQTTServer subscribes to the sensor topics of field gateways on an MQTT
+// broker and feeds the readings to the same ingester as SensorServer.
+//
+// It connects with a persistent session by default. With QoS 1 a message
+// is acknowledged only after its reading is durable, so readings published
+// while the adapter is down or failing to ingest are redelivered.
+type MQTTServer struct {
+	c        *config.MQTTConfig
+	ingester Ingester
+	topic    *topicTemplate
+
+	mu     sync.Mutex
+	client *mqtt.Client
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewMQTTServer creates a new MQTTServer.
+func NewMQTTServer(cfg *config.MQTTConfig, ingester Ingester) (*MQTTServer, error) {
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultMQTTTopic
+	}
+	if cfg.ReconnectInterval <= 0 {
+		cfg.ReconnectInterval = DefaultMQTTReconnectInterval
+	}
+	if cfg.QoS > 1 {
+		return nil, fmt.Errorf("unsupported qos %d", cfg.QoS)
+	}
+	topic, err := parseTopicTemplate(cfg.Topic)
+	if err != nil {
+		return nil, err
+	}
+	return &MQTTServer{c: cfg, ingester: ingester, topic: topic}, nil
+}
+
+// Start connects to the broker and subscribes to the sensor topics, the
+// connection is retried in background if it is lost.
+func (s *MQTTServer) Start() error {
+	s.stop, s.done = make(chan struct{}), make(chan struct{})
+	if err := s.connect(); err != nil {
+		s.stop = nil
+		return err
+	}
+	go s.run()
+	return nil
+}
+
+// Stop disconnects from the broker.
+func (s *MQTTServer) Stop() error {
+	if s.stop == nil {
+		return nil
+	}
+	s.mu.Lock()
+	close(s.stop)
+	if s.client != nil {
+		s.client.Close()
+	}
+	s.mu.Unlock()
+	<-s.done
+	return nil
+}
+
+func (s *MQTTServer) connect() error {
+	client, err := mqtt.Dial(&mqtt.ClientConfig{
+		Addr:         s.c.Broker,
+		ClientID:     s.c.ClientID,
+		Username:     s.c.Username,
+		Password:     s.c.Password,
+		CleanSession: s.c.CleanSession,
+		KeepAlive:    s.c.KeepAlive,
+	}, s.handleMessage)
+	if err != nil {
+		return err
+	}
+	// subscribe again even if the session is resumed, the topic may change
+	if err := client.Subscribe(mqtt.Subscription{Filter: s.topic.filter, QoS: s.c.QoS}); err != nil {
+		client.Close()
+		return err
+	}
+	s.mu.Lock()
+	select {
+	case <-s.stop:
+		// stopped while connecting
+		s.mu.Unlock()
+		client.Close()
+		return ErrServerStopped
+	default:
+	}
+	s.client = client
+	s.mu.Unlock()
+	log.Info("mqtt server subscribed",
+		zap.String("broker", s.c.Broker),
+		zap.String("filter", s.topic.filter),
+		zap.Bool("session-present", client.SessionPresent))
+	return nil
+}
+
+func (s *MQTTServer) run() {
+	defer close(s.done)
+	for {
+		s.mu.Lock()
+		client := s.client
+		s.mu.Unlock()
+		select {
+		case <-s.stop:
+			return
+		case <-client.Done():
+		}
+		log.Warn("mqtt connection lost, will reconnect",
+			zap.String("broker", s.c.Broker), zap.Error(client.Err()))
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.c.ReconnectInterval):
+			}
+			if err := s.connect(); err != nil {
+				log.Warn("failed to reconnect to mqtt broker", zap.String("broker", s.c.Broker), zap.Error(err))
+				continue
+			}
+			break
+		}
+	}
+}
+
+// handleMessage ingests the reading in the message. Returning an error
+// leaves the message unacknowledged and drops the connection, so the broker
+// redelivers it.
+func (s *MQTTServer) handleMessage(msg *mqtt.Message) error {
+	state, err := s.decode(msg)
+	if err != nil {
+		log.Warn("drop invalid sensor message", zap.String("topic", msg.Topic), zap.Error(err))
+		return nil
+	}
+	return s.ingester.Ingest(state)
+}
+
+func (s *MQTTServer) decode(msg *mqtt.Message) (*data_model.BatteryState, error) {
+	ids, gateway, err := s.topic.parse(msg.Topic)
+	if err != nil {
+		return nil, err
+	}
+	state, err := DecodePayload(msg.Payload)
+	if err != nil {
+		return nil, err
+	}
+	// the topic is the identity of the cell and its gateway, ids in the
+	// payload are ignored, the gateway is unknown without a {gateway} level
+	state.Station, state.Container, state.Pack, state.Cell = ids[0], ids[1], ids[2], ids[3]
+	state.Gateway = gateway
+	return state, nil
+}
+
+// AuthorizeMQTT makes the embedded broker authenticate gateways by their id
+// as the username and their token as the password, and only accept
+// publishes to the sensor topics of their stations and containers, topic
+// is the topic template of MQTTConfig. With a {gateway} level in the
+// template, gateways may only publish under their own id.
+func AuthorizeMQTT(b *mqtt.Broker, a *auth.Authenticator, topic string) error {
+	if topic == "" {
+		topic = DefaultMQTTTopic
+	}
+	tpl, err := parseTopicTemplate(topic)
+	if err != nil {
+		return err
+	}
+	b.Authenticate = func(username, password string) bool {
+		_, err := a.AuthenticateToken(username, password, "")
+		return err == nil
+	}
+	b.Authorize = func(username, topic string) bool {
+		g, ok := a.Gateway(username)
+		if !ok {
+			return false
+		}
+		ids, gateway, err := tpl.parse(topic)
+		if err != nil || tpl.gateway >= 0 && gateway != username {
+			a.Audit(&auth.Event{Action: auth.ActionDenied, Gateway: username, Reason: "publish to " + topic})
+			return false
+		}
+		return a.AuthorizeContainer(g, "", ids[0], ids[1]) == nil
+	}
+	return nil
+}
+
+// DecodePayload decodes a sensor payload, a JSON object of BatteryState or
+// the BinaryPayloadSize bytes binary encoding.
+func DecodePayload(payload []byte) (*data_model.BatteryState, error) {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var state data_model.BatteryState
+		if err := json.Unmarshal(trimmed, &state); err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidPayload, err)
+		}
+		return &state, nil
+	}
+	if len(payload) != BinaryPayloadSize {
+		return nil, fmt.Errorf("%w: binary payload size %d, expect %d", errInvalidPayload, len(payload), BinaryPayloadSize)
+	}
+	float := func(i int) float64 {
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(payload[i*4:])))
+	}
+	return &data_model.BatteryState{
+		Voltage:     float(0),
+		Current:     float(1),
+		SOC:         float(2),
+		Temperature: float(3),
+		State:       data_model.State(payload[16]),
+		Timestamp:   int64(binary.BigEndian.Uint64(payload[17:])),
+	}, nil
+}
+
+// EncodeBinaryPayload encodes the reading in the binary payload encoding,
+// it is used by simulators and tests.
+func EncodeBinaryPayload(state *data_model.BatteryState) []byte {
+	payload := make([]byte, 0, BinaryPayloadSize)
+	for _, v := range []float64{state.Voltage, state.Current, state.SOC, state.Temperature} {
+		payload = binary.BigEndian.AppendUint32(payload, math.Float32bits(float32(v)))
+	}
+	payload = append(payload, byte(state.State))
+	return binary.BigEndian.AppendUint64(payload, uint64(state.Timestamp))
+}
+
+// topicIDs are the levels of the topic template carrying cell ids, in the
+// order of station, container, pack and cell.
+var topicIDs = []string{"{station}", "{container}", "{pack}", "{cell}"}
+
+// topicGateway is the optional level of the topic template carrying the
+// gateway id.
+const topicGateway = "{gateway}"
+
+// topicTemplate is a parsed topic template like
+// "bess/{station}/{container}/{pack}/{cell}".
+type topicTemplate struct {
+	levels []string
+	// position of each id in levels
+	positions [4]int
+	// position of the gateway id in levels, -1 if none
+	gateway int
+	// filter is the subscription filter, ids are replaced by +
+	filter string
+}
+
+func parseTopicTemplate(template string) (*topicTemplate, error) {
+	t := &topicTemplate{levels: strings.Split(template, "/"), gateway: -1}
+	t.positions = [4]int{-1, -1, -1, -1}
+	filter := make([]string, len(t.levels))
+	for i, level := range t.levels {
+		filter[i] = level
+		if level == topicGateway {
+			if t.gateway >= 0 {
+				return nil, fmt.Errorf("duplicate %s in topic %q", topicGateway, template)
+			}
+			t.gateway = i
+			filter[i] = "+"
+		}
+		for j, id := range topicIDs {
+			if level == id {
+				if t.positions[j] >= 0 {
+					return nil, fmt.Errorf("duplicate %s in topic %q", id, template)
+				}
+				t.positions[j] = i
+				filter[i] = "+"
+			}
+		}
+		if filter[i] != "+" && strings.ContainsAny(level, "+#{}") {
+			return nil, fmt.Errorf("invalid level %q in topic %q", level, template)
+		}
+	}
+	for j, pos := range t.positions {
+		if pos < 0 {
+			return nil, fmt.Errorf("missing %s in topic %q", topicIDs[j], template)
+		}
+	}
+	t.filter = strings.Join(filter, "/")
+	return t, nil
+}
+
+// parse extracts the cell ids and the gateway id, empty if the template
+// has none, from the topic.
+func (t *topicTemplate) parse(topic string) ([4]int, string, error) {
+	var ids [4]int
+	levels := strings.Split(topic, "/")
+	if len(levels) != len(t.levels) {
+		return ids, "", fmt.Errorf("%w: topic %s doesn't match %s", errInvalidPayload, topic, t.filter)
+	}
+	for i, level := range t.levels {
+		if !t.isID(i) && levels[i] != level {
+			return ids, "", fmt.Errorf("%w: topic %s doesn't match %s", errInvalidPayload, topic, t.filter)
+		}
+	}
+	for j, pos := range t.positions {
+		id, err := strconv.Atoi(levels[pos])
+		if err != nil {
+			return ids, "", fmt.Errorf("%w: invalid %s in topic %s", errInvalidPayload, topicIDs[j], topic)
+		}
+		ids[j] = id
+	}
+	if t.gateway < 0 {
+		return ids, "", nil
+	}
+	if levels[t.gateway] == "" {
+		return ids, "", fmt.Errorf("%w: empty %s in topic %s", errInvalidPayload, topicGateway, topic)
+	}
+	return ids, levels[t.gateway], nil
+}
+
+// isID returns whether the level at i is an id placeholder.
+func (t *topicTemplate) isID(i int) bool {
+	if i == t.gateway {
+		return true
+	}
+	for _, pos := range t.positions {
+		if pos == i {
+			return true
+		}
+	}
+	return false
+}
+
+// AdmitMQTT rate limits the publishes of gateways to the embedded broker by
+// the token buckets of the admission control, gateways are identified by
+// their usernames. The readings themselves should be ingested through the
+// admission control too, i.e. it is the ingester of MQTTServer, so they
+// are shed by priority under overload.
+func AdmitMQTT(b *mqtt.Broker, a *ingestion.Admission) {
+	b.Admit = func(username string, msg *mqtt.Message) bool {
+		return a.Allow(username, 1) == nil
+	}
+}
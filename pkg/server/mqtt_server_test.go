@@ -0,0 +1,249 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/ingestion"
+	"github.com/zhangjinpeng87/openbms/pkg/mqtt"
+)
+
+// syncIngester is a fakeIngester safe to be called from the mqtt client.
+type syncIngester struct {
+	mu     sync.Mutex
+	states []*data_model.BatteryState
+	err    error
+}
+
+func (s *syncIngester) Ingest(states ...*data_model.BatteryState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.states = append(s.states, states...)
+	return nil
+}
+
+func (s *syncIngester) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *syncIngester) received() []*data_model.BatteryState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*data_model.BatteryState(nil), s.states...)
+}
+
+// lockedBuffer is a bytes.Buffer safe to be written by the broker.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestTopicTemplate(t *testing.T) {
+	tpl, err := parseTopicTemplate("site/{station}/c{container}")
+	assert.Error(t, err)
+	assert.Nil(t, tpl)
+	_, err = parseTopicTemplate("bess/{station}/{pack}/{cell}")
+	assert.Error(t, err)
+	_, err = parseTopicTemplate("bess/{station}/{station}/{container}/{pack}/{cell}")
+	assert.Error(t, err)
+
+	tpl, err = parseTopicTemplate("gw/{container}/{station}/data/{pack}/{cell}")
+	require.NoError(t, err)
+	assert.Equal(t, "gw/+/+/data/+/+", tpl.filter)
+	ids, gateway, err := tpl.parse("gw/2/1/data/3/4")
+	require.NoError(t, err)
+	assert.Equal(t, [4]int{1, 2, 3, 4}, ids)
+	assert.Empty(t, gateway)
+	_, _, err = tpl.parse("gw/2/1/data/3")
+	assert.ErrorIs(t, err, errInvalidPayload)
+	_, _, err = tpl.parse("gw/x/1/data/3/4")
+	assert.ErrorIs(t, err, errInvalidPayload)
+	_, _, err = tpl.parse("gw/2/1/x/3/4")
+	assert.ErrorIs(t, err, errInvalidPayload)
+	_, _, err = tpl.parse("foo/2/1/data/3/4")
+	assert.ErrorIs(t, err, errInvalidPayload)
+
+	_, err = parseTopicTemplate("{gateway}/{gateway}/{station}/{container}/{pack}/{cell}")
+	assert.Error(t, err)
+	tpl, err = parseTopicTemplate("bess/{gateway}/{station}/{container}/{pack}/{cell}")
+	require.NoError(t, err)
+	assert.Equal(t, "bess/+/+/+/+/+", tpl.filter)
+	ids, gateway, err = tpl.parse("bess/gw-1/1/2/3/4")
+	require.NoError(t, err)
+	assert.Equal(t, [4]int{1, 2, 3, 4}, ids)
+	assert.Equal(t, "gw-1", gateway)
+	_, _, err = tpl.parse("bess//1/2/3/4")
+	assert.ErrorIs(t, err, errInvalidPayload)
+}
+
+func TestDecodePayload(t *testing.T) {
+	state := &data_model.BatteryState{
+		Voltage: 3.5, Current: -10, SOC: 50, Temperature: 25.25,
+		State: data_model.Charging, Timestamp: 1700000000,
+	}
+	payload := EncodeBinaryPayload(state)
+	require.Len(t, payload, BinaryPayloadSize)
+	got, err := DecodePayload(payload)
+	require.NoError(t, err)
+	assert.Equal(t, state, got)
+
+	got, err = DecodePayload([]byte(` {"voltage":3.7,"soc":80}`))
+	require.NoError(t, err)
+	assert.Equal(t, 3.7, got.Voltage)
+	assert.Equal(t, 80.0, got.SOC)
+
+	_, err = DecodePayload([]byte(`{"voltage":`))
+	assert.ErrorIs(t, err, errInvalidPayload)
+	_, err = DecodePayload(payload[1:])
+	assert.ErrorIs(t, err, errInvalidPayload)
+}
+
+func TestMQTTServer(t *testing.T) {
+	broker := mqtt.NewBroker()
+	require.NoError(t, broker.Start("127.0.0.1:0"))
+	defer broker.Close()
+
+	ingester := &syncIngester{}
+	s, err := NewMQTTServer(&config.MQTTConfig{
+		Broker:            broker.Addr(),
+		ClientID:          "openbms",
+		QoS:               1,
+		ReconnectInterval: 50 * time.Millisecond,
+	}, ingester)
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	gw, err := mqtt.Dial(&mqtt.ClientConfig{Addr: broker.Addr(), ClientID: "gw-1", CleanSession: true}, nil)
+	require.NoError(t, err)
+	defer gw.Close()
+
+	// ids come from the topic, not the payload, which can't claim a gateway
+	require.NoError(t, gw.Publish("bess/1/2/3/4", []byte(`{"station":9,"voltage":3.7,"gateway":"gw-2"}`), 1))
+	require.NoError(t, gw.Publish("bess/1/2/3/5", EncodeBinaryPayload(&data_model.BatteryState{Voltage: 3.5}), 1))
+	// invalid messages are dropped
+	require.NoError(t, gw.Publish("bess/1/2/3/x", []byte(`{}`), 1))
+	require.NoError(t, gw.Publish("bess/1/2/3/6", []byte(`bad`), 1))
+	require.Eventually(t, func() bool { return len(ingester.received()) == 2 }, 5*time.Second, 10*time.Millisecond)
+	states := ingester.received()
+	assert.Equal(t, data_model.BatteryState{Station: 1, Container: 2, Pack: 3, Cell: 4, Voltage: 3.7}, *states[0])
+	assert.Equal(t, 5, states[1].Cell)
+	assert.Equal(t, 3.5, states[1].Voltage)
+	require.Eventually(t, func() bool { return broker.Queued("openbms") == 0 }, 5*time.Second, 10*time.Millisecond)
+
+	// readings which fail to ingest are redelivered after reconnecting
+	ingester.setErr(errors.New("disk full"))
+	require.NoError(t, gw.Publish("bess/1/2/3/7", []byte(`{"voltage":3.6}`), 1))
+	require.Eventually(t, func() bool { return broker.Queued("openbms") == 1 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	ingester.setErr(nil)
+	require.Eventually(t, func() bool { return len(ingester.received()) == 3 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 7, ingester.received()[2].Cell)
+	require.Eventually(t, func() bool { return broker.Queued("openbms") == 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAuthorizeMQTT(t *testing.T) {
+	broker := mqtt.NewBroker()
+	var audit lockedBuffer
+	require.NoError(t, AuthorizeMQTT(broker, testAuthenticator(t, &audit), ""))
+	require.NoError(t, broker.Start("127.0.0.1:0"))
+	defer broker.Close()
+
+	ingester := &syncIngester{}
+	s, err := NewMQTTServer(&config.MQTTConfig{Broker: broker.Addr(), ClientID: "gw-1", Password: "secret", Username: "gw-1", QoS: 1}, ingester)
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	_, err = mqtt.Dial(&mqtt.ClientConfig{Addr: broker.Addr(), ClientID: "gw", Username: "gw-1", Password: "wrong"}, nil)
+	assert.Error(t, err)
+
+	gw, err := mqtt.Dial(&mqtt.ClientConfig{Addr: broker.Addr(), ClientID: "gw", Username: "gw-1", Password: "secret", CleanSession: true}, nil)
+	require.NoError(t, err)
+	require.NoError(t, gw.Publish("bess/1/2/3/4", []byte(`{"voltage":3.7}`), 1))
+	require.Eventually(t, func() bool { return len(ingester.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// publishing for another station disconnects the gateway
+	assert.Error(t, gw.Publish("bess/2/1/3/4", []byte(`{"voltage":3.7}`), 1))
+	assert.Contains(t, audit.String(), `"station":2,"container":1`)
+	assert.Len(t, ingester.received(), 1)
+}
+
+func TestMQTTGatewayTopic(t *testing.T) {
+	const topic = "bess/{gateway}/{station}/{container}/{pack}/{cell}"
+	broker := mqtt.NewBroker()
+	var audit lockedBuffer
+	require.NoError(t, AuthorizeMQTT(broker, testAuthenticator(t, &audit), topic))
+	require.NoError(t, broker.Start("127.0.0.1:0"))
+	defer broker.Close()
+
+	ingester := &syncIngester{}
+	s, err := NewMQTTServer(&config.MQTTConfig{Broker: broker.Addr(), ClientID: "gw-1", Password: "secret", Username: "gw-1", Topic: topic, QoS: 1}, ingester)
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	// the readings are counted under the gateway the broker authenticated
+	gw, err := mqtt.Dial(&mqtt.ClientConfig{Addr: broker.Addr(), ClientID: "gw", Username: "gw-1", Password: "secret", CleanSession: true}, nil)
+	require.NoError(t, err)
+	require.NoError(t, gw.Publish("bess/gw-1/1/2/3/4", []byte(`{"voltage":3.7,"gateway":"gw-2"}`), 1))
+	require.Eventually(t, func() bool { return len(ingester.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "gw-1", ingester.received()[0].Gateway)
+
+	// publishing under another gateway disconnects the gateway
+	assert.Error(t, gw.Publish("bess/gw-2/1/2/3/4", []byte(`{"voltage":3.7}`), 1))
+	assert.Contains(t, audit.String(), "publish to bess/gw-2/1/2/3/4")
+	assert.Len(t, ingester.received(), 1)
+}
+
+func TestAdmitMQTT(t *testing.T) {
+	broker := mqtt.NewBroker()
+	ingester := &syncIngester{}
+	admission := runAdmission(t, &ingestion.AdmissionConfig{Rate: 0.5, Burst: 1}, ingester)
+	AdmitMQTT(broker, admission)
+	require.NoError(t, broker.Start("127.0.0.1:0"))
+	defer broker.Close()
+
+	s, err := NewMQTTServer(&config.MQTTConfig{Broker: broker.Addr(), ClientID: "openbms", QoS: 1}, admission)
+	require.NoError(t, err)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+
+	gw, err := mqtt.Dial(&mqtt.ClientConfig{Addr: broker.Addr(), ClientID: "gw", Username: "gw-1", CleanSession: true}, nil)
+	require.NoError(t, err)
+	require.NoError(t, gw.Publish("bess/1/2/3/4", []byte(`{"voltage":3.7}`), 1))
+	// the gateway is disconnected without an acknowledgement over its rate
+	assert.Error(t, gw.Publish("bess/1/2/3/5", []byte(`{"voltage":3.7}`), 1))
+	require.Eventually(t, func() bool { return len(ingester.received()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// other gateways are not limited by it
+	gw, err = mqtt.Dial(&mqtt.ClientConfig{Addr: broker.Addr(), ClientID: "gw", Username: "gw-2", CleanSession: true}, nil)
+	require.NoError(t, err)
+	defer gw.Close()
+	require.NoError(t, gw.Publish("bess/2/1/3/4", []byte(`{"voltage":3.7}`), 1))
+	require.Eventually(t, func() bool { return len(ingester.received()) == 2 }, 5*time.Second, 10*time.Millisecond)
+}
@@ -2,73 +2,258 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"math"
 	"net"
+	"net/http"
 	"os"
-	"os/signal"
-	"syscall"
+	"strconv"
+	"time"
 
+	"github.com/gorilla/mux"
 	"github.com/pingcap/log"
+	"github.com/zhangjinpeng87/openbms/pkg/auth"
 	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/ingestion"
 	"go.uber.org/zap"
 )
 
-// SensorServer is a TCP server that listens for sensor data.
+const (
+	// DefaultMaxBodySize is the default max size of a request body.
+	DefaultMaxBodySize = 8 << 20
+	// DefaultReadHeaderTimeout is the default time to read request headers.
+	DefaultReadHeaderTimeout = 10 * time.Second
+
+	// shutdownTimeout is how long Stop waits for in-flight requests.
+	shutdownTimeout = 5 * time.Second
+)
+
+// Ingester accepts sensor readings, it returns nil only after the readings
+// are durable, it is implemented by ingestion.Pipeline.
+type Ingester interface {
+	Ingest(states ...*data_model.BatteryState) error
+}
+
+// SensorServer is an HTTP server that listens for sensor data.
 type SensorServer struct {
-	l *net.TCPListener
-	c *config.SensorServerConfig
+	c        *config.SensorServerConfig
+	ingester Ingester
+	auth     *auth.Authenticator
+	admit    *ingestion.Admission
+
+	l   net.Listener
+	srv *http.Server
 }
 
 // NewSensorServer creates a new SensorServer.
-func NewSensorServer(cfg *config.SensorServerConfig) *SensorServer {
-	return &SensorServer{c: cfg}
+func NewSensorServer(cfg *config.SensorServerConfig, ingester Ingester) *SensorServer {
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = DefaultMaxBodySize
+	}
+	if cfg.ReadHeaderTimeout <= 0 {
+		cfg.ReadHeaderTimeout = DefaultReadHeaderTimeout
+	}
+	return &SensorServer{c: cfg, ingester: ingester}
+}
+
+// SetAuthenticator requires gateways to authenticate and only accepts
+// readings of the stations and containers they are allowed to report for.
+// It must be called before Start.
+func (s *SensorServer) SetAuthenticator(a *auth.Authenticator) {
+	s.auth = a
+}
+
+// SetAdmission rate limits gateways and sheds readings under overload
+// through the admission control, which must be running. It must be called
+// before Start.
+func (s *SensorServer) SetAdmission(a *ingestion.Admission) {
+	s.admit = a
 }
 
 // Start starts the server.
 func (s *SensorServer) Start() error {
-	// Create a TCP listener on localhost:8080.
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{
-		IP:   net.IPv4(s.c.Host),
-		Port: s.c.Port,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create listener: %w", err)
+	if err := s.prepare(); err != nil {
+		return err
 	}
-	s.l = l
 
+	go func() {
+		if err := s.srv.Serve(s.l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("sensor server stopped", zap.Error(err))
+		}
+	}()
+	log.Info("sensor server started", zap.String("addr", s.l.Addr().String()))
+	return nil
+}
+
+// Stop stops the server, it waits for in-flight requests to finish.
+func (s *SensorServer) Stop() error {
+	if s.srv == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return s.srv.Shutdown(ctx)
+}
+
+// Addr returns the address the server listens on.
+func (s *SensorServer) Addr() net.Addr {
+	return s.l.Addr()
 }
 
 // prepare prepares the server for serve.
 func (s *SensorServer) prepare() error {
-	// Create a TCP listener on localhost:8080.
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{
-		IP:   net.IPv4(s.c.Host),
-		Port: s.c.Port,
-	})
+	l, err := net.Listen("tcp", net.JoinHostPort(s.c.Host, strconv.Itoa(s.c.Port)))
 	if err != nil {
 		return fmt.Errorf("failed to create listener: %w", err)
 	}
+	if s.c.TLSCertFile != "" {
+		tlsConfig, err := s.tlsConfig()
+		if err != nil {
+			l.Close()
+			return err
+		}
+		l = tls.NewListener(l, tlsConfig)
+	}
 	s.l = l
 
 	// create router
 	r := mux.NewRouter()
 	r.HandleFunc("/sensor", s.handleSensor).Methods(http.MethodPost)
+	s.srv = &http.Server{Handler: r, ReadHeaderTimeout: s.c.ReadHeaderTimeout}
+	return nil
 }
 
+// tlsConfig loads the server certificate, and the client CAs for mutual
+// TLS. Client certificates are optional at the TLS layer so gateways may
+// use tokens instead, the authenticator rejects requests without either.
+func (s *SensorServer) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.c.TLSCertFile, s.c.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load server certificate: %w", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.c.ClientCAFile != "" {
+		pem, err := os.ReadFile(s.c.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client ca: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in client ca file %s", s.c.ClientCAFile)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, nil
+}
+
+// handleSensor accepts a battery state or an array of battery states. The
+// response is sent after the states are durable, so a sender which doesn't
+// get 200 should send them again. With an authenticator, requests without
+// valid credentials get 401, and batches with any reading of a station or
+// container the gateway doesn't own get 403, accepted readings are stamped
+// with the gateway id. With admission control, readings which are rate
+// limited or shed get 429 with Retry-After. A body over MaxBodySize or a
+// batch which never fits in the admission queue gets 413.
 func (s *SensorServer) handleSensor(w http.ResponseWriter, r *http.Request) {
-	var state BatteryState
-	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
-		log.Errorf("failed to decode sensor: %v", err)
+	defer r.Body.Close()
+	r.Body = http.MaxBytesReader(w, r.Body, s.c.MaxBodySize)
+
+	var gateway *auth.Gateway
+	if s.auth != nil {
+		g, err := s.auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		gateway = g
+	}
+
+	var raw json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&raw); err != nil {
+		log.Warn("failed to decode sensor data", zap.Error(err))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-	defer r.Body.Close()
+	var states []*data_model.BatteryState
+	if len(raw) > 0 && raw[0] == '[' {
+		if err := json.Unmarshal(raw, &states); err != nil {
+			log.Warn("failed to decode sensor data", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	} else {
+		var state data_model.BatteryState
+		if err := json.Unmarshal(raw, &state); err != nil {
+			log.Warn("failed to decode sensor data", zap.Error(err))
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		states = append(states, &state)
+	}
 
-	log.Debug("received sensor: %+v", sensor)
+	if gateway != nil {
+		if err := s.auth.Authorize(gateway, r.RemoteAddr, states); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+	// never trust the gateway sent by the client
+	for _, state := range states {
+		state.Gateway = ""
+		if gateway != nil {
+			state.Gateway = gateway.ID
+		}
+	}
+
+	if s.admit != nil {
+		s.admitStates(w, r, gateway, states)
+		return
+	}
+	if err := s.ingester.Ingest(states...); err != nil {
+		log.Error("failed to ingest sensor data", zap.Int("count", len(states)), zap.Error(err))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	log.Debug("received sensor data", zap.Int("count", len(states)))
 	w.WriteHeader(http.StatusOK)
 }
 
-func (s *SensorServer) updateState(state BatteryState) {
-	log.Debug("received sensor: %+v", sensor)
+// admitStates ingests the states through the admission control, gateways
+// are limited by their ids, or by their hosts without an authenticator.
+func (s *SensorServer) admitStates(w http.ResponseWriter, r *http.Request, gateway *auth.Gateway, states []*data_model.BatteryState) {
+	key := r.RemoteAddr
+	if gateway != nil {
+		key = gateway.ID
+	} else if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		key = host
+	}
+
+	err := s.admit.Admit(key, states...)
+	var rejected *ingestion.RejectedError
+	switch {
+	case err == nil:
+		log.Debug("received sensor data", zap.Int("count", len(states)))
+		w.WriteHeader(http.StatusOK)
+	case errors.As(err, &rejected):
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(rejected.RetryAfter.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+	case errors.Is(err, ingestion.ErrBatchTooLarge):
+		log.Warn("reject sensor data over the queue size", zap.Int("count", len(states)), zap.Error(err))
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	default:
+		log.Error("failed to ingest sensor data", zap.Int("count", len(states)), zap.Error(err))
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 }
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/zhangjinpeng87/openbms/pkg/auth"
+	"github.com/zhangjinpeng87/openbms/pkg/config"
+	"github.com/zhangjinpeng87/openbms/pkg/datamanagement/data_model"
+	"github.com/zhangjinpeng87/openbms/pkg/ingestion"
+)
+
+type fakeIngester struct {
+	states []*data_model.BatteryState
+	err    error
+}
+
+func (f *fakeIngester) Ingest(states ...*data_model.BatteryState) error {
+	if f.err != nil {
+		return f.err
+	}
+	f.states = append(f.states, states...)
+	return nil
+}
+
+func TestSensorServer(t *testing.T) {
+	ingester := &fakeIngester{}
+	s := NewSensorServer(&config.SensorServerConfig{Host: "127.0.0.1", MaxBodySize: 256}, ingester)
+	require.NoError(t, s.Start())
+	defer s.Stop()
+	url := "http://" + s.Addr().String() + "/sensor"
+
+	post := func(body string) int {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post(`{"station":1,"cell":2,"voltage":3.7}`))
+	assert.Equal(t, http.StatusOK, post(`[{"station":1,"cell":3},{"station":1,"cell":4,"gateway":"gw-1"}]`))
+	require.Len(t, ingester.states, 3)
+	// the gateway is unknown without an authenticator
+	assert.Empty(t, ingester.states[2].Gateway)
+	assert.Equal(t, 3.7, ingester.states[0].Voltage)
+	assert.Equal(t, 4, ingester.states[2].Cell)
+
+	assert.Equal(t, http.StatusBadRequest, post(`{"station":`))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(`[`+strings.Repeat(`{"station":1},`, 20)+`{"station":1}]`))
+
+	// not acknowledged if the readings are not durable
+	ingester.err = errors.New("disk full")
+	assert.Equal(t, http.StatusServiceUnavailable, post(`{"station":1}`))
+}
+
+func testAuthenticator(t *testing.T, audit io.Writer) *auth.Authenticator {
+	a, err := auth.NewAuthenticator(&config.GatewayAuthConfig{Gateways: []config.GatewayConfig{
+		{ID: "gw-1", TokenSHA256: auth.HashToken("secret"), Stations: []config.GatewayStationACL{{Station: 1}}},
+		{ID: "gw-2", Stations: []config.GatewayStationACL{{Station: 2, Containers: []int{1}}}},
+		{ID: "operator", TokenSHA256: auth.HashToken("secret-op"), Operator: true},
+	}}, auth.NewAuditor(audit))
+	require.NoError(t, err)
+	return a
+}
+
+func TestSensorServerToken(t *testing.T) {
+	ingester := &fakeIngester{}
+	var audit bytes.Buffer
+	s := NewSensorServer(&config.SensorServerConfig{Host: "127.0.0.1"}, ingester)
+	s.SetAuthenticator(testAuthenticator(t, &audit))
+	require.NoError(t, s.Start())
+	defer s.Stop()
+	url := "http://" + s.Addr().String() + "/sensor"
+
+	post := func(token, body string) int {
+		req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		require.NoError(t, err)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("", `{"station":1}`))
+	assert.Equal(t, http.StatusUnauthorized, post("gw-1:wrong", `{"station":1}`))
+	assert.Equal(t, http.StatusOK, post("gw-1:secret", `[{"station":1,"container":1},{"station":1,"container":2,"gateway":"gw-2"}]`))
+	// a gateway can't overwrite the cells of another station
+	assert.Equal(t, http.StatusForbidden, post("gw-1:secret", `[{"station":1,"container":1},{"station":2,"container":1}]`))
+	assert.Len(t, ingester.states, 2)
+	// readings are stamped with the authenticated gateway
+	assert.Equal(t, "gw-1", ingester.states[1].Gateway)
+	assert.Equal(t, 3, strings.Count(audit.String(), "\n"))
+	assert.Contains(t, audit.String(), `"action":"denied","gateway":"gw-1"`)
+}
+
+func TestSensorServerMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCertificate(t, "openbms-ca", nil, nil)
+	server, serverKey := newCertificate(t, "127.0.0.1", ca, caKey)
+	client, clientKey := newCertificate(t, "gw-2", ca, caKey)
+	writePEM(t, filepath.Join(dir, "ca.pem"), "CERTIFICATE", ca.Raw)
+	writePEM(t, filepath.Join(dir, "server.pem"), "CERTIFICATE", server.Raw)
+	writePEM(t, filepath.Join(dir, "server-key.pem"), "EC PRIVATE KEY", marshalKey(t, serverKey))
+
+	ingester := &fakeIngester{}
+	var audit bytes.Buffer
+	s := NewSensorServer(&config.SensorServerConfig{
+		Host:         "127.0.0.1",
+		TLSCertFile:  filepath.Join(dir, "server.pem"),
+		TLSKeyFile:   filepath.Join(dir, "server-key.pem"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}, ingester)
+	s.SetAuthenticator(testAuthenticator(t, &audit))
+	require.NoError(t, s.Start())
+	defer s.Stop()
+	url := "https://" + s.Addr().String() + "/sensor"
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	newClient := func(certs ...tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+	}
+	post := func(c *http.Client, body string) int {
+		resp, err := c.Post(url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	withCert := newClient(tls.Certificate{Certificate: [][]byte{client.Raw}, PrivateKey: clientKey})
+	assert.Equal(t, http.StatusOK, post(withCert, `{"station":2,"container":1}`))
+	assert.Equal(t, http.StatusForbidden, post(withCert, `{"station":2,"container":2}`))
+	// without a client certificate the gateway needs a token
+	assert.Equal(t, http.StatusUnauthorized, post(newClient(), `{"station":2,"container":1}`))
+	assert.Len(t, ingester.states, 1)
+}
+
+func runAdmission(t *testing.T, cfg *ingestion.AdmissionConfig, next ingestion.Ingester) *ingestion.Admission {
+	a := ingestion.NewAdmission(cfg, next)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- a.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-done)
+	})
+	return a
+}
+
+func TestSensorServerAdmission(t *testing.T) {
+	ingester := &syncIngester{}
+	s := NewSensorServer(&config.SensorServerConfig{Host: "127.0.0.1"}, ingester)
+	s.SetAdmission(runAdmission(t, &ingestion.AdmissionConfig{Rate: 0.5, Burst: 2, QueueSize: 2}, ingester))
+	require.NoError(t, s.Start())
+	defer s.Stop()
+	url := "http://" + s.Addr().String() + "/sensor"
+
+	post := func(body string) *http.Response {
+		resp, err := http.Post(url, "application/json", strings.NewReader(body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	assert.Equal(t, http.StatusOK, post(`[{"station":1,"cell":1},{"station":1,"cell":2}]`).StatusCode)
+	resp := post(`{"station":1,"cell":3}`)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "2", resp.Header.Get("Retry-After"))
+	// a batch which never fits in the queue
+	resp = post(`[{"station":1,"cell":3},{"station":1,"cell":4},{"station":1,"cell":5}]`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	assert.Len(t, ingester.received(), 2)
+}
+
+func newCertificate(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		parent, parentKey = tmpl, key
+	} else if ip := net.ParseIP(cn); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert, key
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	der, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return der
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0o600))
+}
@@ -0,0 +1,119 @@
+// File: adaptive_kalman_filter.go
+// Package: utils
+// The Sage-Husa adaptive Kalman filter estimates the process and measurement
+// noise covariances online from the innovations, the differences between
+// the measurements and the predictions. Older innovations are forgotten
+// exponentially, so the estimates follow sensors whose noise changes over
+// time.
+// Ref to Sage, A. P., & Husa, G. W. (1969). Adaptive filtering with unknown
+// prior statistics.
+
+package utils
+
+import "math"
+
+// innovationGate is the max squared innovation in the units of its expected
+// variance, about 3 sigma, a larger innovation is a change of the state
+// rather than measurement noise.
+const innovationGate = 9
+
+// Filter smooths a series of measurements.
+type Filter interface {
+	// Update returns the estimate after the measurement.
+	Update(measurement float64) float64
+	// State returns the estimator state to be restored by SetState.
+	State() FilterState
+	// SetState continues from a state returned by State.
+	SetState(state FilterState)
+}
+
+// FilterState is the estimator state of a filter.
+type FilterState struct {
+	// XHat is the state estimate.
+	XHat float64 `json:"x_hat"`
+	// P is the estimate error covariance.
+	P float64 `json:"p"`
+}
+
+// Noise is the noise covariances of a filter.
+type Noise struct {
+	// Q is the process noise covariance.
+	Q float64 `json:"q"`
+	// R is the measurement noise covariance.
+	R float64 `json:"r"`
+}
+
+// AdaptiveKalmanFilter is a Kalman filter which tunes its noise covariances
+// by the Sage-Husa estimator.
+type AdaptiveKalmanFilter struct {
+	KalmanFilter
+
+	b    float64 // Forgetting factor
+	qMin float64 // Lower bound of the process noise covariance
+	rMin float64 // Lower bound of the measurement noise covariance
+}
+
+// NewAdaptiveKalmanFilter initializes a new AdaptiveKalmanFilter, the noise
+// covariances are the initial guesses. The forgetting factor in (0, 1) is
+// the weight of the previous estimates against the latest innovation,
+// typical values are 0.95 to 0.99, and the estimates never fall below
+// minNoise.
+func NewAdaptiveKalmanFilter(initialValue, initialEstimateError float64, noise, minNoise Noise, forgettingFactor float64) *AdaptiveKalmanFilter {
+	return &AdaptiveKalmanFilter{
+		KalmanFilter: KalmanFilter{
+			xHat: initialValue,
+			p:    initialEstimateError,
+			q:    math.Max(noise.Q, minNoise.Q),
+			r:    math.Max(noise.R, minNoise.R),
+		},
+		b:    forgettingFactor,
+		qMin: minNoise.Q,
+		rMin: minNoise.R,
+	}
+}
+
+// Update performs a single update step of the filter and its noise estimates.
+func (kf *AdaptiveKalmanFilter) Update(measurement float64) float64 {
+	// Weight of the latest innovation
+	d := 1 - kf.b
+
+	// Prediction step
+	xHatMinus := kf.xHat
+	pMinus := kf.p + kf.q
+	innovation := measurement - xHatMinus
+
+	// The innovation variance is pMinus + r. An abnormal innovation, like a
+	// step of the state, inflates the estimate error to follow it quickly
+	// instead of being taken as noise.
+	ratio := innovation * innovation / (pMinus + kf.r)
+	abnormal := ratio > innovationGate
+	if abnormal {
+		pMinus *= ratio
+	} else {
+		// While the estimate error is still large, like at the start, the
+		// unbiased estimate is negative, fall back to the biased one.
+		r := (1-d)*kf.r + d*(innovation*innovation-pMinus)
+		if r < kf.rMin {
+			r = (1-d)*kf.r + d*innovation*innovation
+		}
+		kf.r = math.Max(r, kf.rMin)
+	}
+
+	// Update step
+	kf.k = pMinus / (pMinus + kf.r)
+	kf.xHat = xHatMinus + kf.k*innovation
+	pPrev := kf.p
+	kf.p = (1 - kf.k) * pMinus
+
+	// The state correction explains the process noise
+	if !abnormal {
+		kf.q = math.Max((1-d)*kf.q+d*(kf.k*kf.k*innovation*innovation+kf.p-pPrev), kf.qMin)
+	}
+
+	return kf.xHat
+}
+
+// Noise returns the estimated noise covariances.
+func (kf *AdaptiveKalmanFilter) Noise() Noise {
+	return Noise{Q: kf.q, R: kf.r}
+}
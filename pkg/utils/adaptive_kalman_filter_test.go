@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveKalmanFilter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	// the initial guess of the measurement noise is far too large
+	kf := NewAdaptiveKalmanFilter(3.3, 1, Noise{Q: 0.01, R: 1}, Noise{Q: 1e-8, R: 1e-6}, 0.98)
+
+	var rawErr, filteredErr float64
+	for i := 0; i < 2000; i++ {
+		measurement := 3.3 + rng.NormFloat64()*0.05
+		estimate := kf.Update(measurement)
+		if i >= 1000 {
+			rawErr += (measurement - 3.3) * (measurement - 3.3)
+			filteredErr += (estimate - 3.3) * (estimate - 3.3)
+		}
+	}
+	noise := kf.Noise()
+	// the measurement noise converges to the variance of the sensor
+	assert.InDelta(t, 0.0025, noise.R, 0.001)
+	assert.Less(t, noise.Q, 0.0025)
+	assert.Less(t, math.Sqrt(filteredErr/1000), math.Sqrt(rawErr/1000)/2)
+
+	// a step of the true value is followed
+	for i := 0; i < 500; i++ {
+		kf.Update(3.6 + rng.NormFloat64()*0.05)
+	}
+	assert.InDelta(t, 3.6, kf.Update(3.6), 0.05)
+
+	// the estimates never fall below the bounds
+	kf = NewAdaptiveKalmanFilter(1, 1, Noise{Q: 0.01, R: 0.01}, Noise{Q: 0.001, R: 0.002}, 0.95)
+	for i := 0; i < 100; i++ {
+		kf.Update(1)
+	}
+	assert.Equal(t, Noise{Q: 0.001, R: 0.002}, kf.Noise())
+}
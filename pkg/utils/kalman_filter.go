@@ -10,11 +10,6 @@
 
 package utils
 
-import (
-	"fmt"
-	"math"
-)
-
 // KalmanFilter represents the Kalman filter state.
 type KalmanFilter struct {
 	xHat      float64 // State estimate
@@ -52,3 +47,15 @@ func (kf *KalmanFilter) Update(measurement float64) float64 {
 
 	return kf.xHat
 }
+
+// State returns the state estimate and its error covariance.
+func (kf *KalmanFilter) State() FilterState {
+	return FilterState{XHat: kf.xHat, P: kf.p}
+}
+
+// SetState sets the state estimate and its error covariance, e.g. to
+// continue from the state saved before a restart.
+func (kf *KalmanFilter) SetState(state FilterState) {
+	kf.xHat = state.XHat
+	kf.p = state.P
+}